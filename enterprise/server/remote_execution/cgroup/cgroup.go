@@ -12,6 +12,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
@@ -138,6 +139,201 @@ func (p *Paths) v1Stats(ctx context.Context, cid string) (*repb.UsageStats, erro
 	}, nil
 }
 
+// CumulativeStats returns the total CPU usage and peak memory usage of the
+// container's cgroup over its whole lifetime. Unlike Stats, the returned
+// values don't depend on how often the cgroup is sampled. PeakMemoryBytes is
+// 0 if the kernel doesn't track peak memory usage (memory.peak requires Linux
+// 5.19+ on cgroup v2).
+func (p *Paths) CumulativeStats(ctx context.Context, cid string) (*repb.UsageStats, error) {
+	if err := p.find(ctx, cid); err != nil {
+		return nil, err
+	}
+	var cpuNanos int64
+	var peakMemoryPath string
+	if p.CgroupVersion() == 1 {
+		n, err := readInt64FromFile(strings.ReplaceAll(p.V1CPUTemplate, cidPlaceholder, cid))
+		if err != nil {
+			return nil, err
+		}
+		cpuNanos = n
+		memDir := filepath.Dir(strings.ReplaceAll(p.V1MemoryTemplate, cidPlaceholder, cid))
+		peakMemoryPath = filepath.Join(memDir, "memory.max_usage_in_bytes")
+	} else {
+		dir := strings.ReplaceAll(p.V2DirTemplate, cidPlaceholder, cid)
+		cpuMicros, err := readCgroupInt64Field(filepath.Join(dir, "cpu.stat"), "usage_usec")
+		if err != nil {
+			return nil, err
+		}
+		cpuNanos = cpuMicros * 1e3
+		peakMemoryPath = filepath.Join(dir, "memory.peak")
+	}
+	peakMemoryBytes, err := readInt64FromFile(peakMemoryPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return &repb.UsageStats{
+		CpuNanos:        cpuNanos,
+		PeakMemoryBytes: peakMemoryBytes,
+	}, nil
+}
+
+// OOMKillCount returns the number of processes in the container's cgroup that
+// have been killed by the kernel OOM killer.
+func (p *Paths) OOMKillCount(ctx context.Context, cid string) (int64, error) {
+	if err := p.find(ctx, cid); err != nil {
+		return 0, err
+	}
+	if p.CgroupVersion() == 1 {
+		// memory.oom_control contains a line like "oom_kill <N>" (kernel
+		// 4.13+).
+		memDir := filepath.Dir(strings.ReplaceAll(p.V1MemoryTemplate, cidPlaceholder, cid))
+		return readCgroupInt64Field(filepath.Join(memDir, "memory.oom_control"), "oom_kill")
+	}
+	dir := strings.ReplaceAll(p.V2DirTemplate, cidPlaceholder, cid)
+	// memory.events contains a line like "oom_kill <N>"
+	return readCgroupInt64Field(filepath.Join(dir, "memory.events"), "oom_kill")
+}
+
+// Kill sends SIGKILL to all processes in the container's cgroup.
+func (p *Paths) Kill(ctx context.Context, cid string) error {
+	if err := p.find(ctx, cid); err != nil {
+		return err
+	}
+	if p.CgroupVersion() == 1 {
+		return killDir(filepath.Dir(strings.ReplaceAll(p.V1MemoryTemplate, cidPlaceholder, cid)))
+	}
+	return killDir(strings.ReplaceAll(p.V2DirTemplate, cidPlaceholder, cid))
+}
+
+// Remove kills any processes remaining in the container's cgroup, then removes
+// the cgroup along with any cgroups nested beneath it. The runtime normally
+// removes the cgroup when the container is deleted, but the cgroup can be left
+// behind if the runtime exits uncleanly. Returns nil if the cgroup does not
+// exist.
+func (p *Paths) Remove(ctx context.Context, cid string) error {
+	if err := p.find(ctx, cid); err != nil {
+		if status.IsNotFoundError(err) {
+			return nil
+		}
+		return err
+	}
+	var dirs []string
+	if p.CgroupVersion() == 1 {
+		dirs = []string{
+			filepath.Dir(strings.ReplaceAll(p.V1CPUTemplate, cidPlaceholder, cid)),
+			filepath.Dir(strings.ReplaceAll(p.V1MemoryTemplate, cidPlaceholder, cid)),
+		}
+	} else {
+		dirs = []string{strings.ReplaceAll(p.V2DirTemplate, cidPlaceholder, cid)}
+	}
+	for _, dir := range dirs {
+		if err := removeDir(ctx, dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeDir kills all processes in the given cgroup dir and removes it, along
+// with any nested cgroups.
+func removeDir(ctx context.Context, dir string) error {
+	// Nested cgroups must be removed before their parents, so collect them
+	// in walk order and remove them in reverse.
+	var dirs []string
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := killDir(dirs[i]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		// rmdir fails with EBUSY until the killed processes have exited.
+		for {
+			err := syscall.Rmdir(dirs[i])
+			if err == nil || err == syscall.ENOENT {
+				break
+			}
+			if err != syscall.EBUSY {
+				return err
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+	return nil
+}
+
+// killDir sends SIGKILL to all processes in the given cgroup dir.
+func killDir(dir string) error {
+	// cgroup.kill atomically kills all processes in the cgroup, including
+	// ones that are forking concurrently. It requires Linux 5.14+, and is
+	// only available in cgroup v2.
+	f, err := os.OpenFile(filepath.Join(dir, "cgroup.kill"), os.O_WRONLY, 0)
+	if err == nil {
+		_, err = f.Write([]byte("1"))
+		f.Close()
+		return err
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	// Fall back to killing each process listed in cgroup.procs.
+	pids, err := readProcs(dir)
+	if err != nil {
+		return err
+	}
+	for _, pid := range pids {
+		if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+			return err
+		}
+	}
+	return nil
+}
+
+// Procs returns the IDs of all processes in the container's cgroup.
+func (p *Paths) Procs(ctx context.Context, cid string) ([]int, error) {
+	if err := p.find(ctx, cid); err != nil {
+		return nil, err
+	}
+	if p.CgroupVersion() == 1 {
+		return readProcs(filepath.Dir(strings.ReplaceAll(p.V1MemoryTemplate, cidPlaceholder, cid)))
+	}
+	return readProcs(strings.ReplaceAll(p.V2DirTemplate, cidPlaceholder, cid))
+}
+
+// readProcs reads the process IDs from the cgroup.procs file in the given
+// cgroup dir.
+func readProcs(dir string) ([]int, error) {
+	b, err := os.ReadFile(filepath.Join(dir, "cgroup.procs"))
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, line := range strings.Fields(string(b)) {
+		pid, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, status.InternalErrorf("malformed cgroup.procs line %q", line)
+		}
+		pids = append(pids, pid)
+	}
+	return pids, nil
+}
+
 // find locates cgroup path templates. For this to work, the container must be
 // started (i.e. `podman create` does not set up the cgroups; `podman start`
 // does). We use this walking approach because the logic for figuring out the
@@ -202,7 +398,7 @@ func (p *Paths) find(ctx context.Context, cid string) error {
 		return nil
 	}
 
-	return status.InternalErrorf("failed to locate cgroup under %s", cgroupfsPath)
+	return status.NotFoundErrorf("failed to locate cgroup under %s", cgroupfsPath)
 }
 
 // readInt64FromFile reads a file expected to contain a single int64.
@@ -101,6 +101,33 @@ type Init struct {
 
 	// Publisher can be used to send fine-grained execution progress updates.
 	Publisher *operation.Publisher
+
+	// RootfsTarPath is the path to a local tarball (optionally gzipped)
+	// containing the container's root filesystem. If set, the rootfs is
+	// imported from the tarball instead of being pulled from the image
+	// registry, and Props.ContainerImage is ignored. The tarball must not be
+	// modified after it is first imported. Only supported by the OCI
+	// isolation type.
+	RootfsTarPath string
+
+	// PullProgress, if set, is called with progress updates while the
+	// container's image is pulled. Updates are throttled, and are never sent
+	// concurrently. If the pull is deduped with a concurrent pull of the same
+	// image by another container, only the final update is sent. Currently
+	// only supported by the OCI isolation type.
+	PullProgress func(p *ImagePullProgress)
+}
+
+// ImagePullProgress is a snapshot of the progress of an image pull.
+type ImagePullProgress struct {
+	// BytesDownloaded is the number of compressed bytes downloaded so far.
+	BytesDownloaded int64
+	// BytesTotal is the compressed size of all layers that need to be
+	// downloaded. Layers which are already cached are not included.
+	BytesTotal int64
+	// Done is set in the final update, which is sent once the image has been
+	// pulled successfully.
+	Done bool
 }
 
 // ContainerMetrics handles Prometheus metrics accounting for CommandContainer
@@ -1,23 +1,35 @@
 package ociruntime
 
 import (
+	"archive/tar"
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"flag"
 	"fmt"
+	"io"
 	"io/fs"
+	"maps"
+	"math"
+	"net"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"runtime"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode"
 
 	_ "embed"
 	mrand "math/rand/v2"
@@ -25,42 +37,273 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/cgroup"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/commandutil"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/container"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/oci"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/resources"
 	"github.com/buildbuddy-io/buildbuddy/server/util/disk"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
 	"github.com/buildbuddy-io/buildbuddy/server/util/hash"
+	"github.com/buildbuddy-io/buildbuddy/server/util/ioutil"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/networking"
+	"github.com/buildbuddy-io/buildbuddy/server/util/retry"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/unixcred"
 	"github.com/buildbuddy-io/buildbuddy/third_party/singleflight"
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/sys/unix"
 
+	rgpb "github.com/buildbuddy-io/buildbuddy/proto/registry"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	ctrname "github.com/google/go-containerregistry/pkg/name"
 	ctr "github.com/google/go-containerregistry/pkg/v1"
 	specs "github.com/opencontainers/runtime-spec/specs-go"
+	gstatus "google.golang.org/grpc/status"
 )
 
 var (
-	Runtime     = flag.String("executor.oci.runtime", "", "OCI runtime")
-	runtimeRoot = flag.String("executor.oci.runtime_root", "", "Root directory for storage of container state (see <runtime> --help for default)")
-	pidsLimit   = flag.Int64("executor.oci.pids_limit", 2048, "PID limit for OCI runtime. Set to -1 for unlimited PIDs.")
-	dns         = flag.String("executor.oci.dns", "8.8.8.8", "Specifies a custom DNS server for use inside OCI containers. If set to the empty string, mount /etc/resolv.conf from the host.")
+	Runtime      = flag.String("executor.oci.runtime", "", "Path to the OCI runtime binary. If empty, crun, runc, and runsc are looked up in PATH, in that order.")
+	runtimeRoot  = flag.String("executor.oci.runtime_root", "", "Root directory for storage of container state (see <runtime> --help for default)")
+	pidsLimit    = flag.Int64("executor.oci.pids_limit", 2048, "PID limit for OCI runtime. Set to -1 for unlimited PIDs.")
+	cgroupParent = flag.String("executor.oci.cgroup_parent", "", "Cgroup under which OCI container cgroups are created, as a path relative to the cgroup v2 root, e.g. /buildbuddy.slice/containers. The cgroup is created if it doesn't exist, and its memory and CPU limits are set to the executor's allocated resources, which bounds the combined usage of all containers. It must not contain any processes, so it must not be the executor's own cgroup. Requires cgroup v2. If empty, container cgroups are placed according to the runtime's defaults.")
+	dns          = flag.String("executor.oci.dns", "8.8.8.8", "Specifies a custom DNS server for use inside OCI containers. If set to the empty string, copy /etc/resolv.conf from the host.")
+
+	statePruneInterval = flag.Duration("executor.oci.state_prune_interval", 0, "How often to prune leftover state dirs of containers which are no longer tracked by the executor, e.g. because removing them failed. Both OCI bundle dirs and, if executor.oci.runtime_root is set, runtime state dirs are pruned, according to executor.oci.state_max_age and executor.oci.state_max_count. Containers with live processes are never pruned. If 0, leftover state dirs are only cleaned up when the executor starts.")
+	stateMaxAge        = flag.Duration("executor.oci.state_max_age", 0, "Leftover container state dirs which were last modified longer ago than this are pruned. If 0, state dirs are not pruned based on age.")
+	stateMaxCount      = flag.Int("executor.oci.state_max_count", 0, "Maximum number of leftover container state dirs to keep. Once exceeded, the least recently modified state dirs are pruned. If 0, the number of state dirs is not limited.")
+
+	pullMaxAttempts         = flag.Int("executor.oci.pull_max_attempts", 3, "Maximum number of attempts when pulling an image. Only transient errors (network errors, HTTP 429 or 5xx responses) are retried.")
+	offline                 = flag.Bool("executor.oci.offline", false, "If true, images are never pulled from registries. Only images already in the local image cache can be used, and using any other image fails with a FailedPrecondition error.")
+	pullTimeout             = flag.Duration("executor.oci.pull_timeout", 0, "Maximum time to spend pulling an image, independent of the action timeout. Partially extracted layers are deleted when a pull times out. If 0, pulls are only bounded by the action timeout.")
+	tagCheckInterval        = flag.Duration("executor.oci.image_tag_check_interval", 5*time.Minute, "How long the result of checking whether the tag of a cached image has moved is reused for. Within this interval, new containers use the cached image without contacting the registry. If 0, the registry is checked each time a new container checks whether its image is cached.")
+	pullRetryMaxElapsedTime = flag.Duration("executor.oci.pull_retry_max_elapsed_time", 2*time.Minute, "Image pulls will not be retried after this much time has elapsed since the first attempt.")
+
+	maxOutputBytes = flag.Int64("executor.oci.max_output_bytes", 0, "Maximum number of bytes of stdout and of stderr to capture from each command. Output beyond this limit is discarded, and the command result is marked as truncated. If 0, output is not limited.")
+
+	maxConcurrentLayerDownloads = flag.Int("executor.oci.max_concurrent_layer_downloads", 0, "Maximum number of image layers that may be downloaded concurrently, across all image pulls. If 0, the number of concurrent downloads is unlimited.")
+	layerExtractionParallelism  = flag.Int("executor.oci.layer_extraction_parallelism", 0, "Maximum number of layers of a single image that are downloaded and extracted concurrently. If 0, defaults to the number of CPUs, up to a maximum of 8.")
+	containerdContentStore      = flag.String("executor.oci.containerd_content_store", "", "Path to the content store of a containerd instance on the same host, e.g. /var/lib/containerd/io.containerd.content.v1.content. If set, compressed image layers which containerd has already downloaded are read from its content store rather than downloaded from the registry. The store is only read from, and blobs are verified against the layer digest before being used. This only saves network transfer: layers are still extracted into the executor's own layer cache, so no disk space is shared with containerd.")
+	verifyCachedLayers          = flag.Bool("executor.oci.verify_cached_layers", false, "If true, the contents of previously extracted layers are checked against the digest recorded when they were extracted before they are reused by a pull. Layers which fail the check are deleted and pulled again, unless they are in use by running containers. Verification reads every file in each cached layer, which can make pulls of large cached images much slower.")
+
+	layerCacheMaxSizeBytes    = flag.Int64("executor.oci.layer_cache_max_size_bytes", 0, "Maximum total size of extracted image layers. Once exceeded, the least recently used layers which are not in use by any container are evicted. If 0, the layer cache size is unlimited.")
+	layerGCHighWatermarkBytes = flag.Int64("executor.oci.layer_gc_high_watermark_bytes", 0, "Layer garbage collection only deletes layers once the total size of extracted image layers exceeds this many bytes.")
+	layerGCLowWatermarkBytes  = flag.Int64("executor.oci.layer_gc_low_watermark_bytes", 0, "Layer garbage collection stops deleting layers once the total size of extracted image layers is at or below this many bytes.")
+
+	seccompProfilePath          = flag.String("executor.oci.seccomp_profile", "", "Path to a seccomp profile in docker's JSON format to apply to OCI containers, replacing the built-in default profile. If set to \"unconfined\", seccomp is disabled; this should only be used for debugging.")
+	allowSeccompProfileOverride = flag.Bool("executor.oci.allow_seccomp_profile_override", false, "Allow actions to replace the seccomp profile using the seccomp-profile platform property. Should not be enabled by executors that can run untrusted code.")
+
+	defaultAppArmorProfile       = flag.String("executor.oci.apparmor_profile", "", "Name of an AppArmor profile to confine OCI containers with. The profile must already be loaded on the host. Ignored if AppArmor is not enabled in the kernel.")
+	allowAppArmorProfileOverride = flag.Bool("executor.oci.allow_apparmor_profile_override", false, "Allow actions to replace the AppArmor profile using the apparmor-profile platform property. Should not be enabled by executors that can run untrusted code.")
+
+	allowedAddedCapabilities = flag.Slice("executor.oci.allowed_added_capabilities", []string{}, "Linux capabilities (e.g. CAP_NET_RAW) that actions may add to the default container capabilities using the cap-add platform property. If empty, capabilities may only be dropped. Should not be set by executors that can run untrusted code.")
+
+	allowHostNetwork        = flag.Bool("executor.oci.allow_host_network", false, "Allow actions to share the executor host's network namespace using dockerNetwork=host. Should not be enabled by executors that can run untrusted code.")
+	allowedPublishHostPorts = flag.Slice("executor.oci.allowed_publish_host_ports", []int{}, "Host ports that actions may explicitly request using the publish-ports platform property. Published ports without a host port always use a random available port. If empty, host ports may not be chosen by actions.")
+
+	cniNetwork = flag.String("executor.oci.cni_network", "", "Name of a CNI network to attach OCI containers to, instead of using the built-in networking. The CNI plugins are invoked with ADD when a container is created and with DEL when it is removed. Containers with dockerNetwork=off or dockerNetwork=host are not attached to the CNI network. If empty, the built-in networking is used.")
+	cniConfDir = flag.String("executor.oci.cni_conf_dir", "/etc/cni/net.d", "Directory containing the CNI network config for executor.oci.cni_network.")
+	cniBinDirs = flag.Slice("executor.oci.cni_bin_dirs", []string{"/opt/cni/bin"}, "Directories containing the CNI plugin binaries used by executor.oci.cni_network.")
+
+	overlayfsMode     = flag.String("executor.oci.overlayfs_mode", overlayfsModeAuto, "How to mount the overlay filesystem for image-backed container rootfs. \"kernel\" uses kernel overlayfs, which requires CAP_SYS_ADMIN. \"fuse\" uses fuse-overlayfs, which can be mounted by unprivileged executors. \"auto\" uses kernel overlayfs if permitted, and otherwise falls back to fuse-overlayfs if it is installed.")
+	fuseOverlayfsPath = flag.String("executor.oci.fuse_overlayfs_path", "", "Path to the fuse-overlayfs binary. If empty, fuse-overlayfs is looked up in PATH.")
+	overlayRoot       = flag.String("executor.oci.overlay_root", "", "Directory where the overlayfs upper and work dirs of container rootfs are stored, e.g. on a fast scratch disk. Files written to the rootfs by containers are stored here. If empty, they are stored next to each container's workspace.")
+
+	subuidRange = flag.String("executor.oci.subuid_range", "", "Range of host user IDs to map container user IDs to, in start:count format as in /etc/subuid. If set, containers run in a user namespace where container UID 0 maps to the start of the range, so container root is unprivileged on the host. Must be set together with executor.oci.subgid_range.")
+	subgidRange = flag.String("executor.oci.subgid_range", "", "Range of host group IDs to map container group IDs to, in start:count format as in /etc/subgid. Must be set together with executor.oci.subuid_range.")
+
+	hooks = flag.Slice("executor.oci.hooks", []Hook{}, `OCI lifecycle hooks added to the spec of every OCI container, e.g. for network plumbing or external accounting. Hooks receive the container state as JSON on stdin, as specified by the OCI runtime spec. Format is --executor.oci.hooks='[{"stage":"createRuntime","path":"/usr/local/bin/setup-net","args":["setup-net","--bridge=br0"],"timeout":10}]'. Supported stages are createRuntime, createContainer, startContainer, poststart, poststop, and the deprecated prestart.`)
+
+	extraRuntimeArgs = flag.Slice("executor.oci.extra_runtime_args", []string{}, "Extra global flags passed to every OCI runtime invocation, before the subcommand, e.g. --debug. Flags managed by the executor (such as --root) may not be set.")
+
+	runscPath     = flag.String("executor.oci.runsc_path", "", "Path to the runsc (gVisor) binary, used for containers that set oci-runtime=runsc. If empty, runsc is looked up in PATH.")
+	runscPlatform = flag.String("executor.oci.runsc_platform", "", "gVisor platform used by runsc to intercept syscalls, e.g. systrap, ptrace, or kvm. If empty, the runsc default is used.")
+
+	initPath                = flag.String("executor.oci.init_path", "", "Path to a tini-compatible init binary, which is run as PID 1 in OCI containers that set the dockerInit platform property. If empty, tini is looked up in PATH.")
+	stopGracePeriod         = flag.Duration("executor.oci.stop_grace_period", 0, "When removing an OCI container, how long to wait for its processes to exit after sending them SIGTERM, before killing them with SIGKILL. If 0, processes are killed immediately.")
+	allowedBindMountSources = flag.Slice("executor.oci.allowed_bind_mount_sources", []string{}, "Host directories that actions may bind-mount into OCI containers using the bind-mounts platform property. Subdirectories of these paths may also be mounted. If empty, bind mounts are not allowed. Should not be set by executors that can run untrusted code.")
 )
 
 const (
 	ociVersion = "1.1.0-rc.3" // matches podman
 
+	// CPU quota enforcement period, in microseconds. This matches the kernel
+	// default.
+	cpuPeriodMicros = 100_000
+	// Minimum CPU quota accepted by the kernel, in microseconds.
+	minCPUQuotaMicros = 1000
+
+	// Standard path where cgroupfs is expected to be mounted.
+	cgroupfsPath = "/sys/fs/cgroup"
+
+	// How long before the shutdown deadline Shutdown stops waiting for
+	// containers to be removed by their owners and removes them itself.
+	shutdownForceRemoveTimeout = 5 * time.Second
+
+	// Maximum number of container IDs to try before giving up on finding one
+	// that isn't in use.
+	maxCIDAttempts = 10
+
+	// Number of attempts to unmount a busy overlayfs rootfs before falling
+	// back to a lazy unmount.
+	overlayUnmountAttempts = 5
+
+	// Values of --executor.oci.overlayfs_mode.
+	overlayfsModeAuto   = "auto"
+	overlayfsModeKernel = "kernel"
+	overlayfsModeFuse   = "fuse"
+
+	// Minimum interval between image pull progress updates.
+	pullProgressInterval = 500 * time.Millisecond
+
+	// Maximum number of images pulled concurrently by Prefetch.
+	maxConcurrentPrefetches = 4
+
+	// Name of the file in the layers directory which records layer sizes and
+	// last access times, so that LRU eviction works across executor
+	// restarts.
+	layerIndexFileName = "index.json"
+
+	// Name of the file in the layers directory which records cached images,
+	// so that they can be used after executor restarts without being pulled
+	// again.
+	imageIndexFileName = "images.json"
+
+	// Runs of zero bytes in extracted layer files that are at least
+	// sparseHoleMinSize long, in units of sparseBlockSize, are turned into
+	// holes so that they don't use disk space.
+	sparseBlockSize   = 4096
+	sparseHoleMinSize = 64 * 1024
+
+	// How long to wait for remaining pty output after the runtime exits.
+	consoleDrainTimeout = 1 * time.Second
+
+	// The default terminal EOF character (^D).
+	ttyEOF = 0x04
+
+	// Maximum number of bytes of health check output included in errors.
+	// This matches docker.
+	maxHealthCheckOutputBytes = 4096
+
+	// Path where the init binary is mounted in containers that use one.
+	// /dev is a tmpfs, so the rootfs doesn't need a mount point for it.
+	containerInitPath = "/dev/init"
+
+	// Highest signal number on Linux (SIGRTMAX).
+	maxSignal = 64
+
 	// Execution root directory path relative to the container rootfs directory.
 	execrootPath = "/buildbuddy-execroot"
 
+	// Annotations identifying the execution that a container was created
+	// for, so that runtime hooks and monitoring tools can correlate running
+	// containers with BuildBuddy executions. Recycled containers keep the
+	// annotations of the execution they were originally created for.
+	InvocationIDAnnotation = platform.ReservedAnnotationPrefix + "invocation-id"
+	ExecutionIDAnnotation  = platform.ReservedAnnotationPrefix + "execution-id"
+
 	// Fake image ref indicating that busybox should be manually provisioned.
 	// TODO: get rid of this
 	TestBusyboxImageRef = "test.buildbuddy.io/busybox"
 )
 
+// Errors for common failures, which callers can check for with errors.Is.
+// Errors matching these have descriptive messages and the status code of the
+// underlying failure, and still match after being wrapped with
+// status.WrapError.
+var (
+	// The image doesn't exist, or has no manifest for the requested
+	// platform.
+	ErrImageNotFound = errors.New("image not found")
+	// The registry rejected the credentials used to pull the image.
+	ErrUnauthorized = errors.New("unauthorized")
+	// A process in the container was killed by the kernel OOM killer.
+	ErrOOMKilled = errors.New("OOM killed")
+	// A command or image pull exceeded its timeout.
+	ErrTimeout = errors.New("timed out")
+	// The executor ran out of disk space.
+	ErrDiskFull = errors.New("disk full")
+)
+
+// sentinelError is an error which has the status code and message of the
+// wrapped error, and also matches a sentinel error with errors.Is.
+type sentinelError struct {
+	error
+	sentinel error
+}
+
+// withSentinel returns err with the given sentinel attached, or nil if err is
+// nil.
+func withSentinel(err, sentinel error) error {
+	if err == nil {
+		return nil
+	}
+	return &sentinelError{error: err, sentinel: sentinel}
+}
+
+func (e *sentinelError) GRPCStatus() *gstatus.Status {
+	return gstatus.Convert(e.error)
+}
+
+func (e *sentinelError) Unwrap() []error {
+	return []error{e.error, e.sentinel}
+}
+
+// pullError attaches a sentinel error to the given image pull error based on
+// its status code.
+func pullError(err error) error {
+	switch {
+	case status.IsNotFoundError(err):
+		return withSentinel(err, ErrImageNotFound)
+	case status.IsPermissionDeniedError(err) || status.IsUnauthenticatedError(err):
+		return withSentinel(err, ErrUnauthorized)
+	case status.IsDeadlineExceededError(err):
+		return withSentinel(err, ErrTimeout)
+	}
+	return err
+}
+
+// withDiskFull attaches ErrDiskFull to the status error err if cause
+// indicates that the disk is full.
+func withDiskFull(err, cause error) error {
+	if errors.Is(cause, syscall.ENOSPC) {
+		return withSentinel(err, ErrDiskFull)
+	}
+	return err
+}
+
+// RuntimeType identifies an OCI runtime implementation. Runtimes mostly
+// share the same CLI, but differ in some flags and defaults.
+type RuntimeType string
+
+const (
+	RuntimeTypeCrun  RuntimeType = "crun"
+	RuntimeTypeRunc  RuntimeType = "runc"
+	RuntimeTypeRunsc RuntimeType = "runsc"
+)
+
+// Runtime flags which are set by the executor and may not be overridden by
+// extra runtime args.
+var managedRuntimeFlags = []string{"--root", "--log-format", "--cgroup-manager", "--bundle", "--pid-file", "--console-socket", "--tty", "--cwd", "--env", "--image-path", "--detach", "--keep"}
+
+// Runtime subcommands which accept extra args.
+var runtimeSubcommands = []string{"create", "start", "run", "exec", "kill", "delete", "state", "pause", "resume", "checkpoint", "restore", "events"}
+
+// Runtimes which are auto-detected if no runtime is configured, in order of
+// preference.
+var autoDetectedRuntimes = []RuntimeType{RuntimeTypeCrun, RuntimeTypeRunc, RuntimeTypeRunsc}
+
+// Dirs where each runtime stores container state by default when running as
+// root, if --root is not set.
+var defaultRuntimeStateRoots = map[RuntimeType]string{
+	RuntimeTypeCrun:  "/run/crun",
+	RuntimeTypeRunc:  "/run/runc",
+	RuntimeTypeRunsc: "/var/run/runsc",
+}
+
 //go:embed seccomp.json
 var seccompJSON []byte
 var seccomp specs.LinuxSeccomp
@@ -74,9 +317,92 @@ func init() {
 	}
 }
 
+// Special seccomp profile value indicating that seccomp should be disabled.
+const unconfinedSeccompProfile = "unconfined"
+
+// parseSeccompProfile parses a seccomp profile in docker's JSON format. As
+// with the built-in profile, docker-specific fields such as "archMap" and
+// conditional "includes"/"excludes" rules are ignored. It returns nil if the
+// profile is "unconfined".
+func parseSeccompProfile(profile []byte) (*specs.LinuxSeccomp, error) {
+	if strings.TrimSpace(string(profile)) == unconfinedSeccompProfile {
+		return nil, nil
+	}
+	p := &specs.LinuxSeccomp{}
+	if err := json.Unmarshal(profile, p); err != nil {
+		return nil, status.InvalidArgumentErrorf("parse seccomp profile: %s", err)
+	}
+	if p.DefaultAction == "" {
+		return nil, status.InvalidArgumentError("parse seccomp profile: defaultAction is required")
+	}
+	return p, nil
+}
+
+// Special AppArmor profile value indicating that the container should not be
+// confined by an AppArmor profile.
+const unconfinedAppArmorProfile = "unconfined"
+
+// Path to the kernel parameter indicating whether AppArmor is enabled.
+const appArmorEnabledPath = "/sys/module/apparmor/parameters/enabled"
+
+// isAppArmorEnabled returns whether AppArmor is enabled in the kernel.
+func isAppArmorEnabled() bool {
+	b, err := os.ReadFile(appArmorEnabledPath)
+	if err != nil {
+		return false
+	}
+	return strings.TrimSpace(string(b)) == "Y"
+}
+
 var (
-	// Allowed capabilities.
-	// TODO: allow customizing this (for self-hosted executors).
+	// All Linux capabilities known to the runtime, used to validate
+	// capabilities requested via platform properties.
+	knownCapabilities = []string{
+		"CAP_AUDIT_CONTROL",
+		"CAP_AUDIT_READ",
+		"CAP_AUDIT_WRITE",
+		"CAP_BLOCK_SUSPEND",
+		"CAP_BPF",
+		"CAP_CHECKPOINT_RESTORE",
+		"CAP_CHOWN",
+		"CAP_DAC_OVERRIDE",
+		"CAP_DAC_READ_SEARCH",
+		"CAP_FOWNER",
+		"CAP_FSETID",
+		"CAP_IPC_LOCK",
+		"CAP_IPC_OWNER",
+		"CAP_KILL",
+		"CAP_LEASE",
+		"CAP_LINUX_IMMUTABLE",
+		"CAP_MAC_ADMIN",
+		"CAP_MAC_OVERRIDE",
+		"CAP_MKNOD",
+		"CAP_NET_ADMIN",
+		"CAP_NET_BIND_SERVICE",
+		"CAP_NET_BROADCAST",
+		"CAP_NET_RAW",
+		"CAP_PERFMON",
+		"CAP_SETFCAP",
+		"CAP_SETGID",
+		"CAP_SETPCAP",
+		"CAP_SETUID",
+		"CAP_SYSLOG",
+		"CAP_SYS_ADMIN",
+		"CAP_SYS_BOOT",
+		"CAP_SYS_CHROOT",
+		"CAP_SYS_MODULE",
+		"CAP_SYS_NICE",
+		"CAP_SYS_PACCT",
+		"CAP_SYS_PTRACE",
+		"CAP_SYS_RAWIO",
+		"CAP_SYS_RESOURCE",
+		"CAP_SYS_TIME",
+		"CAP_SYS_TTY_CONFIG",
+		"CAP_WAKE_ALARM",
+	}
+
+	// Default capabilities granted to containers. Actions can add or drop
+	// capabilities using the cap-add and cap-drop platform properties.
 	capabilities = []string{
 		"CAP_CHOWN",
 		"CAP_DAC_OVERRIDE",
@@ -122,26 +448,217 @@ type provider struct {
 
 	// Configured runtime path.
 	runtime string
+	// Type of the configured runtime.
+	runtimeType RuntimeType
+	// Extra flags passed before the subcommand of every runtime invocation.
+	extraGlobalArgs []string
+	// Extra flags passed after the subcommand name, keyed by subcommand.
+	extraCommandArgs map[string][]string
+	// Whether pulling images from registries is disabled.
+	offline bool
+	// Cgroup under which container cgroups are created, relative to the
+	// cgroup v2 root. Empty if containers use the runtime's default cgroups.
+	cgroupParent string
+
+	// Default seccomp profile for containers. Nil if seccomp is disabled.
+	seccomp *specs.LinuxSeccomp
+
+	// Whether AppArmor is enabled in the kernel.
+	appArmorEnabled bool
+
+	// Lifecycle hooks added to the spec of every container, or nil if none
+	// are configured.
+	hooks *specs.Hooks
+
+	// CNI network that containers are attached to, or nil if the built-in
+	// networking is used.
+	cniConfig *networking.CNIConfig
+
+	// How container rootfs overlays are mounted, and the path to
+	// fuse-overlayfs, or empty if fuse-overlayfs can't be used.
+	overlayfsMode     string
+	fuseOverlayfsPath string
+	// Directory where overlay dirs are stored, or empty if they are stored
+	// next to the workspace.
+	overlayRoot string
+
+	// Mappings of container user and group IDs to host IDs, or nil if
+	// containers don't run in a user namespace.
+	uidMapping *specs.LinuxIDMapping
+	gidMapping *specs.LinuxIDMapping
+
+	mu sync.Mutex // protects: containers, shuttingDown
+	// Containers created by the provider which have not been removed yet.
+	containers map[*ociContainer]struct{}
+	// Whether Shutdown has been called.
+	shuttingDown bool
+}
+
+// ProviderOpts configures the OCI runtime used by a provider.
+type ProviderOpts struct {
+	// RuntimePath is the path to the OCI runtime binary, or the name of a
+	// binary in PATH. If empty, --executor.oci.runtime is used, and if that
+	// is also empty, a runtime is auto-detected from PATH.
+	RuntimePath string
+
+	// RuntimeType is the type of the runtime at RuntimePath. If empty, it is
+	// detected from the binary name, or from the output of --version.
+	RuntimeType RuntimeType
+
+	// ExtraGlobalArgs are flags passed to every runtime invocation before the
+	// subcommand, e.g. "--debug". If nil, --executor.oci.extra_runtime_args
+	// is used.
+	ExtraGlobalArgs []string
+
+	// ExtraCommandArgs maps runtime subcommands (e.g. "create") to flags
+	// passed after the subcommand name, e.g. "--no-pivot".
+	ExtraCommandArgs map[string][]string
+
+	// Offline prevents images from being pulled from registries, so that
+	// only locally cached images can be used. It is also enabled by
+	// --executor.oci.offline.
+	Offline bool
+
+	// Hooks are OCI lifecycle hooks added to the spec of every container.
+	// If nil, --executor.oci.hooks is used.
+	Hooks []Hook
+}
+
+// Hook is an OCI lifecycle hook run by the runtime.
+type Hook struct {
+	// Stage is the lifecycle stage at which the hook is run, e.g.
+	// "createRuntime" or "poststop". See the OCI runtime spec for when each
+	// stage runs, and in which namespaces.
+	Stage string `yaml:"stage" json:"stage"`
+	// Path is the absolute path of the hook binary on the host.
+	Path string `yaml:"path" json:"path"`
+	// Args are the hook's arguments, including argv[0].
+	Args []string `yaml:"args" json:"args"`
+	// Env is the hook's environment, as KEY=VALUE pairs.
+	Env []string `yaml:"env" json:"env"`
+	// Timeout is the number of seconds after which the hook is aborted. If
+	// 0, the hook isn't aborted.
+	Timeout int `yaml:"timeout" json:"timeout"`
+}
+
+// specHooks validates the given hooks and returns them as OCI spec hooks, or
+// nil if there are none.
+func specHooks(hooks []Hook) (*specs.Hooks, error) {
+	if len(hooks) == 0 {
+		return nil, nil
+	}
+	out := &specs.Hooks{}
+	for _, h := range hooks {
+		if !filepath.IsAbs(h.Path) {
+			return nil, status.InvalidArgumentErrorf("hook path %q is not absolute", h.Path)
+		}
+		if h.Timeout < 0 {
+			return nil, status.InvalidArgumentErrorf("hook %q has negative timeout %d", h.Path, h.Timeout)
+		}
+		hook := specs.Hook{Path: h.Path, Args: h.Args, Env: h.Env}
+		if h.Timeout > 0 {
+			hook.Timeout = pointer(h.Timeout)
+		}
+		switch h.Stage {
+		case "prestart":
+			out.Prestart = append(out.Prestart, hook)
+		case "createRuntime":
+			out.CreateRuntime = append(out.CreateRuntime, hook)
+		case "createContainer":
+			out.CreateContainer = append(out.CreateContainer, hook)
+		case "startContainer":
+			out.StartContainer = append(out.StartContainer, hook)
+		case "poststart":
+			out.Poststart = append(out.Poststart, hook)
+		case "poststop":
+			out.Poststop = append(out.Poststop, hook)
+		default:
+			return nil, status.InvalidArgumentErrorf("hook %q has unsupported stage %q", h.Path, h.Stage)
+		}
+	}
+	return out, nil
 }
 
+// NewProvider returns a provider which uses the runtime configured by
+// --executor.oci.runtime, or an auto-detected runtime if the flag is not set.
 func NewProvider(env environment.Env, buildRoot string) (*provider, error) {
+	return NewProviderWithOpts(env, buildRoot, &ProviderOpts{})
+}
+
+// NewProviderWithOpts returns a provider using the given runtime options.
+func NewProviderWithOpts(env environment.Env, buildRoot string, opts *ProviderOpts) (*provider, error) {
 	// Enable masquerading on the host if it isn't enabled already.
 	if err := networking.EnableMasquerading(env.GetServerContext()); err != nil {
 		return nil, status.WrapError(err, "enable masquerading")
 	}
 
-	// Try to find a usable runtime if the runtime flag is not explicitly set.
-	rt := *Runtime
-	if rt == "" {
-		for _, r := range []string{"crun", "runc", "runsc"} {
-			if _, err := exec.LookPath(r); err == nil {
-				rt = r
-				break
-			}
+	rt, rtType, err := resolveRuntime(env.GetServerContext(), opts)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Using OCI runtime %q (%s)", rt, rtType)
+	extraGlobalArgs := opts.ExtraGlobalArgs
+	if extraGlobalArgs == nil {
+		extraGlobalArgs = *extraRuntimeArgs
+	}
+	if err := validateExtraRuntimeArgs(extraGlobalArgs); err != nil {
+		return nil, status.WrapError(err, "invalid extra global runtime args")
+	}
+	if len(extraGlobalArgs) > 0 {
+		log.Infof("Passing extra global args to OCI runtime: %q", extraGlobalArgs)
+	}
+	for subcommand, args := range opts.ExtraCommandArgs {
+		if !slices.Contains(runtimeSubcommands, subcommand) {
+			return nil, status.InvalidArgumentErrorf("extra runtime args: unsupported runtime subcommand %q", subcommand)
 		}
+		if err := validateExtraRuntimeArgs(args); err != nil {
+			return nil, status.WrapErrorf(err, "invalid extra runtime args for %q", subcommand)
+		}
+		log.Infof("Passing extra args to OCI runtime %q: %q", subcommand, args)
 	}
-	if rt == "" {
-		return nil, status.FailedPreconditionError("could not find a usable container runtime in PATH")
+
+	hookConfigs := opts.Hooks
+	if hookConfigs == nil {
+		hookConfigs = *hooks
+	}
+	containerHooks, err := specHooks(hookConfigs)
+	if err != nil {
+		return nil, status.WrapError(err, "invalid OCI hooks")
+	}
+
+	var cniConfig *networking.CNIConfig
+	if *cniNetwork != "" {
+		cniConfig = &networking.CNIConfig{
+			ConfDir:     *cniConfDir,
+			NetworkName: *cniNetwork,
+			BinDirs:     *cniBinDirs,
+		}
+		log.Infof("Attaching OCI containers to CNI network %q", *cniNetwork)
+	}
+
+	fusePath, err := resolveFuseOverlayfs(*overlayfsMode, *fuseOverlayfsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if (*subuidRange == "") != (*subgidRange == "") {
+		return nil, status.InvalidArgumentError("executor.oci.subuid_range and executor.oci.subgid_range must be set together")
+	}
+	var uidMapping, gidMapping *specs.LinuxIDMapping
+	if *subuidRange != "" {
+		if uidMapping, err = parseIDRange(*subuidRange); err != nil {
+			return nil, status.WrapError(err, "invalid executor.oci.subuid_range")
+		}
+		if gidMapping, err = parseIDRange(*subgidRange); err != nil {
+			return nil, status.WrapError(err, "invalid executor.oci.subgid_range")
+		}
+		log.Infof("Running OCI containers in a user namespace, with UIDs mapped to %d-%d and GIDs mapped to %d-%d", uidMapping.HostID, uidMapping.HostID+uidMapping.Size-1, gidMapping.HostID, gidMapping.HostID+gidMapping.Size-1)
+	}
+
+	if *overlayRoot != "" {
+		if err := os.MkdirAll(*overlayRoot, 0755); err != nil {
+			return nil, status.UnavailableErrorf("create overlay root: %s", err)
+		}
 	}
 
 	// TODO: make these root dirs configurable via flag
@@ -154,860 +671,4298 @@ func NewProvider(env environment.Env, buildRoot string) (*provider, error) {
 		return nil, err
 	}
 	imageStore := NewImageStore(layersRoot)
-	return &provider{
+	seccompProfile := &seccomp
+	if *seccompProfilePath == unconfinedSeccompProfile {
+		log.Warningf("Seccomp is disabled for OCI containers (executor.oci.seccomp_profile=%s)", unconfinedSeccompProfile)
+		seccompProfile = nil
+	} else if *seccompProfilePath != "" {
+		b, err := os.ReadFile(*seccompProfilePath)
+		if err != nil {
+			return nil, status.FailedPreconditionErrorf("read seccomp profile: %s", err)
+		}
+		seccompProfile, err = parseSeccompProfile(b)
+		if err != nil {
+			return nil, status.FailedPreconditionErrorf("invalid seccomp profile %q: %s", *seccompProfilePath, err)
+		}
+	}
+	parent := ""
+	if *cgroupParent != "" {
+		parent, err = setupCgroupParent(*cgroupParent)
+		if err != nil {
+			return nil, status.WrapError(err, "set up cgroup parent")
+		}
+		log.Infof("Creating OCI container cgroups under %q", parent)
+	}
+	appArmorEnabled := isAppArmorEnabled()
+	if *defaultAppArmorProfile != "" && *defaultAppArmorProfile != unconfinedAppArmorProfile && !appArmorEnabled {
+		log.Warningf("AppArmor is not enabled in the kernel; ignoring configured AppArmor profile %q for OCI containers", *defaultAppArmorProfile)
+	}
+	p := &provider{
 		env:            env,
 		runtime:        rt,
+		runtimeType:    rtType,
 		containersRoot: containersRoot,
 		cgroupPaths:    &cgroup.Paths{},
 		layersRoot:     layersRoot,
 		imageStore:     imageStore,
-	}, nil
-}
-
-func (p *provider) New(ctx context.Context, args *container.Init) (container.CommandContainer, error) {
-	return &ociContainer{
-		env:            p.env,
-		runtime:        p.runtime,
-		containersRoot: p.containersRoot,
-		cgroupPaths:    p.cgroupPaths,
-		layersRoot:     p.layersRoot,
-		imageStore:     p.imageStore,
-
-		imageRef:       args.Props.ContainerImage,
-		networkEnabled: args.Props.DockerNetwork != "off",
-		user:           args.Props.DockerUser,
-		forceRoot:      args.Props.DockerForceRoot,
-	}, nil
-}
+		seccomp:        seccompProfile,
 
-type ociContainer struct {
-	env environment.Env
-
-	runtime        string
-	cgroupPaths    *cgroup.Paths
-	containersRoot string
-	layersRoot     string
-	imageStore     *ImageStore
+		extraGlobalArgs:  extraGlobalArgs,
+		extraCommandArgs: opts.ExtraCommandArgs,
+		offline:          opts.Offline || *offline,
+		cgroupParent:     parent,
 
-	cid              string
-	workDir          string
-	overlayfsMounted bool
-	stats            container.UsageStats
-	network          *networking.ContainerNetwork
+		appArmorEnabled: appArmorEnabled,
+		hooks:           containerHooks,
+		cniConfig:       cniConfig,
 
-	imageRef       string
-	networkEnabled bool
-	user           string
-	forceRoot      bool
-}
+		overlayfsMode:     *overlayfsMode,
+		fuseOverlayfsPath: fusePath,
+		overlayRoot:       *overlayRoot,
 
-// Returns the OCI bundle directory for the container.
-func (c *ociContainer) bundlePath() string {
-	return filepath.Join(c.containersRoot, c.cid)
-}
+		uidMapping: uidMapping,
+		gidMapping: gidMapping,
 
-// Returns the standard rootfs path expected by crun.
-func (c *ociContainer) rootfsPath() string {
-	return filepath.Join(c.bundlePath(), "rootfs")
+		containers: map[*ociContainer]struct{}{},
+	}
+	p.reapOrphanedContainers(env.GetServerContext())
+	if *statePruneInterval > 0 {
+		go p.pruneStateDirsPeriodically(env.GetServerContext(), *statePruneInterval)
+	}
+	return p, nil
 }
 
-// Returns the root path where overlay workdir and upperdir for this container
-// are stored.
-func (c *ociContainer) overlayTmpPath() string {
-	return c.workDir + ".overlay"
+// reapOrphanedContainers cleans up containers left behind by a previous
+// executor process, e.g. if the runtime or the executor crashed before the
+// container was removed. Orphaned containers are found from their bundle dirs
+// and, if a cgroup parent is configured, from the cgroups beneath it.
+// Containers that still have live processes are left alone.
+func (p *provider) reapOrphanedContainers(ctx context.Context) {
+	cids := map[string]struct{}{}
+	dirs := []string{p.containersRoot}
+	if p.cgroupParent != "" {
+		dirs = append(dirs, filepath.Join(cgroupfsPath, p.cgroupParent))
+	}
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			log.CtxWarningf(ctx, "Failed to list orphaned containers in %q: %s", dir, err)
+			continue
+		}
+		for _, entry := range entries {
+			if entry.IsDir() && isCID(entry.Name()) {
+				cids[entry.Name()] = struct{}{}
+			}
+		}
+	}
+	for cid := range cids {
+		reaped, err := p.untrackedContainer(cid).reapOrphan(ctx)
+		if err != nil {
+			log.CtxWarningf(ctx, "Failed to clean up orphaned container %s: %s", cid, err)
+		} else if reaped {
+			log.CtxInfof(ctx, "Cleaned up orphaned container %s", cid)
+		}
+	}
 }
 
-// Returns the standard config.json path expected by crun.
-func (c *ociContainer) configPath() string {
-	return filepath.Join(c.bundlePath(), "config.json")
+// untrackedContainer returns a container for cleaning up the resources of
+// the container with the given ID, which the provider doesn't track.
+func (p *provider) untrackedContainer(cid string) *ociContainer {
+	return &ociContainer{
+		env:              p.env,
+		runtime:          p.runtime,
+		runtimeType:      p.runtimeType,
+		extraGlobalArgs:  p.extraGlobalArgs,
+		extraCommandArgs: p.extraCommandArgs,
+		cgroupPaths:      p.cgroupPaths,
+		containersRoot:   p.containersRoot,
+		cgroupParent:     p.cgroupParent,
+		overlayRoot:      p.overlayRoot,
+		cid:              cid,
+	}
 }
 
-// containerName returns the container short-name.
-func (c *ociContainer) containerName() string {
-	const cidPrefixLen = 12
-	if len(c.cid) <= cidPrefixLen {
-		return c.cid
+// pruneStateDirsPeriodically calls PruneStateDirs at the given interval until
+// the context is done.
+func (p *provider) pruneStateDirsPeriodically(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if n := p.PruneStateDirs(ctx); n > 0 {
+			log.CtxInfof(ctx, "Pruned state dirs of %d untracked OCI containers", n)
+		}
 	}
-	return c.cid[:cidPrefixLen]
 }
 
-// createBundle creates the OCI bundle directory, which includes the OCI spec
-// file (config.json), the rootfs directory, and other supplementary data files
-// (e.g. the 'hosts' file which will be mounted to /etc/hosts).
-func (c *ociContainer) createBundle(ctx context.Context, cmd *repb.Command) error {
-	if err := os.MkdirAll(c.bundlePath(), 0755); err != nil {
-		return fmt.Errorf("mkdir -p %s: %w", c.bundlePath(), err)
+// PruneStateDirs cleans up the state dirs of containers which the provider
+// doesn't track, such as containers whose removal failed, according to
+// --executor.oci.state_max_age and --executor.oci.state_max_count. OCI bundle
+// dirs are always considered. Runtime state dirs are only considered if
+// --executor.oci.runtime_root is set, since the runtime's default root may be
+// shared with other tools. Containers that still have live processes are left
+// alone, so this is safe to call while other containers are running. It
+// returns the number of containers whose state was pruned.
+func (p *provider) PruneStateDirs(ctx context.Context) int {
+	roots := []string{p.containersRoot}
+	if *runtimeRoot != "" {
+		roots = append(roots, *runtimeRoot)
+	}
+	// The most recent modification time of any state dir of each container.
+	modTimes := map[string]time.Time{}
+	for _, root := range roots {
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			log.CtxWarningf(ctx, "Failed to list container state dirs in %q: %s", root, err)
+			continue
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() || !isCID(entry.Name()) {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				// The dir was removed after it was listed.
+				continue
+			}
+			if info.ModTime().After(modTimes[entry.Name()]) {
+				modTimes[entry.Name()] = info.ModTime()
+			}
+		}
 	}
 
-	hostnamePath := filepath.Join(c.bundlePath(), "hostname")
-	if err := os.WriteFile(hostnamePath, []byte("localhost"), 0644); err != nil {
-		return fmt.Errorf("write %s: %w", hostnamePath, err)
+	// Only look up the tracked containers after listing the state dirs.
+	// Containers are tracked before their state dirs are created, so any
+	// live container whose state dirs were listed is guaranteed to be seen
+	// here.
+	p.mu.Lock()
+	if p.shuttingDown {
+		p.mu.Unlock()
+		return 0
 	}
-	// Note: we don't add 'host.containers.internal' here because we don't
-	// support networking across containers.
-	hostsFileLines := strings.Split(strings.TrimSpace(string(hostsFile)), "\n")
-	if c.network.HostNetwork() != nil {
-		hostsFileLines = append(hostsFileLines, fmt.Sprintf("%s %s", c.network.HostNetwork().NamespacedIP(), c.containerName()))
-	} else {
-		hostsFileLines = append(hostsFileLines, fmt.Sprintf("127.0.0.1 %s", c.containerName()))
+	for c := range p.containers {
+		delete(modTimes, c.id)
 	}
-	hostsBytes := []byte(strings.Join(hostsFileLines, "\n") + "\n")
-	if err := os.WriteFile(filepath.Join(c.bundlePath(), "hosts"), hostsBytes, 0644); err != nil {
-		return fmt.Errorf("write hosts file: %w", err)
+	p.mu.Unlock()
+
+	// Order from most to least recently modified, so that the least
+	// recently modified dirs are pruned first when over the max count.
+	cids := make([]string, 0, len(modTimes))
+	for cid := range modTimes {
+		cids = append(cids, cid)
 	}
-	if *dns != "" {
-		dnsLine := "nameserver " + *dns + "\n"
-		if err := os.WriteFile(filepath.Join(c.bundlePath(), "resolv.conf"), []byte(dnsLine), 0644); err != nil {
-			return fmt.Errorf("write resolv.conf file: %w", err)
+	slices.SortFunc(cids, func(a, b string) int {
+		return modTimes[b].Compare(modTimes[a])
+	})
+	pruned := 0
+	for i, cid := range cids {
+		tooOld := *stateMaxAge > 0 && time.Since(modTimes[cid]) > *stateMaxAge
+		tooMany := *stateMaxCount > 0 && i >= *stateMaxCount
+		if !tooOld && !tooMany {
+			continue
+		}
+		reaped, err := p.untrackedContainer(cid).reapOrphan(ctx)
+		if err != nil {
+			log.CtxWarningf(ctx, "Failed to prune state of untracked container %s: %s", cid, err)
+			continue
+		}
+		if !reaped {
+			continue
 		}
+		// Deleting the container with the runtime normally removes its
+		// state dir, but this fails if the state is incomplete.
+		if *runtimeRoot != "" {
+			if err := os.RemoveAll(filepath.Join(*runtimeRoot, cid)); err != nil {
+				log.CtxWarningf(ctx, "Failed to remove runtime state dir of untracked container %s: %s", cid, err)
+				continue
+			}
+		}
+		pruned++
 	}
+	return pruned
+}
 
-	// Create rootfs
-	if err := c.createRootfs(ctx); err != nil {
-		return fmt.Errorf("create rootfs: %w", err)
+// resolveRuntime returns the runtime path and type to use for the given
+// provider options.
+func resolveRuntime(ctx context.Context, opts *ProviderOpts) (string, RuntimeType, error) {
+	rt := opts.RuntimePath
+	if rt == "" {
+		rt = *Runtime
 	}
-
-	// Create config.json from the image config and command
-	image, ok := c.imageStore.CachedImage(c.imageRef)
-	if !ok {
-		return fmt.Errorf("image must be cached before creating OCI bundle")
+	// Try to find a usable runtime if none is explicitly configured.
+	if rt == "" {
+		for _, t := range autoDetectedRuntimes {
+			if _, err := exec.LookPath(string(t)); err == nil {
+				return string(t), t, nil
+			}
+		}
+		return "", "", status.FailedPreconditionError("could not find a usable container runtime in PATH")
+	}
+	if opts.RuntimeType != "" {
+		if !slices.Contains(autoDetectedRuntimes, opts.RuntimeType) {
+			return "", "", status.InvalidArgumentErrorf("unsupported OCI runtime type %q", opts.RuntimeType)
+		}
+		return rt, opts.RuntimeType, nil
 	}
-	cmd, err := withImageConfig(cmd, image)
+	rtType, err := detectRuntimeType(ctx, rt)
 	if err != nil {
-		return fmt.Errorf("apply image config to command: %w", err)
+		return "", "", err
 	}
-	spec, err := c.createSpec(ctx, cmd)
-	if err != nil {
-		return fmt.Errorf("create spec: %w", err)
+	return rt, rtType, nil
+}
+
+// detectRuntimeType returns the type of the given runtime binary, based on
+// its name if possible, falling back to the output of --version.
+func detectRuntimeType(ctx context.Context, runtimePath string) (RuntimeType, error) {
+	name := filepath.Base(runtimePath)
+	for _, t := range autoDetectedRuntimes {
+		if name == string(t) {
+			return t, nil
+		}
 	}
-	b, err := json.Marshal(spec)
+	v, err := runtimeVersion(ctx, runtimePath)
 	if err != nil {
-		return err
+		return "", err
 	}
-	if err := os.WriteFile(c.configPath(), b, 0644); err != nil {
-		return err
+	for _, t := range autoDetectedRuntimes {
+		if v.Name == string(t) {
+			return t, nil
+		}
 	}
+	return "", status.FailedPreconditionErrorf("unsupported OCI runtime %q reported by %s --version", v.Name, runtimePath)
+}
 
-	return nil
+// RuntimeVersion is the name and version of an OCI runtime, as reported by
+// its --version flag.
+type RuntimeVersion struct {
+	// Name is the name of the runtime, such as "crun".
+	Name string
+	// Version is the version string of the runtime, such as "1.15" or
+	// "1.1.12".
+	Version string
 }
 
-func (c *ociContainer) IsolationType() string {
-	return "oci" // TODO: make const in platform.go
+func (v *RuntimeVersion) String() string {
+	return v.Name + " " + v.Version
 }
 
-func (c *ociContainer) IsImageCached(ctx context.Context) (bool, error) {
-	_, ok := c.imageStore.CachedImage(c.imageRef)
-	return ok, nil
+// AtLeast returns whether the runtime version is at least the given
+// dot-separated numeric version, such as "1.2". Any prefix or suffix
+// surrounding the numeric part of the runtime version, such as "-rc1", is
+// ignored, and missing components are treated as zero.
+func (v *RuntimeVersion) AtLeast(minVersion string) bool {
+	have := versionNumbers(v.Version)
+	want := versionNumbers(minVersion)
+	for i := 0; i < max(len(have), len(want)); i++ {
+		var h, w int
+		if i < len(have) {
+			h = have[i]
+		}
+		if i < len(want) {
+			w = want[i]
+		}
+		if h != w {
+			return h > w
+		}
+	}
+	return true
 }
 
-func (c *ociContainer) PullImage(ctx context.Context, creds oci.Credentials) error {
-	if c.imageRef == TestBusyboxImageRef {
+// versionNumbers returns the components of the first dot-separated sequence
+// of numbers in the given version string.
+func versionNumbers(version string) []int {
+	start := strings.IndexFunc(version, unicode.IsDigit)
+	if start < 0 {
 		return nil
 	}
-	if _, err := c.imageStore.Pull(ctx, c.imageRef, creds); err != nil {
-		return status.WrapError(err, "pull OCI image")
+	version = version[start:]
+	if end := strings.IndexFunc(version, func(r rune) bool { return r != '.' && !unicode.IsDigit(r) }); end >= 0 {
+		version = version[:end]
 	}
-	return nil
+	var numbers []int
+	for _, part := range strings.Split(version, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			break
+		}
+		numbers = append(numbers, n)
+	}
+	return numbers
 }
 
-func (c *ociContainer) Run(ctx context.Context, cmd *repb.Command, workDir string, creds oci.Credentials) *interfaces.CommandResult {
-	c.workDir = workDir
-	cid, err := newCID()
+// runtimeVersion runs the given runtime binary with --version and parses the
+// output. All supported runtimes print "<name> version <version>" as the
+// first line.
+func runtimeVersion(ctx context.Context, runtimePath string) (*RuntimeVersion, error) {
+	b, err := exec.CommandContext(ctx, runtimePath, "--version").Output()
 	if err != nil {
-		return commandutil.ErrorResult(status.UnavailableErrorf("generate cid: %s", err))
+		return nil, status.FailedPreconditionErrorf("run %s --version: %s", runtimePath, err)
+	}
+	firstLine, _, _ := strings.Cut(string(b), "\n")
+	fields := strings.Fields(firstLine)
+	if len(fields) < 3 || fields[1] != "version" {
+		return nil, status.FailedPreconditionErrorf("could not parse %s --version output %q", runtimePath, firstLine)
+	}
+	return &RuntimeVersion{Name: fields[0], Version: fields[2]}, nil
+}
+
+// RuntimeType returns the type of the OCI runtime used by the provider.
+func (p *provider) RuntimeType() RuntimeType {
+	return p.runtimeType
+}
+
+// RuntimeVersion returns the name and version of the OCI runtime used by the
+// provider, as reported by the runtime binary.
+func (p *provider) RuntimeVersion(ctx context.Context) (*RuntimeVersion, error) {
+	return runtimeVersion(ctx, p.runtime)
+}
+
+// GC deletes extracted image layers that are not referenced by any cached
+// image. See ImageStore.GC.
+func (p *provider) GC(ctx context.Context) (int64, error) {
+	return p.imageStore.GC(ctx)
+}
+
+// PrefetchResult is the result of prefetching a single image.
+type PrefetchResult struct {
+	ImageRef string
+	// Cached is true if the image was already cached, so it was not pulled.
+	Cached bool
+	// Err is the error that occurred while pulling the image, if any.
+	Err error
+}
+
+// Prefetch pulls the given images for the runtime platform if they are not
+// already cached, so that containers using them can be created without
+// waiting for a pull. Images are pulled concurrently, with bounded
+// parallelism. A result is returned for each image, in the same order as
+// imageRefs, so that a failure to pull one image doesn't prevent the others
+// from being pulled.
+func (p *provider) Prefetch(ctx context.Context, imageRefs []string, creds oci.Credentials) []*PrefetchResult {
+	results := make([]*PrefetchResult, len(imageRefs))
+	var eg errgroup.Group
+	eg.SetLimit(maxConcurrentPrefetches)
+	for i, imageRef := range imageRefs {
+		result := &PrefetchResult{ImageRef: imageRef}
+		results[i] = result
+		eg.Go(func() error {
+			result.Cached, result.Err = p.prefetch(ctx, imageRef, creds)
+			if result.Err != nil {
+				log.CtxWarningf(ctx, "Failed to prefetch image %q: %s", imageRef, result.Err)
+			}
+			return nil
+		})
 	}
-	c.cid = cid
+	eg.Wait()
+	return results
+}
 
-	if err := container.PullImageIfNecessary(ctx, c.env, c, creds, c.imageRef); err != nil {
-		return commandutil.ErrorResult(status.UnavailableErrorf("pull image: %s", err))
+// prefetch pulls the given image if it is not cached, and returns whether it
+// was already cached.
+func (p *provider) prefetch(ctx context.Context, imageRef string, creds oci.Credentials) (bool, error) {
+	c, err := p.New(ctx, &container.Init{Props: &platform.Properties{ContainerImage: imageRef}})
+	if err != nil {
+		return false, err
 	}
-	if err := c.createNetwork(ctx); err != nil {
-		return commandutil.ErrorResult(status.UnavailableErrorf("create network: %s", err))
+	// The container is only used to pull the image. Remove it once the image
+	// is cached, so that it is no longer tracked by the provider and doesn't
+	// keep the image's layers in use.
+	defer func() {
+		if err := c.Remove(ctx); err != nil {
+			log.CtxWarningf(ctx, "Failed to remove prefetch container for %q: %s", imageRef, err)
+		}
+	}()
+	cached, err := c.IsImageCached(ctx)
+	if err != nil {
+		return false, err
 	}
-	if err := c.createBundle(ctx, cmd); err != nil {
-		return commandutil.ErrorResult(status.UnavailableErrorf("create OCI bundle: %s", err))
+	if cached {
+		return true, nil
 	}
-
-	return c.doWithStatsTracking(ctx, func(ctx context.Context) *interfaces.CommandResult {
-		return c.invokeRuntime(ctx, nil /*=cmd*/, &interfaces.Stdio{}, 0 /*=waitDelay*/, "run", "--bundle="+c.bundlePath(), c.cid)
-	})
+	return false, c.PullImage(ctx, creds)
 }
 
-func (c *ociContainer) Create(ctx context.Context, workDir string) error {
-	c.workDir = workDir
-	cid, err := newCID()
+func (p *provider) New(ctx context.Context, args *container.Init) (container.CommandContainer, error) {
+	if args.Props.CPULimitMilliCPU < 0 {
+		return nil, status.InvalidArgumentErrorf("invalid CPU limit %dm", args.Props.CPULimitMilliCPU)
+	}
+	bindMounts, err := validateBindMounts(args.Props.BindMounts)
 	if err != nil {
-		return status.UnavailableErrorf("generate cid: %s", err)
+		return nil, err
 	}
-	c.cid = cid
-
-	if err := c.createNetwork(ctx); err != nil {
-		return status.UnavailableErrorf("create network: %s", err)
+	// dockerNetwork=off runs the container in a new network namespace with
+	// only a loopback device, while dockerNetwork=host skips creating a
+	// network namespace entirely, so that the container shares the host's
+	// network. Neither mode has a veth pair, so ports cannot be published and
+	// IP addresses cannot be assigned in either mode.
+	hostNetwork := args.Props.DockerNetwork == "host"
+	if hostNetwork && !*allowHostNetwork {
+		return nil, status.PermissionDeniedError("dockerNetwork=host is not allowed by this executor")
 	}
-	pid1 := &repb.Command{Arguments: []string{"sleep", "999999999999"}}
-	// Provision bundle directory (OCI config JSON, rootfs, etc.)
-	if err := c.createBundle(ctx, pid1); err != nil {
-		return status.UnavailableErrorf("create OCI bundle: %s", err)
+	if len(args.Props.PublishPorts) > 0 && (args.Props.DockerNetwork == "off" || hostNetwork) {
+		return nil, status.InvalidArgumentErrorf("%s cannot be used with dockerNetwork=%s", platform.PublishPortsPropertyName, args.Props.DockerNetwork)
 	}
-	// Creating the container, at least with crun, already invokes the entrypoint and has it
-	// inherit the stdout and stderr create is invoked with:
-	// https://github.com/containers/crun/blob/f44da38333321335611d45638401e99f5f9548f2/src/libcrun/container.c#L2909
-	// https://github.com/containers/crun/blob/f44da38333321335611d45638401e99f5f9548f2/src/libcrun/container.c#L2459C9-L2459C36
-	// https://github.com/containers/crun/blob/f44da38333321335611d45638401e99f5f9548f2/src/libcrun/linux.c#L4950
-	// https://github.com/containers/crun/blob/f44da38333321335611d45638401e99f5f9548f2/src/libcrun/container.c#L1548
-	// By default, exec.Cmd.Wait() will wait until both the process has exited and the stdout and
-	// stderr pipes have been closed. But since these pipes are inherited by the sleep pid1 process,
-	// they are never closed. We use a very short waitDelay to forcibly close the pipes right after
-	// the process exit.
-	result := c.invokeRuntime(ctx, &repb.Command{}, &interfaces.Stdio{}, 1*time.Nanosecond, "create", "--bundle="+c.bundlePath(), c.cid)
-	if err := asError(result); err != nil {
-		return status.UnavailableErrorf("create container: %s", err)
+	if args.Props.ContainerIP != "" && (args.Props.DockerNetwork == "off" || hostNetwork) {
+		return nil, status.InvalidArgumentErrorf("%s cannot be used with dockerNetwork=%s", platform.ContainerIPPropertyName, args.Props.DockerNetwork)
 	}
-	// Start container
-	if err := c.invokeRuntimeSimple(ctx, "start", c.cid); err != nil {
-		return status.UnavailableErrorf("start container: %s", err)
+	// Addresses and ports are managed by the CNI plugins when using CNI
+	// networking.
+	if p.cniConfig != nil && (len(args.Props.PublishPorts) > 0 || args.Props.ContainerIP != "") {
+		return nil, status.InvalidArgumentErrorf("%s and %s are not supported with CNI networking", platform.PublishPortsPropertyName, platform.ContainerIPPropertyName)
 	}
-	return nil
-}
-
-func (c *ociContainer) Exec(ctx context.Context, cmd *repb.Command, stdio *interfaces.Stdio) *interfaces.CommandResult {
-	// Reset CPU usage and peak memory since we're starting a new task.
-	c.stats.Reset()
-	args := []string{"exec", "--cwd=" + execrootPath}
-	// Respect command env. Note, when setting any --env vars at all, it
-	// completely overrides the env from the bundle, rather than just adding
-	// to it. So we specify the complete env here, including the base env,
-	// image env, and command env.
-	for _, e := range baseEnv {
-		args = append(args, "--env="+e)
+	for _, pm := range args.Props.PublishPorts {
+		if pm.HostPort != 0 && !slices.Contains(*allowedPublishHostPorts, pm.HostPort) {
+			return nil, status.PermissionDeniedErrorf("%s: host port %d is not allowed by this executor", platform.PublishPortsPropertyName, pm.HostPort)
+		}
 	}
-	image, ok := c.imageStore.CachedImage(c.imageRef)
-	if !ok {
-		return commandutil.ErrorResult(status.UnavailableError("exec called before pulling image"))
+	if args.Props.DockerForceRoot && args.Props.ContainerUID != nil && *args.Props.ContainerUID != 0 {
+		return nil, status.InvalidArgumentErrorf("%s=true conflicts with %s=%d", "dockerRunAsRoot", platform.ContainerUIDPropertyName, *args.Props.ContainerUID)
+	}
+	// IDs outside of the user namespace mappings can't be used by processes
+	// in the namespace.
+	if p.uidMapping != nil {
+		if uid := args.Props.ContainerUID; uid != nil && *uid >= p.uidMapping.Size {
+			return nil, status.InvalidArgumentErrorf("%s=%d is outside of the %d UIDs mapped by this executor", platform.ContainerUIDPropertyName, *uid, p.uidMapping.Size)
+		}
+		if gid := args.Props.ContainerGID; gid != nil && *gid >= p.gidMapping.Size {
+			return nil, status.InvalidArgumentErrorf("%s=%d is outside of the %d GIDs mapped by this executor", platform.ContainerGIDPropertyName, *gid, p.gidMapping.Size)
+		}
+		for _, gid := range args.Props.ContainerAdditionalGIDs {
+			if gid >= p.gidMapping.Size {
+				return nil, status.InvalidArgumentErrorf("%s: GID %d is outside of the %d GIDs mapped by this executor", platform.ContainerAdditionalGIDsPropertyName, gid, p.gidMapping.Size)
+			}
+		}
+	}
+	seccompProfile := p.seccomp
+	if args.Props.SeccompProfile != "" {
+		if !*allowSeccompProfileOverride {
+			return nil, status.PermissionDeniedErrorf("%s platform property is not allowed by this executor", platform.SeccompProfilePropertyName)
+		}
+		sp, err := parseSeccompProfile([]byte(args.Props.SeccompProfile))
+		if err != nil {
+			return nil, err
+		}
+		seccompProfile = sp
 	}
-	cmd, err := withImageConfig(cmd, image)
+	appArmorProfile, err := p.appArmorProfile(ctx, args.Props.AppArmorProfile)
 	if err != nil {
-		return commandutil.ErrorResult(status.UnavailableErrorf("apply image config: %s", err))
+		return nil, err
 	}
-	for _, e := range cmd.GetEnvironmentVariables() {
-		args = append(args, fmt.Sprintf("--env=%s=%s", e.GetName(), e.GetValue()))
+	caps, err := containerCapabilities(args.Props.CapAdd, args.Props.CapDrop)
+	if err != nil {
+		return nil, err
 	}
-	args = append(args, c.cid)
+	hostInitPath := ""
+	if args.Props.DockerInit {
+		hostInitPath, err = findInitBinary()
+		if err != nil {
+			return nil, err
+		}
+	}
+	imagePlatform := oci.RuntimePlatform()
+	if args.Props.ContainerImagePlatform != "" {
+		plat, err := oci.ParsePlatform(args.Props.ContainerImagePlatform)
+		if err != nil {
+			return nil, err
+		}
+		imagePlatform = plat
+	}
+	rt, rtType, err := p.containerRuntime(args.Props.OCIRuntime)
+	if err != nil {
+		return nil, err
+	}
+	// Extra runtime args are specific to the provider's runtime, so don't
+	// pass them to a different runtime requested by the action.
+	var extraGlobalArgs []string
+	var extraCommandArgs map[string][]string
+	if rt == p.runtime {
+		extraGlobalArgs = p.extraGlobalArgs
+		extraCommandArgs = p.extraCommandArgs
+	}
+	imageRef := args.Props.ContainerImage
+	if args.RootfsTarPath != "" {
+		if !filepath.IsAbs(args.RootfsTarPath) {
+			return nil, status.InvalidArgumentErrorf("rootfs tarball path %q is not absolute", args.RootfsTarPath)
+		}
+		imageRef = rootfsTarImageRefPrefix + args.RootfsTarPath
+	}
+	c := &ociContainer{
+		env:            p.env,
+		runtime:        rt,
+		runtimeType:    rtType,
+		containersRoot: p.containersRoot,
+		cgroupPaths:    p.cgroupPaths,
+		layersRoot:     p.layersRoot,
+		imageStore:     p.imageStore,
+		seccomp:        seccompProfile,
 
-	return c.doWithStatsTracking(ctx, func(ctx context.Context) *interfaces.CommandResult {
-		return c.invokeRuntime(ctx, cmd, stdio, 1*time.Microsecond, args...)
-	})
-}
+		extraGlobalArgs:  extraGlobalArgs,
+		extraCommandArgs: extraCommandArgs,
+		offline:          p.offline,
+		cgroupParent:     p.cgroupParent,
 
-func (c *ociContainer) Pause(ctx context.Context) error {
-	return c.invokeRuntimeSimple(ctx, "pause", c.cid)
-}
+		appArmorProfile: appArmorProfile,
+		capabilities:    caps,
+		hooks:           p.hooks,
+		cniConfig:       p.cniConfig,
 
-func (c *ociContainer) Unpause(ctx context.Context) error {
-	return c.invokeRuntimeSimple(ctx, "resume", c.cid)
-}
+		overlayfsMode:     p.overlayfsMode,
+		fuseOverlayfsPath: p.fuseOverlayfsPath,
+		overlayRoot:       p.overlayRoot,
 
-//nolint:nilness
-func (c *ociContainer) Remove(ctx context.Context) error {
-	if c.cid == "" {
-		// We haven't created anything yet
-		return nil
+		uidMapping: p.uidMapping,
+		gidMapping: p.gidMapping,
+
+		imageRef:         imageRef,
+		rootfsTarPath:    args.RootfsTarPath,
+		pullProgress:     args.PullProgress,
+		imagePlatform:    imagePlatform,
+		networkEnabled:   args.Props.DockerNetwork != "off",
+		hostNetwork:      hostNetwork,
+		user:             args.Props.DockerUser,
+		forceRoot:        args.Props.DockerForceRoot,
+		memoryLimitBytes: args.Props.MemoryLimitBytes,
+		cpuLimitMilliCPU: args.Props.CPULimitMilliCPU,
+		pidsLimit:        args.Props.PidsLimit,
+		ioWeight:         args.Props.IOWeight,
+		ioReadBPS:        args.Props.IOReadBPS,
+		ioWriteBPS:       args.Props.IOWriteBPS,
+		readOnlyRootfs:   args.Props.ReadOnlyRootfs,
+		ulimits:          args.Props.Ulimits,
+		tmpfsMounts:      args.Props.TmpfsMounts,
+		bindMounts:       bindMounts,
+		extraHosts:       args.Props.ExtraHosts,
+		dnsServers:       args.Props.DNSServers,
+		dnsSearch:        args.Props.DNSSearch,
+		publishPorts:     args.Props.PublishPorts,
+		staticIP:         args.Props.ContainerIP,
+		gpu:              args.Props.GPU,
+		useImageWorkDir:  args.Props.UseImageWorkingDir,
+		useImageEnv:      !args.Props.IgnoreImageEnv,
+		uid:              args.Props.ContainerUID,
+		gid:              args.Props.ContainerGID,
+		additionalGids:   args.Props.ContainerAdditionalGIDs,
+		workDirOverride:  args.Props.ContainerWorkingDir,
+		hostnameOverride: args.Props.ContainerHostname,
+		initPath:         hostInitPath,
+		annotations:      containerAnnotations(args),
+		healthCheck:      args.Props.HealthCheck,
+	}
+	id, err := c.newUniqueCID(ctx)
+	if err != nil {
+		return nil, status.UnavailableErrorf("generate cid: %s", err)
+	}
+	c.id = id
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.shuttingDown {
+		return nil, status.UnavailableError("OCI container provider is shutting down")
+	}
+	p.containers[c] = struct{}{}
+	metrics.OCILiveContainers.Inc()
+	c.untrack = func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if _, ok := p.containers[c]; ok {
+			delete(p.containers, c)
+			metrics.OCILiveContainers.Dec()
+		}
 	}
+	return c, nil
+}
 
-	var firstErr error
+// Shutdown removes all containers created by the provider that have not been
+// removed yet, then deletes the provider's container bundle dirs. New
+// containers can't be created once Shutdown is called.
+//
+// During a graceful executor shutdown, tasks are canceled shortly before the
+// shutdown deadline so that their containers can be removed normally. So
+// containers are given until shutdownForceRemoveTimeout before the context's
+// deadline to be removed by their owners before they are forcibly removed.
+func (p *provider) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	p.shuttingDown = true
+	p.mu.Unlock()
 
-	if err := c.invokeRuntimeSimple(ctx, "delete", "--force", c.cid); err != nil && firstErr == nil {
-		firstErr = status.UnavailableErrorf("delete container: %s", err)
+	if deadline, ok := ctx.Deadline(); ok {
+		p.waitForRemoval(ctx, deadline.Add(-shutdownForceRemoveTimeout))
 	}
 
-	if c.overlayfsMounted {
-		if err := syscall.Unmount(c.rootfsPath(), syscall.MNT_FORCE); err != nil && firstErr == nil {
-			firstErr = status.UnavailableErrorf("unmount overlayfs: %s", err)
-		}
+	p.mu.Lock()
+	containers := make([]*ociContainer, 0, len(p.containers))
+	for c := range p.containers {
+		containers = append(containers, c)
+	}
+	p.mu.Unlock()
+	if len(containers) > 0 {
+		log.CtxWarningf(ctx, "Forcibly removing %d OCI containers on shutdown", len(containers))
 	}
+	var eg errgroup.Group
+	for _, c := range containers {
+		eg.Go(func() error {
+			if err := c.Remove(ctx); err != nil {
+				return status.WrapErrorf(err, "remove container %s", c.cid)
+			}
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		// Leave the bundle dirs in place, since a container's rootfs may
+		// still be mounted in its bundle. They are cleaned up when the next
+		// provider starts.
+		return err
+	}
+	if err := os.RemoveAll(p.containersRoot); err != nil {
+		return status.UnavailableErrorf("remove containers root: %s", err)
+	}
+	return nil
+}
 
-	if c.network != nil {
-		if err := c.network.Cleanup(ctx); err != nil && firstErr == nil {
-			firstErr = status.UnavailableErrorf("cleanup network: %s", err)
+// waitForRemoval waits until all of the provider's containers have been
+// removed, or until the given deadline.
+func (p *provider) waitForRemoval(ctx context.Context, deadline time.Time) {
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for p.numContainers() > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 		}
 	}
+}
 
-	if err := os.RemoveAll(c.bundlePath()); err != nil && firstErr == nil {
-		firstErr = status.UnavailableErrorf("remove bundle: %s", err)
-	}
+func (p *provider) numContainers() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.containers)
+}
 
-	return firstErr
+// containerAnnotations returns the extra OCI spec annotations for a container,
+// including the annotations requested via platform properties and the
+// well-known annotations identifying the initial task.
+func containerAnnotations(args *container.Init) map[string]string {
+	annotations := maps.Clone(args.Props.ContainerAnnotations)
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	task := args.Task.GetExecutionTask()
+	if id := task.GetInvocationId(); id != "" {
+		annotations[InvocationIDAnnotation] = id
+	}
+	if id := task.GetExecutionId(); id != "" {
+		annotations[ExecutionIDAnnotation] = id
+	}
+	return annotations
 }
 
-func (c *ociContainer) createNetwork(ctx context.Context) error {
-	loopbackOnly := !c.networkEnabled
-	network, err := networking.CreateContainerNetwork(ctx, loopbackOnly)
+// containerRuntime returns the runtime path and type to use for a container
+// requesting the given runtime via the oci-runtime platform property.
+func (p *provider) containerRuntime(requested string) (string, RuntimeType, error) {
+	if requested == "" || RuntimeType(requested) == p.runtimeType {
+		return p.runtime, p.runtimeType, nil
+	}
+	if RuntimeType(requested) != RuntimeTypeRunsc {
+		return "", "", status.InvalidArgumentErrorf("unsupported %s %q", platform.OCIRuntimePropertyName, requested)
+	}
+	if *runscPath != "" {
+		return *runscPath, RuntimeTypeRunsc, nil
+	}
+	path, err := exec.LookPath(string(RuntimeTypeRunsc))
 	if err != nil {
-		return status.WrapError(err, "create network")
+		return "", "", status.FailedPreconditionErrorf("%s=%s requested, but runsc is not installed on this executor", platform.OCIRuntimePropertyName, requested)
+	}
+	return path, RuntimeTypeRunsc, nil
+}
+
+// validateExtraRuntimeArgs returns an error if the given extra runtime args
+// are not flags, or set flags which are managed by the executor.
+func validateExtraRuntimeArgs(args []string) error {
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			return status.InvalidArgumentErrorf("%q is not a flag", arg)
+		}
+		name, _, _ := strings.Cut(arg, "=")
+		if slices.Contains(managedRuntimeFlags, name) {
+			return status.InvalidArgumentErrorf("flag %q is managed by the executor", name)
+		}
 	}
-	c.network = network
 	return nil
 }
 
-func (c *ociContainer) Stats(ctx context.Context) (*repb.UsageStats, error) {
-	lifetimeStats, err := c.cgroupPaths.Stats(ctx, c.cid)
+// findInitBinary returns the host path of the init binary used for
+// containers with dockerInit=true.
+func findInitBinary() (string, error) {
+	if *initPath != "" {
+		return *initPath, nil
+	}
+	path, err := exec.LookPath("tini")
 	if err != nil {
-		return nil, err
+		return "", status.FailedPreconditionErrorf("%s was requested, but no init binary is available on this executor", platform.DockerInitPropertyName)
 	}
-	c.stats.Update(lifetimeStats)
-	return c.stats.TaskStats(), nil
+	return path, nil
 }
 
-// Instruments an OCI runtime call with monitor() to ensure that resource usage
-// metrics are updated while the function is being executed, and that the
-// resource usage results are populated in the returned CommandResult.
-func (c *ociContainer) doWithStatsTracking(ctx context.Context, invokeRuntimeFn func(ctx context.Context) *interfaces.CommandResult) *interfaces.CommandResult {
-	stop, statsCh := container.TrackStats(ctx, c)
-	res := invokeRuntimeFn(ctx)
-	stop()
-	// statsCh will report stats for processes inside the container, and
-	// res.UsageStats will report stats for the container runtime itself.
-	// Combine these stats to get the total usage.
-	runtimeProcessStats := res.UsageStats
-	taskStats := <-statsCh
-	if taskStats == nil {
-		taskStats = &repb.UsageStats{}
+// appArmorProfile returns the AppArmor profile that should be applied to a
+// container, given the value of the apparmor-profile platform property. It
+// returns an empty string if the container should not be confined, including
+// when AppArmor is not enabled on the host.
+func (p *provider) appArmorProfile(ctx context.Context, propValue string) (string, error) {
+	profile := *defaultAppArmorProfile
+	if propValue != "" {
+		if !*allowAppArmorProfileOverride {
+			return "", status.PermissionDeniedErrorf("%s platform property is not allowed by this executor", platform.AppArmorProfilePropertyName)
+		}
+		if strings.ContainsAny(propValue, " \t\n") {
+			return "", status.InvalidArgumentErrorf("invalid %s %q", platform.AppArmorProfilePropertyName, propValue)
+		}
+		profile = propValue
 	}
-	combinedStats := taskStats.CloneVT()
-	combinedStats.CpuNanos += runtimeProcessStats.GetCpuNanos()
-	if runtimeProcessStats.GetPeakMemoryBytes() > taskStats.GetPeakMemoryBytes() {
-		combinedStats.PeakMemoryBytes = runtimeProcessStats.GetPeakMemoryBytes()
+	if profile == "" || profile == unconfinedAppArmorProfile {
+		return "", nil
 	}
-	res.UsageStats = combinedStats
-	return res
+	if !p.appArmorEnabled {
+		if propValue != "" {
+			log.CtxWarningf(ctx, "AppArmor is not enabled in the kernel; not applying AppArmor profile %q", profile)
+		}
+		return "", nil
+	}
+	return profile, nil
 }
 
-func (c *ociContainer) createRootfs(ctx context.Context) error {
-	if err := os.MkdirAll(c.rootfsPath(), 0755); err != nil {
-		return fmt.Errorf("create rootfs dir: %w", err)
+// normalizeCapability converts a capability name like "net_raw" to its
+// canonical form ("CAP_NET_RAW").
+func normalizeCapability(name string) string {
+	name = strings.ToUpper(name)
+	if name != "ALL" && !strings.HasPrefix(name, "CAP_") {
+		name = "CAP_" + name
 	}
+	return name
+}
 
-	// For testing only, support a fake image ref that means "install busybox
-	// manually".
-	// TODO: improve testing setup and get rid of this
-	if c.imageRef == TestBusyboxImageRef {
-		return installBusybox(ctx, c.rootfsPath())
+// containerCapabilities returns the default container capabilities with the
+// given capabilities added and dropped. Dropped capabilities take precedence
+// over added ones.
+func containerCapabilities(add, drop []string) ([]string, error) {
+	if len(add) == 0 && len(drop) == 0 {
+		return capabilities, nil
 	}
-
-	if c.imageRef == "" {
-		// No image specified (sandbox-only).
-		return nil
+	dropSet := map[string]bool{}
+	for _, name := range drop {
+		capName := normalizeCapability(name)
+		if capName != "ALL" && !slices.Contains(knownCapabilities, capName) {
+			return nil, status.InvalidArgumentErrorf("%s: unknown capability %q", platform.CapDropPropertyName, name)
+		}
+		dropSet[capName] = true
 	}
-
-	// Create an overlayfs with the pulled image layers.
-	var lowerDirs []string
-	image, ok := c.imageStore.CachedImage(c.imageRef)
-	if !ok {
-		return fmt.Errorf("bad state: attempted to create rootfs before pulling image")
+	var caps []string
+	for _, capName := range capabilities {
+		if !dropSet["ALL"] && !dropSet[capName] {
+			caps = append(caps, capName)
+		}
 	}
-	// overlayfs "lowerdir" mount args are ordered from uppermost to lowermost,
-	// but manifest layers are ordered from lowermost to uppermost. So we
-	// iterate in reverse order when building the lowerdir args.
-	for i := len(image.Layers) - 1; i >= 0; i-- {
-		layer := image.Layers[i]
-		path := layerPath(c.layersRoot, layer.DiffID)
-		// Skip empty dirs - these can cause conflicts since they will always
-		// have the same digest, and also just add more overhead.
-		// TODO: precompute this
-		children, err := os.ReadDir(path)
-		if err != nil {
-			return fmt.Errorf("read layer dir: %w", err)
+	for _, name := range add {
+		capName := normalizeCapability(name)
+		if !slices.Contains(knownCapabilities, capName) {
+			return nil, status.InvalidArgumentErrorf("%s: unknown capability %q", platform.CapAddPropertyName, name)
 		}
-		if len(children) == 0 {
+		if !slices.ContainsFunc(*allowedAddedCapabilities, func(allowed string) bool {
+			return normalizeCapability(allowed) == capName
+		}) {
+			return nil, status.PermissionDeniedErrorf("%s: capability %s is not allowed by this executor", platform.CapAddPropertyName, capName)
+		}
+		if dropSet[capName] || slices.Contains(caps, capName) {
 			continue
 		}
-		lowerDirs = append(lowerDirs, path)
-	}
-	// Create workdir and upperdir.
-	workdir := filepath.Join(c.overlayTmpPath(), "work")
-	if err := os.MkdirAll(workdir, 0755); err != nil {
-		return fmt.Errorf("create overlay workdir: %w", err)
+		caps = append(caps, capName)
 	}
-	upperdir := filepath.Join(c.overlayTmpPath(), "upper")
-	if err := os.MkdirAll(upperdir, 0755); err != nil {
-		return fmt.Errorf("create overlay upperdir: %w", err)
+	return caps, nil
+}
+
+type ociContainer struct {
+	env environment.Env
+
+	runtime          string
+	runtimeType      RuntimeType
+	extraGlobalArgs  []string
+	extraCommandArgs map[string][]string
+	cgroupPaths      *cgroup.Paths
+	containersRoot   string
+	layersRoot       string
+	imageStore       *ImageStore
+	offline          bool
+	cgroupParent     string
+	seccomp          *specs.LinuxSeccomp
+	// AppArmor profile name, or empty if the container should not be
+	// confined by an AppArmor profile.
+	appArmorProfile string
+	// Linux capabilities granted to the container process.
+	capabilities []string
+	// Lifecycle hooks run by the runtime, or nil if none are configured.
+	hooks *specs.Hooks
+	// CNI network to attach the container to, or nil if the built-in
+	// networking is used.
+	cniConfig *networking.CNIConfig
+	// How the rootfs overlay is mounted, and the path to fuse-overlayfs, or
+	// empty if fuse-overlayfs can't be used.
+	overlayfsMode     string
+	fuseOverlayfsPath string
+	// Directory where the overlay dirs are stored, or empty if they are
+	// stored next to the workspace.
+	overlayRoot string
+	// Mappings of container user and group IDs to host IDs, or nil if the
+	// container doesn't run in a user namespace.
+	uidMapping *specs.LinuxIDMapping
+	gidMapping *specs.LinuxIDMapping
+
+	// ID assigned to the container by New.
+	id string
+	// The ID of the created container, which is id once the container has
+	// been created or run, or empty before then.
+	cid              string
+	workDir          string
+	overlayfsMounted bool
+	// Whether the mounted overlay is a fuse-overlayfs mount rather than a
+	// kernel overlayfs mount.
+	overlayfsFuse bool
+	// Whether Remove has completed successfully.
+	removed bool
+	// Stops tracking the container in its provider once it is removed.
+	untrack func()
+	// Whether the container's init process is the placeholder process
+	// started by Create, rather than a command passed to Run.
+	placeholderInit bool
+	// statsMu guards stats, which may be sampled concurrently by
+	// StreamStats, and activeExecs.
+	statsMu sync.Mutex
+	stats   container.UsageStats
+	// Number of Exec calls in progress. Stats are only reset when an Exec
+	// starts while no other Exec is in progress.
+	activeExecs int
+	network     *networking.ContainerNetwork
+	// Maps published container ports to host ports.
+	publishedPorts map[int]int
+	// pullProgress receives image pull progress updates, if set.
+	pullProgress func(p *container.ImagePullProgress)
+	// acquiredImage is the image whose layers are used by the container's
+	// rootfs, if any. Its layers are pinned from when the image is pulled
+	// until the container is removed.
+	acquiredImage *Image
+
+	imageRef string
+	// Digest that imageRef resolved to when the image was first pulled, and
+	// the corresponding digest ref. Empty until the image is pulled.
+	imageDigest    string
+	pinnedImageRef string
+	// Host path of a tarball to import the rootfs from, or empty if the
+	// image is pulled from imageRef.
+	rootfsTarPath    string
+	imagePlatform    *rgpb.Platform
+	networkEnabled   bool
+	hostNetwork      bool
+	user             string
+	forceRoot        bool
+	memoryLimitBytes int64
+	cpuLimitMilliCPU int64
+	pidsLimit        int64
+	ioWeight         int64
+	ioReadBPS        int64
+	ioWriteBPS       int64
+	readOnlyRootfs   bool
+	ulimits          []*platform.Ulimit
+	tmpfsMounts      []*platform.TmpfsMount
+	bindMounts       []*platform.BindMount
+	extraHosts       []*platform.HostEntry
+	dnsServers       []string
+	dnsSearch        []string
+	publishPorts     []*platform.PortMapping
+	staticIP         string
+	gpu              bool
+	useImageWorkDir  bool
+	useImageEnv      bool
+	uid              *uint32
+	gid              *uint32
+	additionalGids   []uint32
+	workDirOverride  string
+	hostnameOverride string
+	// Host path of the init binary to run as PID 1, or empty if the
+	// command should run as PID 1.
+	initPath string
+	// Extra annotations to set in the OCI spec.
+	annotations map[string]string
+	// Health check run by WaitHealthy, or nil if none is configured.
+	healthCheck *platform.HealthCheck
+	// Time at which Create was called, used for the health check start
+	// period.
+	createTime time.Time
+}
+
+// Returns the OCI bundle directory for the container.
+func (c *ociContainer) bundlePath() string {
+	return filepath.Join(c.containersRoot, c.cid)
+}
+
+// Returns the standard rootfs path expected by crun.
+func (c *ociContainer) rootfsPath() string {
+	return filepath.Join(c.bundlePath(), "rootfs")
+}
+
+// Returns the root path where overlay workdir and upperdir for this container
+// are stored. If an overlay root is configured, the dirs are stored there,
+// keyed by container ID, and otherwise next to the workspace.
+func (c *ociContainer) overlayTmpPath() string {
+	if c.overlayRoot != "" {
+		return filepath.Join(c.overlayRoot, c.cid)
 	}
+	return c.workDir + ".overlay"
+}
 
-	// TODO: do this mount inside a namespace so that it gets removed even if
-	// the executor crashes (also needed for rootless support)
+// Returns the overlayfs upperdir path, which holds files written to the
+// container's rootfs.
+func (c *ociContainer) overlayUpperPath() string {
+	return filepath.Join(c.overlayTmpPath(), "upper")
+}
 
-	// - userxattr is needed for compatibility with older kernels
-	// - volatile disables fsync, as a performance optimization
-	options := fmt.Sprintf(
-		"lowerdir=%s,upperdir=%s,workdir=%s,userxattr,volatile",
-		strings.Join(lowerDirs, ":"), upperdir, workdir)
-	log.CtxDebugf(ctx, "Mounting overlayfs to %q, options=%q", c.rootfsPath(), options)
-	if err := syscall.Mount("none", c.rootfsPath(), "overlay", 0, options); err != nil {
-		return fmt.Errorf("mount overlayfs: %w", err)
+// Returns the standard config.json path expected by crun.
+func (c *ociContainer) configPath() string {
+	return filepath.Join(c.bundlePath(), "config.json")
+}
+
+// ID returns the ID of the container, which is assigned when the container is
+// constructed and doesn't change for its lifetime. It is used as the OCI
+// runtime container ID, so it is also the name of the container's state
+// directory under the runtime root, its bundle directory, and its cgroup.
+func (c *ociContainer) ID() string {
+	return c.id
+}
+
+// containerName returns the container short-name.
+func (c *ociContainer) containerName() string {
+	const cidPrefixLen = 12
+	if len(c.cid) <= cidPrefixLen {
+		return c.cid
 	}
-	c.overlayfsMounted = true
+	return c.cid[:cidPrefixLen]
+}
+
+// hostname returns the hostname of the container's UTS namespace.
+func (c *ociContainer) hostname() string {
+	if c.hostnameOverride != "" {
+		return c.hostnameOverride
+	}
+	return c.containerName()
+}
+
+// baseEnv returns the environment variables applied to all commands executed
+// in the container, before applying the image and command env.
+func (c *ociContainer) baseEnv() []string {
+	if c.hostnameOverride == "" {
+		return slices.Clone(baseEnv)
+	}
+	env := make([]string, 0, len(baseEnv))
+	for _, e := range baseEnv {
+		if strings.HasPrefix(e, "HOSTNAME=") {
+			e = "HOSTNAME=" + c.hostnameOverride
+		}
+		env = append(env, e)
+	}
+	return env
+}
+
+// Returns the path to the resolv.conf file in the OCI bundle, which is mounted
+// to /etc/resolv.conf.
+func (c *ociContainer) resolvConfPath() string {
+	return filepath.Join(c.bundlePath(), "resolv.conf")
+}
+
+// resolvConf returns the contents of the container's /etc/resolv.conf file.
+// DNS servers and search domains requested via platform properties take
+// precedence over the executor-configured DNS server. If neither are
+// configured, the host's resolv.conf is copied. Returns nil if there is no
+// resolv.conf to apply.
+func (c *ociContainer) resolvConf() ([]byte, error) {
+	var lines []string
+	servers := c.dnsServers
+	if len(servers) == 0 && *dns != "" {
+		servers = []string{*dns}
+	}
+	if len(servers) == 0 {
+		b, err := os.ReadFile("/etc/resolv.conf")
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+			// Search domains from the host are replaced if any are
+			// configured.
+			fields := strings.Fields(line)
+			if len(c.dnsSearch) > 0 && len(fields) > 0 && (fields[0] == "search" || fields[0] == "domain") {
+				continue
+			}
+			if line != "" {
+				lines = append(lines, line)
+			}
+		}
+	}
+	for _, s := range servers {
+		lines = append(lines, "nameserver "+s)
+	}
+	if len(c.dnsSearch) > 0 {
+		lines = append(lines, "search "+strings.Join(c.dnsSearch, " "))
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	return []byte(strings.Join(lines, "\n") + "\n"), nil
+}
+
+// createBundle creates the OCI bundle directory, which includes the OCI spec
+// file (config.json), the rootfs directory, and other supplementary data files
+// (e.g. the 'hosts' file which will be mounted to /etc/hosts).
+func (c *ociContainer) createBundle(ctx context.Context, cmd *repb.Command) error {
+	if err := os.MkdirAll(c.bundlePath(), 0755); err != nil {
+		return fmt.Errorf("mkdir -p %s: %w", c.bundlePath(), err)
+	}
+
+	hostnamePath := filepath.Join(c.bundlePath(), "hostname")
+	etcHostname := "localhost"
+	if c.hostnameOverride != "" {
+		etcHostname = c.hostnameOverride
+	}
+	if err := os.WriteFile(hostnamePath, []byte(etcHostname), 0644); err != nil {
+		return fmt.Errorf("write %s: %w", hostnamePath, err)
+	}
+	// Note: we don't add 'host.containers.internal' here because we don't
+	// support networking across containers.
+	hostsFileLines := strings.Split(strings.TrimSpace(string(hostsFile)), "\n")
+	if c.network != nil && c.network.HostNetwork() != nil {
+		hostsFileLines = append(hostsFileLines, fmt.Sprintf("%s %s", c.network.HostNetwork().NamespacedIP(), c.hostname()))
+		if ipv6 := c.network.HostNetwork().NamespacedIPv6(); ipv6 != "" {
+			hostsFileLines = append(hostsFileLines, fmt.Sprintf("%s %s", ipv6, c.hostname()))
+		}
+	} else {
+		hostsFileLines = append(hostsFileLines, fmt.Sprintf("127.0.0.1 %s", c.hostname()))
+	}
+	for _, h := range c.extraHosts {
+		hostsFileLines = append(hostsFileLines, fmt.Sprintf("%s %s", h.IP, h.Hostname))
+	}
+	hostsBytes := []byte(strings.Join(hostsFileLines, "\n") + "\n")
+	if err := os.WriteFile(filepath.Join(c.bundlePath(), "hosts"), hostsBytes, 0644); err != nil {
+		return fmt.Errorf("write hosts file: %w", err)
+	}
+	// DNS is not needed if networking is disabled, so don't write a
+	// resolv.conf file in that case.
+	if c.networkEnabled {
+		resolvConf, err := c.resolvConf()
+		if err != nil {
+			return fmt.Errorf("get resolv.conf contents: %w", err)
+		}
+		if resolvConf != nil {
+			if err := os.WriteFile(c.resolvConfPath(), resolvConf, 0644); err != nil {
+				return fmt.Errorf("write resolv.conf file: %w", err)
+			}
+		}
+	}
+
+	// Create rootfs
+	if err := c.createRootfs(ctx); err != nil {
+		return fmt.Errorf("create rootfs: %w", err)
+	}
+
+	// Create config.json from the image config and command
+	image, ok := c.imageStore.CachedImage(c.resolvedImageRef(), c.imagePlatform)
+	if !ok {
+		return fmt.Errorf("image must be cached before creating OCI bundle")
+	}
+	cmd, err := withImageConfig(cmd, image, c.useImageEnv)
+	if err != nil {
+		return fmt.Errorf("apply image config to command: %w", err)
+	}
+	spec, err := c.createSpec(ctx, cmd)
+	if err != nil {
+		return fmt.Errorf("create spec: %w", err)
+	}
+	b, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(c.configPath(), b, 0644); err != nil {
+		return err
+	}
+
 	return nil
 }
 
-func installBusybox(ctx context.Context, path string) error {
-	busyboxPath, err := exec.LookPath("busybox")
+// validateBindMounts returns an error if any of the given bind mounts are not
+// permitted by the executor configuration or if their source paths do not
+// exist. Otherwise, it returns a copy of the bind mounts with symlinks in
+// their source paths resolved.
+func validateBindMounts(mounts []*platform.BindMount) ([]*platform.BindMount, error) {
+	validated := make([]*platform.BindMount, 0, len(mounts))
+	for _, m := range mounts {
+		source, err := resolveBindMountSource(m.Source)
+		if err != nil {
+			return nil, err
+		}
+		validated = append(validated, &platform.BindMount{
+			Source:   source,
+			Target:   m.Target,
+			ReadOnly: m.ReadOnly,
+		})
+	}
+	return validated, nil
+}
+
+// resolveBindMountSource resolves symlinks in the given bind mount source
+// path, so that a symlink within an allowed directory can't be used to mount
+// an arbitrary host path, and returns an error if the resolved path is not
+// within one of the allowed bind mount sources.
+func resolveBindMountSource(source string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(source)
 	if err != nil {
-		return fmt.Errorf("find busybox in PATH: %w", err)
+		return "", status.InvalidArgumentErrorf("bind mount source %q: %s", source, err)
 	}
-	binDir := filepath.Join(path, "bin")
-	if err := os.MkdirAll(binDir, 0755); err != nil {
-		return fmt.Errorf("mkdir -p %s: %w", binDir, err)
+	for _, dir := range *allowedBindMountSources {
+		dir = filepath.Clean(dir)
+		if r, err := filepath.EvalSymlinks(dir); err == nil {
+			dir = r
+		}
+		if resolved == dir || strings.HasPrefix(resolved, dir+string(filepath.Separator)) {
+			return resolved, nil
+		}
 	}
-	if err := disk.CopyViaTmpSibling(busyboxPath, filepath.Join(binDir, "busybox")); err != nil {
-		return fmt.Errorf("copy busybox binary: %w", err)
+	return "", status.PermissionDeniedErrorf("bind mount source %q is not allowed by this executor", source)
+}
+
+func (c *ociContainer) IsolationType() string {
+	return "oci" // TODO: make const in platform.go
+}
+
+// IsImageCached returns whether the container's image is cached. Once the
+// container has pulled its image, only the pinned digest is considered. Before
+// that, if the image ref is a tag which was previously pulled, the tag is
+// resolved against the registry, and the image is treated as not cached if the
+// tag has moved to a different digest since it was pulled. The tag is resolved
+// at most once per --executor.oci.image_tag_check_interval.
+func (c *ociContainer) IsImageCached(ctx context.Context) (bool, error) {
+	image, ok := c.imageStore.CachedImage(c.resolvedImageRef(), c.imagePlatform)
+	if !ok {
+		return false, nil
 	}
-	b, err := exec.CommandContext(ctx, busyboxPath, "--list").Output()
+	// In offline mode, the cache is authoritative, since there's no way to
+	// pull a newer image anyway.
+	if c.offline || c.pinnedImageRef != "" || image.Digest.Hex == "" || isDigestRef(c.imageRef) {
+		return true, nil
+	}
+	digest, ok := c.imageStore.recentTagDigest(c.imageRef, c.imagePlatform)
+	if !ok {
+		digest = c.resolveTagDigest(ctx, image.Digest)
+		c.imageStore.recordTagDigest(c.imageRef, c.imagePlatform, digest)
+	}
+	if digest != image.Digest {
+		log.CtxInfof(ctx, "Image %q has moved from %s to %s since it was cached", c.imageRef, image.Digest, digest)
+		return false, nil
+	}
+	return true, nil
+}
+
+// resolveTagDigest resolves the container's image tag against the registry,
+// and returns the digest it currently points to. If the tag can't be
+// resolved, the given cached digest is returned.
+func (c *ociContainer) resolveTagDigest(ctx context.Context, cached ctr.Hash) ctr.Hash {
+	remoteImage, err := oci.Resolve(ctx, c.imageRef, c.imagePlatform, oci.Credentials{})
 	if err != nil {
-		return fmt.Errorf("list: %w", err)
+		// We may not be able to resolve the tag without credentials, or the
+		// registry may be unreachable. Fall back to the cached image.
+		log.CtxDebugf(ctx, "Could not check whether cached image %q is up to date: %s", c.imageRef, err)
+		return cached
 	}
-	names := strings.Split(strings.TrimSpace(string(b)), "\n")
-	for _, name := range names {
-		if name == "busybox" {
-			continue
+	digest, err := remoteImage.Digest()
+	if err != nil {
+		log.CtxDebugf(ctx, "Could not check whether cached image %q is up to date: %s", c.imageRef, err)
+		return cached
+	}
+	return digest
+}
+
+// ImageDigest returns the manifest digest that the container's image ref
+// resolved to when it was first pulled, e.g. "sha256:abc123...". The
+// container keeps using this digest for its lifetime, even if the image ref
+// is a tag that later moves. It returns an empty string if the image has not
+// been pulled yet, or is not pulled from a registry.
+func (c *ociContainer) ImageDigest() string {
+	return c.imageDigest
+}
+
+// resolvedImageRef returns the digest-pinned image ref if the image has been
+// pulled, otherwise the image ref that the container was created with.
+func (c *ociContainer) resolvedImageRef() string {
+	if c.pinnedImageRef != "" {
+		return c.pinnedImageRef
+	}
+	return c.imageRef
+}
+
+func (c *ociContainer) PullImage(ctx context.Context, creds oci.Credentials) error {
+	start := time.Now()
+	err := c.pullImageWithTimeout(ctx, creds)
+	recordOperation("pull", err)
+	repo := imageRepo(c.imageRef)
+	if err != nil {
+		metrics.OCIImagePullFailureCount.With(prometheus.Labels{
+			metrics.ContainerImageRepo:     repo,
+			metrics.ImagePullFailureReason: pullFailureReason(err),
+		}).Inc()
+		return err
+	}
+	metrics.OCIImagePullLatencyUsec.With(prometheus.Labels{
+		metrics.ContainerImageRepo: repo,
+	}).Observe(float64(time.Since(start).Microseconds()))
+	return nil
+}
+
+func (c *ociContainer) pullImageWithTimeout(ctx context.Context, creds oci.Credentials) error {
+	if *pullTimeout <= 0 {
+		return c.pullImage(ctx, creds)
+	}
+	pullCtx, cancel := context.WithTimeout(ctx, *pullTimeout)
+	defer cancel()
+	err := c.pullImage(pullCtx, creds)
+	// Report pull timeouts separately from the action timeout. Layer
+	// extraction is canceled along with the pull, and extracted layers are
+	// only moved into the layer cache once complete, so the timed out pull
+	// doesn't leave partial layers behind.
+	if err != nil && ctx.Err() == nil && errors.Is(pullCtx.Err(), context.DeadlineExceeded) {
+		return withSentinel(status.UnavailableErrorf("pull image %q: timed out after %s", c.imageRef, *pullTimeout), ErrTimeout)
+	}
+	return err
+}
+
+func (c *ociContainer) pullImage(ctx context.Context, creds oci.Credentials) error {
+	if c.imageRef == TestBusyboxImageRef {
+		return nil
+	}
+	if c.rootfsTarPath != "" {
+		if _, err := c.imageStore.Import(ctx, c.rootfsTarPath, c.imageRef, c.imagePlatform); err != nil {
+			return status.WrapError(err, "import rootfs tarball")
 		}
-		if err := os.Symlink("busybox", filepath.Join(binDir, name)); err != nil {
+		return c.acquireImage()
+	}
+	var image *Image
+	if c.offline {
+		cached, ok := c.imageStore.CachedImage(c.resolvedImageRef(), c.imagePlatform)
+		if !ok {
+			return status.FailedPreconditionErrorf("image %q is not available offline: it is not in the local image cache, and pulling images is disabled", c.imageRef)
+		}
+		image = cached
+	} else {
+		var sentDone atomic.Bool
+		reportProgress := func(p *PullProgress) {
+			if c.pullProgress != nil {
+				sentDone.Store(p.Done)
+				c.pullProgress(&container.ImagePullProgress{
+					BytesDownloaded: p.BytesDownloaded,
+					BytesTotal:      p.BytesTotal,
+					Done:            p.Done,
+				})
+			}
+			if p.Done {
+				log.CtxInfof(ctx, "Pulled %q: %s", c.imageRef, formatLayerStats(p.Layers))
+				return
+			}
+			log.CtxDebugf(ctx, "Pulling %q: %.2f of %.2f MiB downloaded", c.imageRef, float64(p.BytesDownloaded)/1e6, float64(p.BytesTotal)/1e6)
+		}
+		pulled, err := c.imageStore.Pull(ctx, c.resolvedImageRef(), c.imagePlatform, creds, reportProgress)
+		if err != nil {
+			return status.WrapError(err, "pull OCI image")
+		}
+		// If the pull was deduped with a concurrent pull of the same image,
+		// only the other caller received progress updates, so send the final
+		// update here.
+		if c.pullProgress != nil && !sentDone.Load() {
+			c.pullProgress(&container.ImagePullProgress{Done: true})
+		}
+		image = pulled
+	}
+	// Pin the digest, so that subsequent pulls and container creation use
+	// the same image even if the tag moves.
+	if c.pinnedImageRef == "" && image.Digest.Hex != "" {
+		pinned, err := digestImageRef(c.imageRef, image.Digest)
+		if err != nil {
 			return err
 		}
+		log.CtxInfof(ctx, "Resolved image %q to %s", c.imageRef, image.Digest)
+		c.pinnedImageRef = pinned
+		c.imageDigest = image.Digest.String()
+	}
+	return c.acquireImage()
+}
+
+// acquireImage marks the layers of the pulled image as in use, if they
+// aren't already, so that they are not evicted by other pulls between now
+// and when the container is created. They are released in Remove().
+func (c *ociContainer) acquireImage() error {
+	if c.acquiredImage != nil {
+		return nil
+	}
+	image, ok := c.imageStore.acquireImage(c.resolvedImageRef(), c.imagePlatform)
+	if !ok {
+		// The layers were evicted by another pull after this pull
+		// completed.
+		return status.UnavailableErrorf("image %q was evicted from the layer cache before it could be used", c.imageRef)
+	}
+	c.acquiredImage = image
+	return nil
+}
+
+// formatLayerStats returns a summary of the download time and sizes of each
+// pulled layer, for finding the layers responsible for slow pulls.
+func formatLayerStats(layers []LayerProgress) string {
+	stats := make([]string, 0, len(layers))
+	for i, l := range layers {
+		if l.Status == LayerCached {
+			stats = append(stats, fmt.Sprintf("layer %d (%s): cached, %.2f MiB extracted", i, l.Digest, float64(l.ExtractedBytes)/1e6))
+			continue
+		}
+		stats = append(stats, fmt.Sprintf("layer %d (%s): downloaded %.2f MiB in %s, %.2f MiB extracted", i, l.Digest, float64(l.BytesTotal)/1e6, l.DownloadDuration, float64(l.ExtractedBytes)/1e6))
+	}
+	return strings.Join(stats, "; ")
+}
+
+// recordOperation counts a container lifecycle operation with the status of
+// the given error.
+func recordOperation(operation string, err error) {
+	metrics.OCIContainerOperationCount.With(prometheus.Labels{
+		metrics.ContainerOperation:       operation,
+		metrics.StatusHumanReadableLabel: status.MetricsLabel(err),
+	}).Inc()
+}
+
+// imageRepo returns the repository of the given image ref, without the tag or
+// digest, for use as a metrics label with bounded cardinality.
+func imageRepo(imageRef string) string {
+	ref, err := ctrname.ParseReference(imageRef)
+	if err != nil {
+		return "unknown"
+	}
+	return ref.Context().Name()
+}
+
+// pullFailureReason returns the metrics label for the reason that an image
+// pull failed.
+func pullFailureReason(err error) string {
+	switch {
+	case errors.Is(err, ErrTimeout):
+		return "timeout"
+	case errors.Is(err, ErrUnauthorized):
+		return "unauthorized"
+	case errors.Is(err, ErrImageNotFound):
+		return "image_not_found"
+	case errors.Is(err, ErrDiskFull):
+		return "disk_full"
+	default:
+		return "other"
+	}
+}
+
+// ImageLabels returns the labels set in the container image config, or nil if
+// the image has not been pulled yet.
+func (c *ociContainer) ImageLabels() map[string]string {
+	image := c.acquiredImage
+	if image == nil {
+		cached, ok := c.imageStore.CachedImage(c.resolvedImageRef(), c.imagePlatform)
+		if !ok {
+			return nil
+		}
+		image = cached
+	}
+	return maps.Clone(image.Config.Labels)
+}
+
+func (c *ociContainer) Run(ctx context.Context, cmd *repb.Command, workDir string, creds oci.Credentials) *interfaces.CommandResult {
+	return c.RunWithStdio(ctx, cmd, workDir, creds, &interfaces.Stdio{})
+}
+
+// RunWithStdio is like Run, but attaches the given stdio to the command.
+// Output written to stdio writers is streamed to them as it is produced,
+// rather than being returned in the command result.
+func (c *ociContainer) RunWithStdio(ctx context.Context, cmd *repb.Command, workDir string, creds oci.Credentials, stdio *interfaces.Stdio) *interfaces.CommandResult {
+	res := c.runWithStdio(ctx, cmd, workDir, creds, stdio)
+	recordOperation("run", res.Error)
+	return res
+}
+
+func (c *ociContainer) runWithStdio(ctx context.Context, cmd *repb.Command, workDir string, creds oci.Credentials, stdio *interfaces.Stdio) *interfaces.CommandResult {
+	if stdio != nil && stdio.Tty {
+		return commandutil.ErrorResult(status.UnimplementedError("tty is not supported for Run"))
+	}
+	c.workDir = workDir
+	c.cid = c.id
+
+	if err := container.PullImageIfNecessary(ctx, c.env, c, creds, c.imageRef); err != nil {
+		return commandutil.ErrorResult(status.WrapError(err, "pull image"))
+	}
+	if err := c.createNetwork(ctx); err != nil {
+		return commandutil.ErrorResult(err)
+	}
+	if err := c.createBundle(ctx, cmd); err != nil {
+		return commandutil.ErrorResult(withDiskFull(status.UnavailableErrorf("create OCI bundle: %s", err), err))
+	}
+	if err := c.chownWorkspaceToContainerRoot(); err != nil {
+		return commandutil.ErrorResult(status.UnavailableErrorf("chown workspace: %s", err))
+	}
+
+	// If the context is done, kill all processes in the container's cgroup
+	// rather than relying on the runtime to clean them up after it is killed.
+	killDone := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(killDone)
+		c.killCgroup(context.WithoutCancel(ctx))
+	})
+
+	// Pass --keep so that the container's cgroup is not deleted as soon as the
+	// process exits, allowing us to inspect it afterwards (e.g. for OOM
+	// kills). The container is deleted in Remove().
+	res := c.doWithStatsTracking(ctx, c.cumulativeTaskStats, func(ctx context.Context) *interfaces.CommandResult {
+		return c.invokeRuntime(ctx, nil /*=cmd*/, stdio, 0 /*=waitDelay*/, "run", "--keep", "--bundle="+c.bundlePath(), c.cid)
+	})
+	if !stop() {
+		<-killDone
+	}
+	c.checkOOMKilled(ctx, res, 0 /*=oomKillsBefore*/)
+	setTerminatingSignal(res)
+	return res
+}
+
+func (c *ociContainer) Create(ctx context.Context, workDir string) error {
+	return c.create(ctx, workDir, "" /*=checkpointDir*/)
+}
+
+// create creates and starts the container, and records metrics for the
+// operation.
+func (c *ociContainer) create(ctx context.Context, workDir, checkpointDir string) error {
+	start := time.Now()
+	err := c.doCreate(ctx, workDir, checkpointDir)
+	recordOperation("create", err)
+	if err == nil {
+		metrics.OCIContainerCreateLatencyUsec.Observe(float64(time.Since(start).Microseconds()))
+	}
+	return err
+}
+
+// CreateFromCheckpoint is like Create, but restores the container's processes
+// from a checkpoint written by Checkpoint, rather than starting a new init
+// process. The container must use the same image and workDir as the
+// checkpointed container, and the workDir contents should be unchanged since
+// the checkpoint was taken, since restored processes may have open files in
+// it.
+func (c *ociContainer) CreateFromCheckpoint(ctx context.Context, workDir, checkpointDir string) error {
+	return c.create(ctx, workDir, checkpointDir)
+}
+
+func (c *ociContainer) doCreate(ctx context.Context, workDir, checkpointDir string) error {
+	c.createTime = time.Now()
+	c.workDir = workDir
+	c.cid = c.id
+
+	if err := c.createNetwork(ctx); err != nil {
+		return err
+	}
+	pid1 := &repb.Command{Arguments: []string{"sleep", "999999999999"}}
+	// Provision bundle directory (OCI config JSON, rootfs, etc.)
+	if err := c.createBundle(ctx, pid1); err != nil {
+		return withDiskFull(status.UnavailableErrorf("create OCI bundle: %s", err), err)
+	}
+	// Creating the container, at least with crun, already invokes the entrypoint and has it
+	// inherit the stdout and stderr create is invoked with:
+	// https://github.com/containers/crun/blob/f44da38333321335611d45638401e99f5f9548f2/src/libcrun/container.c#L2909
+	// https://github.com/containers/crun/blob/f44da38333321335611d45638401e99f5f9548f2/src/libcrun/container.c#L2459C9-L2459C36
+	// https://github.com/containers/crun/blob/f44da38333321335611d45638401e99f5f9548f2/src/libcrun/linux.c#L4950
+	// https://github.com/containers/crun/blob/f44da38333321335611d45638401e99f5f9548f2/src/libcrun/container.c#L1548
+	// By default, exec.Cmd.Wait() will wait until both the process has exited and the stdout and
+	// stderr pipes have been closed. But since these pipes are inherited by the sleep pid1 process,
+	// they are never closed. We use a very short waitDelay to forcibly close the pipes right after
+	// the process exit.
+	if checkpointDir != "" {
+		// Restoring creates and starts the container in one step. The
+		// restored process inherits the stdio of the restore command in the
+		// same way.
+		result := c.invokeRuntime(ctx, &repb.Command{}, &interfaces.Stdio{}, 1*time.Nanosecond, "restore", "--detach", "--bundle="+c.bundlePath(), "--image-path="+checkpointDir, c.cid)
+		if err := asError(result); err != nil {
+			return status.UnavailableErrorf("restore container from checkpoint: %s", err)
+		}
+		c.placeholderInit = true
+		return nil
+	}
+	result := c.invokeRuntime(ctx, &repb.Command{}, &interfaces.Stdio{}, 1*time.Nanosecond, "create", "--bundle="+c.bundlePath(), c.cid)
+	if err := asError(result); err != nil {
+		return status.UnavailableErrorf("create container: %s", err)
+	}
+	c.placeholderInit = true
+	// Start container
+	if err := c.invokeRuntimeSimple(ctx, "start", c.cid); err != nil {
+		return status.UnavailableErrorf("start container: %s", err)
+	}
+	return nil
+}
+
+// Exec runs a command in the created container.
+//
+// Exec is safe to call concurrently on the same container. Each call runs a
+// separate process with its own stdio pipes (or pty), output buffers, and PID
+// file, so the stdio of concurrent calls is never mixed, and cancelling one
+// call only kills that call's process group. Usage stats and OOM kills are
+// tracked for the container as a whole, so the usage reported by concurrent
+// calls includes the usage of all processes in the container while each call
+// was running, and an OOM kill fails all calls that were running at the time.
+func (c *ociContainer) Exec(ctx context.Context, cmd *repb.Command, stdio *interfaces.Stdio) *interfaces.CommandResult {
+	res := c.exec(ctx, cmd, stdio)
+	recordOperation("exec", res.Error)
+	return res
+}
+
+func (c *ociContainer) exec(ctx context.Context, cmd *repb.Command, stdio *interfaces.Stdio) *interfaces.CommandResult {
+	// Reset CPU usage and peak memory since we're starting a new task,
+	// unless other tasks are still running.
+	c.statsMu.Lock()
+	if c.activeExecs == 0 {
+		c.stats.Reset()
+	}
+	c.activeExecs++
+	c.statsMu.Unlock()
+	defer func() {
+		c.statsMu.Lock()
+		c.activeExecs--
+		c.statsMu.Unlock()
+	}()
+	// Inputs for this task may have been added to the workspace since the
+	// container was created.
+	if err := c.chownWorkspaceToContainerRoot(); err != nil {
+		return commandutil.ErrorResult(status.UnavailableErrorf("chown workspace: %s", err))
+	}
+	args := []string{"exec"}
+	// Respect command env. Note, when setting any --env vars at all, it
+	// completely overrides the env from the bundle, rather than just adding
+	// to it. So we specify the complete env here, including the base env,
+	// image env, and command env.
+	for _, e := range c.baseEnv() {
+		args = append(args, "--env="+e)
+	}
+	image, ok := c.imageStore.CachedImage(c.resolvedImageRef(), c.imagePlatform)
+	if !ok {
+		return commandutil.ErrorResult(status.UnavailableError("exec called before pulling image"))
+	}
+	cmd, err := withImageConfig(cmd, image, c.useImageEnv)
+	if err != nil {
+		return commandutil.ErrorResult(status.WrapError(err, "apply image config"))
+	}
+	args = append(args, "--cwd="+c.processCwd(image))
+	for _, e := range cmd.GetEnvironmentVariables() {
+		args = append(args, fmt.Sprintf("--env=%s=%s", e.GetName(), e.GetValue()))
+	}
+	var tty *console
+	if stdio != nil && stdio.Tty {
+		tty, err = newConsole(stdio)
+		if err != nil {
+			return commandutil.ErrorResult(status.UnavailableErrorf("create console socket: %s", err))
+		}
+		defer tty.Close()
+		args = append(args, "--tty", "--console-socket="+tty.SocketPath())
+		// The process's stdio is attached to the pty, so the runtime's own
+		// stdio is only used for runtime errors.
+		stdio = &interfaces.Stdio{}
+	}
+	// Record the exec'd process's PID so that it can be killed if the
+	// context is done. Killing just the runtime would otherwise leave the
+	// process running in the container. Note that unlike Run, we don't kill
+	// the whole cgroup here, since that would also kill the container's init
+	// process.
+	execID, err := newCID()
+	if err != nil {
+		return commandutil.ErrorResult(status.UnavailableErrorf("generate exec ID: %s", err))
+	}
+	pidFile := filepath.Join(c.bundlePath(), "exec-"+execID+".pid")
+	defer os.Remove(pidFile)
+	args = append(args, "--pid-file="+pidFile)
+	args = append(args, c.cid)
+
+	killDone := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(killDone)
+		killExecProcessGroup(ctx, pidFile)
+	})
+	defer func() {
+		// Make sure the process group is killed before returning.
+		if !stop() {
+			<-killDone
+		}
+	}()
+
+	oomKillsBefore := c.oomKillCount(ctx)
+	res := c.doWithStatsTracking(ctx, nil /*=finalStatsFn*/, func(ctx context.Context) *interfaces.CommandResult {
+		return c.invokeRuntime(ctx, cmd, stdio, 1*time.Microsecond, args...)
+	})
+	// The runtime may exit on its own after the process group is killed,
+	// before it is killed due to the context being done, in which case the
+	// exit code doesn't indicate a timeout or cancellation.
+	if res.Error == nil && ctx.Err() != nil {
+		res.Error = status.FromContextError(ctx)
+	}
+	if tty != nil {
+		out, size, truncated, err := tty.Wait()
+		if err != nil && res.Error == nil {
+			res.Error = status.UnavailableErrorf("copy pty output: %s", err)
+		}
+		res.Stdout = out
+		res.StdoutSize = size
+		res.StdoutTruncated = truncated
+	}
+	c.checkOOMKilled(ctx, res, oomKillsBefore)
+	setTerminatingSignal(res)
+	return res
+}
+
+// WaitHealthy runs the container's health check until it passes, following
+// docker's HEALTHCHECK semantics. It returns nil once a check passes, or
+// immediately if no health check is configured. It returns an Unavailable
+// error once the configured number of consecutive checks have failed. Checks
+// are run using Exec, so WaitHealthy should not be called while a task is
+// executing in the container.
+func (c *ociContainer) WaitHealthy(ctx context.Context) error {
+	hc := c.healthCheck
+	if hc == nil {
+		return nil
+	}
+	if c.cid == "" {
+		return status.FailedPreconditionError("container has not been created")
+	}
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx)
+		case <-time.After(hc.Interval):
+		}
+		checkCtx, cancel := context.WithTimeout(ctx, hc.Timeout)
+		res := c.Exec(checkCtx, &repb.Command{Arguments: hc.Command}, &interfaces.Stdio{})
+		cancel()
+		if res.Error == nil && res.ExitCode == 0 {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return status.FromContextError(ctx)
+		}
+		// Failures during the start period don't count towards the retry
+		// budget.
+		if time.Since(c.createTime) < hc.StartPeriod {
+			continue
+		}
+		failures++
+		if failures < hc.Retries {
+			continue
+		}
+		if res.Error != nil {
+			return status.UnavailableErrorf("container is unhealthy after %d failed health checks: %s", failures, res.Error)
+		}
+		output := append(res.Stdout, res.Stderr...)
+		if len(output) > maxHealthCheckOutputBytes {
+			output = output[:maxHealthCheckOutputBytes]
+		}
+		return status.UnavailableErrorf("container is unhealthy after %d failed health checks: exit code %d: %q", failures, res.ExitCode, output)
+	}
+}
+
+// Checkpoint dumps the state of the container's processes to the given
+// directory using CRIU, so that they can later be restored with
+// CreateFromCheckpoint. The container keeps running (or stays paused, if it
+// is paused) after the checkpoint is taken. The runtime must be built with
+// CRIU support, and the criu binary must be installed on the host.
+func (c *ociContainer) Checkpoint(ctx context.Context, dir string) error {
+	if c.cid == "" {
+		return status.FailedPreconditionError("container has not been created")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return status.UnavailableErrorf("create checkpoint dir: %s", err)
+	}
+	if err := c.invokeRuntimeSimple(ctx, "checkpoint", "--leave-running", "--image-path="+dir, c.cid); err != nil {
+		return status.UnavailableErrorf("checkpoint container: %s", err)
+	}
+	return nil
+}
+
+// Commit packages the changes made to the container's root filesystem as a
+// new layer on top of the container's image, and adds the resulting image to
+// the image store under the given image name. Containers subsequently created
+// with that image name use the committed filesystem without pulling.
+//
+// If the container is running, it is paused while the layer is created.
+func (c *ociContainer) Commit(ctx context.Context, imageName string) error {
+	if !c.overlayfsMounted || c.acquiredImage == nil {
+		return status.FailedPreconditionError("container does not have an image-backed rootfs")
+	}
+	unpause, err := c.pauseIfRunning(ctx)
+	if err != nil {
+		return err
+	}
+	defer unpause()
+	if _, err := c.imageStore.Commit(ctx, c.acquiredImage, c.overlayUpperPath(), imageName, c.imagePlatform); err != nil {
+		return status.WrapError(err, "commit image")
+	}
+	return nil
+}
+
+// ExportDiff writes the changes made to the container's root filesystem to w
+// as an uncompressed tarball in OCI layer format. Deleted files and replaced
+// directories are represented by OCI whiteout files.
+//
+// If the container is running, it is paused while the tarball is written.
+func (c *ociContainer) ExportDiff(ctx context.Context, w io.Writer) error {
+	if !c.overlayfsMounted {
+		return status.FailedPreconditionError("container does not have an image-backed rootfs")
+	}
+	unpause, err := c.pauseIfRunning(ctx)
+	if err != nil {
+		return err
+	}
+	defer unpause()
+	if err := writeLayerTar(w, c.overlayUpperPath()); err != nil {
+		return status.UnavailableErrorf("write rootfs diff: %s", err)
+	}
+	return nil
+}
+
+// pauseIfRunning pauses the container if it is running, so that its
+// filesystem can be read consistently. The returned func unpauses the
+// container if it was paused.
+func (c *ociContainer) pauseIfRunning(ctx context.Context) (unpause func(), err error) {
+	state, err := c.state(ctx)
+	if err != nil {
+		return nil, status.UnavailableErrorf("get container state: %s", err)
+	}
+	if state.Status != specs.StateRunning {
+		return func() {}, nil
+	}
+	if err := c.Pause(ctx); err != nil {
+		return nil, status.UnavailableErrorf("pause container: %s", err)
+	}
+	return func() {
+		if err := c.Unpause(ctx); err != nil {
+			log.CtxWarningf(ctx, "Failed to unpause container: %s", err)
+		}
+	}, nil
+}
+
+func (c *ociContainer) Pause(ctx context.Context) error {
+	return c.invokeRuntimeSimple(ctx, "pause", c.cid)
+}
+
+func (c *ociContainer) Unpause(ctx context.Context) error {
+	return c.invokeRuntimeSimple(ctx, "resume", c.cid)
+}
+
+//nolint:nilness
+func (c *ociContainer) Remove(ctx context.Context) error {
+	err := c.remove(ctx)
+	recordOperation("remove", err)
+	return err
+}
+
+func (c *ociContainer) remove(ctx context.Context) error {
+	if c.cid == "" {
+		// We haven't created anything yet, but the image may have been
+		// pulled.
+		if c.acquiredImage != nil {
+			c.imageStore.releaseImage(ctx, c.acquiredImage)
+			c.acquiredImage = nil
+		}
+		if c.untrack != nil {
+			c.untrack()
+		}
+		return nil
+	}
+	if c.removed {
+		return nil
+	}
+	// Each step below is safe to repeat, so that if Remove fails partway,
+	// calling it again cleans up whatever was left behind.
+
+	var firstErr error
+
+	if *stopGracePeriod > 0 {
+		c.stopGracefully(ctx, *stopGracePeriod)
+	}
+	// Force-deleting the container kills any remaining processes and waits
+	// for the cgroup to be emptied before removing it. Only the container's
+	// own cgroup is removed; the cgroup parent, if any, is shared by all
+	// containers and is left in place.
+	if err := c.invokeRuntimeSimple(ctx, "delete", "--force", c.cid); err != nil && firstErr == nil {
+		firstErr = status.UnavailableErrorf("delete container: %s", err)
+	}
+	// Make sure the cgroup is gone even if the runtime crashed before
+	// removing it.
+	if err := c.cgroupPaths.Remove(ctx, c.cid); err != nil && firstErr == nil {
+		firstErr = status.UnavailableErrorf("remove cgroup: %s", err)
+	}
+
+	if err := c.unmountOverlay(ctx); err != nil && firstErr == nil {
+		firstErr = status.UnavailableErrorf("unmount overlayfs: %s", err)
+	}
+
+	if c.acquiredImage != nil {
+		c.imageStore.releaseImage(ctx, c.acquiredImage)
+		c.acquiredImage = nil
+	}
+
+	if c.network != nil {
+		if err := c.network.Cleanup(ctx); err != nil {
+			if firstErr == nil {
+				firstErr = status.UnavailableErrorf("cleanup network: %s", err)
+			}
+		} else {
+			c.network = nil
+		}
+	}
+
+	// The overlay dirs and the bundle, which contains the rootfs mount
+	// point, are only removed once the rootfs is unmounted. Otherwise,
+	// removing the bundle would delete files through the mount.
+	if !c.overlayfsMounted {
+		if c.workDir != "" {
+			if err := os.RemoveAll(c.overlayTmpPath()); err != nil && firstErr == nil {
+				firstErr = status.UnavailableErrorf("remove overlay dirs: %s", err)
+			}
+		}
+		if err := os.RemoveAll(c.bundlePath()); err != nil && firstErr == nil {
+			firstErr = status.UnavailableErrorf("remove bundle: %s", err)
+		}
+	}
+
+	c.removed = firstErr == nil
+	// Stop tracking the container even if removal failed, so that whatever
+	// was left behind is cleaned up by PruneStateDirs once the container's
+	// processes have exited. Removal may still be retried by calling Remove
+	// again.
+	if c.untrack != nil {
+		c.untrack()
+	}
+	return firstErr
+}
+
+// unmountOverlay unmounts the container's overlayfs rootfs, if it is mounted.
+// Unmounting is retried while the mount is busy, e.g. if processes holding
+// files open in the rootfs are still exiting. As a last resort, the rootfs is
+// unmounted lazily, which detaches it immediately and lets the kernel clean it
+// up once it is no longer in use.
+func (c *ociContainer) unmountOverlay(ctx context.Context) error {
+	if !c.overlayfsMounted {
+		return nil
+	}
+	unmount := func(flags int) error {
+		return syscall.Unmount(c.rootfsPath(), flags)
+	}
+	// Unprivileged users can only unmount FUSE filesystems using the setuid
+	// fusermount helper.
+	if c.overlayfsFuse && unix.Getuid() != 0 {
+		unmount = func(flags int) error {
+			return fuseUnmount(ctx, c.rootfsPath(), flags&syscall.MNT_DETACH != 0)
+		}
+	}
+	var err error
+	for attempt := 1; attempt <= overlayUnmountAttempts; attempt++ {
+		err = unmount(syscall.MNT_FORCE)
+		if err != syscall.EBUSY {
+			break
+		}
+		if attempt < overlayUnmountAttempts {
+			time.Sleep(time.Duration(attempt) * 50 * time.Millisecond)
+		}
+	}
+	if err == syscall.EBUSY {
+		log.CtxWarningf(ctx, "Overlayfs rootfs for container %s is still busy, unmounting lazily", c.cid)
+		err = unmount(syscall.MNT_DETACH)
+	}
+	// EINVAL means the rootfs is not a mount point, e.g. because a previous
+	// unmount attempt succeeded.
+	if err != nil && err != syscall.EINVAL {
+		return err
+	}
+	c.overlayfsMounted = false
+	c.overlayfsFuse = false
+	return nil
+}
+
+// parseIDRange parses a host ID range in start:count format, as used in
+// /etc/subuid and /etc/subgid, and returns a mapping of container IDs
+// starting at 0 to the range.
+func parseIDRange(s string) (*specs.LinuxIDMapping, error) {
+	startStr, countStr, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, status.InvalidArgumentErrorf("ID range %q is not in start:count format", s)
+	}
+	start, err := strconv.ParseUint(startStr, 10, 32)
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("invalid ID range start %q: %s", startStr, err)
+	}
+	count, err := strconv.ParseUint(countStr, 10, 32)
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("invalid ID range count %q: %s", countStr, err)
+	}
+	// Mapping container root to host root would make container root
+	// privileged on the host, which defeats the purpose of the mapping.
+	if start == 0 {
+		return nil, status.InvalidArgumentErrorf("ID range %q may not include ID 0", s)
+	}
+	if count == 0 || start+count-1 > math.MaxUint32 {
+		return nil, status.InvalidArgumentErrorf("invalid ID range %q", s)
+	}
+	return &specs.LinuxIDMapping{ContainerID: 0, HostID: uint32(start), Size: uint32(count)}, nil
+}
+
+// chownToContainerRoot changes the owner of the given path to the host IDs
+// that container root is mapped to, if the container runs in a user
+// namespace.
+func (c *ociContainer) chownToContainerRoot(path string) error {
+	if c.uidMapping == nil {
+		return nil
+	}
+	return os.Lchown(path, int(c.uidMapping.HostID), int(c.gidMapping.HostID))
+}
+
+// chownWorkspaceToContainerRoot changes the owner of the workspace directory
+// and all directories under it to container root, if the container runs in a
+// user namespace, so that actions can create outputs. Otherwise the workspace
+// is owned by the executor's IDs, which are not mapped in the namespace.
+//
+// Only directories are chowned, since input files may be hardlinked from the
+// file cache and shared with other workspaces. Input files remain readable
+// by the container, but can't be modified in place.
+func (c *ociContainer) chownWorkspaceToContainerRoot() error {
+	if c.uidMapping == nil {
+		return nil
+	}
+	return filepath.WalkDir(c.workDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		return c.chownToContainerRoot(path)
+	})
+}
+
+// resolveFuseOverlayfs validates the given overlayfs mode, and returns the
+// path to the fuse-overlayfs binary if it may be used in that mode, or an
+// empty string if not.
+func resolveFuseOverlayfs(mode, path string) (string, error) {
+	if path == "" {
+		path = "fuse-overlayfs"
+	}
+	switch mode {
+	case overlayfsModeKernel:
+		return "", nil
+	case overlayfsModeFuse:
+		resolved, err := exec.LookPath(path)
+		if err != nil {
+			return "", status.FailedPreconditionErrorf("overlayfs mode is %q, but fuse-overlayfs was not found: %s", mode, err)
+		}
+		log.Infof("Using fuse-overlayfs %q for container rootfs overlays", resolved)
+		return resolved, nil
+	case overlayfsModeAuto:
+		resolved, err := exec.LookPath(path)
+		if err != nil {
+			log.Debugf("fuse-overlayfs not found (%s); container rootfs overlays require kernel overlayfs mount permissions", err)
+			return "", nil
+		}
+		return resolved, nil
+	default:
+		return "", status.InvalidArgumentErrorf("invalid overlayfs mode %q", mode)
+	}
+}
+
+// mountFuseOverlayfs mounts an overlay filesystem at the given path using
+// fuse-overlayfs, which runs as a daemon serving the mount until it is
+// unmounted. lowerDirs are ordered from uppermost to lowermost, as for kernel
+// overlayfs.
+func mountFuseOverlayfs(ctx context.Context, fuseOverlayfsPath string, lowerDirs []string, upperDir, workDir, target string) error {
+	options := fmt.Sprintf(
+		"lowerdir=%s,upperdir=%s,workdir=%s",
+		strings.Join(lowerDirs, ":"), upperDir, workDir)
+	log.CtxDebugf(ctx, "Mounting fuse-overlayfs to %q, options=%q", target, options)
+	cmd := exec.CommandContext(ctx, fuseOverlayfsPath, "-o", options, target)
+	if b, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %q", err, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
+
+// fuseUnmount unmounts a FUSE filesystem using fusermount, which doesn't
+// require privileges. Errors are mapped to the errno returned by unmount(2)
+// where possible, so that callers can handle busy mounts.
+func fuseUnmount(ctx context.Context, target string, lazy bool) error {
+	fusermount, err := exec.LookPath("fusermount3")
+	if err != nil {
+		if fusermount, err = exec.LookPath("fusermount"); err != nil {
+			return fmt.Errorf("find fusermount: %w", err)
+		}
+	}
+	args := []string{"-u"}
+	if lazy {
+		args = append(args, "-z")
+	}
+	b, err := exec.CommandContext(ctx, fusermount, append(args, target)...).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	out := string(b)
+	switch {
+	case strings.Contains(out, "Device or resource busy"):
+		return syscall.EBUSY
+	case strings.Contains(out, "not found in") || strings.Contains(out, "Invalid argument"):
+		return syscall.EINVAL
+	}
+	return fmt.Errorf("%s: %w: %q", filepath.Base(fusermount), err, strings.TrimSpace(out))
+}
+
+// reapOrphan removes the state, cgroup, and bundle of a container which was
+// not removed by the executor process that created it, unless the container
+// still has live processes. Returns whether the container was removed.
+func (c *ociContainer) reapOrphan(ctx context.Context) (bool, error) {
+	if state, err := c.state(ctx); err == nil && state.Status != specs.StateStopped {
+		return false, nil
+	}
+	if pids, err := c.cgroupPaths.Procs(ctx, c.cid); err == nil && len(pids) > 0 {
+		return false, nil
+	}
+	// The runtime's state dir may already be gone, in which case this fails
+	// and the remaining resources are cleaned up directly.
+	if err := c.invokeRuntimeSimple(ctx, "delete", "--force", c.cid); err != nil {
+		log.CtxDebugf(ctx, "Failed to delete orphaned container %s: %s", c.cid, err)
+	}
+	if err := c.cgroupPaths.Remove(ctx, c.cid); err != nil {
+		return false, status.UnavailableErrorf("remove cgroup: %s", err)
+	}
+	// Never delete the bundle while the rootfs is mounted, since that would
+	// delete files through the mount.
+	if err := unix.Unmount(c.rootfsPath(), 0); err != nil && err != unix.EINVAL && err != unix.ENOENT {
+		return false, status.UnavailableErrorf("unmount rootfs: %s", err)
+	}
+	if err := os.RemoveAll(c.bundlePath()); err != nil {
+		return false, status.UnavailableErrorf("remove bundle: %s", err)
+	}
+	// Overlay dirs stored in the overlay root are keyed by container ID, so
+	// they can be cleaned up as well. Otherwise, they are next to the
+	// workspace, which is cleaned up by whoever owns it.
+	if c.overlayRoot != "" {
+		if err := os.RemoveAll(c.overlayTmpPath()); err != nil {
+			return false, status.UnavailableErrorf("remove overlay dirs: %s", err)
+		}
+	}
+	return true, nil
+}
+
+// stopGracefully sends SIGTERM to all processes in the container, then waits
+// up to the given grace period for them to exit. Any processes still running
+// afterwards are left for the caller to kill.
+func (c *ociContainer) stopGracefully(ctx context.Context, gracePeriod time.Duration) {
+	state, err := c.state(ctx)
+	if err != nil {
+		log.CtxWarningf(ctx, "Failed to get container state: %s", err)
+		return
+	}
+	// Processes in a paused container can't handle signals, and a stopped
+	// container has nothing left to signal.
+	if state.Status != specs.StateRunning {
+		return
+	}
+	if err := c.invokeRuntimeSimple(ctx, "kill", "--all", c.cid, "TERM"); err != nil {
+		log.CtxWarningf(ctx, "Failed to send SIGTERM to container processes: %s", err)
+		return
+	}
+	// The placeholder init process ignores SIGTERM (as PID 1, it has no
+	// handler for it), so don't wait for it to exit.
+	initPID := 0
+	if c.placeholderInit {
+		initPID = state.Pid
+	}
+	ctx, cancel := context.WithTimeout(ctx, gracePeriod)
+	defer cancel()
+	r := retry.New(ctx, &retry.Options{
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     250 * time.Millisecond,
+		Multiplier:     2,
+		MaxRetries:     math.MaxInt,
+	})
+	for r.Next() {
+		pids, err := c.cgroupPaths.Procs(ctx, c.cid)
+		if err != nil {
+			log.CtxWarningf(ctx, "Failed to list container processes: %s", err)
+			return
+		}
+		if len(pids) == 0 || (len(pids) == 1 && pids[0] == initPID) {
+			return
+		}
+	}
+	log.CtxInfof(ctx, "Container processes did not exit within %s of SIGTERM", gracePeriod)
+}
+
+// state returns the container state reported by the runtime.
+func (c *ociContainer) state(ctx context.Context) (*specs.State, error) {
+	res := c.invokeRuntime(ctx, &repb.Command{}, &interfaces.Stdio{}, 0, "state", c.cid)
+	if err := asError(res); err != nil {
+		return nil, err
+	}
+	state := &specs.State{}
+	if err := json.Unmarshal(res.Stdout, state); err != nil {
+		return nil, status.InternalErrorf("unmarshal container state: %s", err)
+	}
+	return state, nil
+}
+
+// createNetwork creates the container's network namespace and publishes any
+// requested ports. If a CNI network is configured, the namespace is attached
+// to it instead of to the built-in network. Errors are returned as
+// Unavailable, except for conflicts with a statically assigned IP address,
+// which are returned as AlreadyExists.
+func (c *ociContainer) createNetwork(ctx context.Context) error {
+	if c.hostNetwork {
+		// The container will run in the host's network namespace.
+		return nil
+	}
+	if c.networkEnabled && c.cniConfig != nil {
+		network, err := networking.CreateCNIContainerNetwork(ctx, c.cniConfig, c.cid)
+		if err != nil {
+			return status.UnavailableErrorf("create CNI network: %s", err)
+		}
+		c.network = network
+		return nil
+	}
+	loopbackOnly := !c.networkEnabled
+	network, err := networking.CreateContainerNetwork(ctx, loopbackOnly, c.staticIP)
+	if err != nil {
+		if status.IsAlreadyExistsError(err) {
+			return status.WrapError(err, "create network")
+		}
+		return status.UnavailableErrorf("create network: %s", err)
+	}
+	c.network = network
+	publishedPorts := make(map[int]int, len(c.publishPorts))
+	for _, p := range c.publishPorts {
+		hostPort, err := network.PublishPort(ctx, p.HostPort, p.ContainerPort)
+		if err != nil {
+			return status.UnavailableErrorf("create network: publish container port %d: %s", p.ContainerPort, err)
+		}
+		publishedPorts[p.ContainerPort] = hostPort
+	}
+	c.publishedPorts = publishedPorts
+	return nil
+}
+
+// PublishedPorts returns a map from published container ports to the host
+// ports that they are reachable on via the host's loopback interface. This
+// is only populated after the container network is created.
+func (c *ociContainer) PublishedPorts() map[int]int {
+	return maps.Clone(c.publishedPorts)
+}
+
+func (c *ociContainer) Stats(ctx context.Context) (*repb.UsageStats, error) {
+	var lifetimeStats *repb.UsageStats
+	var err error
+	if c.runtimeType == RuntimeTypeRunsc {
+		lifetimeStats, err = c.runscStats(ctx)
+	} else {
+		lifetimeStats, err = c.cgroupPaths.Stats(ctx, c.cid)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	c.stats.Update(lifetimeStats)
+	return c.stats.TaskStats(), nil
+}
+
+// runscEvent is the subset of the `runsc events --stats` output that is used
+// for usage stats.
+type runscEvent struct {
+	Data struct {
+		CPU struct {
+			Usage struct {
+				Total uint64 `json:"total"`
+			} `json:"usage"`
+		} `json:"cpu"`
+		Memory struct {
+			Usage struct {
+				Usage uint64 `json:"usage"`
+			} `json:"usage"`
+		} `json:"memory"`
+	} `json:"data"`
+}
+
+// runscStats returns lifetime usage stats for a gVisor container. The sandbox
+// cgroup on the host mostly accounts for the gVisor kernel rather than the
+// container's processes, so stats are read from runsc instead.
+func (c *ociContainer) runscStats(ctx context.Context) (*repb.UsageStats, error) {
+	res := c.invokeRuntime(ctx, &repb.Command{}, &interfaces.Stdio{}, 0, "events", "--stats", c.cid)
+	if err := asError(res); err != nil {
+		if strings.Contains(string(res.Stderr), "does not exist") {
+			return nil, os.ErrNotExist
+		}
+		return nil, status.UnavailableErrorf("get runsc stats: %s", err)
+	}
+	var event runscEvent
+	if err := json.Unmarshal(res.Stdout, &event); err != nil {
+		return nil, status.InternalErrorf("parse runsc stats: %s", err)
+	}
+	return &repb.UsageStats{
+		CpuNanos:    int64(event.Data.CPU.Usage.Total),
+		MemoryBytes: int64(event.Data.Memory.Usage.Usage),
+	}, nil
+}
+
+// runscArgs returns global flags for runsc.
+func (c *ociContainer) runscArgs() []string {
+	// The sandbox network stack runs inside gVisor using the container's
+	// network namespace. Containers sharing the host network use the host
+	// network stack directly.
+	network := "sandbox"
+	if c.hostNetwork {
+		network = "host"
+	}
+	args := []string{"--network=" + network}
+	if *runscPlatform != "" {
+		args = append(args, "--platform="+*runscPlatform)
+	}
+	return args
+}
+
+// StreamStats samples the container's resource usage for the current task at
+// the given interval, and sends the samples on the returned channel. Sampling
+// stops and the channel is closed when the context is done or the container's
+// cgroup is removed.
+func (c *ociContainer) StreamStats(ctx context.Context, interval time.Duration) <-chan *repb.UsageStats {
+	ch := make(chan *repb.UsageStats)
+	go func() {
+		defer close(ch)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+			stats, err := c.Stats(ctx)
+			if os.IsNotExist(err) {
+				// The container was removed.
+				return
+			}
+			if err != nil {
+				// The container may not have been started yet.
+				log.CtxDebugf(ctx, "Failed to read container stats: %s", err)
+				continue
+			}
+			select {
+			case ch <- stats:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// oomKillCount returns the number of OOM kills that have occurred in the
+// container's cgroup so far. Returns 0 if the count could not be determined.
+func (c *ociContainer) oomKillCount(ctx context.Context) int64 {
+	n, err := c.cgroupPaths.OOMKillCount(ctx, c.cid)
+	if err != nil {
+		// The count is only critical to report when the container has a
+		// memory limit; otherwise OOM kills are rare.
+		if c.memoryLimitBytes > 0 {
+			log.CtxWarningf(ctx, "Failed to read OOM kill count for container %s: %s", c.cid, err)
+		} else {
+			log.CtxDebugf(ctx, "Failed to read OOM kill count for container %s: %s", c.cid, err)
+		}
+		return 0
+	}
+	return n
+}
+
+// checkOOMKilled marks the given result as OOM-killed, with a
+// ResourceExhausted error, if any process in the container was OOM-killed
+// since oomKillsBefore was recorded. This covers both the container exceeding
+// its own memory limit and the kernel killing container processes due to
+// memory pressure on the host. The exit code is left as-is.
+func (c *ociContainer) checkOOMKilled(ctx context.Context, res *interfaces.CommandResult, oomKillsBefore int64) {
+	if res.Error != nil {
+		return
+	}
+	if c.oomKillCount(ctx) <= oomKillsBefore {
+		return
+	}
+	res.OOMKilled = true
+	metrics.OCIContainerOOMKillCount.Inc()
+	if c.memoryLimitBytes > 0 {
+		res.Error = withSentinel(status.ResourceExhaustedErrorf("container was OOM-killed (exceeded memory limit of %d bytes)", c.memoryLimitBytes), ErrOOMKilled)
+	} else {
+		res.Error = withSentinel(status.ResourceExhaustedError("container was OOM-killed"), ErrOOMKilled)
+	}
+}
+
+// killCgroup kills all processes in the container's cgroup.
+func (c *ociContainer) killCgroup(ctx context.Context) {
+	if err := c.cgroupPaths.Kill(ctx, c.cid); err != nil {
+		// The cgroup may not exist if the runtime hasn't started the
+		// container yet, or if it already exited.
+		log.CtxDebugf(ctx, "Failed to kill container cgroup: %s", err)
+	}
+}
+
+// killExecProcessGroup kills the process group of the exec'd process whose
+// host PID is recorded in the given pid file. The container's init process is
+// in a separate process group, so the container keeps running.
+func killExecProcessGroup(ctx context.Context, pidFile string) {
+	b, err := os.ReadFile(pidFile)
+	if err != nil {
+		// The runtime may not have started the process yet.
+		log.CtxDebugf(ctx, "Failed to read exec pid file: %s", err)
+		return
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		log.CtxWarningf(ctx, "Invalid exec pid file contents %q", string(b))
+		return
+	}
+	pgid, err := unix.Getpgid(pid)
+	if err != nil {
+		// The process already exited.
+		return
+	}
+	if pgid == unix.Getpgrp() {
+		// Never kill our own process group.
+		pgid = pid
+	}
+	if err := unix.Kill(-pgid, unix.SIGKILL); err != nil && err != unix.ESRCH {
+		log.CtxWarningf(ctx, "Failed to kill exec process group %d: %s", pgid, err)
+	}
+}
+
+// setTerminatingSignal records the signal that terminated the command's
+// process, if any. OCI runtimes report a process killed by signal N as exit
+// code 128+N, the same as shells do, so (also like shells) this can't be
+// distinguished from the process explicitly exiting with that code.
+func setTerminatingSignal(res *interfaces.CommandResult) {
+	if res.ExitCode <= 128 || res.ExitCode > 128+maxSignal {
+		return
+	}
+	res.Signal = syscall.Signal(res.ExitCode - 128)
+}
+
+// Instruments an OCI runtime call with monitor() to ensure that resource usage
+// metrics are updated while the function is being executed, and that the
+// resource usage results are populated in the returned CommandResult. If
+// finalStatsFn is non-nil, it is called after the runtime exits to refine the
+// polled task stats.
+func (c *ociContainer) doWithStatsTracking(ctx context.Context, finalStatsFn func(ctx context.Context, polled *repb.UsageStats) *repb.UsageStats, invokeRuntimeFn func(ctx context.Context) *interfaces.CommandResult) *interfaces.CommandResult {
+	netStatsBefore := c.networkStats(ctx)
+	stop, statsCh := container.TrackStats(ctx, c)
+	res := invokeRuntimeFn(ctx)
+	stop()
+	netStatsAfter := c.networkStats(ctx)
+	// statsCh will report stats for processes inside the container, and
+	// res.UsageStats will report stats for the container runtime itself.
+	// Combine these stats to get the total usage.
+	runtimeProcessStats := res.UsageStats
+	taskStats := <-statsCh
+	if taskStats == nil {
+		taskStats = &repb.UsageStats{}
+	}
+	if finalStatsFn != nil {
+		taskStats = finalStatsFn(ctx, taskStats)
+	}
+	combinedStats := taskStats.CloneVT()
+	combinedStats.CpuNanos += runtimeProcessStats.GetCpuNanos()
+	if runtimeProcessStats.GetPeakMemoryBytes() > taskStats.GetPeakMemoryBytes() {
+		combinedStats.PeakMemoryBytes = runtimeProcessStats.GetPeakMemoryBytes()
+	}
+	combinedStats.NetworkRxBytes = netStatsAfter.RxBytes - netStatsBefore.RxBytes
+	combinedStats.NetworkTxBytes = netStatsAfter.TxBytes - netStatsBefore.TxBytes
+	if c.overlayfsMounted {
+		size, err := disk.DirSize(c.overlayUpperPath())
+		if err != nil {
+			log.CtxWarningf(ctx, "Failed to compute overlay upperdir size: %s", err)
+		} else {
+			combinedStats.ContainerDiskBytes = size
+		}
+	}
+	res.UsageStats = combinedStats
+	return res
+}
+
+// networkStats returns the container's network traffic counters. The
+// counters are zero if the container doesn't have its own network namespace
+// or if the network is loopback-only.
+func (c *ociContainer) networkStats(ctx context.Context) *networking.NetworkStats {
+	if c.network == nil {
+		return &networking.NetworkStats{}
+	}
+	stats, err := c.network.Stats()
+	if err != nil {
+		log.CtxWarningf(ctx, "Failed to read container network stats: %s", err)
+		return &networking.NetworkStats{}
+	}
+	return stats
+}
+
+// cumulativeTaskStats returns the polled task stats, updated with the total
+// CPU usage and peak memory usage recorded by the container's cgroup. This
+// makes stats accurate even for commands that exit before they can be polled.
+// It is only valid after Run, since the cgroup's counters cover the
+// container's whole lifetime, and the cgroup is only kept after the container
+// exits if Run passed --keep.
+func (c *ociContainer) cumulativeTaskStats(ctx context.Context, polled *repb.UsageStats) *repb.UsageStats {
+	cumulative, err := c.cgroupPaths.CumulativeStats(ctx, c.cid)
+	if err != nil {
+		log.CtxDebugf(ctx, "Failed to read cumulative cgroup stats: %s", err)
+		return polled
+	}
+	stats := polled.CloneVT()
+	stats.CpuNanos = max(stats.GetCpuNanos(), cumulative.GetCpuNanos())
+	stats.PeakMemoryBytes = max(stats.GetPeakMemoryBytes(), cumulative.GetPeakMemoryBytes())
+	return stats
+}
+
+func (c *ociContainer) createRootfs(ctx context.Context) error {
+	if err := os.MkdirAll(c.rootfsPath(), 0755); err != nil {
+		return fmt.Errorf("create rootfs dir: %w", err)
+	}
+	if err := c.chownToContainerRoot(c.rootfsPath()); err != nil {
+		return fmt.Errorf("chown rootfs dir: %w", err)
+	}
+
+	// For testing only, support a fake image ref that means "install busybox
+	// manually".
+	// TODO: improve testing setup and get rid of this
+	if c.imageRef == TestBusyboxImageRef {
+		return installBusybox(ctx, c.rootfsPath())
+	}
+
+	if c.imageRef == "" {
+		// No image specified (sandbox-only).
+		return nil
+	}
+
+	// Create an overlayfs with the pulled image layers. The extracted layers
+	// are used directly as lowerdirs rather than being copied, so all
+	// containers using a layer share a single copy on disk. This is safe
+	// since overlayfs never modifies lowerdirs: writes, including deletions,
+	// go to the container's own upperdir, and the layer dirs are not
+	// reachable from inside the container.
+	//
+	// Since no file data is copied when setting up the rootfs, there's
+	// nothing to gain from reflink (FICLONE) copies here. Files are only
+	// copied when a container first modifies a lowerdir file ("copy up"),
+	// which the kernel already does by cloning the file if the upperdir's
+	// filesystem supports it (e.g. XFS or Btrfs).
+	var lowerDirs []string
+	// The layers are normally acquired when the image is pulled, but
+	// pulling is skipped if the image was already cached.
+	if err := c.acquireImage(); err != nil {
+		return fmt.Errorf("bad state: attempted to create rootfs before pulling image: %w", err)
+	}
+	image := c.acquiredImage
+	// overlayfs "lowerdir" mount args are ordered from uppermost to lowermost,
+	// but manifest layers are ordered from lowermost to uppermost. So we
+	// iterate in reverse order when building the lowerdir args.
+	for i := len(image.Layers) - 1; i >= 0; i-- {
+		layer := image.Layers[i]
+		path := layerPath(c.layersRoot, layer.DiffID)
+		// Skip empty dirs - these can cause conflicts since they will always
+		// have the same digest, and also just add more overhead.
+		// TODO: precompute this
+		children, err := os.ReadDir(path)
+		if err != nil {
+			return fmt.Errorf("read layer dir: %w", err)
+		}
+		if len(children) == 0 {
+			continue
+		}
+		lowerDirs = append(lowerDirs, path)
+	}
+	// Images built FROM scratch may have no layers, or only empty ones, but
+	// overlayfs requires at least one lowerdir, so use an empty one.
+	if len(lowerDirs) == 0 {
+		emptyDir := filepath.Join(c.overlayTmpPath(), "empty")
+		if err := os.MkdirAll(emptyDir, 0755); err != nil {
+			return fmt.Errorf("create empty overlay lowerdir: %w", err)
+		}
+		lowerDirs = append(lowerDirs, emptyDir)
+	}
+	// Create workdir and upperdir.
+	workdir := filepath.Join(c.overlayTmpPath(), "work")
+	if err := os.MkdirAll(workdir, 0755); err != nil {
+		return fmt.Errorf("create overlay workdir: %w", err)
+	}
+	upperdir := c.overlayUpperPath()
+	if err := os.MkdirAll(upperdir, 0755); err != nil {
+		return fmt.Errorf("create overlay upperdir: %w", err)
+	}
+	// The upperdir is the root dir of the rootfs as seen by the container,
+	// so it must be owned by container root. Files that the container
+	// writes to the upperdir are owned by the host IDs that the container
+	// IDs are mapped to.
+	if err := c.chownToContainerRoot(upperdir); err != nil {
+		return fmt.Errorf("chown overlay upperdir: %w", err)
+	}
+
+	// TODO: do this mount inside a namespace so that it gets removed even if
+	// the executor crashes
+
+	if c.overlayfsMode != overlayfsModeFuse {
+		// - userxattr is needed for compatibility with older kernels
+		// - volatile disables fsync, as a performance optimization
+		options := fmt.Sprintf(
+			"lowerdir=%s,upperdir=%s,workdir=%s,userxattr,volatile",
+			strings.Join(lowerDirs, ":"), upperdir, workdir)
+		log.CtxDebugf(ctx, "Mounting overlayfs to %q, options=%q", c.rootfsPath(), options)
+		err := syscall.Mount("none", c.rootfsPath(), "overlay", 0, options)
+		if err == nil {
+			c.overlayfsMounted = true
+			return nil
+		}
+		// Mounting kernel overlayfs requires CAP_SYS_ADMIN, so unprivileged
+		// executors fall back to fuse-overlayfs if it's available.
+		if c.fuseOverlayfsPath == "" || (err != syscall.EPERM && err != syscall.EACCES) {
+			return fmt.Errorf("mount overlayfs: %w", err)
+		}
+		log.CtxDebugf(ctx, "Not permitted to mount kernel overlayfs (%s), falling back to fuse-overlayfs", err)
+	}
+	if err := mountFuseOverlayfs(ctx, c.fuseOverlayfsPath, lowerDirs, upperdir, workdir, c.rootfsPath()); err != nil {
+		return fmt.Errorf("mount fuse-overlayfs: %w", err)
+	}
+	c.overlayfsMounted = true
+	c.overlayfsFuse = true
+	return nil
+}
+
+func installBusybox(ctx context.Context, path string) error {
+	busyboxPath, err := exec.LookPath("busybox")
+	if err != nil {
+		return fmt.Errorf("find busybox in PATH: %w", err)
+	}
+	binDir := filepath.Join(path, "bin")
+	if err := os.MkdirAll(binDir, 0755); err != nil {
+		return fmt.Errorf("mkdir -p %s: %w", binDir, err)
+	}
+	if err := disk.CopyViaTmpSibling(busyboxPath, filepath.Join(binDir, "busybox")); err != nil {
+		return fmt.Errorf("copy busybox binary: %w", err)
+	}
+	b, err := exec.CommandContext(ctx, busyboxPath, "--list").Output()
+	if err != nil {
+		return fmt.Errorf("list: %w", err)
+	}
+	names := strings.Split(strings.TrimSpace(string(b)), "\n")
+	for _, name := range names {
+		if name == "busybox" {
+			continue
+		}
+		if err := os.Symlink("busybox", filepath.Join(binDir, name)); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(path, "usr"), 0755); err != nil {
+		return err
+	}
+	if err := os.Symlink("../bin", filepath.Join(path, "usr", "bin")); err != nil {
+		return err
+	}
+	return nil
+}
+
+// rlimits returns the resource limits for the container process: the default
+// limits, overridden by any limits requested via platform properties.
+func (c *ociContainer) rlimits() []specs.POSIXRlimit {
+	rlimits := []specs.POSIXRlimit{
+		{Type: "RLIMIT_NPROC", Hard: 4194304, Soft: 4194304},
+	}
+	for _, u := range c.ulimits {
+		rlimits = slices.DeleteFunc(rlimits, func(r specs.POSIXRlimit) bool {
+			return r.Type == u.Type
+		})
+		rlimits = append(rlimits, specs.POSIXRlimit{Type: u.Type, Soft: u.Soft, Hard: u.Hard})
+	}
+	return rlimits
+}
+
+func (c *ociContainer) createSpec(ctx context.Context, cmd *repb.Command) (*specs.Spec, error) {
+	env := append(c.baseEnv(), commandutil.EnvStringList(cmd)...)
+	var pids *specs.LinuxPids
+	if limit := c.effectivePidsLimit(); limit >= 0 {
+		// This is written to pids.max by the runtime. Once the limit is
+		// reached, fork() and clone() fail with EAGAIN inside the container.
+		pids = &specs.LinuxPids{Limit: limit}
+	}
+	var memory *specs.LinuxMemory
+	if c.memoryLimitBytes > 0 {
+		// This is written to memory.max (cgroup v2) by the runtime.
+		memory = &specs.LinuxMemory{Limit: pointer(c.memoryLimitBytes)}
+	}
+	var cpu *specs.LinuxCPU
+	if c.cpuLimitMilliCPU > 0 {
+		// This is written to cpu.max (cgroup v2) by the runtime as
+		// "<quota> <period>". Note that throttling does not affect the
+		// accuracy of the CPU usage reported in cpu.stat.
+		cpu = &specs.LinuxCPU{
+			Quota:  pointer(max(c.cpuLimitMilliCPU*cpuPeriodMicros/1000, minCPUQuotaMicros)),
+			Period: pointer(uint64(cpuPeriodMicros)),
+		}
+	}
+	devices, deviceRules, err := c.devices()
+	if err != nil {
+		return nil, fmt.Errorf("get devices: %w", err)
+	}
+	blockIO, err := c.blockIOResources(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get block IO limits: %w", err)
+	}
+	image, _ := c.imageStore.CachedImage(c.resolvedImageRef(), c.imagePlatform)
+	user, err := getUser(ctx, image, c.rootfsPath(), c.user, c.forceRoot, c.uidMapping != nil, &idOverrides{uid: c.uid, gid: c.gid, additionalGids: c.additionalGids})
+	if err != nil {
+		return nil, fmt.Errorf("get container user: %w", err)
+	}
+	spec := specs.Spec{
+		Version: ociVersion,
+		Process: &specs.Process{
+			Terminal: false,
+			User:     *user,
+			Args:     c.processArgs(cmd),
+			Cwd:      c.processCwd(image),
+			Env:      env,
+			Rlimits:  c.rlimits(),
+			// As in runc and docker, the inheritable and ambient sets are
+			// left empty, so that non-root processes don't keep any
+			// capabilities after execve.
+			Capabilities: &specs.LinuxCapabilities{
+				Bounding:  c.capabilities,
+				Effective: c.capabilities,
+				Permitted: c.capabilities,
+			},
+			ApparmorProfile: c.appArmorProfile,
+		},
+		Root: &specs.Root{
+			Path: c.rootfsPath(),
+			// Note: the overlayfs is still mounted with an upperdir in this
+			// case, since the runtime needs to be able to create mount points
+			// within the rootfs. The runtime remounts the rootfs as read-only
+			// after all mounts are set up.
+			Readonly: c.readOnlyRootfs,
+		},
+		Hostname: c.hostname(),
+		Mounts: []specs.Mount{
+			{
+				Destination: "/proc",
+				Type:        "proc",
+				Source:      "proc",
+				Options:     []string{"nosuid", "noexec", "nodev"},
+			},
+			{
+				Destination: "/dev",
+				Type:        "tmpfs",
+				Source:      "tmpfs",
+				Options:     []string{"nosuid", "strictatime", "mode=755", "size=65536k"},
+			},
+			{
+				Destination: "/sys",
+				Type:        "sysfs",
+				Source:      "sysfs",
+				Options:     []string{"nosuid", "noexec", "nodev", "ro"},
+			},
+			{
+				Destination: "/dev/pts",
+				Type:        "devpts",
+				Source:      "devpts",
+				Options: []string{
+					"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620",
+					// TODO: gid=5 doesn't work in some circumstances.
+					// See https://github.com/containers/podman/blob/b8d95a5893572b37c8257407e964ad06ba87ade6/pkg/specgen/generate/oci_linux.go#L141-L173
+					"gid=5",
+				},
+			},
+			{
+				Destination: "/dev/mqueue",
+				Type:        "mqueue",
+				Source:      "mqueue",
+				Options:     []string{"nosuid", "noexec", "nodev"},
+			},
+			{
+				Destination: "/etc/hosts",
+				Type:        "bind",
+				Source:      filepath.Join(c.bundlePath(), "hosts"),
+				Options:     []string{"bind", "rprivate"},
+			},
+			{
+				Destination: "/dev/shm",
+				Type:        "tmpfs",
+				Source:      "shm",
+				Options:     []string{"rw", "nosuid", "nodev", "noexec", "relatime", "size=64000k", "inode64"},
+			},
+			// TODO: .containerenv
+			// {
+			// 		Destination: "/run/.containerenv",
+			// 		Type:        "bind",
+			// 		Source:      "/run/containers/storage/overlay-containers/99133d16f4f9d0678f87972c01209e308ebafc074f333822805a633620f12507/userdata/.containerenv",
+			// 		Options:     []string{"bind", "rprivate"},
+			// },
+			{
+				Destination: "/etc/hostname",
+				Type:        "bind",
+				Source:      filepath.Join(c.bundlePath(), "hostname"),
+				Options:     []string{"bind", "rprivate"},
+			},
+			{
+				Destination: "/sys/fs/cgroup",
+				Type:        "cgroup",
+				Source:      "cgroup",
+				Options:     []string{"rprivate", "nosuid", "noexec", "nodev", "relatime", "ro"},
+			},
+			{
+				Destination: execrootPath,
+				Type:        "bind",
+				Source:      c.workDir,
+				Options:     []string{"bind", "rprivate"},
+			},
+		},
+		Annotations: c.specAnnotations(),
+		Linux: &specs.Linux{
+			// TODO: set up cgroups
+			CgroupsPath: c.cgroupsPath(),
+			Namespaces:  c.namespaces(),
+			Seccomp:     c.seccomp,
+			Devices:     devices,
+			Sysctl:      c.sysctls(user),
+			Resources: &specs.LinuxResources{
+				Pids:    pids,
+				Memory:  memory,
+				CPU:     cpu,
+				BlockIO: blockIO,
+				Devices: deviceRules,
+			},
+			// TODO: grok MaskedPaths and ReadonlyPaths - just copied from podman.
+			MaskedPaths: []string{
+				"/proc/acpi",
+				"/proc/kcore",
+				"/proc/keys",
+				"/proc/latency_stats",
+				"/proc/timer_list",
+				"/proc/timer_stats",
+				"/proc/sched_debug",
+				"/proc/scsi",
+				"/sys/firmware",
+				"/sys/fs/selinux",
+				"/sys/dev/block",
+			},
+			ReadonlyPaths: []string{
+				"/proc/asound",
+				"/proc/bus",
+				"/proc/fs",
+				"/proc/irq",
+				"/proc/sys",
+				"/proc/sysrq-trigger",
+			},
+		},
+	}
+	for _, m := range c.tmpfsMounts {
+		options := []string{"rw", "nosuid", "nodev"}
+		if m.SizeBytes > 0 {
+			options = append(options, fmt.Sprintf("size=%d", m.SizeBytes))
+		}
+		spec.Mounts = append(spec.Mounts, specs.Mount{
+			Destination: m.Path,
+			Type:        "tmpfs",
+			Source:      "tmpfs",
+			Options:     options,
+		})
+	}
+	for _, m := range c.bindMounts {
+		// The source was resolved when the container was created, but a
+		// path component may have been replaced with a symlink since then,
+		// so check it again right before it is mounted.
+		source, err := resolveBindMountSource(m.Source)
+		if err != nil {
+			return nil, err
+		}
+		if source != m.Source {
+			return nil, status.PermissionDeniedErrorf("bind mount source %q now resolves to %q", m.Source, source)
+		}
+		options := []string{"bind", "rprivate"}
+		if m.ReadOnly {
+			options = append(options, "ro")
+		}
+		spec.Mounts = append(spec.Mounts, specs.Mount{
+			Destination: m.Target,
+			Type:        "bind",
+			Source:      m.Source,
+			Options:     options,
+		})
+	}
+	if c.initPath != "" {
+		spec.Mounts = append(spec.Mounts, specs.Mount{
+			Destination: containerInitPath,
+			Type:        "bind",
+			Source:      c.initPath,
+			Options:     []string{"bind", "rprivate", "ro"},
+		})
+	}
+	if _, err := os.Stat(c.resolvConfPath()); err == nil {
+		spec.Mounts = append(spec.Mounts, specs.Mount{
+			Destination: "/etc/resolv.conf",
+			Type:        "bind",
+			Source:      c.resolvConfPath(),
+			Options:     []string{"bind", "rprivate"},
+		})
+	}
+	spec.Hooks = c.hooks
+	if c.uidMapping != nil {
+		spec.Linux.UIDMappings = []specs.LinuxIDMapping{*c.uidMapping}
+		spec.Linux.GIDMappings = []specs.LinuxIDMapping{*c.gidMapping}
+	}
+
+	return &spec, nil
+}
+
+// specAnnotations returns the annotations to set in the container spec: the
+// default stop signal annotation, plus the container's own annotations.
+func (c *ociContainer) specAnnotations() map[string]string {
+	annotations := map[string]string{
+		// Annotate with podman's default stop signal.
+		// TODO: is this strictly needed?
+		"org.opencontainers.image.stopSignal": syscall.SIGTERM.String(),
+	}
+	maps.Copy(annotations, c.annotations)
+	return annotations
+}
+
+// cgroupsPath returns the cgroup path to set in the container spec. crun
+// places containers in a cgroup named after the container ID if the path is
+// empty, which is what cgroup.Paths expects. Other runtimes may pick a
+// different default, so the same path is set explicitly for them. If a cgroup
+// parent is configured, the container's cgroup is always created beneath it.
+func (c *ociContainer) cgroupsPath() string {
+	if c.cgroupParent != "" {
+		return path.Join(c.cgroupParent, c.cid)
+	}
+	if c.runtimeType == RuntimeTypeCrun {
+		return ""
+	}
+	return "/" + c.cid
+}
+
+// setupCgroupParent creates the cgroup with the given path relative to the
+// cgroup v2 root, if it doesn't already exist, and returns its cleaned path.
+// Controllers are enabled along the path so that container cgroups beneath it
+// can be limited, and the cgroup itself is limited to the executor's allocated
+// memory and CPU.
+func setupCgroupParent(parent string) (string, error) {
+	parent = path.Clean("/" + parent)
+	if parent == "/" {
+		return "", status.InvalidArgumentError("cgroup parent must not be the cgroup root")
+	}
+	b, err := os.ReadFile(filepath.Join(cgroupfsPath, "cgroup.controllers"))
+	if err != nil {
+		return "", status.FailedPreconditionErrorf("cgroup parent requires cgroup v2: read cgroup.controllers: %s", err)
+	}
+	available := strings.Fields(string(b))
+	var enable []string
+	for _, controller := range []string{"cpu", "memory", "pids", "io"} {
+		if slices.Contains(available, controller) {
+			enable = append(enable, "+"+controller)
+		}
+	}
+	// Walk down from the root, delegating controllers to each cgroup along
+	// the path, including the container cgroups beneath the parent.
+	dir := cgroupfsPath
+	for _, name := range append(strings.Split(parent[1:], "/"), "") {
+		if len(enable) > 0 {
+			if err := os.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte(strings.Join(enable, " ")), 0); err != nil {
+				return "", status.UnavailableErrorf("enable cgroup controllers in %q: %s", dir, err)
+			}
+		}
+		if name == "" {
+			break
+		}
+		dir = filepath.Join(dir, name)
+		if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+			return "", status.UnavailableErrorf("create cgroup %q: %s", dir, err)
+		}
+	}
+	if ram := resources.GetAllocatedRAMBytes(); ram > 0 {
+		if err := os.WriteFile(filepath.Join(dir, "memory.max"), []byte(strconv.FormatInt(ram, 10)), 0); err != nil {
+			return "", status.UnavailableErrorf("set cgroup parent memory limit: %s", err)
+		}
+	}
+	if milliCPU := resources.GetAllocatedCPUMillis(); milliCPU > 0 {
+		quota := fmt.Sprintf("%d %d", milliCPU*cpuPeriodMicros/1000, cpuPeriodMicros)
+		if err := os.WriteFile(filepath.Join(dir, "cpu.max"), []byte(quota), 0); err != nil {
+			return "", status.UnavailableErrorf("set cgroup parent CPU limit: %s", err)
+		}
+	}
+	return parent, nil
+}
+
+// processArgs returns the arguments for the container's init process. If an
+// init binary is configured, it runs as PID 1 so that it can reap orphaned
+// processes and forward signals, and the command runs as its child.
+func (c *ociContainer) processArgs(cmd *repb.Command) []string {
+	if c.initPath == "" {
+		return cmd.GetArguments()
+	}
+	return append([]string{containerInitPath, "--"}, cmd.GetArguments()...)
+}
+
+// namespaces returns the Linux namespaces for the container.
+func (c *ociContainer) namespaces() []specs.LinuxNamespace {
+	namespaces := []specs.LinuxNamespace{
+		{Type: specs.PIDNamespace},
+		{Type: specs.IPCNamespace},
+		{Type: specs.UTSNamespace},
+		{Type: specs.MountNamespace},
+		{Type: specs.CgroupNamespace},
+	}
+	if c.uidMapping != nil {
+		namespaces = append(namespaces, specs.LinuxNamespace{Type: specs.UserNamespace})
+	}
+	// In host network mode, no network namespace is specified, so the
+	// container joins the runtime's (i.e. the host's) network namespace.
+	if c.network != nil {
+		namespaces = append(namespaces, specs.LinuxNamespace{
+			Type: specs.NetworkNamespace,
+			Path: "/var/run/netns/" + c.network.NetNamespace(),
+		})
+	}
+	return namespaces
+}
+
+// sysctls returns the namespaced sysctls to apply in the container.
+func (c *ociContainer) sysctls(user *specs.User) map[string]string {
+	if c.network == nil {
+		// Network sysctls can't be set without a network namespace, since
+		// they would apply to the host.
+		return nil
+	}
+	return map[string]string{
+		"net.ipv4.ping_group_range": fmt.Sprintf("%d %d", user.GID, user.GID),
+	}
+}
+
+// devices returns the devices to be created in the container, along with the
+// cgroup rules allowing access to them. These are in addition to the default
+// devices (/dev/null, /dev/zero etc.) which are always provisioned by the
+// runtime.
+func (c *ociContainer) devices() ([]specs.LinuxDevice, []specs.LinuxDeviceCgroup, error) {
+	devices := []specs.LinuxDevice{}
+	var rules []specs.LinuxDeviceCgroup
+	if !c.gpu {
+		return devices, rules, nil
+	}
+	paths, err := filepath.Glob("/dev/nvidia*")
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, path := range paths {
+		var st unix.Stat_t
+		if err := unix.Stat(path, &st); err != nil {
+			return nil, nil, fmt.Errorf("stat %s: %w", path, err)
+		}
+		// Skip non-device entries like /dev/nvidia-caps/.
+		if st.Mode&unix.S_IFMT != unix.S_IFCHR {
+			continue
+		}
+		major, minor := int64(unix.Major(st.Rdev)), int64(unix.Minor(st.Rdev))
+		devices = append(devices, specs.LinuxDevice{
+			Path:     path,
+			Type:     "c",
+			Major:    major,
+			Minor:    minor,
+			FileMode: pointer(fs.FileMode(st.Mode & 0777)),
+			UID:      pointer(st.Uid),
+			GID:      pointer(st.Gid),
+		})
+		rules = append(rules, specs.LinuxDeviceCgroup{
+			Allow:  true,
+			Type:   "c",
+			Major:  pointer(major),
+			Minor:  pointer(minor),
+			Access: "rwm",
+		})
+	}
+	if len(devices) == 0 {
+		return nil, nil, status.FailedPreconditionError("GPU requested, but no NVIDIA devices were found on the executor")
+	}
+	return devices, rules, nil
+}
+
+// blockIOResources returns the block IO limits for the container, or nil if no
+// limits are configured or if the io cgroup controller is unavailable.
+func (c *ociContainer) blockIOResources(ctx context.Context) (*specs.LinuxBlockIO, error) {
+	if c.ioWeight <= 0 && c.ioReadBPS <= 0 && c.ioWriteBPS <= 0 {
+		return nil, nil
+	}
+	controllers, err := os.ReadFile(filepath.Join(cgroupfsPath, "cgroup.controllers"))
+	if err != nil || !slices.Contains(strings.Fields(string(controllers)), "io") {
+		log.CtxWarningf(ctx, "Ignoring block IO limits for container %s: io cgroup controller is not available", c.cid)
+		return nil, nil
+	}
+	blockIO := &specs.LinuxBlockIO{}
+	if c.ioWeight > 0 {
+		// The runtime converts this to the io.weight range.
+		blockIO.Weight = pointer(uint16(c.ioWeight))
+	}
+	if c.ioReadBPS > 0 || c.ioWriteBPS > 0 {
+		dev, err := blockDevice(c.workDir)
+		if err != nil {
+			return nil, fmt.Errorf("find block device for %s: %w", c.workDir, err)
+		}
+		if c.ioReadBPS > 0 {
+			blockIO.ThrottleReadBpsDevice = []specs.LinuxThrottleDevice{
+				{LinuxBlockIODevice: dev, Rate: uint64(c.ioReadBPS)},
+			}
+		}
+		if c.ioWriteBPS > 0 {
+			blockIO.ThrottleWriteBpsDevice = []specs.LinuxThrottleDevice{
+				{LinuxBlockIODevice: dev, Rate: uint64(c.ioWriteBPS)},
+			}
+		}
+	}
+	return blockIO, nil
+}
+
+// blockDevice returns the major/minor numbers of the disk backing the given
+// path. If the path is on a partition, the parent disk is returned, since the
+// io controller only accepts whole disks.
+func blockDevice(path string) (specs.LinuxBlockIODevice, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return specs.LinuxBlockIODevice{}, err
+	}
+	major, minor := unix.Major(st.Dev), unix.Minor(st.Dev)
+	sysPath := fmt.Sprintf("/sys/dev/block/%d:%d", major, minor)
+	if _, err := os.Stat(filepath.Join(sysPath, "partition")); err == nil {
+		// /sys/dev/block/<major>:<minor> is a symlink to the partition dir,
+		// which is nested under the parent disk dir.
+		partitionPath, err := filepath.EvalSymlinks(sysPath)
+		if err != nil {
+			return specs.LinuxBlockIODevice{}, err
+		}
+		b, err := os.ReadFile(filepath.Join(filepath.Dir(partitionPath), "dev"))
+		if err != nil {
+			return specs.LinuxBlockIODevice{}, fmt.Errorf("read parent device: %w", err)
+		}
+		if _, err := fmt.Sscanf(strings.TrimSpace(string(b)), "%d:%d", &major, &minor); err != nil {
+			return specs.LinuxBlockIODevice{}, fmt.Errorf("parse parent device %q: %w", b, err)
+		}
+	}
+	return specs.LinuxBlockIODevice{Major: int64(major), Minor: int64(minor)}, nil
+}
+
+// processCwd returns the working directory for container processes. This is
+// the execution root unless overridden by platform properties.
+func (c *ociContainer) processCwd(image *Image) string {
+	if c.workDirOverride != "" {
+		return c.workDirOverride
+	}
+	if c.useImageWorkDir && image != nil && image.Config.WorkingDir != "" {
+		return image.Config.WorkingDir
+	}
+	return execrootPath
+}
+
+// effectivePidsLimit returns the PID limit to apply to the container, or -1 if
+// PIDs should be unlimited. The limit requested via platform properties may
+// lower the executor-configured limit, but never raise it.
+func (c *ociContainer) effectivePidsLimit() int64 {
+	if c.pidsLimit <= 0 {
+		return *pidsLimit
+	}
+	if *pidsLimit >= 0 && c.pidsLimit > *pidsLimit {
+		return *pidsLimit
+	}
+	return c.pidsLimit
+}
+
+func (c *ociContainer) invokeRuntimeSimple(ctx context.Context, args ...string) error {
+	res := c.invokeRuntime(ctx, &repb.Command{}, &interfaces.Stdio{}, 0, args...)
+	return asError(res)
+}
+
+func asError(res *interfaces.CommandResult) error {
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.ExitCode != 0 {
+		if len(res.Stderr) > 0 {
+			return fmt.Errorf("%s", strings.TrimSpace(string(res.Stderr)))
+		} else if len(res.Stdout) > 0 {
+			return fmt.Errorf("%s", strings.TrimSpace(string(res.Stdout)))
+		}
+		return fmt.Errorf("exit code %d", res.ExitCode)
+	}
+	return nil
+}
+
+func (c *ociContainer) invokeRuntime(ctx context.Context, command *repb.Command, stdio *interfaces.Stdio, waitDelay time.Duration, args ...string) *interfaces.CommandResult {
+	start := time.Now()
+	defer func() {
+		// TODO: better profiling/tracing
+		log.CtxDebugf(ctx, "[%s] %s %s\n", time.Since(start), c.runtime, args[0])
+	}()
+
+	globalArgs := []string{
+		// "strace", "-o", "/tmp/strace.log",
+		c.runtime,
+		"--log-format=json",
+	}
+	// runc and runsc use cgroupfs unless --systemd-cgroup is set, but crun
+	// may default to systemd.
+	if c.runtimeType == RuntimeTypeCrun {
+		globalArgs = append(globalArgs, "--cgroup-manager=cgroupfs")
+	}
+	if c.runtimeType == RuntimeTypeRunsc {
+		globalArgs = append(globalArgs, c.runscArgs()...)
+	}
+	if *runtimeRoot != "" {
+		globalArgs = append(globalArgs, "--root="+*runtimeRoot)
+	}
+
+	globalArgs = append(globalArgs, c.extraGlobalArgs...)
+
+	runtimeArgs := append(globalArgs, args[0])
+	runtimeArgs = append(runtimeArgs, c.extraCommandArgs[args[0]]...)
+	runtimeArgs = append(runtimeArgs, args[1:]...)
+	runtimeArgs = append(runtimeArgs, command.GetArguments()...)
+
+	// working dir for crun itself doesn't really matter - just default to cwd.
+	wd, err := os.Getwd()
+	if err != nil {
+		return commandutil.ErrorResult(status.UnavailableErrorf("getwd: %s", err))
+	}
+
+	log.CtxDebugf(ctx, "Running %v", runtimeArgs)
+
+	cmd := exec.CommandContext(ctx, runtimeArgs[0], runtimeArgs[1:]...)
+	cmd.Dir = wd
+	var stdout *outputBuffer
+	var stderr *outputBuffer
+	// Count output bytes even when streaming output to stdio writers, in
+	// which case the output isn't returned in the result.
+	stdoutCounter := &ioutil.Counter{}
+	stderrCounter := &ioutil.Counter{}
+	// If stdio is nil, the output will be discarded.
+	if stdio != nil {
+		// Stdin is streamed rather than buffered: exec.Cmd copies it to
+		// the runtime through a pipe using a small fixed-size buffer, so
+		// stdin is only read as fast as the process consumes it.
+		cmd.Stdin = stdio.Stdin
+		if stdio.Stdout == nil {
+			stdout = newOutputBuffer(stdio.OutputTruncation)
+			cmd.Stdout = io.MultiWriter(stdout, stdoutCounter)
+		} else {
+			stdout = nil
+			cmd.Stdout = io.MultiWriter(stdio.Stdout, stdoutCounter)
+		}
+		if stdio.Stderr == nil {
+			stderr = newOutputBuffer(stdio.OutputTruncation)
+			cmd.Stderr = io.MultiWriter(stderr, stderrCounter)
+		} else {
+			stderr = nil
+			cmd.Stderr = io.MultiWriter(stdio.Stderr, stderrCounter)
+		}
+		if stdio.Combined != nil {
+			mux := &lineMux{w: stdio.Combined}
+			stdoutLines := &lineMuxStream{mux: mux}
+			stderrLines := &lineMuxStream{mux: mux}
+			cmd.Stdout = io.MultiWriter(cmd.Stdout, stdoutLines)
+			cmd.Stderr = io.MultiWriter(cmd.Stderr, stderrLines)
+			// Write any trailing output that doesn't end with a newline.
+			defer func() {
+				stdoutLines.Flush()
+				stderrLines.Flush()
+			}()
+		}
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	// In the "run" case, start the runtime in its own pid namespace so that
+	// when it is killed, the container process gets killed automatically
+	// instead of getting reparented and continuing to execute.
+	// TODO: figure out why this is only needed for run and not exec.
+	if args[0] == "run" {
+		cmd.SysProcAttr.Cloneflags = syscall.CLONE_NEWPID
+	}
+
+	cmd.WaitDelay = waitDelay
+	runError := cmd.Run()
+	if errors.Is(runError, exec.ErrWaitDelay) {
+		// The stdio streams were forcibly closed after a non-zero waitDelay. Any error from the
+		// process takes precedence over ErrWaitDelay, so we can ignore the error here without
+		// a risk of shadowing a more important error.
+		runError = nil
+	}
+	code, err := commandutil.ExitCode(ctx, cmd, runError)
+	if status.IsDeadlineExceededError(err) {
+		err = withSentinel(err, ErrTimeout)
+	}
+	result := &interfaces.CommandResult{
+		ExitCode:   code,
+		Error:      err,
+		StdoutSize: stdoutCounter.Count(),
+		StderrSize: stderrCounter.Count(),
+	}
+	if stdout != nil {
+		result.Stdout = stdout.Bytes()
+		result.StdoutTruncated = stdout.Truncated()
+	}
+	if stderr != nil {
+		result.Stderr = stderr.Bytes()
+		result.StderrTruncated = stderr.Truncated()
+	}
+	return result
+}
+
+// console receives the pseudo-terminal master from the OCI runtime when a
+// process is executed with a terminal, and copies data between the master and
+// the caller's stdio. See
+// https://github.com/opencontainers/runc/blob/main/docs/terminals.md
+type console struct {
+	dir      string
+	listener *net.UnixListener
+	stdio    *interfaces.Stdio
+	stdout   *outputBuffer
+	done     chan error
+	// Number of bytes copied from the pty. Only valid after done is
+	// signaled.
+	stdoutSize int64
+
+	mu     sync.Mutex
+	master *os.File
+}
+
+func newConsole(stdio *interfaces.Stdio) (*console, error) {
+	// Unix socket paths are limited to 108 bytes, so create the socket in a
+	// short temp dir rather than in the bundle dir.
+	dir, err := os.MkdirTemp("", "oci-console-")
+	if err != nil {
+		return nil, err
+	}
+	addr := &net.UnixAddr{Name: filepath.Join(dir, "console.sock"), Net: "unix"}
+	listener, err := net.ListenUnix("unix", addr)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	c := &console{
+		dir:      dir,
+		listener: listener,
+		stdio:    stdio,
+		done:     make(chan error, 1),
+	}
+	if stdio.Stdout == nil {
+		c.stdout = newOutputBuffer(stdio.OutputTruncation)
+	}
+	go func() {
+		c.done <- c.attach()
+	}()
+	return c, nil
+}
+
+// SocketPath returns the path to pass to the runtime's --console-socket flag.
+func (c *console) SocketPath() string {
+	return filepath.Join(c.dir, "console.sock")
+}
+
+// attach waits for the runtime to send the pty master, then copies stdin to
+// the master and the master to stdout until the process exits.
+func (c *console) attach() error {
+	conn, err := c.listener.AcceptUnix()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	buf := make([]byte, 1024)
+	oob := make([]byte, unix.CmsgSpace(4))
+	_, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return err
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return err
+	}
+	if len(msgs) != 1 {
+		return fmt.Errorf("expected 1 control message, got %d", len(msgs))
+	}
+	fds, err := unix.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return err
+	}
+	if len(fds) != 1 {
+		return fmt.Errorf("expected 1 fd, got %d", len(fds))
+	}
+	// Make the master non-blocking so that reads can be interrupted by
+	// closing it.
+	if err := unix.SetNonblock(fds[0], true); err != nil {
+		unix.Close(fds[0])
+		return err
+	}
+	master := os.NewFile(uintptr(fds[0]), "pty-master")
+	c.mu.Lock()
+	c.master = master
+	c.mu.Unlock()
+
+	if c.stdio.Stdin != nil {
+		go copyTerminalInput(master, c.stdio.Stdin)
+	}
+	var stdout io.Writer = c.stdout
+	if c.stdio.Stdout != nil {
+		stdout = c.stdio.Stdout
+	}
+	if c.stdio.Combined != nil {
+		// The pty already combines stdout and stderr.
+		stdout = io.MultiWriter(stdout, c.stdio.Combined)
+	}
+	c.stdoutSize, err = io.Copy(stdout, master)
+	// Reading from the master returns EIO once all processes attached to
+	// the pty have exited.
+	if errors.Is(err, syscall.EIO) || errors.Is(err, os.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// copyTerminalInput copies stdin to the pty master. Closing the master would
+// hang up the terminal rather than signal the end of input, so once stdin is
+// exhausted, the terminal's EOF character is written instead. If the input
+// doesn't end with a newline, the first EOF character only flushes the
+// pending partial line, so a second one is needed.
+func copyTerminalInput(master io.Writer, stdin io.Reader) {
+	w := &lastByteWriter{w: master}
+	if _, err := io.Copy(w, stdin); err != nil {
+		return
+	}
+	eof := []byte{ttyEOF}
+	if w.n > 0 && w.last != '\n' {
+		eof = append(eof, ttyEOF)
+	}
+	master.Write(eof)
+}
+
+// lastByteWriter records the number of bytes written and the last byte
+// written.
+type lastByteWriter struct {
+	w    io.Writer
+	n    int64
+	last byte
+}
+
+func (w *lastByteWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if n > 0 {
+		w.n += int64(n)
+		w.last = p[n-1]
+	}
+	return n, err
+}
+
+// Wait waits for the pty output to be fully copied and returns the captured
+// output, if stdio did not specify a stdout writer, along with the total
+// number of output bytes and whether the captured output was truncated. It
+// should be called after the runtime exits.
+func (c *console) Wait() ([]byte, int64, bool, error) {
+	// If the runtime never connected (e.g. it failed to start the process),
+	// closing the listener unblocks attach().
+	c.listener.Close()
+	var err error
+	select {
+	case err = <-c.done:
+	case <-time.After(consoleDrainTimeout):
+		// Background processes may keep the pty open after the main process
+		// exits. Close the master so that we don't wait for them.
+		c.mu.Lock()
+		if c.master != nil {
+			c.master.Close()
+		}
+		c.mu.Unlock()
+		err = <-c.done
+	}
+	if c.stdout == nil {
+		return nil, c.stdoutSize, false, err
+	}
+	return c.stdout.Bytes(), c.stdoutSize, c.stdout.Truncated(), err
+}
+
+func (c *console) Close() error {
+	c.listener.Close()
+	c.mu.Lock()
+	if c.master != nil {
+		c.master.Close()
+	}
+	c.mu.Unlock()
+	return os.RemoveAll(c.dir)
+}
+
+// outputBuffer captures command output, up to --executor.oci.max_output_bytes.
+// Depending on the truncation mode, either the beginning or the end of the
+// output is kept, and the rest is discarded. Writes always succeed, so that
+// the command's output pipe keeps being drained and the command never blocks
+// on a full pipe.
+type outputBuffer struct {
+	// limit is the maximum number of bytes to keep, or 0 if unlimited.
+	limit int
+	tail  bool
+	// total is the total number of bytes written.
+	total int64
+
+	// buf holds the captured output in head mode. In tail mode, it is used
+	// as a ring buffer once it reaches the limit, and pos is the offset of
+	// the oldest byte.
+	buf []byte
+	pos int
+}
+
+func newOutputBuffer(mode interfaces.OutputTruncationMode) *outputBuffer {
+	b := &outputBuffer{limit: int(*maxOutputBytes), tail: mode == interfaces.TruncateTail}
+	if mode == interfaces.TruncateNone {
+		b.limit = 0
+	}
+	return b
+}
+
+func (b *outputBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	b.total += int64(n)
+	switch {
+	case b.limit <= 0:
+		b.buf = append(b.buf, p...)
+	case !b.tail:
+		b.buf = append(b.buf, p[:min(len(p), max(b.limit-len(b.buf), 0))]...)
+	case len(p) >= b.limit:
+		b.buf = append(b.buf[:0], p[len(p)-b.limit:]...)
+		b.pos = 0
+	default:
+		// Fill the buffer up to the limit, then overwrite the oldest bytes.
+		fill := min(b.limit-len(b.buf), len(p))
+		b.buf = append(b.buf, p[:fill]...)
+		p = p[fill:]
+		for len(p) > 0 {
+			copied := copy(b.buf[b.pos:], p)
+			b.pos = (b.pos + copied) % b.limit
+			p = p[copied:]
+		}
+	}
+	return n, nil
+}
+
+// Bytes returns the captured output.
+func (b *outputBuffer) Bytes() []byte {
+	if b.pos == 0 {
+		return b.buf
+	}
+	return append(slices.Clone(b.buf[b.pos:]), b.buf[:b.pos]...)
+}
+
+// Truncated returns whether any output was discarded.
+func (b *outputBuffer) Truncated() bool {
+	return b.total > int64(len(b.buf))
+}
+
+// lineMux multiplexes the output of multiple streams into a single writer,
+// one line at a time, so that lines from different streams aren't
+// interleaved.
+type lineMux struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// lineMuxStream is a writer for a single stream within a lineMux. It buffers
+// partial lines until they are completed by a newline or flushed.
+type lineMuxStream struct {
+	mux *lineMux
+	buf []byte
+}
+
+func (s *lineMuxStream) Write(p []byte) (int, error) {
+	s.mux.mu.Lock()
+	defer s.mux.mu.Unlock()
+	s.buf = append(s.buf, p...)
+	i := bytes.LastIndexByte(s.buf, '\n')
+	if i < 0 {
+		return len(p), nil
+	}
+	// Write all complete lines at once. Errors from the combined writer are
+	// ignored so that they don't interrupt the separate stdout and stderr
+	// captures.
+	s.mux.w.Write(s.buf[:i+1])
+	s.buf = s.buf[i+1:]
+	return len(p), nil
+}
+
+// Flush writes any buffered partial line.
+func (s *lineMuxStream) Flush() {
+	s.mux.mu.Lock()
+	defer s.mux.mu.Unlock()
+	if len(s.buf) > 0 {
+		s.mux.w.Write(s.buf)
+		s.buf = nil
+	}
+}
+
+// idOverrides holds explicitly requested process IDs, which take precedence
+// over the image USER and the dockerUser property.
+type idOverrides struct {
+	uid            *uint32
+	gid            *uint32
+	additionalGids []uint32
+}
+
+func getUser(ctx context.Context, image *Image, rootfsPath string, dockerUserProp string, dockerForceRootProp bool, userNamespace bool, overrides *idOverrides) (*specs.User, error) {
+	// TODO: for rootless support we'll need to handle the case where the
+	// executor user doesn't have permissions to access files created as the
+	// requested user ID
+
+	// Note that unless containers use a user namespace, IDs inside the
+	// container are the same as on the host. In particular, files created in
+	// the overlayfs upperdir or workspace are owned by the requested uid/gid
+	// on the host. With a user namespace, they are owned by the host IDs
+	// that the requested IDs are mapped to, and files owned by unmapped host
+	// IDs, such as the workspace inputs, are only accessible to the
+	// container through their "other" permission bits.
+	spec := ""
+	if image != nil {
+		spec = image.Config.User
+	}
+	if dockerUserProp != "" {
+		spec = dockerUserProp
+	}
+	if dockerForceRootProp {
+		spec = "0"
+	}
+	if overrides.uid != nil {
+		spec = fmt.Sprintf("%d", *overrides.uid)
+	}
+	if spec == "" && userNamespace {
+		// The executor's IDs aren't meaningful inside the user namespace,
+		// so default to container root, which is unprivileged on the host.
+		spec = "0:0"
+	}
+	if spec == "" {
+		// Inherit the current uid/gid.
+		spec = fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
+	}
+
+	user, group, err := container.ParseUserGroup(spec)
+	if err != nil {
+		return nil, fmt.Errorf(`invalid "USER[:GROUP]" spec %q`, spec)
+	}
+	if overrides.gid != nil {
+		group = &unixcred.NameOrID{ID: *overrides.gid}
+	}
+
+	var uid, gid uint32
+	username := user.Name
+
+	// If the user is non-numeric then we need to look it up from /etc/passwd.
+	// If no gid is specified then we need to find the user entry in /etc/passwd
+	// to know what group they are in.
+	if user.Name != "" || group == nil {
+		userRecord, err := unixcred.LookupUser(filepath.Join(rootfsPath, "/etc/passwd"), user)
+		if (err == unixcred.ErrUserNotFound || os.IsNotExist(err)) && user.Name == "" {
+			// If no user was found in /etc/passwd and we specified only a
+			// numeric user ID then just set the group ID to 0 (root). This is
+			// what docker/podman do, presumably because it's usually safe to
+			// assume that gid 0 exists.
+			uid = user.ID
+			gid = 0
+		} else if err != nil {
+			return nil, fmt.Errorf("lookup user %q in /etc/passwd: %w", user, err)
+		} else {
+			uid = userRecord.UID
+			username = userRecord.Username
+			if group == nil {
+				gid = userRecord.GID
+			}
+		}
+	} else {
+		uid = user.ID
+	}
+
+	if group != nil {
+		// If a group was specified by name then look it up from /etc/group.
+		if group.Name != "" {
+			groupRecord, err := unixcred.LookupGroup(filepath.Join(rootfsPath, "/etc/group"), group)
+			if err != nil {
+				return nil, fmt.Errorf("lookup group %q in /etc/group: %w", group, err)
+			}
+			gid = groupRecord.GID
+		} else {
+			gid = group.ID
+		}
+	}
+
+	gids := []uint32{gid}
+
+	// If no group is explicitly specified and we have a username, then
+	// search /etc/group for additional groups that the user might be in
+	// (/etc/group lists members by username, not by uid).
+	if group == nil && username != "" {
+		groups, err := unixcred.GetGroupsWithUser(filepath.Join(rootfsPath, "/etc/group"), username)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("lookup groups with user %q in /etc/passwd: %w", username, err)
+		}
+		for _, g := range groups {
+			gids = append(gids, g.GID)
+		}
+	}
+	gids = append(gids, overrides.additionalGids...)
+	slices.Sort(gids)
+	gids = slices.Compact(gids)
+
+	return &specs.User{
+		UID:            uid,
+		GID:            gid,
+		AdditionalGids: gids,
+		Umask:          pointer(uint32(022)), // 0644 file perms by default
+	}, nil
+}
+
+func pointer[T any](val T) *T {
+	return &val
+}
+
+// isCID returns whether the given name is a container ID created by newCID.
+func isCID(name string) bool {
+	if len(name) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+func newCID() (string, error) {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", b), nil
+}
+
+// generateCID generates container IDs. It can be replaced in tests.
+var generateCID = newCID
+
+// SetCIDGeneratorForTest replaces the function used to generate container
+// IDs, and returns a function that restores the original.
+func SetCIDGeneratorForTest(f func() (string, error)) (restore func()) {
+	generateCID = f
+	return func() { generateCID = newCID }
+}
+
+// newUniqueCID returns a new container ID which doesn't collide with state
+// left behind by a previous container, such as a bundle dir, runtime state
+// dir, or cgroup. Otherwise, the runtime would fail to create the container.
+func (c *ociContainer) newUniqueCID(ctx context.Context) (string, error) {
+	for range maxCIDAttempts {
+		cid, err := generateCID()
+		if err != nil {
+			return "", err
+		}
+		stale := c.staleStatePath(cid)
+		if stale == "" {
+			return cid, nil
+		}
+		log.CtxWarningf(ctx, "Container ID %s is already in use by %q, generating a new ID", cid, stale)
+	}
+	return "", status.UnavailableErrorf("failed to generate a unique container ID after %d attempts", maxCIDAttempts)
+}
+
+// staleStatePath returns the path of existing state for a container with the
+// given ID, or "" if there is none.
+func (c *ociContainer) staleStatePath(cid string) string {
+	paths := []string{filepath.Join(c.containersRoot, cid)}
+	if root := c.runtimeStateRoot(); root != "" {
+		paths = append(paths, filepath.Join(root, cid))
+	}
+	if c.cgroupParent != "" {
+		paths = append(paths, filepath.Join(cgroupfsPath, c.cgroupParent, cid))
+	}
+	for _, path := range paths {
+		if _, err := os.Lstat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// runtimeStateRoot returns the dir where the runtime stores container state,
+// or "" if it is unknown.
+func (c *ociContainer) runtimeStateRoot() string {
+	if *runtimeRoot != "" {
+		return *runtimeRoot
+	}
+	// Rootless runtimes store state under $XDG_RUNTIME_DIR by default, which
+	// isn't checked here.
+	if os.Geteuid() != 0 {
+		return ""
+	}
+	return defaultRuntimeStateRoots[c.runtimeType]
+}
+
+// whiteoutPrefix is the filename prefix used by OCI layer tarballs to mark
+// deleted files.
+const whiteoutPrefix = ".wh."
+
+// rootfsTarImageRefPrefix is prepended to the path of a rootfs tarball to form
+// the image name under which the imported image is cached.
+const rootfsTarImageRefPrefix = "tarball://"
+
+// layerPath returns the path where the extracted image layer with the given
+// hash is stored on disk.
+func layerPath(layersDir string, hash ctr.Hash) string {
+	return filepath.Join(layersDir, hash.Algorithm, hash.Hex)
+}
+
+// ImageStore handles image layer storage for OCI containers.
+type ImageStore struct {
+	layersDir      string
+	imagePullGroup singleflight.Group[string, *Image]
+	layerPullGroup singleflight.Group[string, any]
+
+	mu           sync.RWMutex
+	cachedImages map[string]*Image
+	// tagDigests records the digest that each image tag was last resolved
+	// to, and when, so that cached images don't need to be checked against
+	// the registry every time they are used.
+	tagDigests map[string]tagDigest
+
+	// gcMu is held for reading during pulls and held exclusively during GC,
+	// so that GC never deletes layers which are being extracted, or which a
+	// pull has found on disk but not yet recorded as part of a cached image.
+	gcMu sync.RWMutex
+
+	// indexMu guards layerIndex and layerRefs. If both indexMu and mu are
+	// held, indexMu must be acquired first.
+	indexMu sync.Mutex
+	// layerIndex maps layer keys (see layerKey) to layer sizes and last
+	// access times. It is persisted to the layers dir.
+	layerIndex map[string]*layerIndexEntry
+	// layerRefs counts the number of containers using each layer. Layers in
+	// use are never evicted.
+	layerRefs map[string]int
+
+	// layerDownloadSem bounds the number of concurrent layer downloads
+	// across all pulls. It is nil if downloads are unbounded.
+	layerDownloadSem chan struct{}
+}
+
+// tagDigest is the digest that an image tag was resolved to at a given time.
+type tagDigest struct {
+	digest     ctr.Hash
+	resolvedAt time.Time
+}
+
+// layerIndexEntry records the size and last access time of an extracted
+// layer.
+type layerIndexEntry struct {
+	SizeBytes  int64     `json:"size_bytes"`
+	LastAccess time.Time `json:"last_access"`
+	// ContentDigest is the digest of the extracted layer directory (see
+	// layerContentDigest), computed when the layer was extracted. It is empty
+	// for layers extracted before content digests were recorded.
+	ContentDigest string `json:"content_digest,omitempty"`
+}
+
+// Image represents a cached image, including all layer digests and image
+// configuration.
+type Image struct {
+	// Layers holds the image layers from lowermost to uppermost.
+	Layers []*ImageLayer
+
+	// Config holds various image settings such as user and environment
+	// directives.
+	Config ctr.Config
+
+	// Digest is the digest of the image manifest, if the image was pulled
+	// from a registry.
+	Digest ctr.Hash
+}
+
+// ImageLayer represents a resolved image layer.
+type ImageLayer struct {
+	// DiffID is the uncompressed image digest.
+	DiffID ctr.Hash
+}
+
+func NewImageStore(layersDir string) *ImageStore {
+	s := &ImageStore{
+		layersDir:    layersDir,
+		cachedImages: map[string]*Image{},
+		tagDigests:   map[string]tagDigest{},
+		layerIndex:   map[string]*layerIndexEntry{},
+		layerRefs:    map[string]int{},
 	}
-	if err := os.MkdirAll(filepath.Join(path, "usr"), 0755); err != nil {
-		return err
+	if *maxConcurrentLayerDownloads > 0 {
+		s.layerDownloadSem = make(chan struct{}, *maxConcurrentLayerDownloads)
 	}
-	if err := os.Symlink("../bin", filepath.Join(path, "usr", "bin")); err != nil {
-		return err
+	if err := s.loadLayerIndex(); err != nil {
+		log.Warningf("Failed to load OCI layer index from %q; layer access times will be reset: %s", layersDir, err)
 	}
-	return nil
+	if err := s.loadImageIndex(); err != nil {
+		log.Warningf("Failed to load OCI image index from %q; images will be pulled again: %s", layersDir, err)
+	}
+	return s
 }
 
-func (c *ociContainer) createSpec(ctx context.Context, cmd *repb.Command) (*specs.Spec, error) {
-	env := append(baseEnv, commandutil.EnvStringList(cmd)...)
-	var pids *specs.LinuxPids
-	if *pidsLimit >= 0 {
-		pids = &specs.LinuxPids{Limit: *pidsLimit}
+// loadImageIndex restores the cached images persisted by saveImageIndex.
+// Images with layers which are no longer on disk are skipped.
+func (s *ImageStore) loadImageIndex() error {
+	b, err := os.ReadFile(filepath.Join(s.layersDir, imageIndexFileName))
+	if os.IsNotExist(err) {
+		return nil
 	}
-	image, _ := c.imageStore.CachedImage(c.imageRef)
-	user, err := getUser(ctx, image, c.rootfsPath(), c.user, c.forceRoot)
 	if err != nil {
-		return nil, fmt.Errorf("get container user: %w", err)
+		return err
 	}
-	spec := specs.Spec{
-		Version: ociVersion,
-		Process: &specs.Process{
-			Terminal: false,
-			User:     *user,
-			Args:     cmd.GetArguments(),
-			Cwd:      execrootPath,
-			Env:      env,
-			Rlimits: []specs.POSIXRlimit{
-				{Type: "RLIMIT_NPROC", Hard: 4194304, Soft: 4194304},
-			},
-			Capabilities: &specs.LinuxCapabilities{
-				Bounding:  capabilities,
-				Effective: capabilities,
-				Permitted: capabilities,
-			},
-			// TODO: apparmor
-			ApparmorProfile: "",
-		},
-		Root: &specs.Root{
-			Path:     c.rootfsPath(),
-			Readonly: false,
-		},
-		Hostname: c.containerName(),
-		Mounts: []specs.Mount{
-			{
-				Destination: "/proc",
-				Type:        "proc",
-				Source:      "proc",
-				Options:     []string{"nosuid", "noexec", "nodev"},
-			},
-			{
-				Destination: "/dev",
-				Type:        "tmpfs",
-				Source:      "tmpfs",
-				Options:     []string{"nosuid", "strictatime", "mode=755", "size=65536k"},
-			},
-			{
-				Destination: "/sys",
-				Type:        "sysfs",
-				Source:      "sysfs",
-				Options:     []string{"nosuid", "noexec", "nodev", "ro"},
-			},
-			{
-				Destination: "/dev/pts",
-				Type:        "devpts",
-				Source:      "devpts",
-				Options: []string{
-					"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620",
-					// TODO: gid=5 doesn't work in some circumstances.
-					// See https://github.com/containers/podman/blob/b8d95a5893572b37c8257407e964ad06ba87ade6/pkg/specgen/generate/oci_linux.go#L141-L173
-					"gid=5",
-				},
-			},
-			{
-				Destination: "/dev/mqueue",
-				Type:        "mqueue",
-				Source:      "mqueue",
-				Options:     []string{"nosuid", "noexec", "nodev"},
-			},
-			{
-				Destination: "/etc/hosts",
-				Type:        "bind",
-				Source:      filepath.Join(c.bundlePath(), "hosts"),
-				Options:     []string{"bind", "rprivate"},
-			},
-			{
-				Destination: "/dev/shm",
-				Type:        "tmpfs",
-				Source:      "shm",
-				Options:     []string{"rw", "nosuid", "nodev", "noexec", "relatime", "size=64000k", "inode64"},
-			},
-			// TODO: .containerenv
-			// {
-			// 		Destination: "/run/.containerenv",
-			// 		Type:        "bind",
-			// 		Source:      "/run/containers/storage/overlay-containers/99133d16f4f9d0678f87972c01209e308ebafc074f333822805a633620f12507/userdata/.containerenv",
-			// 		Options:     []string{"bind", "rprivate"},
-			// },
-			{
-				Destination: "/etc/hostname",
-				Type:        "bind",
-				Source:      filepath.Join(c.bundlePath(), "hostname"),
-				Options:     []string{"bind", "rprivate"},
-			},
-			{
-				Destination: "/sys/fs/cgroup",
-				Type:        "cgroup",
-				Source:      "cgroup",
-				Options:     []string{"rprivate", "nosuid", "noexec", "nodev", "relatime", "ro"},
-			},
-			{
-				Destination: execrootPath,
-				Type:        "bind",
-				Source:      c.workDir,
-				Options:     []string{"bind", "rprivate"},
-			},
-		},
-		Annotations: map[string]string{
-			// Annotate with podman's default stop signal.
-			// TODO: is this strictly needed?
-			"org.opencontainers.image.stopSignal": syscall.SIGTERM.String(),
-		},
-		Linux: &specs.Linux{
-			// TODO: set up cgroups
-			CgroupsPath: "",
-			Namespaces: []specs.LinuxNamespace{
-				{Type: specs.PIDNamespace},
-				{Type: specs.IPCNamespace},
-				{Type: specs.UTSNamespace},
-				{Type: specs.MountNamespace},
-				{Type: specs.CgroupNamespace},
-				{
-					Type: specs.NetworkNamespace,
-					Path: "/var/run/netns/" + c.network.NetNamespace(),
-				},
-			},
-			Seccomp: &seccomp,
-			Devices: []specs.LinuxDevice{},
-			Sysctl: map[string]string{
-				"net.ipv4.ping_group_range": fmt.Sprintf("%d %d", user.GID, user.GID),
-			},
-			Resources: &specs.LinuxResources{
-				Pids: pids,
-			},
-			// TODO: grok MaskedPaths and ReadonlyPaths - just copied from podman.
-			MaskedPaths: []string{
-				"/proc/acpi",
-				"/proc/kcore",
-				"/proc/keys",
-				"/proc/latency_stats",
-				"/proc/timer_list",
-				"/proc/timer_stats",
-				"/proc/sched_debug",
-				"/proc/scsi",
-				"/sys/firmware",
-				"/sys/fs/selinux",
-				"/sys/dev/block",
-			},
-			ReadonlyPaths: []string{
-				"/proc/asound",
-				"/proc/bus",
-				"/proc/fs",
-				"/proc/irq",
-				"/proc/sys",
-				"/proc/sysrq-trigger",
-			},
-		},
+	images := map[string]*Image{}
+	if err := json.Unmarshal(b, &images); err != nil {
+		return err
 	}
-	if *dns != "" {
-		spec.Mounts = append(spec.Mounts, specs.Mount{
-			Destination: "/etc/resolv.conf",
-			Type:        "bind",
-			Source:      filepath.Join(c.bundlePath(), "resolv.conf"),
-			Options:     []string{"bind", "rprivate"},
-		})
-	} else {
-		if _, err := os.Stat("/etc/resolv.conf"); err == nil {
-			spec.Mounts = append(spec.Mounts, specs.Mount{
-				Destination: "/etc/resolv.conf",
-				Type:        "bind",
-				Source:      "/etc/resolv.conf",
-				Options:     []string{"bind", "rprivate"},
-			})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, image := range images {
+		complete := true
+		for _, layer := range image.Layers {
+			if _, err := os.Stat(layerPath(s.layersDir, layer.DiffID)); err != nil {
+				complete = false
+				break
+			}
+		}
+		if complete {
+			s.cachedImages[key] = image
 		}
 	}
+	return nil
+}
 
-	return &spec, nil
+// saveImageIndex persists the cached images.
+func (s *ImageStore) saveImageIndex(ctx context.Context) {
+	s.mu.RLock()
+	b, err := json.Marshal(s.cachedImages)
+	s.mu.RUnlock()
+	if err != nil {
+		log.CtxWarningf(ctx, "Failed to save OCI image index: %s", err)
+		return
+	}
+	path := filepath.Join(s.layersDir, imageIndexFileName)
+	tmpPath := path + tmpSuffix()
+	if err := os.WriteFile(tmpPath, b, 0644); err != nil {
+		log.CtxWarningf(ctx, "Failed to save OCI image index: %s", err)
+		return
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		log.CtxWarningf(ctx, "Failed to save OCI image index: %s", err)
+	}
 }
 
-func (c *ociContainer) invokeRuntimeSimple(ctx context.Context, args ...string) error {
-	res := c.invokeRuntime(ctx, &repb.Command{}, &interfaces.Stdio{}, 0, args...)
-	return asError(res)
+// layerKey returns the path of the layer with the given diff ID, relative to
+// the layers dir.
+func layerKey(hash ctr.Hash) string {
+	return filepath.Join(hash.Algorithm, hash.Hex)
 }
 
-func asError(res *interfaces.CommandResult) error {
-	if res.Error != nil {
-		return res.Error
+// loadLayerIndex loads the persisted layer index and reconciles it with the
+// layers that are present on disk.
+func (s *ImageStore) loadLayerIndex() error {
+	persisted := map[string]*layerIndexEntry{}
+	b, err := os.ReadFile(filepath.Join(s.layersDir, layerIndexFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
 	}
-	if res.ExitCode != 0 {
-		if len(res.Stderr) > 0 {
-			return fmt.Errorf("%s", strings.TrimSpace(string(res.Stderr)))
-		} else if len(res.Stdout) > 0 {
-			return fmt.Errorf("%s", strings.TrimSpace(string(res.Stdout)))
+	if err == nil {
+		if err := json.Unmarshal(b, &persisted); err != nil {
+			return err
 		}
-		return fmt.Errorf("exit code %d", res.ExitCode)
+	}
+	layers, _, err := s.listLayerDirs()
+	if err != nil {
+		return err
+	}
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	// Entries for layers which no longer exist on disk are dropped. Layers
+	// missing from the index (e.g. extracted before the index existed) are
+	// added using their mtime as an approximate access time.
+	for _, l := range layers {
+		key, err := filepath.Rel(s.layersDir, l.path)
+		if err != nil {
+			return err
+		}
+		if e, ok := persisted[key]; ok {
+			s.layerIndex[key] = e
+			continue
+		}
+		size, err := disk.DirSize(l.path)
+		if err != nil {
+			return err
+		}
+		s.layerIndex[key] = &layerIndexEntry{SizeBytes: size, LastAccess: l.modTime}
 	}
 	return nil
 }
 
-func (c *ociContainer) invokeRuntime(ctx context.Context, command *repb.Command, stdio *interfaces.Stdio, waitDelay time.Duration, args ...string) *interfaces.CommandResult {
-	start := time.Now()
-	defer func() {
-		// TODO: better profiling/tracing
-		log.CtxDebugf(ctx, "[%s] %s %s\n", time.Since(start), c.runtime, args[0])
-	}()
-
-	globalArgs := []string{
-		// "strace", "-o", "/tmp/strace.log",
-		c.runtime,
-		"--log-format=json",
+// saveLayerIndexLocked persists the layer index. indexMu must be held.
+func (s *ImageStore) saveLayerIndexLocked() error {
+	b, err := json.Marshal(s.layerIndex)
+	if err != nil {
+		return err
 	}
-	runtimeName := filepath.Base(c.runtime)
-	if runtimeName == "crun" {
-		globalArgs = append(globalArgs, "--cgroup-manager=cgroupfs")
+	path := filepath.Join(s.layersDir, layerIndexFileName)
+	tmpPath := path + tmpSuffix()
+	if err := os.WriteFile(tmpPath, b, 0644); err != nil {
+		return err
 	}
-	if *runtimeRoot != "" {
-		globalArgs = append(globalArgs, "--root="+*runtimeRoot)
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
 	}
+	return nil
+}
 
-	runtimeArgs := append(globalArgs, args...)
-	runtimeArgs = append(runtimeArgs, command.GetArguments()...)
-
-	// working dir for crun itself doesn't really matter - just default to cwd.
-	wd, err := os.Getwd()
-	if err != nil {
-		return commandutil.ErrorResult(status.UnavailableErrorf("getwd: %s", err))
+func (s *ImageStore) saveLayerIndex(ctx context.Context) {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	if err := s.saveLayerIndexLocked(); err != nil {
+		log.CtxWarningf(ctx, "Failed to save OCI layer index: %s", err)
 	}
+}
 
-	log.CtxDebugf(ctx, "Running %v", runtimeArgs)
-
-	cmd := exec.CommandContext(ctx, runtimeArgs[0], runtimeArgs[1:]...)
-	cmd.Dir = wd
-	var stdout *bytes.Buffer
-	var stderr *bytes.Buffer
-	// If stdio is nil, the output will be discarded.
-	if stdio != nil {
-		cmd.Stdin = stdio.Stdin
-		if stdio.Stdout == nil {
-			stdout = &bytes.Buffer{}
-			cmd.Stdout = stdout
-		} else {
-			stdout = nil
-			cmd.Stdout = stdio.Stdout
-		}
-		if stdio.Stderr == nil {
-			stderr = &bytes.Buffer{}
-			cmd.Stderr = stderr
-		} else {
-			stderr = nil
-			cmd.Stderr = stdio.Stderr
+// touchLayer records an access to the given extracted layer, adding it to the
+// layer index if needed. If contentDigest is non-empty, it is recorded as the
+// layer's content digest.
+func (s *ImageStore) touchLayer(ctx context.Context, hash ctr.Hash, contentDigest string) {
+	key := layerKey(hash)
+	s.indexMu.Lock()
+	if e, ok := s.layerIndex[key]; ok {
+		e.LastAccess = time.Now()
+		if contentDigest != "" {
+			e.ContentDigest = contentDigest
 		}
+		s.indexMu.Unlock()
+		return
 	}
-	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-	// In the "run" case, start the runtime in its own pid namespace so that
-	// when it is killed, the container process gets killed automatically
-	// instead of getting reparented and continuing to execute.
-	// TODO: figure out why this is only needed for run and not exec.
-	if args[0] == "run" {
-		cmd.SysProcAttr.Cloneflags = syscall.CLONE_NEWPID
+	s.indexMu.Unlock()
+
+	size, err := disk.DirSize(filepath.Join(s.layersDir, key))
+	if err != nil {
+		log.CtxWarningf(ctx, "Failed to compute size of layer %s: %s", key, err)
+		return
 	}
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	s.layerIndex[key] = &layerIndexEntry{SizeBytes: size, LastAccess: time.Now(), ContentDigest: contentDigest}
+}
 
-	cmd.WaitDelay = waitDelay
-	runError := cmd.Run()
-	if errors.Is(runError, exec.ErrWaitDelay) {
-		// The stdio streams were forcibly closed after a non-zero waitDelay. Any error from the
-		// process takes precedence over ErrWaitDelay, so we can ignore the error here without
-		// a risk of shadowing a more important error.
-		runError = nil
+// layerSize returns the recorded size of the given extracted layer, or 0 if
+// its size is unknown.
+func (s *ImageStore) layerSize(hash ctr.Hash) int64 {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	if e, ok := s.layerIndex[layerKey(hash)]; ok {
+		return e.SizeBytes
 	}
-	code, err := commandutil.ExitCode(ctx, cmd, runError)
-	result := &interfaces.CommandResult{
-		ExitCode: code,
-		Error:    err,
+	return 0
+}
+
+// verifyCachedLayer checks the contents of the given extracted layer against
+// the content digest recorded when it was extracted. Layers without a
+// recorded content digest are assumed to be valid.
+func (s *ImageStore) verifyCachedLayer(hash ctr.Hash) error {
+	key := layerKey(hash)
+	s.indexMu.Lock()
+	var expected string
+	if e, ok := s.layerIndex[key]; ok {
+		expected = e.ContentDigest
 	}
-	if stdout != nil {
-		result.Stdout = stdout.Bytes()
+	s.indexMu.Unlock()
+	if expected == "" {
+		return nil
 	}
-	if stderr != nil {
-		result.Stderr = stderr.Bytes()
+	actual, err := layerContentDigest(filepath.Join(s.layersDir, key))
+	if err != nil {
+		return status.UnavailableErrorf("compute layer content digest: %s", err)
 	}
-	return result
+	if actual != expected {
+		return status.DataLossErrorf("layer %s content digest %s does not match expected digest %s", key, actual, expected)
+	}
+	return nil
 }
 
-func getUser(ctx context.Context, image *Image, rootfsPath string, dockerUserProp string, dockerForceRootProp bool) (*specs.User, error) {
-	// TODO: for rootless support we'll need to handle the case where the
-	// executor user doesn't have permissions to access files created as the
-	// requested user ID
-	spec := ""
-	if image != nil {
-		spec = image.Config.User
+// acquireImage returns the cached image for the given image name and platform
+// and marks its layers as in use, so that they are not evicted until
+// releaseImage is called.
+func (s *ImageStore) acquireImage(imageName string, platform *rgpb.Platform) (*Image, bool) {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	image, ok := s.CachedImage(imageName, platform)
+	if !ok {
+		return nil, false
 	}
-	if dockerUserProp != "" {
-		spec = dockerUserProp
+	now := time.Now()
+	for _, layer := range image.Layers {
+		key := layerKey(layer.DiffID)
+		s.layerRefs[key]++
+		if e, ok := s.layerIndex[key]; ok {
+			e.LastAccess = now
+		}
 	}
-	if dockerForceRootProp {
-		spec = "0"
+	return image, true
+}
+
+// releaseImage marks the layers of an image returned by acquireImage as no
+// longer in use.
+func (s *ImageStore) releaseImage(ctx context.Context, image *Image) {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	for _, layer := range image.Layers {
+		key := layerKey(layer.DiffID)
+		s.layerRefs[key]--
+		if s.layerRefs[key] <= 0 {
+			delete(s.layerRefs, key)
+		}
 	}
-	if spec == "" {
-		// Inherit the current uid/gid.
-		spec = fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
+	if err := s.saveLayerIndexLocked(); err != nil {
+		log.CtxWarningf(ctx, "Failed to save OCI layer index: %s", err)
 	}
+}
 
-	user, group, err := container.ParseUserGroup(spec)
-	if err != nil {
-		return nil, fmt.Errorf(`invalid "USER[:GROUP]" spec %q`, spec)
+// evictLayers deletes least recently used layers until the total size of the
+// layer cache is within --executor.oci.layer_cache_max_size_bytes. Layers in
+// use by containers and layers of the given image are never evicted. Cached
+// images referencing evicted layers are removed from the cache.
+func (s *ImageStore) evictLayers(ctx context.Context, keep *Image) {
+	if *layerCacheMaxSizeBytes <= 0 {
+		return
 	}
+	// Don't evict layers while pulls are in progress, since they may have
+	// found layers on disk without yet recording them as part of an image.
+	s.gcMu.Lock()
+	defer s.gcMu.Unlock()
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
 
-	var uid, gid uint32
-	username := user.Name
-
-	// If the user is non-numeric then we need to look it up from /etc/passwd.
-	// If no gid is specified then we need to find the user entry in /etc/passwd
-	// to know what group they are in.
-	if user.Name != "" || group == nil {
-		userRecord, err := unixcred.LookupUser(filepath.Join(rootfsPath, "/etc/passwd"), user)
-		if (err == unixcred.ErrUserNotFound || os.IsNotExist(err)) && user.Name == "" {
-			// If no user was found in /etc/passwd and we specified only a
-			// numeric user ID then just set the group ID to 0 (root). This is
-			// what docker/podman do, presumably because it's usually safe to
-			// assume that gid 0 exists.
-			uid = user.ID
-			gid = 0
-		} else if err != nil {
-			return nil, fmt.Errorf("lookup user %q in /etc/passwd: %w", user, err)
-		} else {
-			uid = userRecord.UID
-			username = userRecord.Username
-			if group == nil {
-				gid = userRecord.GID
-			}
+	var total int64
+	keys := make([]string, 0, len(s.layerIndex))
+	for key, e := range s.layerIndex {
+		total += e.SizeBytes
+		keys = append(keys, key)
+	}
+	if total <= *layerCacheMaxSizeBytes {
+		return
+	}
+	keepKeys := map[string]bool{}
+	for _, layer := range keep.Layers {
+		keepKeys[layerKey(layer.DiffID)] = true
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		return s.layerIndex[a].LastAccess.Compare(s.layerIndex[b].LastAccess)
+	})
+	evicted := map[string]bool{}
+	for _, key := range keys {
+		if total <= *layerCacheMaxSizeBytes {
+			break
 		}
-	} else {
-		uid = user.ID
+		if keepKeys[key] || s.layerRefs[key] > 0 {
+			continue
+		}
+		if err := disk.ForceRemove(ctx, filepath.Join(s.layersDir, key)); err != nil {
+			log.CtxWarningf(ctx, "Failed to evict layer %s: %s", key, err)
+			continue
+		}
+		total -= s.layerIndex[key].SizeBytes
+		delete(s.layerIndex, key)
+		evicted[key] = true
 	}
+	if len(evicted) == 0 {
+		return
+	}
+	log.CtxInfof(ctx, "Evicted %d layers from the OCI layer cache; %d bytes remaining", len(evicted), total)
 
-	if group != nil {
-		// If a group was specified by name then look it up from /etc/group.
-		if group.Name != "" {
-			groupRecord, err := unixcred.LookupGroup(filepath.Join(rootfsPath, "/etc/group"), user)
-			if err != nil {
-				return nil, fmt.Errorf("lookup group %q in /etc/group: %w", group, err)
+	s.mu.Lock()
+	for cacheKey, image := range s.cachedImages {
+		for _, layer := range image.Layers {
+			if evicted[layerKey(layer.DiffID)] {
+				delete(s.cachedImages, cacheKey)
+				break
 			}
-			gid = groupRecord.GID
-		} else {
-			gid = group.ID
 		}
 	}
+	s.mu.Unlock()
+}
 
-	gids := []uint32{gid}
+// LayerStatus describes the state of a single layer during an image pull.
+type LayerStatus int
 
-	// If no group is explicitly specified and we have a username, then
-	// search /etc/group for additional groups that the user might be in
-	// (/etc/group lists members by username, not by uid).
-	if group == nil && username != "" {
-		groups, err := unixcred.GetGroupsWithUser(filepath.Join(rootfsPath, "/etc/group"), username)
-		if err != nil && !os.IsNotExist(err) {
-			return nil, fmt.Errorf("lookup groups with user %q in /etc/passwd: %w", username, err)
-		}
-		for _, g := range groups {
-			gids = append(gids, g.GID)
-		}
-	}
-	slices.Sort(gids)
-	gids = slices.Compact(gids)
+const (
+	// LayerPending means the layer has not started downloading yet.
+	LayerPending LayerStatus = iota
+	// LayerDownloading means the layer is being downloaded and extracted.
+	LayerDownloading
+	// LayerCached means the layer was already present locally and did not
+	// need to be downloaded.
+	LayerCached
+	// LayerDone means the layer was downloaded and extracted successfully.
+	LayerDone
+)
 
-	return &specs.User{
-		UID:            uid,
-		GID:            gid,
-		AdditionalGids: gids,
-		Umask:          pointer(uint32(022)), // 0644 file perms by default
-	}, nil
+// LayerProgress is the download progress of a single image layer.
+type LayerProgress struct {
+	// Digest is the compressed layer digest.
+	Digest string
+	// Status is the current layer status.
+	Status LayerStatus
+	// BytesDownloaded is the number of compressed bytes downloaded so far.
+	BytesDownloaded int64
+	// BytesTotal is the compressed layer size.
+	BytesTotal int64
+	// ExtractedBytes is the size of the extracted (decompressed) layer on
+	// disk. It is only set once the layer is cached or done.
+	ExtractedBytes int64
+	// DownloadDuration is the time taken to download and extract the layer,
+	// including time spent waiting for a download slot or for a concurrent
+	// pull of the same layer. It is only set once the layer is done, and is
+	// always zero for cached layers.
+	DownloadDuration time.Duration
 }
 
-func pointer[T any](val T) *T {
-	return &val
+// PullProgress is a snapshot of the progress of an image pull.
+type PullProgress struct {
+	// BytesDownloaded is the number of compressed bytes downloaded so far,
+	// summed across all layers.
+	BytesDownloaded int64
+	// BytesTotal is the compressed size of all layers that need to be
+	// downloaded. Cached layers are not included.
+	BytesTotal int64
+	// Layers holds the progress of each layer, from lowermost to uppermost.
+	Layers []LayerProgress
+	// Done is set in the final update, which is sent once all layers have
+	// been pulled successfully.
+	Done bool
 }
 
-func newCID() (string, error) {
-	var b [32]byte
-	if _, err := rand.Read(b[:]); err != nil {
-		return "", err
-	}
-	return fmt.Sprintf("%x", b), nil
+// PullProgressFunc receives progress updates during an image pull. Updates
+// are throttled, and the func is never called concurrently for the same pull.
+// The PullProgress is only valid for the duration of the call.
+type PullProgressFunc func(p *PullProgress)
+
+// pullProgressTracker accumulates layer download progress and reports it to a
+// PullProgressFunc at most once per pullProgressInterval, plus once whenever
+// a layer changes status. A nil tracker ignores all updates.
+type pullProgressTracker struct {
+	fn PullProgressFunc
+
+	mu         sync.Mutex
+	progress   PullProgress
+	lastReport time.Time
+	// Times at which each layer started downloading.
+	startTimes []time.Time
 }
 
-// layerPath returns the path where the extracted image layer with the given
-// hash is stored on disk.
-func layerPath(layersDir string, hash ctr.Hash) string {
-	return filepath.Join(layersDir, hash.Algorithm, hash.Hex)
+func newPullProgressTracker(fn PullProgressFunc, numLayers int) *pullProgressTracker {
+	if fn == nil {
+		return nil
+	}
+	return &pullProgressTracker{
+		fn:         fn,
+		progress:   PullProgress{Layers: make([]LayerProgress, numLayers)},
+		startTimes: make([]time.Time, numLayers),
+	}
 }
 
-// ImageStore handles image layer storage for OCI containers.
-type ImageStore struct {
-	layersDir      string
-	imagePullGroup singleflight.Group[string, *Image]
-	layerPullGroup singleflight.Group[string, any]
+// setStatus updates the status of a layer. extractedBytes is the size of the
+// extracted layer, and is only used for cached and done layers.
+func (t *pullProgressTracker) setStatus(layerIndex int, digest string, size int64, status LayerStatus, extractedBytes int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l := &t.progress.Layers[layerIndex]
+	l.Digest = digest
+	if l.BytesTotal == 0 && status != LayerCached {
+		t.progress.BytesTotal += size
+	}
+	l.BytesTotal = size
+	switch status {
+	case LayerDownloading:
+		t.startTimes[layerIndex] = time.Now()
+	case LayerCached:
+		l.ExtractedBytes = extractedBytes
+	case LayerDone:
+		// The layer download may have been deduped with a concurrent pull,
+		// in which case we never observed the bytes being read.
+		t.progress.BytesDownloaded += size - l.BytesDownloaded
+		l.BytesDownloaded = size
+		l.ExtractedBytes = extractedBytes
+		l.DownloadDuration = time.Since(t.startTimes[layerIndex])
+	}
+	l.Status = status
+	t.report()
+}
 
-	mu           sync.RWMutex
-	cachedImages map[string]*Image
+// done sends the final progress update.
+func (t *pullProgressTracker) done() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.progress.Done = true
+	t.report()
 }
 
-// Image represents a cached image, including all layer digests and image
-// configuration.
-type Image struct {
-	// Layers holds the image layers from lowermost to uppermost.
-	Layers []*ImageLayer
+func (t *pullProgressTracker) addBytes(layerIndex int, n int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.progress.Layers[layerIndex].BytesDownloaded += n
+	t.progress.BytesDownloaded += n
+	if time.Since(t.lastReport) >= pullProgressInterval {
+		t.report()
+	}
+}
 
-	// Config holds various image settings such as user and environment
-	// directives.
-	Config ctr.Config
+// report invokes the progress func. It must be called with mu held.
+func (t *pullProgressTracker) report() {
+	t.lastReport = time.Now()
+	t.fn(&t.progress)
 }
 
-// ImageLayer represents a resolved image layer.
-type ImageLayer struct {
-	// DiffID is the uncompressed image digest.
-	DiffID ctr.Hash
+// progressReader counts bytes read from a layer and reports them to a
+// pullProgressTracker.
+type progressReader struct {
+	io.Reader
+	tracker    *pullProgressTracker
+	layerIndex int
 }
 
-func NewImageStore(layersDir string) *ImageStore {
-	return &ImageStore{
-		layersDir:    layersDir,
-		cachedImages: map[string]*Image{},
-	}
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.tracker.addBytes(r.layerIndex, int64(n))
+	return n, err
 }
 
 // Pull downloads and extracts image layers to a directory, skipping layers
@@ -1016,27 +4971,52 @@ func NewImageStore(layersDir string) *ImageStore {
 // Pull always re-authenticates the credentials with the image registry.
 // Each layer is extracted to a subdirectory given by {algorithm}/{hash}, e.g.
 // "sha256/abc123".
-func (s *ImageStore) Pull(ctx context.Context, imageName string, creds oci.Credentials) (*Image, error) {
-	key := hash.Strings(imageName, creds.Username, creds.Password)
+//
+// If progress is non-nil, it receives periodic progress updates. If the pull
+// is deduped with a concurrent pull of the same image, only the progress func
+// passed to the first caller is invoked.
+func (s *ImageStore) Pull(ctx context.Context, imageName string, platform *rgpb.Platform, creds oci.Credentials, progress PullProgressFunc) (*Image, error) {
+	key := hash.Strings(imageName, platformString(platform), creds.Username, creds.Password)
 	image, _, err := s.imagePullGroup.Do(ctx, key, func(ctx context.Context) (*Image, error) {
-		image, err := s.pull(ctx, imageName, creds)
+		s.gcMu.RLock()
+		defer s.gcMu.RUnlock()
+
+		image, err := s.pullWithRetry(ctx, imageName, platform, creds, progress)
 		if err != nil {
 			return nil, err
 		}
 
 		s.mu.Lock()
-		s.cachedImages[imageName] = image
+		s.cachedImages[imageCacheKey(imageName, platform)] = image
+		// Also cache the image by digest, so that containers which have
+		// pinned the digest can find it after the tag moves.
+		if digestRef, err := digestImageRef(imageName, image.Digest); err == nil {
+			s.cachedImages[imageCacheKey(digestRef, platform)] = image
+		}
 		s.mu.Unlock()
 
 		return image, nil
 	})
-	return image, err
+	if err != nil {
+		// The pull group returns as soon as the context is done, while the
+		// pull itself is canceled and cleans up in the background once no
+		// callers are waiting for it.
+		if ctx.Err() != nil {
+			return nil, pullError(status.FromContextError(ctx))
+		}
+		return nil, err
+	}
+	s.evictLayers(ctx, image)
+	s.saveLayerIndex(ctx)
+	s.saveImageIndex(ctx)
+	return image, nil
 }
 
 // CachedLayers returns references to the cached image layers if the image
-// has been pulled. The second return value indicates whether the image has
-// been pulled - if false, the returned slice of layers will be nil.
-func (s *ImageStore) CachedImage(imageName string) (image *Image, ok bool) {
+// has been pulled for the given platform. The second return value indicates
+// whether the image has been pulled - if false, the returned slice of layers
+// will be nil.
+func (s *ImageStore) CachedImage(imageName string, platform *rgpb.Platform) (image *Image, ok bool) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -1046,107 +5026,693 @@ func (s *ImageStore) CachedImage(imageName string) (image *Image, ok bool) {
 		return &Image{}, true
 	}
 
-	image, ok = s.cachedImages[imageName]
-	return image, ok
+	image, ok = s.cachedImages[imageCacheKey(imageName, platform)]
+	return image, ok
+}
+
+// recentTagDigest returns the digest that the given image tag was resolved to,
+// if it was resolved within --executor.oci.image_tag_check_interval.
+func (s *ImageStore) recentTagDigest(imageName string, platform *rgpb.Platform) (ctr.Hash, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	d, ok := s.tagDigests[imageCacheKey(imageName, platform)]
+	if !ok || time.Since(d.resolvedAt) >= *tagCheckInterval {
+		return ctr.Hash{}, false
+	}
+	return d.digest, true
+}
+
+// recordTagDigest records that the given image tag was just resolved to the
+// given digest.
+func (s *ImageStore) recordTagDigest(imageName string, platform *rgpb.Platform, digest ctr.Hash) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tagDigests[imageCacheKey(imageName, platform)] = tagDigest{digest: digest, resolvedAt: time.Now()}
+}
+
+// Import extracts the layer tarball at the given path, which may be gzipped,
+// and caches a single-layer image with an empty config under the given image
+// name and platform.
+func (s *ImageStore) Import(ctx context.Context, tarPath string, imageName string, platform *rgpb.Platform) (*Image, error) {
+	image, _, err := s.imagePullGroup.Do(ctx, imageCacheKey(imageName, platform), func(ctx context.Context) (*Image, error) {
+		s.gcMu.RLock()
+		defer s.gcMu.RUnlock()
+
+		// The tarball is read twice: once to compute the diff ID, which
+		// determines the layer path, and once to extract it.
+		h := sha256.New()
+		if err := readLayerTarball(tarPath, func(r io.Reader, compressed bool) error {
+			if compressed {
+				zr, err := gzip.NewReader(r)
+				if err != nil {
+					return err
+				}
+				defer zr.Close()
+				r = zr
+			}
+			_, err := io.Copy(h, r)
+			return err
+		}); err != nil {
+			return nil, status.UnavailableErrorf("compute layer digest: %s", err)
+		}
+		diffID := ctr.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(h.Sum(nil))}
+
+		destDir := layerPath(s.layersDir, diffID)
+		contentDigest := ""
+		if _, err := os.Stat(destDir); err != nil {
+			if !os.IsNotExist(err) {
+				return nil, status.UnavailableErrorf("stat layer directory: %s", err)
+			}
+			if err := readLayerTarball(tarPath, func(r io.Reader, compressed bool) error {
+				var err error
+				contentDigest, err = extractLayer(ctx, r, destDir, compressed, layerDigests{DiffID: diffID})
+				return err
+			}); err != nil {
+				return nil, status.WrapError(err, "extract layer")
+			}
+		}
+		s.touchLayer(ctx, diffID, contentDigest)
+
+		image := &Image{Layers: []*ImageLayer{{DiffID: diffID}}}
+		s.mu.Lock()
+		s.cachedImages[imageCacheKey(imageName, platform)] = image
+		s.mu.Unlock()
+		return image, nil
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, status.FromContextError(ctx)
+		}
+		return nil, err
+	}
+	s.evictLayers(ctx, image)
+	s.saveLayerIndex(ctx)
+	s.saveImageIndex(ctx)
+	return image, nil
+}
+
+// readLayerTarball opens the tarball at the given path and calls fn with its
+// contents and whether it is gzip-compressed.
+func readLayerTarball(path string, fn func(r io.Reader, compressed bool) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	return fn(br, bytes.Equal(magic, []byte{0x1f, 0x8b}))
+}
+
+// Commit creates a new layer from the given overlayfs upperdir and caches an
+// image consisting of the base image's layers plus the new layer under the
+// given image name and platform. The base image config is kept as-is.
+func (s *ImageStore) Commit(ctx context.Context, base *Image, upperDir string, imageName string, platform *rgpb.Platform) (*Image, error) {
+	s.gcMu.RLock()
+	defer s.gcMu.RUnlock()
+
+	// The diff ID is the digest of the uncompressed layer tarball, so compute
+	// it up front in order to determine the layer path.
+	h := sha256.New()
+	if err := writeLayerTar(h, upperDir); err != nil {
+		return nil, status.UnavailableErrorf("compute layer digest: %s", err)
+	}
+	diffID := ctr.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(h.Sum(nil))}
+
+	destDir := layerPath(s.layersDir, diffID)
+	contentDigest := ""
+	if _, err := os.Stat(destDir); err != nil {
+		if !os.IsNotExist(err) {
+			return nil, status.UnavailableErrorf("stat layer directory: %s", err)
+		}
+		// Extract the layer from a tarball rather than copying the upperdir
+		// directly, so that committed layers have exactly the same format as
+		// pulled layers.
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(writeLayerTar(pw, upperDir))
+		}()
+		var err error
+		contentDigest, err = extractLayer(ctx, pr, destDir, false /*=compressed*/, layerDigests{DiffID: diffID})
+		pr.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.touchLayer(ctx, diffID, contentDigest)
+
+	image := &Image{
+		Layers: append(slices.Clone(base.Layers), &ImageLayer{DiffID: diffID}),
+		Config: base.Config,
+	}
+	s.mu.Lock()
+	s.cachedImages[imageCacheKey(imageName, platform)] = image
+	s.mu.Unlock()
+	s.saveLayerIndex(ctx)
+	s.saveImageIndex(ctx)
+	return image, nil
+}
+
+// GC deletes extracted layers which are not referenced by any cached image,
+// once the total size of all extracted layers exceeds
+// --executor.oci.layer_gc_high_watermark_bytes. Unreferenced layers are deleted
+// in order of least recent modification until the total size is at or below
+// --executor.oci.layer_gc_low_watermark_bytes. Temporary directories left
+// behind by interrupted layer extractions are always deleted.
+//
+// GC blocks until any in-progress pulls have completed, and new pulls are
+// blocked until GC completes. It returns the number of bytes reclaimed.
+func (s *ImageStore) GC(ctx context.Context) (int64, error) {
+	s.gcMu.Lock()
+	defer s.gcMu.Unlock()
+
+	start := time.Now()
+	layers, tmpDirs, err := s.listLayerDirs()
+	if err != nil {
+		return 0, status.UnavailableErrorf("list layers: %s", err)
+	}
+
+	var reclaimed int64
+	// Since no pulls are in progress, any temp dirs are from extractions
+	// that were interrupted (e.g. by an executor restart).
+	for _, dir := range tmpDirs {
+		size, err := disk.DirSize(dir)
+		if err != nil {
+			return reclaimed, status.UnavailableErrorf("get temp layer dir size: %s", err)
+		}
+		if err := disk.ForceRemove(ctx, dir); err != nil {
+			return reclaimed, status.UnavailableErrorf("remove temp layer dir: %s", err)
+		}
+		reclaimed += size
+	}
+
+	var total int64
+	for _, l := range layers {
+		size, err := disk.DirSize(l.path)
+		if err != nil {
+			return reclaimed, status.UnavailableErrorf("get layer dir size: %s", err)
+		}
+		l.size = size
+		total += l.size
+	}
+	if total <= *layerGCHighWatermarkBytes {
+		return reclaimed, nil
+	}
+
+	referenced := map[string]bool{}
+	s.mu.RLock()
+	for _, image := range s.cachedImages {
+		for _, layer := range image.Layers {
+			referenced[layerPath(s.layersDir, layer.DiffID)] = true
+		}
+	}
+	s.mu.RUnlock()
+
+	slices.SortFunc(layers, func(a, b *layerDir) int {
+		return a.modTime.Compare(b.modTime)
+	})
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	deleted := 0
+	for _, l := range layers {
+		if total <= *layerGCLowWatermarkBytes {
+			break
+		}
+		key, err := filepath.Rel(s.layersDir, l.path)
+		if err != nil {
+			return reclaimed, status.InternalErrorf("get layer key: %s", err)
+		}
+		if referenced[l.path] || s.layerRefs[key] > 0 {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return reclaimed, status.FromContextError(ctx)
+		}
+		if err := disk.ForceRemove(ctx, l.path); err != nil {
+			return reclaimed, status.UnavailableErrorf("remove layer: %s", err)
+		}
+		delete(s.layerIndex, key)
+		total -= l.size
+		reclaimed += l.size
+		deleted++
+	}
+	if err := s.saveLayerIndexLocked(); err != nil {
+		log.CtxWarningf(ctx, "Failed to save OCI layer index: %s", err)
+	}
+	log.CtxInfof(ctx, "Layer GC deleted %d layers (%d bytes) in %s; %d bytes remaining", deleted, reclaimed, time.Since(start), total)
+	return reclaimed, nil
+}
+
+// layerDir is an extracted layer directory on disk.
+type layerDir struct {
+	path    string
+	modTime time.Time
+
+	// size is the total size of the layer dir. It is only populated by GC.
+	size int64
+}
+
+// listLayerDirs returns the extracted layer directories in the layers dir,
+// as well as any temporary extraction directories.
+func (s *ImageStore) listLayerDirs() (layers []*layerDir, tmpDirs []string, err error) {
+	algorithmEntries, err := os.ReadDir(s.layersDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, algorithmEntry := range algorithmEntries {
+		if !algorithmEntry.IsDir() {
+			continue
+		}
+		algorithmDir := filepath.Join(s.layersDir, algorithmEntry.Name())
+		entries, err := os.ReadDir(algorithmDir)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			path := filepath.Join(algorithmDir, entry.Name())
+			if strings.HasSuffix(entry.Name(), ".tmp") {
+				tmpDirs = append(tmpDirs, path)
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return nil, nil, err
+			}
+			layers = append(layers, &layerDir{path: path, modTime: info.ModTime()})
+		}
+	}
+	return layers, tmpDirs, nil
+}
+
+// digestImageRef returns a ref to the image with the given digest in the same
+// repository as the given image ref.
+func digestImageRef(imageName string, digest ctr.Hash) (string, error) {
+	ref, err := ctrname.ParseReference(imageName)
+	if err != nil {
+		return "", status.InvalidArgumentErrorf("invalid image %q", imageName)
+	}
+	return ref.Context().Digest(digest.String()).String(), nil
+}
+
+// isDigestRef returns whether the given image ref refers to an image by
+// digest rather than by tag.
+func isDigestRef(imageName string) bool {
+	ref, err := ctrname.ParseReference(imageName)
+	if err != nil {
+		return false
+	}
+	_, ok := ref.(ctrname.Digest)
+	return ok
+}
+
+func imageCacheKey(imageName string, platform *rgpb.Platform) string {
+	return imageName + "|" + platformString(platform)
+}
+
+func platformString(p *rgpb.Platform) string {
+	s := p.GetOs() + "/" + p.GetArch()
+	if p.GetVariant() != "" {
+		s += "/" + p.GetVariant()
+	}
+	return s
+}
+
+// pullWithRetry calls pull, retrying transient failures with exponential
+// backoff.
+func (s *ImageStore) pullWithRetry(ctx context.Context, imageName string, platform *rgpb.Platform, creds oci.Credentials, progress PullProgressFunc) (*Image, error) {
+	start := time.Now()
+	r := retry.New(ctx, &retry.Options{
+		InitialBackoff: 1 * time.Second,
+		MaxBackoff:     30 * time.Second,
+		Multiplier:     2,
+		MaxRetries:     max(0, *pullMaxAttempts-1),
+	})
+	var lastErr error
+	for r.Next() {
+		image, err := s.pull(ctx, imageName, platform, creds, progress)
+		if err == nil {
+			return image, nil
+		}
+		lastErr = err
+		if !isRetryablePullError(ctx, err) {
+			return nil, err
+		}
+		if time.Since(start) >= *pullRetryMaxElapsedTime {
+			break
+		}
+		log.CtxWarningf(ctx, "Pull attempt %d of %d for %q failed: %s", r.AttemptNumber(), *pullMaxAttempts, imageName, err)
+	}
+	if lastErr == nil {
+		// The context was done before the first attempt.
+		return nil, status.FromContextError(ctx)
+	}
+	return nil, lastErr
+}
+
+// isRetryablePullError returns whether the given pull error is likely
+// transient. Authentication failures, missing images, and invalid image
+// references are not retried.
+func isRetryablePullError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	return status.IsUnavailableError(err) || status.IsResourceExhaustedError(err)
+}
+
+// layerExtractionLimit returns the maximum number of layers of a single image
+// to download and extract concurrently.
+func layerExtractionLimit() int {
+	if *layerExtractionParallelism > 0 {
+		return *layerExtractionParallelism
+	}
+	return min(8, runtime.NumCPU())
 }
 
-func (s *ImageStore) pull(ctx context.Context, imageName string, creds oci.Credentials) (*Image, error) {
-	img, err := oci.Resolve(ctx, imageName, oci.RuntimePlatform(), creds)
+func (s *ImageStore) pull(ctx context.Context, imageName string, platform *rgpb.Platform, creds oci.Credentials, progress PullProgressFunc) (*Image, error) {
+	// If signature verification is enabled, pull the verified image by
+	// digest so that a tag moved after verification can't be pulled instead.
+	verifiedRef, err := oci.VerifiedImageRef(ctx, imageName, creds)
+	if err != nil {
+		return nil, status.WrapError(pullError(err), "verify image signature")
+	}
+	img, err := oci.Resolve(ctx, verifiedRef, platform, creds)
 	if err != nil {
-		return nil, status.WrapError(err, "resolve image")
+		return nil, status.WrapError(pullError(err), "resolve image")
 	}
 	layers, err := img.Layers()
 	if err != nil {
 		return nil, status.UnavailableErrorf("get image layers: %s", err)
 	}
 
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, status.UnavailableErrorf("get image digest: %s", err)
+	}
+	// Parse the config file ourselves rather than using img.ConfigFile(),
+	// which doesn't accept shell-form ENTRYPOINT and CMD values. This means
+	// layer diff IDs have to be taken from the config file too, since
+	// layer.DiffID() also parses the config file using img.ConfigFile().
+	rawConfig, err := img.RawConfigFile()
+	if err != nil {
+		return nil, status.UnavailableErrorf("get image config file: %s", err)
+	}
+	configFile, err := parseImageConfigFile(rawConfig)
+	if err != nil {
+		return nil, err
+	}
+	if len(configFile.RootFS.DiffIDs) != len(layers) {
+		return nil, status.InvalidArgumentErrorf("image config has %d diff IDs, but the image has %d layers", len(configFile.RootFS.DiffIDs), len(layers))
+	}
 	resolvedImage := &Image{
 		Layers: make([]*ImageLayer, 0, len(layers)),
+		Config: configFile.Config,
+		Digest: digest,
 	}
+	tracker := newPullProgressTracker(progress, len(layers))
 
-	// Download and extract layers concurrently.
-	var eg errgroup.Group
-	eg.SetLimit(min(8, runtime.NumCPU()))
-	for _, layer := range layers {
-		layer := layer
+	// Download and extract layers concurrently. Layers don't need to be
+	// applied in order: each layer is extracted into its own directory, with
+	// OCI whiteouts converted to overlayfs whiteouts rather than applied to
+	// lower layers, and overlayfs resolves them by layer order when the
+	// rootfs is mounted.
+	// If any layer fails, cancel the rest rather than waiting for them.
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.SetLimit(layerExtractionLimit())
+	for i, layer := range layers {
+		i, layer := i, layer
 		resolvedLayer := &ImageLayer{}
 		resolvedImage.Layers = append(resolvedImage.Layers, resolvedLayer)
 		eg.Go(func() error {
-			d, err := layer.DiffID()
-			if err != nil {
-				return status.UnavailableErrorf("get layer digest: %s", err)
+			// Don't start layers that are waiting for a slot after the
+			// pull has been canceled.
+			if ctx.Err() != nil {
+				return status.FromContextError(ctx)
 			}
+			d := configFile.RootFS.DiffIDs[i]
 			resolvedLayer.DiffID = d
 
 			destDir := layerPath(s.layersDir, d)
 
-			// If the destination directory already exists then we can skip
-			// the download.
-			if _, err := os.Stat(destDir); err != nil {
-				if !os.IsNotExist(err) {
-					return status.UnavailableErrorf("stat layer directory: %s", err)
-				}
-			} else {
-				return nil
-			}
-
 			size, err := layer.Size()
 			if err != nil {
 				return status.UnavailableErrorf("get layer size: %s", err)
 			}
+			digest, err := layer.Digest()
+			if err != nil {
+				return status.UnavailableErrorf("get layer digest: %s", err)
+			}
+
+			// If the layer has already been extracted then we can skip the
+			// download.
+			cached, err := s.isLayerCached(ctx, d, destDir)
+			if err != nil {
+				return err
+			}
+			if cached {
+				s.touchLayer(ctx, d, "")
+				tracker.setStatus(i, digest.String(), size, LayerCached, s.layerSize(d))
+				return nil
+			}
+
+			tracker.setStatus(i, digest.String(), size, LayerDownloading, 0)
 			start := time.Now()
 			log.CtxDebugf(ctx, "Pulling layer %s (%.2f MiB)", d.Hex, float64(size)/1e6)
 			defer func() { log.CtxDebugf(ctx, "Pulled layer %s in %s", d.Hex, time.Since(start)) }()
 
 			// Images often share layers - dedupe individual layer pulls.
-			// Note that each layer pull is also authorized, so include
-			// the credentials in the key here too.
+			// Layers are keyed by diff ID, so pulls of different refs to
+			// the same image (e.g. a tag and a digest) share layer
+			// downloads too. Note that each layer pull is also authorized,
+			// so include the credentials in the key here too.
 			key := hash.Strings(destDir, creds.Username, creds.Password)
-			_, _, err = s.layerPullGroup.Do(ctx, key, func(ctx context.Context) (any, error) {
-				err := downloadLayer(ctx, layer, destDir)
-				return nil, err
+			res, _, err := s.layerPullGroup.Do(ctx, key, func(ctx context.Context) (any, error) {
+				// A concurrent pull of the same layer may have finished
+				// between the check above and joining the group, in which
+				// case there's nothing left to do.
+				if _, err := os.Stat(destDir); err == nil {
+					return "", nil
+				}
+				if s.layerDownloadSem != nil {
+					select {
+					case s.layerDownloadSem <- struct{}{}:
+						defer func() { <-s.layerDownloadSem }()
+					case <-ctx.Done():
+						return nil, status.FromContextError(ctx)
+					}
+				}
+				return downloadLayer(ctx, layer, d, destDir, tracker, i)
 			})
-			return err
+			if err != nil {
+				return err
+			}
+			contentDigest, _ := res.(string)
+			s.touchLayer(ctx, d, contentDigest)
+			tracker.setStatus(i, digest.String(), size, LayerDone, s.layerSize(d))
+			return nil
 		})
 	}
-	// Fetch image config file concurrently with layer downloads.
-	eg.Go(func() error {
-		f, err := img.ConfigFile()
-		if err != nil {
-			return status.UnavailableErrorf("get image config file: %s", err)
-		}
-		resolvedImage.Config = f.Config
-		return nil
-	})
 	if err := eg.Wait(); err != nil {
 		return nil, err
 	}
+	tracker.done()
 	return resolvedImage, nil
 }
 
 // downloadLayer downloads and extracts the given layer to the given destination
 // dir. The extracted layer is suitable for use as an overlayfs lowerdir.
-func downloadLayer(ctx context.Context, layer ctr.Layer, destDir string) error {
+// diffID is the layer's diff ID from the image config file.
+// Download progress is reported to the given tracker, which may be nil.
+// The layer's compressed digest and diff ID are verified before the
+// extracted layer is moved into place. The content digest of the extracted
+// layer is returned.
+func downloadLayer(ctx context.Context, layer ctr.Layer, diffID ctr.Hash, destDir string, tracker *pullProgressTracker, layerIndex int) (string, error) {
+	digest, err := layer.Digest()
+	if err != nil {
+		return "", status.UnavailableErrorf("get layer digest: %s", err)
+	}
+	if *containerdContentStore != "" {
+		contentDigest, err := extractContainerdBlob(ctx, *containerdContentStore, destDir, layerDigests{Digest: digest, DiffID: diffID})
+		if err == nil {
+			return contentDigest, nil
+		}
+		if !status.IsNotFoundError(err) {
+			log.CtxWarningf(ctx, "Failed to extract layer %s from containerd content store, downloading it instead: %s", digest, err)
+		}
+	}
 	rc, err := layer.Compressed()
 	if err != nil {
-		return status.UnavailableErrorf("get layer reader: %s", err)
+		return "", status.UnavailableErrorf("get layer reader: %s", err)
 	}
 	defer rc.Close()
+	return extractLayer(ctx, &progressReader{Reader: rc, tracker: tracker, layerIndex: layerIndex}, destDir, true /*=compressed*/, layerDigests{Digest: digest, DiffID: diffID})
+}
+
+// extractContainerdBlob extracts the compressed layer with the given digests
+// from the containerd content store at the given path, which stores blobs at
+// blobs/<algorithm>/<hex>. It returns a NotFound error if the store doesn't
+// have the layer. The blob is verified against the layer digests while it is
+// extracted. Only the download is avoided; the layer is extracted to destDir
+// like any other layer rather than shared with containerd's snapshotter.
+func extractContainerdBlob(ctx context.Context, contentStore, destDir string, digests layerDigests) (string, error) {
+	f, err := os.Open(filepath.Join(contentStore, "blobs", digests.Digest.Algorithm, digests.Digest.Hex))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", status.NotFoundErrorf("layer %s is not in the containerd content store", digests.Digest)
+		}
+		return "", status.UnavailableErrorf("open containerd blob: %s", err)
+	}
+	defer f.Close()
+	return extractLayer(ctx, f, destDir, true /*=compressed*/, digests)
+}
+
+// layerDigests holds the expected digests of a layer tarball. Zero-valued
+// digests are not checked.
+type layerDigests struct {
+	// Digest is the digest of the layer tarball as read, which is compressed
+	// for compressed layers.
+	Digest ctr.Hash
+	// DiffID is the digest of the uncompressed layer tarball.
+	DiffID ctr.Hash
+}
+
+// isLayerCached returns whether the given layer has already been extracted to
+// destDir. If --executor.oci.verify_cached_layers is enabled, the extracted
+// layer is verified first, and deleted if it has been corrupted so that it can
+// be pulled again.
+func (s *ImageStore) isLayerCached(ctx context.Context, hash ctr.Hash, destDir string) (bool, error) {
+	if _, err := os.Stat(destDir); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, status.UnavailableErrorf("stat layer directory: %s", err)
+	}
+	if !*verifyCachedLayers {
+		return true, nil
+	}
+	err := s.verifyCachedLayer(hash)
+	if err == nil {
+		return true, nil
+	}
+	if !status.IsDataLossError(err) {
+		return false, err
+	}
+	// Layers are shared by all containers using them as lowerdirs, so
+	// never delete a layer out from under running containers.
+	s.indexMu.Lock()
+	inUse := s.layerRefs[layerKey(hash)] > 0
+	s.indexMu.Unlock()
+	if inUse {
+		return false, status.WrapError(err, "layer is in use by running containers, so it can't be replaced")
+	}
+	log.CtxWarningf(ctx, "Deleting corrupted layer: %s", err)
+	// Move the layer out of the way first so that the layer path is never
+	// observed in a partially deleted state.
+	tmp := destDir + tmpSuffix()
+	if err := os.Rename(destDir, tmp); err != nil {
+		return false, status.UnavailableErrorf("move corrupted layer: %s", err)
+	}
+	if err := os.RemoveAll(tmp); err != nil {
+		log.CtxWarningf(ctx, "Failed to delete corrupted layer %q: %s", tmp, err)
+	}
+	return false, nil
+}
 
+// extractLayer extracts the layer tarball read from r to the given destination
+// dir, converting OCI whiteout files to overlayfs format. Extended attributes
+// in the security and user namespaces are preserved. The tarball is
+// checked against the given digests before the extracted layer is moved into
+// place. The content digest of the extracted layer is returned.
+func extractLayer(ctx context.Context, r io.Reader, destDir string, compressed bool, expected layerDigests) (string, error) {
 	tempUnpackDir := destDir + tmpSuffix()
 	if err := os.MkdirAll(tempUnpackDir, 0755); err != nil {
-		return status.UnavailableErrorf("create layer unpack dir: %s", err)
+		return "", withDiskFull(status.UnavailableErrorf("create layer unpack dir: %s", err), err)
 	}
 	defer os.RemoveAll(tempUnpackDir)
 
+	digestHash := sha256.New()
+	r = io.TeeReader(r, digestHash)
+	if compressed {
+		// Decompress here rather than with tar --gzip so that the diff ID
+		// can be computed.
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return "", status.UnavailableErrorf("read compressed layer: %s", err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	diffIDHash := sha256.New()
+	r = io.TeeReader(r, diffIDHash)
+
 	// TODO: avoid tar command.
-	cmd := exec.CommandContext(ctx, "tar", "--no-same-owner", "--extract", "--gzip", "--directory", tempUnpackDir)
+	// Always preserve permissions exactly, including setuid, setgid, and
+	// sticky bits. tar only does this by default when running as root;
+	// otherwise the umask is applied and these bits are dropped.
+	args := []string{"--no-same-owner", "--same-permissions", "--extract", "--directory", tempUnpackDir}
+	// Preserve extended attributes, which images use for things like file
+	// capabilities (security.capability). Overlayfs xattrs are excluded so
+	// that layers can't forge whiteouts or opaque directories that don't
+	// come from OCI whiteout files.
+	args = append(args, "--xattrs", "--xattrs-include=security.*", "--xattrs-include=user.*", "--xattrs-exclude=user.overlay.*")
+	cmd := exec.CommandContext(ctx, "tar", args...)
 	var stderr bytes.Buffer
-	cmd.Stdin = rc
+	// Validate entries before they reach tar, so that a malicious layer
+	// can't write outside of the unpack dir.
+	pr, pw := io.Pipe()
+	copyErrCh := make(chan error, 1)
+	var sparseFiles []string
+	go func() {
+		var err error
+		sparseFiles, err = copyLayerTar(pw, r)
+		pw.CloseWithError(err)
+		copyErrCh <- err
+	}()
+	cmd.Stdin = pr
 	cmd.Stderr = &stderr
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-	if err := cmd.Run(); err != nil {
-		return status.UnavailableErrorf("download and extract layer tarball: %s: %q", err, stderr.String())
+	runErr := cmd.Run()
+	// Unblock the copy if tar exited without reading everything.
+	pr.Close()
+	copyErr := <-copyErrCh
+	if status.IsInvalidArgumentError(copyErr) {
+		return "", copyErr
+	}
+	if runErr != nil {
+		err := status.UnavailableErrorf("extract layer tarball: %s: %q", runErr, stderr.String())
+		// tar reports write errors on stderr, using the capitalized libc
+		// error message.
+		if strings.Contains(strings.ToLower(stderr.String()), syscall.ENOSPC.Error()) {
+			return "", withSentinel(err, ErrDiskFull)
+		}
+		return "", err
+	}
+	if copyErr != nil {
+		return "", copyErr
+	}
+	// tar may stop reading at the end-of-archive marker, so read any
+	// remaining data in order to hash the full tarball.
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return "", status.UnavailableErrorf("read layer tarball: %s", err)
+	}
+	if err := checkDigest("digest", expected.Digest, digestHash.Sum(nil)); err != nil {
+		return "", err
+	}
+	if err := checkDigest("diff ID", expected.DiffID, diffIDHash.Sum(nil)); err != nil {
+		return "", err
+	}
+
+	// tar writes out every byte of large, mostly empty files such as
+	// preallocated databases, so punch holes in them afterwards.
+	for _, name := range sparseFiles {
+		if err := punchHoles(filepath.Join(tempUnpackDir, name)); err != nil {
+			log.CtxWarningf(ctx, "Failed to make layer file %q sparse: %s", name, err)
+		}
 	}
 
 	// Convert whiteout files to overlayfs format.
@@ -1161,11 +5727,16 @@ func downloadLayer(ctx context.Context, layer ctr.Layer, destDir string) error {
 
 		base := filepath.Base(path)
 		dir := filepath.Dir(path)
-		const whiteoutPrefix = ".wh."
 
 		// Directory whiteouts
 		if base == whiteoutPrefix+whiteoutPrefix+".opq" {
 			if err := unix.Setxattr(dir, "trusted.overlay.opaque", []byte{'y'}, 0); err != nil {
+				// Only privileged users can set trusted.* xattrs. In that
+				// case the layer can only be mounted with fuse-overlayfs,
+				// which understands OCI whiteout files, so keep the marker.
+				if err == unix.EPERM {
+					return nil
+				}
 				return fmt.Errorf("setxattr on deleted dir: %w", err)
 			}
 			if err := os.Remove(path); err != nil {
@@ -1179,6 +5750,11 @@ func downloadLayer(ctx context.Context, layer ctr.Layer, destDir string) error {
 			originalBase := base[len(whiteoutPrefix):]
 			originalPath := filepath.Join(dir, originalBase)
 			if err := unix.Mknod(originalPath, unix.S_IFCHR, 0); err != nil {
+				// As above, unprivileged users can't create whiteout
+				// devices, but fuse-overlayfs understands the OCI marker.
+				if err == unix.EPERM {
+					return nil
+				}
 				return fmt.Errorf("mknod for whiteout marker: %w", err)
 			}
 			if err := os.Remove(path); err != nil {
@@ -1190,7 +5766,12 @@ func downloadLayer(ctx context.Context, layer ctr.Layer, destDir string) error {
 		return nil
 	})
 	if err != nil {
-		return status.UnavailableErrorf("walk layer dir: %s", err)
+		return "", status.UnavailableErrorf("walk layer dir: %s", err)
+	}
+
+	contentDigest, err := layerContentDigest(tempUnpackDir)
+	if err != nil {
+		return "", status.UnavailableErrorf("compute layer content digest: %s", err)
 	}
 
 	if err := os.Rename(tempUnpackDir, destDir); err != nil {
@@ -1198,37 +5779,483 @@ func downloadLayer(ctx context.Context, layer ctr.Layer, destDir string) error {
 		// pulling the same layer concurrently with different credentials.
 		if os.IsExist(err) {
 			log.CtxDebugf(ctx, "Ignoring temp layer dir rename failure %q (likely due to concurrent layer download)", err)
+			return contentDigest, nil
+		}
+
+		return "", status.UnavailableErrorf("rename temp layer dir: %s", err)
+	}
+
+	return contentDigest, nil
+}
+
+// copyLayerTar copies the layer tarball read from r to w, returning an
+// InvalidArgument error if any entry would be written outside of the layer
+// dir. Entry names and hard link targets may not contain ".." components, and
+// no entry may be written through a symlink extracted earlier in the layer,
+// since symlinks can point anywhere on the host. Names are cleaned so that
+// tar extracts exactly the paths that were validated. Symlink targets are
+// left alone, since they are only resolved within the container.
+//
+// The names of regular files containing runs of zero bytes that can be
+// turned into holes are returned.
+func copyLayerTar(w io.Writer, r io.Reader) (sparseFiles []string, err error) {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	// Paths of the symlinks extracted so far.
+	symlinks := map[string]bool{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, status.UnavailableErrorf("read layer tarball: %s", err)
+		}
+		name, err := layerEntryPath(hdr.Name, symlinks)
+		if err != nil {
+			return nil, err
+		}
+		// tar replaces existing non-directories by unlinking them, but may
+		// keep a symlink to a directory in place of a directory entry.
+		if hdr.Typeflag == tar.TypeDir && symlinks[name] {
+			return nil, status.InvalidArgumentErrorf("layer tarball entry %q replaces a symlink with a directory", hdr.Name)
+		}
+		hdr.Name = name
+		if hdr.Typeflag == tar.TypeLink {
+			linkname, err := layerEntryPath(hdr.Linkname, symlinks)
+			if err != nil {
+				return nil, err
+			}
+			hdr.Linkname = linkname
+		}
+		if hdr.Typeflag == tar.TypeSymlink {
+			symlinks[name] = true
+		} else {
+			delete(symlinks, name)
+		}
+		// PAX can represent every header that the reader returns.
+		hdr.Format = tar.FormatPAX
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		var dst io.Writer = tw
+		var zeros *zeroRunDetector
+		if hdr.Typeflag == tar.TypeReg && hdr.Size >= sparseHoleMinSize && canPunchHoles(hdr) {
+			zeros = &zeroRunDetector{}
+			dst = io.MultiWriter(tw, zeros)
+		}
+		if _, err := io.Copy(dst, tr); err != nil {
+			return nil, err
+		}
+		if zeros != nil && zeros.found {
+			sparseFiles = append(sparseFiles, name)
+		}
+	}
+	return sparseFiles, tw.Close()
+}
+
+// canPunchHoles returns whether holes can be punched in the extracted file
+// for the given tarball entry without changing its metadata. Writing to a
+// file clears its setuid and setgid bits and file capabilities.
+func canPunchHoles(hdr *tar.Header) bool {
+	if hdr.FileInfo().Mode()&(fs.ModeSetuid|fs.ModeSetgid) != 0 {
+		return false
+	}
+	_, hasCapability := hdr.PAXRecords["SCHILY.xattr.security.capability"]
+	return !hasCapability
+}
+
+// zeroRunDetector is a writer that records whether the data written to it
+// contains a block-aligned run of zero bytes that is long enough to be
+// turned into a hole.
+type zeroRunDetector struct {
+	// Number of bytes written so far.
+	offset int64
+	// Whether the current block contains a non-zero byte.
+	dirty bool
+	// Length of the current run of zero blocks.
+	run   int64
+	found bool
+}
+
+var zeroBlock = make([]byte, sparseBlockSize)
+
+func (d *zeroRunDetector) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		k := min(int64(len(p)), sparseBlockSize-d.offset%sparseBlockSize)
+		if !d.dirty && !bytes.Equal(p[:k], zeroBlock[:k]) {
+			d.dirty = true
+		}
+		d.offset += k
+		p = p[k:]
+		if d.offset%sparseBlockSize != 0 {
+			continue
+		}
+		if d.dirty {
+			d.run = 0
+		} else {
+			d.run += sparseBlockSize
+			d.found = d.found || d.run >= sparseHoleMinSize
+		}
+		d.dirty = false
+	}
+	return n, nil
+}
+
+// punchHoles deallocates the block-aligned runs of zero bytes in the given
+// file that are at least sparseHoleMinSize long. The file's size, contents,
+// permissions, and modification time are unchanged.
+func punchHoles(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	// The file may have been replaced by a later entry in the tarball.
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	// Opening read-only files for writing requires temporarily making them
+	// writable, unless running as root.
+	if info.Mode().Perm()&0200 == 0 && os.Geteuid() != 0 {
+		if err := os.Chmod(path, info.Mode().Perm()|0200); err != nil {
+			return err
+		}
+		defer os.Chmod(path, info.Mode().Perm())
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := make([]byte, sparseBlockSize)
+	var holeStart, offset int64
+	punch := func() error {
+		if offset-holeStart < sparseHoleMinSize {
 			return nil
 		}
+		return unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, holeStart, offset-holeStart)
+	}
+	for {
+		n, err := io.ReadFull(f, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(buf[:n], zeroBlock) {
+			if err := punch(); err != nil {
+				return err
+			}
+			holeStart = offset + int64(n)
+		}
+		offset += int64(n)
+	}
+	if err := punch(); err != nil {
+		return err
+	}
+	return os.Chtimes(path, time.Time{}, info.ModTime())
+}
 
-		return status.UnavailableErrorf("rename temp layer dir: %s", err)
+// layerEntryPath returns the cleaned path of a layer tarball entry relative to
+// the layer root, or an InvalidArgument error if the path escapes the layer
+// root or passes through one of the given symlinks. Leading slashes are
+// stripped, as tar does.
+func layerEntryPath(name string, symlinks map[string]bool) (string, error) {
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", status.InvalidArgumentErrorf("layer tarball entry %q escapes the layer directory", name)
+		}
+	}
+	cleaned := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if cleaned == "" {
+		return "./", nil
+	}
+	for dir := path.Dir(cleaned); dir != "."; dir = path.Dir(dir) {
+		if symlinks[dir] {
+			return "", status.InvalidArgumentErrorf("layer tarball entry %q is under symlink %q", name, dir)
+		}
 	}
+	return cleaned, nil
+}
 
+// checkDigest returns a DataLoss error if the given sha256 sum does not match
+// the expected digest. A zero expected digest is not checked.
+func checkDigest(name string, expected ctr.Hash, sum []byte) error {
+	if expected == (ctr.Hash{}) {
+		return nil
+	}
+	if expected.Algorithm != "sha256" {
+		return status.UnimplementedErrorf("unsupported layer %s algorithm %q", name, expected.Algorithm)
+	}
+	if actual := hex.EncodeToString(sum); actual != expected.Hex {
+		return status.DataLossErrorf("layer %s mismatch: expected %s, got sha256:%s", name, expected, actual)
+	}
 	return nil
 }
 
-func withImageConfig(cmd *repb.Command, image *Image) (*repb.Command, error) {
-	// Apply any env vars from the image which aren't overridden by the command
-	cmdVarNames := make(map[string]bool, len(cmd.EnvironmentVariables))
-	for _, cmdVar := range cmd.GetEnvironmentVariables() {
-		cmdVarNames[cmdVar.GetName()] = true
+// layerContentDigest returns a digest of the extracted layer in the given
+// directory, covering the path, type, permissions, size, and contents of each
+// file, symlink targets, device numbers, and overlayfs opaque directory
+// markers. Ownership and timestamps are not included.
+func layerContentDigest(dir string) (string, error) {
+	h := sha256.New()
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%q %o %d", rel, info.Mode(), info.Size())
+		switch {
+		case info.Mode().IsRegular():
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			fh := sha256.New()
+			_, err = io.Copy(fh, f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, " %x", fh.Sum(nil))
+		case info.Mode()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, " %q", target)
+		case info.Mode()&fs.ModeDevice != 0:
+			if st, ok := info.Sys().(*syscall.Stat_t); ok {
+				fmt.Fprintf(h, " %d", st.Rdev)
+			}
+		case info.IsDir():
+			fmt.Fprintf(h, " %t", isOpaqueDir(path))
+		}
+		h.Write([]byte{'\n'})
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeLayerTar writes the contents of the given overlayfs upperdir to w as an
+// uncompressed OCI layer tarball. Overlayfs whiteouts (0/0 character devices)
+// and opaque directories are converted to OCI whiteout files. Entries are
+// written in lexical order, and access and change times are omitted, so that
+// the tarball is reproducible.
+func writeLayerTar(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("unexpected stat type %T", info.Sys())
+		}
+
+		// File whiteouts
+		if info.Mode()&fs.ModeCharDevice != 0 && st.Rdev == 0 {
+			return tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     filepath.Join(filepath.Dir(rel), whiteoutPrefix+filepath.Base(rel)),
+				Mode:     0644,
+				ModTime:  info.ModTime(),
+			})
+		}
+
+		link := ""
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Uname, hdr.Gname = "", ""
+		hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			// Directory whiteouts
+			if isOpaqueDir(path) {
+				return tw.WriteHeader(&tar.Header{
+					Typeflag: tar.TypeReg,
+					Name:     filepath.Join(rel, whiteoutPrefix+whiteoutPrefix+".opq"),
+					Mode:     0644,
+					ModTime:  info.ModTime(),
+				})
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// isOpaqueDir returns whether the given overlayfs or fuse-overlayfs directory
+// is marked opaque, meaning that it hides the contents of the same directory
+// in lower layers.
+func isOpaqueDir(path string) bool {
+	buf := make([]byte, 1)
+	for _, attr := range []string{"user.overlay.opaque", "trusted.overlay.opaque", "user.fuseoverlayfs.opaque"} {
+		if n, err := unix.Lgetxattr(path, attr, buf); err == nil && n == 1 && buf[0] == 'y' {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultImageShell is the shell used to run shell-form ENTRYPOINT and CMD
+// values if the image doesn't specify a SHELL.
+var defaultImageShell = []string{"/bin/sh", "-c"}
+
+// parseImageConfigFile parses an image config file. Unlike
+// ctr.ParseConfigFile, it accepts shell-form ENTRYPOINT and CMD values, which
+// are JSON strings rather than arrays. As in docker, these are converted to
+// exec-form commands which run the string using the image's SHELL, or
+// "/bin/sh -c" if the image doesn't specify one.
+func parseImageConfigFile(raw []byte) (*ctr.ConfigFile, error) {
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &top); err != nil {
+		return nil, status.InvalidArgumentErrorf("parse image config file: %s", err)
+	}
+	var config map[string]json.RawMessage
+	if rawConfig, ok := top["config"]; ok {
+		if err := json.Unmarshal(rawConfig, &config); err != nil {
+			return nil, status.InvalidArgumentErrorf("parse image config: %s", err)
+		}
+	}
+	// Remove any shell-form values so that the rest of the config file can
+	// be parsed normally.
+	shellForms := map[string]string{}
+	for _, key := range []string{"Entrypoint", "Cmd"} {
+		var shellForm string
+		if err := json.Unmarshal(config[key], &shellForm); err == nil {
+			shellForms[key] = shellForm
+			delete(config, key)
+		}
+	}
+	if len(shellForms) > 0 {
+		b, err := json.Marshal(config)
+		if err != nil {
+			return nil, status.InternalErrorf("marshal image config: %s", err)
+		}
+		top["config"] = b
+		if raw, err = json.Marshal(top); err != nil {
+			return nil, status.InternalErrorf("marshal image config file: %s", err)
+		}
 	}
-	imageEnv, err := commandutil.EnvProto(image.Config.Env)
+	f, err := ctr.ParseConfigFile(bytes.NewReader(raw))
 	if err != nil {
-		return nil, status.WrapError(err, "parse image env")
+		return nil, status.InvalidArgumentErrorf("parse image config file: %s", err)
 	}
+	shell := f.Config.Shell
+	if len(shell) == 0 {
+		shell = defaultImageShell
+	}
+	shellCommand := func(command string) []string {
+		if command == "" {
+			return nil
+		}
+		return append(slices.Clone(shell), command)
+	}
+	if command, ok := shellForms["Entrypoint"]; ok {
+		f.Config.Entrypoint = shellCommand(command)
+	}
+	if command, ok := shellForms["Cmd"]; ok {
+		f.Config.Cmd = shellCommand(command)
+	}
+	return f, nil
+}
+
+// withImageConfig returns a copy of the command with the image config
+// applied. If useImageEnv is true, the image ENV variables are appended to the
+// command's environment, except for variables which the command sets itself:
+// command variables always take precedence over image variables.
+func withImageConfig(cmd *repb.Command, image *Image, useImageEnv bool) (*repb.Command, error) {
 	outEnv := slices.Clone(cmd.EnvironmentVariables)
-	for _, imageVar := range imageEnv {
-		if cmdVarNames[imageVar.GetName()] {
-			continue
+	if useImageEnv {
+		// Apply any env vars from the image which aren't overridden by the
+		// command
+		cmdVarNames := make(map[string]bool, len(cmd.EnvironmentVariables))
+		for _, cmdVar := range cmd.GetEnvironmentVariables() {
+			cmdVarNames[cmdVar.GetName()] = true
+		}
+		imageEnv, err := commandutil.EnvProto(image.Config.Env)
+		if err != nil {
+			return nil, status.WrapError(err, "parse image env")
+		}
+		for _, imageVar := range imageEnv {
+			if cmdVarNames[imageVar.GetName()] {
+				continue
+			}
+			outEnv = append(outEnv, imageVar)
 		}
-		outEnv = append(outEnv, imageVar)
 	}
 
-	// TODO: ENTRYPOINT, CMD
+	// If the command doesn't specify any arguments, fall back to the image
+	// ENTRYPOINT and CMD. Unlike docker, explicit command arguments replace
+	// the ENTRYPOINT too, rather than being passed as arguments to it.
+	//
+	// As in docker, the CMD is appended to the ENTRYPOINT even if the
+	// ENTRYPOINT is shell-form. In that case the CMD arguments are passed to
+	// the shell after the command string, where they only set $0, $1, etc.,
+	// so a shell-form ENTRYPOINT effectively ignores the CMD.
+	args := cmd.GetArguments()
+	if len(args) == 0 {
+		args = append(slices.Clone(image.Config.Entrypoint), image.Config.Cmd...)
+		if len(args) == 0 {
+			return nil, status.InvalidArgumentError("command has no arguments, and the image does not specify an ENTRYPOINT or CMD")
+		}
+	}
 
 	// Return a copy of the command but with the image config applied
 	out := cmd.CloneVT()
+	out.Arguments = args
 	out.EnvironmentVariables = outEnv
 	return out, nil
 }
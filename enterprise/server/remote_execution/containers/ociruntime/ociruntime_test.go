@@ -1,18 +1,28 @@
 package ociruntime_test
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
 	"math/rand/v2"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -25,25 +35,39 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/workspace"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/oci"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testfs"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testmetrics"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testnetworking"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testregistry"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testshell"
 	"github.com/buildbuddy-io/buildbuddy/server/util/disk"
 	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
 	"github.com/buildbuddy-io/buildbuddy/server/util/uuid"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sys/unix"
 
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	wkpb "github.com/buildbuddy-io/buildbuddy/proto/worker"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 )
 
 // Set via x_defs in BUILD file.
 var crunRlocationpath string
 var busyboxRlocationpath string
+var tiniRlocationpath string
 var testworkerRlocationpath string
 
 func init() {
@@ -85,26 +109,25 @@ func manuallyProvisionedBusyboxImage(t *testing.T) string {
 }
 
 // Returns an image ref pointing to a remotely hosted busybox image.
-// Skips the test if we don't have mount permissions.
-// TODO: support rootless overlayfs mounts and get rid of this
+// Skips the test if we can't mount the overlay rootfs.
 func realBusyboxImage(t *testing.T) string {
-	if !hasMountPermissions(t) {
-		t.Skipf("using a real container image with overlayfs requires mount permissions")
+	if !canMountOverlay(t) {
+		t.Skipf("using a real container image requires overlayfs mount permissions or fuse-overlayfs")
 	}
 	return "mirror.gcr.io/library/busybox"
 }
 
 func netToolsImage(t *testing.T) string {
-	if !hasMountPermissions(t) {
-		t.Skipf("using a real container image with overlayfs requires mount permissions")
+	if !canMountOverlay(t) {
+		t.Skipf("using a real container image requires overlayfs mount permissions or fuse-overlayfs")
 	}
 	return "gcr.io/flame-public/net-tools@sha256:ac701954d2c522d0d2b5296323127cacaaf77627e69db848a8d6ecb53149d344"
 }
 
 // Returns a remote reference to the image in //dockerfiles/test_images/ociruntime_test/image_config_test_image
 func imageConfigTestImage(t *testing.T) string {
-	if !hasMountPermissions(t) {
-		t.Skipf("using a real container image with overlayfs requires mount permissions")
+	if !canMountOverlay(t) {
+		t.Skipf("using a real container image requires overlayfs mount permissions or fuse-overlayfs")
 	}
 	return "gcr.io/flame-public/image-config-test@sha256:44dc4623f3709eef89b0a6d6c8e1c3a9d54db73f6beb8cf99f402052ba9abe56"
 }
@@ -177,11 +200,9 @@ func TestRunUsageStats(t *testing.T) {
 		require.NoError(t, err)
 	})
 
-	// Run (sleep long enough to collect stats)
-	// TODO: in the Run case, we should be able to use the memory.peak file and
-	// cumulative CPU usage file to reliably return stats even if we don't have
-	// a chance to poll
-	cmd := &repb.Command{Arguments: []string{"sleep", "0.5"}}
+	// Run a command that exits before stats can be polled. Stats should
+	// still be reported, using the cgroup's cumulative usage counters.
+	cmd := &repb.Command{Arguments: []string{"sh", "-c", "head -c 1000000 /dev/zero | md5sum"}}
 	res := c.Run(ctx, cmd, wd, oci.Credentials{})
 	require.NoError(t, res.Error)
 	require.Equal(t, 0, res.ExitCode)
@@ -189,6 +210,81 @@ func TestRunUsageStats(t *testing.T) {
 	assert.Greater(t, res.UsageStats.GetCpuNanos(), int64(0), "CPU")
 }
 
+func TestRunWithStdio_StreamsOutput(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+	}})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+
+	// The command only finishes after the first line of output has been
+	// streamed to the stdout writer, which creates the CONTINUE file.
+	cmd := &repb.Command{Arguments: []string{"sh", "-c", `
+		echo hello
+		echo err >&2
+		while ! [ -e ./CONTINUE ]; do sleep 0.1; done
+		echo world
+	`}}
+	stdout := &notifyingWriter{onWrite: func() {
+		err := os.WriteFile(filepath.Join(wd, "CONTINUE"), nil, 0644)
+		require.NoError(t, err)
+	}}
+	runner := c.(interface {
+		RunWithStdio(context.Context, *repb.Command, string, oci.Credentials, *interfaces.Stdio) *interfaces.CommandResult
+	})
+	res := runner.RunWithStdio(ctx, cmd, wd, oci.Credentials{}, &interfaces.Stdio{Stdout: stdout})
+	require.NoError(t, res.Error)
+	assert.Equal(t, 0, res.ExitCode)
+	assert.Equal(t, "hello\nworld\n", stdout.String())
+	assert.Empty(t, string(res.Stdout))
+	assert.Equal(t, int64(len("hello\nworld\n")), res.StdoutSize)
+	// Stderr is still captured in the result, since no writer was provided.
+	assert.Equal(t, "err\n", string(res.Stderr))
+	assert.Equal(t, int64(len("err\n")), res.StderrSize)
+}
+
+// notifyingWriter is a buffer that calls onWrite after each write. It is safe
+// for concurrent use.
+type notifyingWriter struct {
+	onWrite func()
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (w *notifyingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	n, err := w.buf.Write(p)
+	w.mu.Unlock()
+	w.onWrite()
+	return n, err
+}
+
+func (w *notifyingWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.String()
+}
+
 func TestRunWithImage(t *testing.T) {
 	testnetworking.Setup(t)
 
@@ -240,10 +336,11 @@ TEST_ENV_VAR=foo
 	assert.Equal(t, 0, res.ExitCode)
 }
 
-func TestCreateExecRemove(t *testing.T) {
+func TestRunWithImageEnv(t *testing.T) {
 	testnetworking.Setup(t)
 
-	image := manuallyProvisionedBusyboxImage(t)
+	// The image sets TEST_ENV_VAR=foo and adds /test/bin to PATH.
+	image := imageConfigTestImage(t)
 
 	ctx := context.Background()
 	env := testenv.GetTestEnv(t)
@@ -255,38 +352,216 @@ func TestCreateExecRemove(t *testing.T) {
 
 	provider, err := ociruntime.NewProvider(env, buildRoot)
 	require.NoError(t, err)
-	wd := testfs.MakeDirAll(t, buildRoot, "work")
 
-	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
-		ContainerImage: image,
-	}})
-	require.NoError(t, err)
+	for _, test := range []struct {
+		name           string
+		ignoreImageEnv bool
+		commandEnv     []*repb.Command_EnvironmentVariable
+		expectedOutput string
+	}{
+		{
+			name:           "CommandEnvOverridesImageEnv",
+			commandEnv:     []*repb.Command_EnvironmentVariable{{Name: "TEST_ENV_VAR", Value: "bar"}},
+			expectedOutput: "TEST_ENV_VAR=bar\nPATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin:/test/bin\n",
+		},
+		{
+			name:           "ImageEnvIgnored",
+			ignoreImageEnv: true,
+			expectedOutput: "TEST_ENV_VAR=\nPATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin\n",
+		},
+		{
+			name:           "ImageEnvIgnoredWithCommandEnv",
+			ignoreImageEnv: true,
+			commandEnv:     []*repb.Command_EnvironmentVariable{{Name: "TEST_ENV_VAR", Value: "bar"}},
+			expectedOutput: "TEST_ENV_VAR=bar\nPATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin\n",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			wd := testfs.MakeDirAll(t, buildRoot, "work-"+test.name)
+			c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+				ContainerImage: image,
+				IgnoreImageEnv: test.ignoreImageEnv,
+			}})
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				err := c.Remove(ctx)
+				require.NoError(t, err)
+			})
 
-	// Create
+			cmd := &repb.Command{
+				Arguments: []string{"sh", "-c", `
+					echo "TEST_ENV_VAR=$TEST_ENV_VAR"
+					echo "PATH=$PATH"
+				`},
+				EnvironmentVariables: test.commandEnv,
+			}
+			res := c.Run(ctx, cmd, wd, oci.Credentials{})
+			require.NoError(t, res.Error)
+			assert.Equal(t, test.expectedOutput, string(res.Stdout))
+			assert.Empty(t, string(res.Stderr))
+			assert.Equal(t, 0, res.ExitCode)
+		})
+	}
+}
+
+func TestRunWithImageEntrypointForms(t *testing.T) {
+	if !hasMountPermissions(t) {
+		t.Skipf("using an image-backed rootfs with overlayfs requires mount permissions")
+	}
+	testnetworking.Setup(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	// Build an image containing just busybox, with /bin/sh linked to it.
+	busyboxPath, err := runfiles.Rlocation(busyboxRlocationpath)
 	require.NoError(t, err)
-	err = c.Create(ctx, wd)
+	busybox, err := os.ReadFile(busyboxPath)
 	require.NoError(t, err)
-	t.Cleanup(func() {
-		err = c.Remove(ctx)
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "bin/", Mode: 0755},
+		{Typeflag: tar.TypeReg, Name: "bin/busybox", Mode: 0755, Size: int64(len(busybox))},
+		{Typeflag: tar.TypeSymlink, Name: "bin/sh", Linkname: "busybox"},
+	} {
+		err := tw.WriteHeader(hdr)
 		require.NoError(t, err)
+		if hdr.Typeflag == tar.TypeReg {
+			_, err = tw.Write(busybox)
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf.Bytes())), nil
 	})
+	require.NoError(t, err)
+	diffID, err := layer.DiffID()
+	require.NoError(t, err)
 
-	// Exec
-	cmd := &repb.Command{Arguments: []string{"sh", "-c", "cat && pwd"}}
-	stdio := interfaces.Stdio{
-		Stdin: strings.NewReader("buildbuddy was here: "),
+	reg := testregistry.Run(t, testregistry.Opts{})
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	for _, test := range []struct {
+		name string
+		// config is the "config" section of the image config file.
+		config         string
+		expectedOutput string
+	}{
+		{
+			name:           "ExecFormEntrypoint",
+			config:         `{"Entrypoint": ["/bin/busybox", "echo", "exec-form"], "Cmd": ["entrypoint"]}`,
+			expectedOutput: "exec-form entrypoint\n",
+		},
+		{
+			name:           "ShellFormEntrypoint",
+			config:         `{"Entrypoint": "echo shell-form entrypoint $((1 + 2))", "Cmd": ["ignored"]}`,
+			expectedOutput: "shell-form entrypoint 3\n",
+		},
+		{
+			name:           "ExecFormCmd",
+			config:         `{"Cmd": ["/bin/busybox", "echo", "exec-form", "$((1 + 2))"]}`,
+			expectedOutput: "exec-form $((1 + 2))\n",
+		},
+		{
+			name:           "ShellFormCmd",
+			config:         `{"Cmd": "echo shell-form cmd $((1 + 2))"}`,
+			expectedOutput: "shell-form cmd 3\n",
+		},
+		{
+			name:           "ShellFormEntrypointWithCustomShell",
+			config:         `{"Shell": ["/bin/busybox", "sh", "-c"], "Entrypoint": "echo custom shell"}`,
+			expectedOutput: "custom shell\n",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			rawConfig := fmt.Sprintf(`{"architecture": %q, "os": "linux", "rootfs": {"type": "layers", "diff_ids": [%q]}, "config": %s}`, runtime.GOARCH, diffID, test.config)
+			image, err := partial.CompressedToImage(&rawConfigImage{layer: layer, rawConfig: []byte(rawConfig)})
+			require.NoError(t, err)
+			imageName := reg.Push(t, image, "entrypoint-"+strings.ToLower(test.name))
+			wd := testfs.MakeDirAll(t, buildRoot, test.name)
+
+			c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+				ContainerImage: imageName,
+			}})
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				err := c.Remove(ctx)
+				require.NoError(t, err)
+			})
+
+			// Run with no arguments, so that the image ENTRYPOINT and CMD
+			// are used.
+			res := c.Run(ctx, &repb.Command{}, wd, oci.Credentials{})
+			require.NoError(t, res.Error)
+			assert.Equal(t, test.expectedOutput, string(res.Stdout))
+			assert.Empty(t, string(res.Stderr))
+			assert.Equal(t, 0, res.ExitCode)
+		})
 	}
-	res := c.Exec(ctx, cmd, &stdio)
-	require.NoError(t, res.Error)
+}
 
-	assert.Equal(t, 0, res.ExitCode)
-	assert.Empty(t, string(res.Stderr))
-	assert.Equal(t, "buildbuddy was here: /buildbuddy-execroot\n", string(res.Stdout))
+// rawConfigImage is a single-layer image with a config file with the given
+// contents, which may use fields that ctr.ParseConfigFile doesn't accept.
+type rawConfigImage struct {
+	layer     v1.Layer
+	rawConfig []byte
 }
 
-func TestExecUsageStats(t *testing.T) {
+func (i *rawConfigImage) RawConfigFile() ([]byte, error) {
+	return i.rawConfig, nil
+}
+
+func (i *rawConfigImage) MediaType() (types.MediaType, error) {
+	return types.OCIManifestSchema1, nil
+}
+
+func (i *rawConfigImage) RawManifest() ([]byte, error) {
+	configDigest, configSize, err := v1.SHA256(bytes.NewReader(i.rawConfig))
+	if err != nil {
+		return nil, err
+	}
+	layerDigest, err := i.layer.Digest()
+	if err != nil {
+		return nil, err
+	}
+	layerSize, err := i.layer.Size()
+	if err != nil {
+		return nil, err
+	}
+	layerMediaType, err := i.layer.MediaType()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&v1.Manifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIManifestSchema1,
+		Config:        v1.Descriptor{MediaType: types.OCIConfigJSON, Digest: configDigest, Size: configSize},
+		Layers:        []v1.Descriptor{{MediaType: layerMediaType, Digest: layerDigest, Size: layerSize}},
+	})
+}
+
+func (i *rawConfigImage) LayerByDigest(h v1.Hash) (partial.CompressedLayer, error) {
+	layerDigest, err := i.layer.Digest()
+	if err != nil {
+		return nil, err
+	}
+	if h != layerDigest {
+		return nil, fmt.Errorf("unknown layer %s", h)
+	}
+	return i.layer, nil
+}
+
+func TestRunWithImageCmd(t *testing.T) {
 	testnetworking.Setup(t)
 
+	// The busybox image specifies CMD ["sh"] and no ENTRYPOINT.
 	image := realBusyboxImage(t)
 
 	ctx := context.Background()
@@ -305,34 +580,42 @@ func TestExecUsageStats(t *testing.T) {
 		ContainerImage: image,
 	}})
 	require.NoError(t, err)
-	err = c.PullImage(ctx, oci.Credentials{})
-	require.NoError(t, err)
-	err = c.Create(ctx, wd)
-	require.NoError(t, err)
 	t.Cleanup(func() {
-		err = c.Remove(ctx)
+		err := c.Remove(ctx)
 		require.NoError(t, err)
 	})
 
-	// Exec
-	cmd := &repb.Command{Arguments: []string{"sleep", "0.5"}}
-	res := c.Exec(ctx, cmd, &interfaces.Stdio{})
+	// Run with no arguments; the image CMD should read the script from
+	// stdin.
+	res := c.Run(ctx, &repb.Command{}, wd, oci.Credentials{})
 	require.NoError(t, res.Error)
-	require.Equal(t, 0, res.ExitCode)
-	assert.Greater(t, res.UsageStats.GetMemoryBytes(), int64(0), "memory")
-	assert.Greater(t, res.UsageStats.GetCpuNanos(), int64(0), "CPU")
+	assert.Equal(t, 0, res.ExitCode)
 
-	// Stats
-	s, err := c.Stats(ctx)
+	// Exec with no arguments should also use the image CMD.
+	c2, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+	}})
 	require.NoError(t, err)
-	assert.Greater(t, s.GetMemoryBytes(), int64(0), "memory")
-	assert.Greater(t, s.GetCpuNanos(), int64(0), "CPU")
+	t.Cleanup(func() {
+		err := c2.Remove(ctx)
+		require.NoError(t, err)
+	})
+	err = c2.PullImage(ctx, oci.Credentials{})
+	require.NoError(t, err)
+	err = c2.Create(ctx, wd)
+	require.NoError(t, err)
+	res = c2.Exec(ctx, &repb.Command{}, &interfaces.Stdio{
+		Stdin: strings.NewReader("echo hello from image cmd"),
+	})
+	require.NoError(t, res.Error)
+	assert.Equal(t, "hello from image cmd\n", string(res.Stdout))
+	assert.Equal(t, 0, res.ExitCode)
 }
 
-func TestPullCreateExecRemove(t *testing.T) {
+func TestContainerWorkingDir(t *testing.T) {
 	testnetworking.Setup(t)
 
-	image := imageConfigTestImage(t)
+	image := manuallyProvisionedBusyboxImage(t)
 
 	ctx := context.Background()
 	env := testenv.GetTestEnv(t)
@@ -346,71 +629,25 @@ func TestPullCreateExecRemove(t *testing.T) {
 	require.NoError(t, err)
 	wd := testfs.MakeDirAll(t, buildRoot, "work")
 
-	c, err := provider.New(ctx, &container.Init{
-		Props: &platform.Properties{
-			ContainerImage: image,
-		},
-	})
-	require.NoError(t, err)
-
-	// Pull
-	err = c.PullImage(ctx, oci.Credentials{})
-	require.NoError(t, err)
-
-	// Ensure cached
-	cached, err := c.IsImageCached(ctx)
-	require.NoError(t, err)
-	assert.True(t, cached, "IsImageCached")
-
-	// Create
-	require.NoError(t, err)
-	err = c.Create(ctx, wd)
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage:      image,
+		ContainerWorkingDir: "/bin",
+	}})
 	require.NoError(t, err)
 	t.Cleanup(func() {
-		err = c.Remove(ctx)
+		err := c.Remove(ctx)
 		require.NoError(t, err)
 	})
 
-	// Exec
-	cmd := &repb.Command{
-		Arguments: []string{"sh", "-ec", `
-			touch /bin/foo.txt
-			pwd
-			env | sort
-		`},
-		EnvironmentVariables: []*repb.Command_EnvironmentVariable{
-			{Name: "GREETING", Value: "Hello"},
-		},
-	}
-	stdio := interfaces.Stdio{}
-	res := c.Exec(ctx, cmd, &stdio)
+	cmd := &repb.Command{Arguments: []string{"pwd"}}
+	res := c.Run(ctx, cmd, wd, oci.Credentials{})
 	require.NoError(t, res.Error)
-
-	assert.Equal(t, 0, res.ExitCode)
+	assert.Equal(t, "/bin\n", string(res.Stdout))
 	assert.Empty(t, string(res.Stderr))
-	assert.Equal(t, `/buildbuddy-execroot
-GREETING=Hello
-HOME=/root
-HOSTNAME=localhost
-PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin:/test/bin
-PWD=/buildbuddy-execroot
-SHLVL=1
-TEST_ENV_VAR=foo
-`, string(res.Stdout))
-
-	// Make sure the image layers were unmodified and that foo.txt was written
-	// to the upper dir in the overlayfs.
-	layersRoot := filepath.Join(buildRoot, "executor", "oci", "layers")
-	err = filepath.WalkDir(layersRoot, func(path string, entry fs.DirEntry, err error) error {
-		require.NoError(t, err)
-		assert.NotEqual(t, entry.Name(), "foo.txt")
-		return nil
-	})
-	require.NoError(t, err)
-	assert.True(t, testfs.Exists(t, "", filepath.Join(wd+".overlay", "upper", "bin", "foo.txt")))
+	assert.Equal(t, 0, res.ExitCode)
 }
 
-func TestCreateExecPauseUnpause(t *testing.T) {
+func TestCreateExecRemove(t *testing.T) {
 	testnetworking.Setup(t)
 
 	image := manuallyProvisionedBusyboxImage(t)
@@ -441,79 +678,74 @@ func TestCreateExecPauseUnpause(t *testing.T) {
 		require.NoError(t, err)
 	})
 
-	// Exec: start a bg process that increments a counter file every 10ms.
-	const updateInterval = 10 * time.Millisecond
-	cmd := &repb.Command{Arguments: []string{"sh", "-c", `
-		printf 0 > count.txt
-		(
-			count=0
-			while true; do
-				count=$((count+1))
-				printf '%d' "$count" > count.txt
-				sleep ` + fmt.Sprintf("%f", updateInterval.Seconds()) + `
-			done
-		) &
-	`}}
-	res := c.Exec(ctx, cmd, &interfaces.Stdio{})
+	// Exec
+	cmd := &repb.Command{Arguments: []string{"sh", "-c", "cat && pwd"}}
+	stdio := interfaces.Stdio{
+		Stdin: strings.NewReader("buildbuddy was here: "),
+	}
+	res := c.Exec(ctx, cmd, &stdio)
 	require.NoError(t, res.Error)
 
-	t.Logf("Started update process in container")
-
+	assert.Equal(t, 0, res.ExitCode)
 	assert.Empty(t, string(res.Stderr))
-	assert.Empty(t, string(res.Stdout))
-	require.Equal(t, 0, res.ExitCode)
+	assert.Equal(t, "buildbuddy was here: /buildbuddy-execroot\n", string(res.Stdout))
+}
 
-	readCounterFile := func() int {
-		for {
-			b, err := os.ReadFile(filepath.Join(wd, "count.txt"))
-			require.NoError(t, err)
-			s := string(b)
-			if s == "" {
-				// File is being written concurrently; retry
-				continue
-			}
-			c, err := strconv.Atoi(s)
-			require.NoError(t, err)
-			return c
-		}
-	}
+func TestExecStdinEOF(t *testing.T) {
+	testnetworking.Setup(t)
 
-	waitUntilCounterIncremented := func() {
-		var lastCount *int
-		for {
-			count := readCounterFile()
-			if lastCount != nil && count > *lastCount {
-				return
-			}
-			lastCount = &count
-			time.Sleep(updateInterval)
-		}
-	}
+	image := manuallyProvisionedBusyboxImage(t)
 
-	// Counter should be getting continually updated since we started a
-	// background process in the container and we haven't paused yet.
-	waitUntilCounterIncremented()
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
 
-	// Pause
-	err = c.Pause(ctx)
-	require.NoError(t, err)
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
 
-	// Counter should not be getting updated anymore since we're paused.
-	d1 := readCounterFile()
-	require.NotEmpty(t, d1)
-	time.Sleep(updateInterval * 10)
-	d2 := readCounterFile()
-	require.Equal(t, d1, d2, "expected counter file not to be updated")
+	buildRoot := testfs.MakeTempDir(t)
 
-	// Unpause
-	err = c.Unpause(ctx)
+	provider, err := ociruntime.NewProvider(env, buildRoot)
 	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
 
-	// Counter should be getting continually updated again since we're unpaused.
-	waitUntilCounterIncremented()
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+	}})
+	require.NoError(t, err)
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err = c.Remove(ctx)
+		require.NoError(t, err)
+	})
+
+	for _, tty := range []bool{false, true} {
+		t.Run(fmt.Sprintf("tty=%t", tty), func(t *testing.T) {
+			// cat should exit once the writer is closed. Leave the input
+			// without a trailing newline, which needs special handling
+			// when using a tty.
+			pr, pw := io.Pipe()
+			go func() {
+				pw.Write([]byte("hello"))
+				pw.Close()
+			}()
+			ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			defer cancel()
+			cmd := &repb.Command{Arguments: []string{"cat"}}
+			res := c.Exec(ctx, cmd, &interfaces.Stdio{Stdin: pr, Tty: tty})
+			require.NoError(t, res.Error)
+			assert.Equal(t, 0, res.ExitCode)
+			if tty {
+				// The terminal echoes the input too.
+				assert.Contains(t, string(res.Stdout), "hello")
+			} else {
+				assert.Equal(t, "hello", string(res.Stdout))
+			}
+		})
+	}
 }
 
-func TestCreateFailureHasStderr(t *testing.T) {
+func TestExecStreamsStdin(t *testing.T) {
 	testnetworking.Setup(t)
 
 	image := manuallyProvisionedBusyboxImage(t)
@@ -530,18 +762,51 @@ func TestCreateFailureHasStderr(t *testing.T) {
 	require.NoError(t, err)
 	wd := testfs.MakeDirAll(t, buildRoot, "work")
 
-	// Create
-	c, err := provider.New(ctx, &container.Init{
-		Props: &platform.Properties{
-			ContainerImage: image,
-		},
-	})
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+	}})
 	require.NoError(t, err)
-	err = c.Create(ctx, wd+"nonexistent")
-	require.ErrorContains(t, err, "nonexistent")
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err = c.Remove(ctx)
+		require.NoError(t, err)
+	})
+
+	// Stream a large input.
+	const size = 256 * 1024 * 1024
+	stdin := &zeroReader{}
+	cmd := &repb.Command{Arguments: []string{"wc", "-c"}}
+	res := c.Exec(ctx, cmd, &interfaces.Stdio{Stdin: io.LimitReader(stdin, size)})
+	require.NoError(t, res.Error)
+	assert.Equal(t, 0, res.ExitCode)
+	assert.Equal(t, strconv.Itoa(size), strings.TrimSpace(string(res.Stdout)))
+
+	// Stdin should only be read as fast as the process consumes it. The
+	// process only reads 1MiB of the endless input, so only slightly more
+	// than that should be read, to fill pipe buffers.
+	stdin = &zeroReader{}
+	cmd = &repb.Command{Arguments: []string{"sh", "-c", "head -c 1048576 | wc -c"}}
+	res = c.Exec(ctx, cmd, &interfaces.Stdio{Stdin: stdin})
+	require.NoError(t, res.Error)
+	assert.Equal(t, 0, res.ExitCode)
+	assert.Equal(t, "1048576", strings.TrimSpace(string(res.Stdout)))
+	assert.Less(t, stdin.n.Load(), int64(2*1024*1024))
 }
 
-func TestDevices(t *testing.T) {
+// zeroReader is an endless stream of zeros which records the number of bytes
+// read.
+type zeroReader struct {
+	n atomic.Int64
+}
+
+func (r *zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	r.n.Add(int64(len(p)))
+	return len(p), nil
+}
+
+func TestMaxOutputBytes(t *testing.T) {
 	testnetworking.Setup(t)
 
 	image := manuallyProvisionedBusyboxImage(t)
@@ -551,6 +816,7 @@ func TestDevices(t *testing.T) {
 
 	runtimeRoot := testfs.MakeTempDir(t)
 	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+	flags.Set(t, "executor.oci.max_output_bytes", int64(1000))
 
 	buildRoot := testfs.MakeTempDir(t)
 
@@ -558,47 +824,62 @@ func TestDevices(t *testing.T) {
 	require.NoError(t, err)
 	wd := testfs.MakeDirAll(t, buildRoot, "work")
 
-	// Create
-	c, err := provider.New(ctx, &container.Init{
-		Props: &platform.Properties{
-			ContainerImage: image,
-		},
-	})
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+	}})
 	require.NoError(t, err)
-	res := c.Run(ctx, &repb.Command{
-		Arguments: []string{"sh", "-e", "-c", `
-			# Print out device file types and major/minor device numbers
-			stat -c '%n: %F (%t,%T)' /dev/null /dev/zero /dev/random /dev/urandom
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err = c.Remove(ctx)
+		require.NoError(t, err)
+	})
 
-			# Perform a bit of device I/O
-			cat /dev/random | head -c1 >/dev/null
-			cat /dev/urandom | head -c1 >/dev/null
-			cat /dev/zero | head -c1 >/dev/null
-			echo foo >/dev/null
-		`},
-	}, wd, oci.Credentials{})
+	// Output beyond the limit should be discarded without blocking the
+	// process.
+	cmd := &repb.Command{Arguments: []string{"sh", "-c", "head -c 10000000 /dev/zero && echo err >&2"}}
+	res := c.Exec(ctx, cmd, &interfaces.Stdio{})
 	require.NoError(t, res.Error)
 	assert.Equal(t, 0, res.ExitCode)
-	expectedLines := []string{
-		"/dev/null: character special file (1,3)",
-		"/dev/zero: character special file (1,5)",
-		"/dev/random: character special file (1,8)",
-		"/dev/urandom: character special file (1,9)",
+	assert.Len(t, res.Stdout, 1000)
+	assert.True(t, res.StdoutTruncated)
+	assert.Equal(t, int64(10000000), res.StdoutSize)
+	assert.Equal(t, "err\n", string(res.Stderr))
+	assert.False(t, res.StderrTruncated)
+
+	// Test each truncation mode with output that is written in many small
+	// chunks.
+	cmd = &repb.Command{Arguments: []string{"seq", "1", "100000"}}
+	var seq strings.Builder
+	for i := 1; i <= 100000; i++ {
+		fmt.Fprintf(&seq, "%d\n", i)
+	}
+	expected := seq.String()
+	for _, test := range []struct {
+		name      string
+		mode      interfaces.OutputTruncationMode
+		stdout    string
+		truncated bool
+	}{
+		{name: "head", mode: interfaces.TruncateHead, stdout: expected[:1000], truncated: true},
+		{name: "tail", mode: interfaces.TruncateTail, stdout: expected[len(expected)-1000:], truncated: true},
+		{name: "none", mode: interfaces.TruncateNone, stdout: expected, truncated: false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			res := c.Exec(ctx, cmd, &interfaces.Stdio{OutputTruncation: test.mode})
+			require.NoError(t, res.Error)
+			assert.Equal(t, 0, res.ExitCode)
+			assert.Equal(t, test.stdout, string(res.Stdout))
+			assert.Equal(t, test.truncated, res.StdoutTruncated)
+			assert.Equal(t, int64(len(expected)), res.StdoutSize)
+		})
 	}
-	assert.Equal(t, strings.Join(expectedLines, "\n")+"\n", string(res.Stdout))
-	assert.Equal(t, "", string(res.Stderr))
 }
 
-func TestNetwork_Enabled(t *testing.T) {
+func TestConcurrentExec(t *testing.T) {
 	testnetworking.Setup(t)
 
-	// Note: busybox has ping, but it fails with 'permission denied (are you
-	// root?)' This is fixed by adding CAP_NET_RAW but we don't want to do this.
-	// So just use the net-tools image which doesn't have this issue for
-	// whatever reason (presumably it's some difference in the ping
-	// implementation) - it's enough to just set `net.ipv4.ping_group_range`.
-	// (Note that podman has this same issue.)
-	image := netToolsImage(t)
+	image := manuallyProvisionedBusyboxImage(t)
 
 	ctx := context.Background()
 	env := testenv.GetTestEnv(t)
@@ -616,36 +897,48 @@ func TestNetwork_Enabled(t *testing.T) {
 		ContainerImage: image,
 	}})
 	require.NoError(t, err)
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
 	t.Cleanup(func() {
-		err := c.Remove(ctx)
+		err = c.Remove(ctx)
 		require.NoError(t, err)
 	})
 
-	// Run
-	cmd := &repb.Command{
-		Arguments: []string{"sh", "-ec", `
-			ping -c1 -W1 $(hostname)
-			ping -c1 -W2 8.8.8.8
-			ping -c1 -W2 example.com
-		`},
+	// Run execs which interleave their output, and make sure that each
+	// exec's stdio is isolated from the others.
+	const n = 8
+	results := make([]*interfaces.CommandResult, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cmd := &repb.Command{Arguments: []string{"sh", "-c", fmt.Sprintf(`
+				cat
+				for j in 1 2 3; do
+					echo out-%d
+					echo err-%d >&2
+					sleep 0.01
+				done
+				exit %d
+			`, i, i, i)}}
+			stdio := &interfaces.Stdio{Stdin: strings.NewReader(fmt.Sprintf("in-%d\n", i))}
+			results[i] = c.Exec(ctx, cmd, stdio)
+		}()
+	}
+	wg.Wait()
+	for i, res := range results {
+		require.NoError(t, res.Error)
+		assert.Equal(t, i, res.ExitCode)
+		assert.Equal(t, fmt.Sprintf("in-%d\n", i)+strings.Repeat(fmt.Sprintf("out-%d\n", i), 3), string(res.Stdout))
+		assert.Equal(t, strings.Repeat(fmt.Sprintf("err-%d\n", i), 3), string(res.Stderr))
 	}
-	res := c.Run(ctx, cmd, wd, oci.Credentials{})
-	require.NoError(t, res.Error)
-	t.Logf("stdout: %s", string(res.Stdout))
-	assert.Empty(t, string(res.Stderr))
-	assert.Equal(t, 0, res.ExitCode)
 }
 
-func TestNetwork_Disabled(t *testing.T) {
+func TestCreateWithStaleContainerState(t *testing.T) {
 	testnetworking.Setup(t)
 
-	// Note: busybox has ping, but it fails with 'permission denied (are you
-	// root?)' This is fixed by adding CAP_NET_RAW but we don't want to do this.
-	// So just use the net-tools image which doesn't have this issue for
-	// whatever reason (presumably it's some difference in the ping
-	// implementation) - it's enough to just set `net.ipv4.ping_group_range`.
-	// (Note that podman has this same issue.)
-	image := netToolsImage(t)
+	image := manuallyProvisionedBusyboxImage(t)
 
 	ctx := context.Background()
 	env := testenv.GetTestEnv(t)
@@ -654,43 +947,63 @@ func TestNetwork_Disabled(t *testing.T) {
 	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
 
 	buildRoot := testfs.MakeTempDir(t)
+	containersRoot := filepath.Join(buildRoot, "executor", "oci", "run")
 
 	provider, err := ociruntime.NewProvider(env, buildRoot)
 	require.NoError(t, err)
 	wd := testfs.MakeDirAll(t, buildRoot, "work")
 
+	// Simulate state left behind by a previous container with the same ID
+	// as the first one generated for the new container.
+	randomCID := func() string {
+		return fmt.Sprintf("%016x%016x%016x%016x", rand.Uint64(), rand.Uint64(), rand.Uint64(), rand.Uint64())
+	}
+	staleCID := randomCID()
+	testfs.WriteAllFileContents(t, runtimeRoot, map[string]string{
+		filepath.Join(staleCID, "status"): "{}",
+	})
+	testfs.WriteAllFileContents(t, containersRoot, map[string]string{
+		filepath.Join(staleCID, "config.json"): "{}",
+	})
+	var generated []string
+	t.Cleanup(ociruntime.SetCIDGeneratorForTest(func() (string, error) {
+		cid := randomCID()
+		if len(generated) == 0 {
+			cid = staleCID
+		}
+		generated = append(generated, cid)
+		return cid, nil
+	}))
+
 	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
 		ContainerImage: image,
-		DockerNetwork:  "off",
 	}})
 	require.NoError(t, err)
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
 	t.Cleanup(func() {
 		err := c.Remove(ctx)
 		require.NoError(t, err)
 	})
+	require.Len(t, generated, 2, "a new container ID should be generated")
+	assert.Equal(t, generated[1], c.(interface{ ID() string }).ID())
 
-	// Run
-	cmd := &repb.Command{
-		Arguments: []string{"sh", "-ec", `
-			# Should still have a loopback device available.
-			ping -c1 -W1 $(hostname)
-
-			if ping -c1 -W2 8.8.8.8 2>/dev/null; then
-				echo >&2 'Should not be able to ping external network'
-				exit 1
-			fi
-		`},
-	}
-	res := c.Run(ctx, cmd, wd, oci.Credentials{})
+	res := c.Exec(ctx, &repb.Command{Arguments: []string{"echo", "hello"}}, &interfaces.Stdio{})
 	require.NoError(t, res.Error)
-	t.Logf("stdout: %s", string(res.Stdout))
-	assert.Empty(t, string(res.Stderr))
+	assert.Equal(t, "hello\n", string(res.Stdout))
 	assert.Equal(t, 0, res.ExitCode)
+
+	// The stale state may belong to something else, so it should be left
+	// alone.
+	assert.FileExists(t, filepath.Join(runtimeRoot, staleCID, "status"))
+	assert.FileExists(t, filepath.Join(containersRoot, staleCID, "config.json"))
 }
 
-func TestUser(t *testing.T) {
+func TestContainerID(t *testing.T) {
 	testnetworking.Setup(t)
 
+	image := manuallyProvisionedBusyboxImage(t)
+
 	ctx := context.Background()
 	env := testenv.GetTestEnv(t)
 
@@ -698,106 +1011,55 @@ func TestUser(t *testing.T) {
 	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
 
 	buildRoot := testfs.MakeTempDir(t)
+	containersRoot := filepath.Join(buildRoot, "executor", "oci", "run")
 
 	provider, err := ociruntime.NewProvider(env, buildRoot)
 	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
 
-	for _, test := range []struct {
-		name       string
-		props      *platform.Properties
-		expectedID string
-	}{
-		{
-			name: "Busybox/Default",
-			props: &platform.Properties{
-				ContainerImage: realBusyboxImage(t),
-			},
-			expectedID: "uid=0(root) gid=0(root) groups=0(root)",
-		},
-		{
-			name: "Busybox/UnknownUID",
-			props: &platform.Properties{
-				ContainerImage: realBusyboxImage(t),
-				DockerUser:     "2024",
-			},
-			expectedID: "uid=2024 gid=0(root) groups=0(root)",
-		},
-		{
-			name: "Busybox/UnknownUIDAndGID",
-			props: &platform.Properties{
-				ContainerImage: realBusyboxImage(t),
-				DockerUser:     "2024:2024",
-			},
-			expectedID: "uid=2024 gid=2024 groups=2024",
-		},
-		{
-			name: "TestImage/ForceRoot",
-			props: &platform.Properties{
-				ContainerImage:  imageConfigTestImage(t),
-				DockerForceRoot: true,
-			},
-			// With force-root, we only specify uid=0, and no gid.
-			// So we should be running with all groups that uid 0 is a part of.
-			expectedID: "uid=0(root) gid=0(root) groups=0(root),1(bin),2(daemon),3(sys),4(adm),6(disk),10(wheel),11(floppy),20(dialout),26(tape),27(video)",
-		},
-		{
-			name: "TestImage/DefaultToImageUSER",
-			props: &platform.Properties{
-				ContainerImage: imageConfigTestImage(t),
-			},
-			// There's a USER directive specifying that buildbuddy should be
-			// used, so this should override the default (root).
-			expectedID: "uid=1000(buildbuddy) gid=1000(buildbuddy) groups=1000(buildbuddy)",
-		},
-		{
-			name: "TestImage/UserProp=buildbuddy",
-			props: &platform.Properties{
-				ContainerImage: imageConfigTestImage(t),
-				DockerUser:     "buildbuddy",
-			},
-			expectedID: "uid=1000(buildbuddy) gid=1000(buildbuddy) groups=1000(buildbuddy)",
-		},
-		{
-			name: "TestImage/UserProp=1001(basil)",
-			props: &platform.Properties{
-				ContainerImage: imageConfigTestImage(t),
-				DockerUser:     "1001",
-			},
-			expectedID: "uid=1001(basil) gid=1001(basil) groups=1001(basil),1002(auxgroup)",
-		},
-		{
-			name: "TestImage/UserProp=basil:basil",
-			props: &platform.Properties{
-				ContainerImage: imageConfigTestImage(t),
-				DockerUser:     "basil:basil",
-			},
-			// Extra groups aren't included when explicitly setting a group ID
-			expectedID: "uid=1001(basil) gid=1001(basil) groups=1001(basil)",
-		},
-	} {
-		t.Run(test.name, func(t *testing.T) {
-			wd := testfs.MakeDirAll(t, buildRoot, uuid.New())
-			c, err := provider.New(ctx, &container.Init{Props: test.props})
-			require.NoError(t, err)
-			t.Cleanup(func() {
-				err := c.Remove(ctx)
-				require.NoError(t, err)
-			})
-			cmd := &repb.Command{Arguments: []string{"id"}}
-			res := c.Run(ctx, cmd, wd, oci.Credentials{})
-			require.NoError(t, res.Error)
-			assert.Equal(t, test.expectedID, strings.TrimSpace(string(res.Stdout)))
-			assert.Empty(t, string(res.Stderr))
-			assert.Equal(t, 0, res.ExitCode)
-		})
-	}
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+	}})
+	require.NoError(t, err)
+	id := c.(interface{ ID() string }).ID()
+	require.NotEmpty(t, id)
+
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+	assert.Equal(t, id, c.(interface{ ID() string }).ID())
+	assert.DirExists(t, filepath.Join(runtimeRoot, id))
+	assert.DirExists(t, filepath.Join(containersRoot, id))
+
+	res := c.Exec(ctx, &repb.Command{Arguments: []string{"true"}}, &interfaces.Stdio{})
+	require.NoError(t, res.Error)
+	require.Equal(t, 0, res.ExitCode)
+	assert.Equal(t, id, c.(interface{ ID() string }).ID())
+
+	err = c.Pause(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, id, c.(interface{ ID() string }).ID())
+	err = c.Unpause(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, id, c.(interface{ ID() string }).ID())
 
+	// Each container gets its own ID.
+	other, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+	}})
+	require.NoError(t, err)
+	assert.NotEqual(t, id, other.(interface{ ID() string }).ID())
+	err = other.Remove(ctx)
+	require.NoError(t, err)
 }
 
-func TestOverlayfsEdgeCases(t *testing.T) {
+func TestCreateExecRemove_Tty(t *testing.T) {
 	testnetworking.Setup(t)
 
-	image := imageConfigTestImage(t)
+	image := manuallyProvisionedBusyboxImage(t)
 
 	ctx := context.Background()
 	env := testenv.GetTestEnv(t)
@@ -815,26 +1077,32 @@ func TestOverlayfsEdgeCases(t *testing.T) {
 		ContainerImage: image,
 	}})
 	require.NoError(t, err)
+
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
 	t.Cleanup(func() {
-		err := c.Remove(ctx)
+		err = c.Remove(ctx)
 		require.NoError(t, err)
 	})
 
-	// Run
-	cmd := &repb.Command{Arguments: []string{"sh", "-c", `
-		test "$(cat /test/foo)" -eq 2 || echo >&2 "/test/foo contains $(cat /test/foo) but should contain '2'"
-		test -e /test/DELETED_DIR && echo >&2 "/test/DELETED_DIR unexpectedly exists"
-		test -e /test/DELETED_FILE && echo >&2 "/test/DELETED_FILE unexpectedly exists"
-		exit 0
-	`}}
-	res := c.Run(ctx, cmd, wd, oci.Credentials{})
+	// Without a tty, stdout is a pipe.
+	cmd := &repb.Command{Arguments: []string{"sh", "-c", "test -t 1 && echo tty || echo notty"}}
+	res := c.Exec(ctx, cmd, &interfaces.Stdio{})
+	require.NoError(t, res.Error)
+	assert.Equal(t, 0, res.ExitCode)
+	assert.Equal(t, "notty\n", string(res.Stdout))
+
+	// With a tty, stdin and stdout are a terminal, and stderr is merged into
+	// stdout. Note that the terminal translates "\n" to "\r\n".
+	cmd = &repb.Command{Arguments: []string{"sh", "-c", "test -t 0 && test -t 1 && tty && echo err >&2"}}
+	res = c.Exec(ctx, cmd, &interfaces.Stdio{Tty: true})
 	require.NoError(t, res.Error)
-	assert.Empty(t, string(res.Stdout))
-	assert.Empty(t, string(res.Stderr))
 	assert.Equal(t, 0, res.ExitCode)
+	assert.Regexp(t, `^/dev/pts/\d+\r\nerr\r\n$`, string(res.Stdout))
+	assert.Empty(t, string(res.Stderr))
 }
 
-func TestPersistentWorker(t *testing.T) {
+func TestRemoveGracePeriod(t *testing.T) {
 	testnetworking.Setup(t)
 
 	image := manuallyProvisionedBusyboxImage(t)
@@ -844,68 +1112,142 @@ func TestPersistentWorker(t *testing.T) {
 
 	runtimeRoot := testfs.MakeTempDir(t)
 	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+	flags.Set(t, "executor.oci.stop_grace_period", 10*time.Second)
 
-	// Create workspace with testworker binary
 	buildRoot := testfs.MakeTempDir(t)
-	ws, err := workspace.New(env, buildRoot, &workspace.Opts{Preserve: true})
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
 	require.NoError(t, err)
-	testworkerPath, err := runfiles.Rlocation(testworkerRlocationpath)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+	}})
 	require.NoError(t, err)
-	testfs.CopyFile(t, testworkerPath, ws.Path(), "testworker")
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+
+	// Start a background process that handles SIGTERM by writing a file.
+	cmd := &repb.Command{Arguments: []string{"sh", "-c", `
+		sh -c '
+			trap "touch TERMINATED; exit 0" TERM
+			touch READY
+			while true; do sleep 0.1; done
+		' >/dev/null 2>&1 &
+	`}}
+	res := c.Exec(ctx, cmd, &interfaces.Stdio{})
+	require.NoError(t, res.Error)
+	require.Equal(t, 0, res.ExitCode)
+	err = disk.WaitUntilExists(ctx, filepath.Join(wd, "READY"), disk.WaitOpts{Timeout: 10 * time.Second})
+	require.NoError(t, err)
+
+	// Remove should give the process a chance to exit gracefully, and
+	// shouldn't wait for the full grace period once it does.
+	start := time.Now()
+	err = c.Remove(ctx)
+	require.NoError(t, err)
+	assert.Less(t, time.Since(start), 10*time.Second)
+	assert.FileExists(t, filepath.Join(wd, "TERMINATED"))
+}
+
+func TestRemoveTwice(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := realBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+	containersRoot := filepath.Join(buildRoot, "executor", "oci", "run")
 
 	provider, err := ociruntime.NewProvider(env, buildRoot)
 	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
 
 	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
 		ContainerImage: image,
 	}})
 	require.NoError(t, err)
+	err = c.PullImage(ctx, oci.Credentials{})
+	require.NoError(t, err)
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
 
-	// Create container
+	// Hold a file open in the rootfs so that the overlayfs mount is busy
+	// when the container is removed.
+	bundles, err := os.ReadDir(containersRoot)
 	require.NoError(t, err)
-	err = c.Create(ctx, ws.Path())
+	require.Len(t, bundles, 1)
+	f, err := os.Open(filepath.Join(containersRoot, bundles[0].Name(), "rootfs", "bin", "sh"))
 	require.NoError(t, err)
-	t.Cleanup(func() {
-		err = c.Remove(ctx)
-		require.NoError(t, err)
-	})
+	defer f.Close()
 
-	// Prepare a static response that the persistent worker will return on each
-	// request.
-	responseBase64 := ""
-	{
-		rsp := &wkpb.WorkResponse{
-			Output:   "test-output",
-			ExitCode: 42,
-		}
-		b, err := proto.Marshal(rsp)
-		require.NoError(t, err)
-		size := make([]byte, binary.MaxVarintLen64)
-		n := binary.PutUvarint(size, uint64(len(b)))
-		responseBase64 = base64.StdEncoding.EncodeToString(append(size[:n], b...))
-	}
+	err = c.Remove(ctx)
+	require.NoError(t, err)
+	assert.NoDirExists(t, filepath.Join(containersRoot, bundles[0].Name()))
+	assert.NoDirExists(t, wd+".overlay")
 
-	// Start worker (Exec)
-	worker := persistentworker.Start(ctx, ws, c, "proto" /*=protocol*/, &repb.Command{
-		Arguments: []string{"./testworker", "--persistent_worker", "--response_base64", responseBase64},
-	})
+	// Removing the container again should be a no-op.
+	err = c.Remove(ctx)
+	require.NoError(t, err)
+}
 
-	// Send work request.
-	// The command doesn't matter - the test worker always just returns a fixed
-	// response.
-	res := worker.Exec(ctx, &repb.Command{})
+func TestProviderShutdown(t *testing.T) {
+	testnetworking.Setup(t)
 
-	assert.Equal(t, "test-output", string(res.Stderr))
-	assert.Equal(t, 42, res.ExitCode)
+	image := manuallyProvisionedBusyboxImage(t)
 
-	// Pause container and stop worker
-	err = c.Pause(ctx)
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+	containersRoot := filepath.Join(buildRoot, "executor", "oci", "run")
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
 	require.NoError(t, err)
-	err = worker.Stop()
-	assert.NoError(t, err)
+
+	// Create a couple of containers which are never removed by their
+	// owners, as well as one which is.
+	var containers []container.CommandContainer
+	for i := range 3 {
+		wd := testfs.MakeDirAll(t, buildRoot, fmt.Sprintf("work-%d", i))
+		c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+			ContainerImage: image,
+		}})
+		require.NoError(t, err)
+		err = c.Create(ctx, wd)
+		require.NoError(t, err)
+		containers = append(containers, c)
+	}
+	err = containers[0].Remove(ctx)
+	require.NoError(t, err)
+
+	err = provider.Shutdown(ctx)
+	require.NoError(t, err)
+	assert.NoDirExists(t, containersRoot)
+
+	// Removing the containers again should be a no-op.
+	for _, c := range containers {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	}
+
+	// New containers can't be created after shutdown.
+	_, err = provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+	}})
+	require.Error(t, err)
+	assert.True(t, status.IsUnavailableError(err), "expected Unavailable error, got %v", err)
 }
 
-func TestCancelRun(t *testing.T) {
+func TestExecCombinedOutput(t *testing.T) {
 	testnetworking.Setup(t)
 
 	image := manuallyProvisionedBusyboxImage(t)
@@ -926,42 +1268,37 @@ func TestCancelRun(t *testing.T) {
 		ContainerImage: image,
 	}})
 	require.NoError(t, err)
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
 	t.Cleanup(func() {
-		err := c.Remove(context.Background())
+		err := c.Remove(ctx)
 		require.NoError(t, err)
 	})
 
-	// Run
-	childID := "child" + fmt.Sprint(rand.Uint64())
-	cmd := &repb.Command{
-		Arguments: []string{"sh", "-c", `
-			echo "Hello world!"
-			touch ./DONE
-			sh -c "sleep 1000000000 # ` + childID + `" &
-			sleep 1000000000
-		`},
-	}
-	// Wait for the command to write the file "DONE" which means it is done
-	// writing to stdout.
-	ctx, cancel := context.WithCancel(ctx)
-	go func() {
-		defer cancel()
-		err := disk.WaitUntilExists(ctx, filepath.Join(wd, "DONE"), disk.WaitOpts{Timeout: -1})
-		require.NoError(t, err)
-	}()
-	res := c.Run(ctx, cmd, wd, oci.Credentials{})
-	assert.True(t, status.IsCanceledError(res.Error), "expected CanceledError, got %+#v", res.Error)
-	assert.Equal(t, "Hello world!\n", string(res.Stdout))
-	assert.Empty(t, string(res.Stderr))
-	// Make sure all child processes were killed.
-	out := testshell.Run(t, wd, `( ps aux | grep `+childID+` | grep -v grep ) || true`)
-	assert.Empty(t, out)
+	cmd := &repb.Command{Arguments: []string{"sh", "-c", `
+		echo out1
+		sleep 0.1
+		printf 'err' >&2
+		printf '1\n' >&2
+		sleep 0.1
+		echo out2
+		sleep 0.1
+		printf err2 >&2
+	`}}
+	combined := &bytes.Buffer{}
+	res := c.Exec(ctx, cmd, &interfaces.Stdio{Combined: combined})
+	require.NoError(t, res.Error)
+	assert.Equal(t, 0, res.ExitCode)
+	assert.Equal(t, "out1\nerr1\nout2\nerr2", combined.String())
+	// Stdout and stderr should still be captured separately.
+	assert.Equal(t, "out1\nout2\n", string(res.Stdout))
+	assert.Equal(t, "err1\nerr2", string(res.Stderr))
 }
 
-func TestCancelExec(t *testing.T) {
+func TestExecUsageStats(t *testing.T) {
 	testnetworking.Setup(t)
 
-	image := manuallyProvisionedBusyboxImage(t)
+	image := realBusyboxImage(t)
 
 	ctx := context.Background()
 	env := testenv.GetTestEnv(t)
@@ -979,55 +1316,4671 @@ func TestCancelExec(t *testing.T) {
 		ContainerImage: image,
 	}})
 	require.NoError(t, err)
-	// Create
+	err = c.PullImage(ctx, oci.Credentials{})
+	require.NoError(t, err)
 	err = c.Create(ctx, wd)
 	require.NoError(t, err)
-	removed := false
 	t.Cleanup(func() {
-		if removed {
-			return
-		}
-		err := c.Remove(context.Background())
+		err = c.Remove(ctx)
 		require.NoError(t, err)
 	})
-	childID := "child" + fmt.Sprint(rand.Uint64())
-	cmd := &repb.Command{
-		Arguments: []string{"sh", "-c", `
-			echo "Hello world!"
-			touch ./DONE
-			sh -c "sleep 1000000000 # ` + childID + `" &
-			sleep 1000000000
-		`},
-	}
-	// Wait for the command to write the file "DONE" which means it is done
-	// writing to stdout.
-	ctx, cancel := context.WithCancel(ctx)
-	go func() {
-		defer cancel()
-		err := disk.WaitUntilExists(ctx, filepath.Join(wd, "DONE"), disk.WaitOpts{Timeout: -1})
+
+	// Exec
+	cmd := &repb.Command{Arguments: []string{"sleep", "0.5"}}
+	res := c.Exec(ctx, cmd, &interfaces.Stdio{})
+	require.NoError(t, res.Error)
+	require.Equal(t, 0, res.ExitCode)
+	assert.Greater(t, res.UsageStats.GetMemoryBytes(), int64(0), "memory")
+	assert.Greater(t, res.UsageStats.GetCpuNanos(), int64(0), "CPU")
+
+	// Stats
+	s, err := c.Stats(ctx)
+	require.NoError(t, err)
+	assert.Greater(t, s.GetMemoryBytes(), int64(0), "memory")
+	assert.Greater(t, s.GetCpuNanos(), int64(0), "CPU")
+}
+
+func TestStreamStats(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+	}})
+	require.NoError(t, err)
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+	removed := false
+	t.Cleanup(func() {
+		if removed {
+			return
+		}
+		err := c.Remove(ctx)
 		require.NoError(t, err)
-	}()
+	})
+
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	statsCh := c.(interface {
+		StreamStats(context.Context, time.Duration) <-chan *repb.UsageStats
+	}).StreamStats(streamCtx, 10*time.Millisecond)
+
+	// Burn some CPU while collecting samples.
+	cmd := &repb.Command{Arguments: []string{"sh", "-c", "timeout 1 sh -c 'while true; do :; done' || true"}}
 	res := c.Exec(ctx, cmd, &interfaces.Stdio{})
-	assert.True(t, status.IsCanceledError(res.Error), "expected CanceledError, got %+#v", res.Error)
-	assert.Equal(t, "Hello world!\n", string(res.Stdout))
-	assert.Empty(t, string(res.Stderr))
-	// Make sure all child processes were killed.
-	// In the Exec() case, it's fine if child processes stick around until we
-	// call Remove().
-	err = c.Remove(context.Background())
+	require.NoError(t, res.Error)
+
+	var samples []*repb.UsageStats
+	for len(samples) < 5 {
+		samples = append(samples, <-statsCh)
+	}
+	for _, s := range samples {
+		assert.Greater(t, s.GetMemoryBytes(), int64(0), "memory")
+	}
+	assert.Greater(t, samples[len(samples)-1].GetCpuNanos(), int64(0), "CPU")
+
+	// The stream should end once the container is removed.
+	err = c.Remove(ctx)
 	require.NoError(t, err)
 	removed = true
-	out := testshell.Run(t, wd, `( ps aux | grep `+childID+` | grep -v grep ) || true`)
-	assert.Empty(t, out)
+	for range statsCh {
+	}
 }
 
-func hasMountPermissions(t *testing.T) bool {
-	dir1 := testfs.MakeTempDir(t)
-	dir2 := testfs.MakeTempDir(t)
-	if err := syscall.Mount(dir1, dir2, "", syscall.MS_BIND, ""); err != nil {
-		return false
+func TestPullCreateExecRemove(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := imageConfigTestImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	c, err := provider.New(ctx, &container.Init{
+		Props: &platform.Properties{
+			ContainerImage: image,
+		},
+	})
+	require.NoError(t, err)
+
+	// Pull
+	err = c.PullImage(ctx, oci.Credentials{})
+	require.NoError(t, err)
+
+	// Ensure cached
+	cached, err := c.IsImageCached(ctx)
+	require.NoError(t, err)
+	assert.True(t, cached, "IsImageCached")
+
+	// Create
+	require.NoError(t, err)
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err = c.Remove(ctx)
+		require.NoError(t, err)
+	})
+
+	// Exec
+	cmd := &repb.Command{
+		Arguments: []string{"sh", "-ec", `
+			touch /bin/foo.txt
+			pwd
+			env | sort
+		`},
+		EnvironmentVariables: []*repb.Command_EnvironmentVariable{
+			{Name: "GREETING", Value: "Hello"},
+		},
+	}
+	stdio := interfaces.Stdio{}
+	res := c.Exec(ctx, cmd, &stdio)
+	require.NoError(t, res.Error)
+
+	assert.Equal(t, 0, res.ExitCode)
+	assert.Empty(t, string(res.Stderr))
+	assert.Equal(t, `/buildbuddy-execroot
+GREETING=Hello
+HOME=/root
+HOSTNAME=localhost
+PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin:/test/bin
+PWD=/buildbuddy-execroot
+SHLVL=1
+TEST_ENV_VAR=foo
+`, string(res.Stdout))
+
+	// Make sure the image layers were unmodified and that foo.txt was written
+	// to the upper dir in the overlayfs.
+	layersRoot := filepath.Join(buildRoot, "executor", "oci", "layers")
+	err = filepath.WalkDir(layersRoot, func(path string, entry fs.DirEntry, err error) error {
+		require.NoError(t, err)
+		assert.NotEqual(t, entry.Name(), "foo.txt")
+		return nil
+	})
+	require.NoError(t, err)
+	assert.True(t, testfs.Exists(t, "", filepath.Join(wd+".overlay", "upper", "bin", "foo.txt")))
+
+	// Files written to the rootfs should count towards the container disk
+	// usage, but files written to the workspace should not.
+	cmd = &repb.Command{Arguments: []string{"sh", "-ec", `
+		head -c 1000000 /dev/zero > /tmp/rootfs.bin
+		head -c 5000000 /dev/zero > ./workspace.bin
+	`}}
+	res = c.Exec(ctx, cmd, &interfaces.Stdio{})
+	require.NoError(t, res.Error)
+	require.Equal(t, 0, res.ExitCode)
+	assert.GreaterOrEqual(t, res.UsageStats.GetContainerDiskBytes(), int64(1_000_000))
+	assert.Less(t, res.UsageStats.GetContainerDiskBytes(), int64(5_000_000))
+}
+
+func TestReadOnlyRootfs(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+		ReadOnlyRootfs: true,
+	}})
+	require.NoError(t, err)
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err = c.Remove(ctx)
+		require.NoError(t, err)
+	})
+
+	cmd := &repb.Command{Arguments: []string{"sh", "-c", `
+		touch /bin/foo.txt
+		touch /buildbuddy-execroot/foo.txt
+	`}}
+	res := c.Exec(ctx, cmd, &interfaces.Stdio{})
+	require.NoError(t, res.Error)
+	assert.Equal(t, 0, res.ExitCode)
+	assert.Contains(t, string(res.Stderr), "Read-only file system")
+	assert.True(t, testfs.Exists(t, wd, "foo.txt"))
+}
+
+func TestBindMounts(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+	hostDir := testfs.MakeTempDir(t)
+	testfs.WriteAllFileContents(t, hostDir, map[string]string{"toolchain/VERSION": "1.2.3"})
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	props := &platform.Properties{
+		ContainerImage: image,
+		BindMounts: []*platform.BindMount{
+			{Source: filepath.Join(hostDir, "toolchain"), Target: "/toolchain", ReadOnly: true},
+		},
+	}
+
+	// Bind mounts should be rejected unless explicitly allowed.
+	_, err = provider.New(ctx, &container.Init{Props: props})
+	require.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied error, got %v", err)
+
+	flags.Set(t, "executor.oci.allowed_bind_mount_sources", []string{hostDir})
+	c, err := provider.New(ctx, &container.Init{Props: props})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+
+	cmd := &repb.Command{Arguments: []string{"sh", "-c", `
+		cat /toolchain/VERSION
+		touch /toolchain/foo.txt
+	`}}
+	res := c.Run(ctx, cmd, wd, oci.Credentials{})
+	require.NoError(t, res.Error)
+	assert.Equal(t, "1.2.3", string(res.Stdout))
+	assert.Contains(t, string(res.Stderr), "Read-only file system")
+	assert.False(t, testfs.Exists(t, hostDir, "toolchain/foo.txt"))
+	// The caller's properties should not be modified.
+	assert.Equal(t, filepath.Join(hostDir, "toolchain"), props.BindMounts[0].Source)
+
+	// If the source is replaced with a symlink to a disallowed path after
+	// the container is created, mounting it should fail.
+	outsideDir := testfs.MakeTempDir(t)
+	swapDir := testfs.MakeDirAll(t, hostDir, "swap")
+	c2, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+		BindMounts:     []*platform.BindMount{{Source: swapDir, Target: "/swap"}},
+	}})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c2.Remove(ctx)
+		require.NoError(t, err)
+	})
+	err = os.Remove(swapDir)
+	require.NoError(t, err)
+	err = os.Symlink(outsideDir, swapDir)
+	require.NoError(t, err)
+	wd2 := testfs.MakeDirAll(t, buildRoot, "work2")
+	res = c2.Run(ctx, &repb.Command{Arguments: []string{"ls", "/swap"}}, wd2, oci.Credentials{})
+	require.Error(t, res.Error)
+	assert.Contains(t, res.Error.Error(), "not allowed by this executor")
+}
+
+func TestCreateExecPauseUnpause(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+	}})
+	require.NoError(t, err)
+
+	// Create
+	require.NoError(t, err)
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err = c.Remove(ctx)
+		require.NoError(t, err)
+	})
+
+	// Exec: start a bg process that increments a counter file every 10ms.
+	const updateInterval = 10 * time.Millisecond
+	cmd := &repb.Command{Arguments: []string{"sh", "-c", `
+		printf 0 > count.txt
+		(
+			count=0
+			while true; do
+				count=$((count+1))
+				printf '%d' "$count" > count.txt
+				sleep ` + fmt.Sprintf("%f", updateInterval.Seconds()) + `
+			done
+		) &
+	`}}
+	res := c.Exec(ctx, cmd, &interfaces.Stdio{})
+	require.NoError(t, res.Error)
+
+	t.Logf("Started update process in container")
+
+	assert.Empty(t, string(res.Stderr))
+	assert.Empty(t, string(res.Stdout))
+	require.Equal(t, 0, res.ExitCode)
+
+	readCounterFile := func() int {
+		for {
+			b, err := os.ReadFile(filepath.Join(wd, "count.txt"))
+			require.NoError(t, err)
+			s := string(b)
+			if s == "" {
+				// File is being written concurrently; retry
+				continue
+			}
+			c, err := strconv.Atoi(s)
+			require.NoError(t, err)
+			return c
+		}
+	}
+
+	waitUntilCounterIncremented := func() {
+		var lastCount *int
+		for {
+			count := readCounterFile()
+			if lastCount != nil && count > *lastCount {
+				return
+			}
+			lastCount = &count
+			time.Sleep(updateInterval)
+		}
+	}
+
+	// Counter should be getting continually updated since we started a
+	// background process in the container and we haven't paused yet.
+	waitUntilCounterIncremented()
+
+	// Pause
+	err = c.Pause(ctx)
+	require.NoError(t, err)
+
+	// Counter should not be getting updated anymore since we're paused.
+	d1 := readCounterFile()
+	require.NotEmpty(t, d1)
+	time.Sleep(updateInterval * 10)
+	d2 := readCounterFile()
+	require.Equal(t, d1, d2, "expected counter file not to be updated")
+
+	// Unpause
+	err = c.Unpause(ctx)
+	require.NoError(t, err)
+
+	// Counter should be getting continually updated again since we're unpaused.
+	waitUntilCounterIncremented()
+}
+
+func TestCreateFailureHasStderr(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	// Create
+	c, err := provider.New(ctx, &container.Init{
+		Props: &platform.Properties{
+			ContainerImage: image,
+		},
+	})
+	require.NoError(t, err)
+	err = c.Create(ctx, wd+"nonexistent")
+	require.ErrorContains(t, err, "nonexistent")
+}
+
+func TestSignalExitCode(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+	}})
+	require.NoError(t, err)
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+
+	// Send SIGTERM to a sleeping process from a background subshell.
+	cmd := &repb.Command{Arguments: []string{"sh", "-c", `
+		(sleep 0.5 && kill -TERM $$) &
+		exec sleep 30
+	`}}
+	res := c.Exec(ctx, cmd, &interfaces.Stdio{})
+	require.NoError(t, res.Error)
+	assert.Equal(t, 143, res.ExitCode)
+	assert.Equal(t, syscall.SIGTERM, res.Signal)
+
+	// A normal exit should not record a signal.
+	cmd = &repb.Command{Arguments: []string{"sh", "-c", "exit 3"}}
+	res = c.Exec(ctx, cmd, &interfaces.Stdio{})
+	require.NoError(t, res.Error)
+	assert.Equal(t, 3, res.ExitCode)
+	assert.Equal(t, syscall.Signal(0), res.Signal)
+}
+
+func TestDevices(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	// Create
+	c, err := provider.New(ctx, &container.Init{
+		Props: &platform.Properties{
+			ContainerImage: image,
+		},
+	})
+	require.NoError(t, err)
+	res := c.Run(ctx, &repb.Command{
+		Arguments: []string{"sh", "-e", "-c", `
+			# Print out device file types and major/minor device numbers
+			stat -c '%n: %F (%t,%T)' /dev/null /dev/zero /dev/random /dev/urandom
+
+			# Perform a bit of device I/O
+			cat /dev/random | head -c1 >/dev/null
+			cat /dev/urandom | head -c1 >/dev/null
+			cat /dev/zero | head -c1 >/dev/null
+			echo foo >/dev/null
+		`},
+	}, wd, oci.Credentials{})
+	require.NoError(t, res.Error)
+	assert.Equal(t, 0, res.ExitCode)
+	expectedLines := []string{
+		"/dev/null: character special file (1,3)",
+		"/dev/zero: character special file (1,5)",
+		"/dev/random: character special file (1,8)",
+		"/dev/urandom: character special file (1,9)",
+	}
+	assert.Equal(t, strings.Join(expectedLines, "\n")+"\n", string(res.Stdout))
+	assert.Equal(t, "", string(res.Stderr))
+}
+
+func TestMemoryLimit(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage:   image,
+		MemoryLimitBytes: 32 * 1024 * 1024,
+	}})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+
+	// Run a command that allocates well over the memory limit.
+	cmd := &repb.Command{Arguments: []string{"sh", "-c", `
+		cat /sys/fs/cgroup/memory.max
+		x=$(head -c 128m /dev/zero | tr '\0' a)
+		echo "should have been OOM-killed"
+	`}}
+	res := c.Run(ctx, cmd, wd, oci.Credentials{})
+	assert.True(t, status.IsResourceExhaustedError(res.Error), "expected ResourceExhausted error, got %+#v", res.Error)
+	assert.ErrorContains(t, res.Error, "OOM")
+	assert.ErrorIs(t, res.Error, ociruntime.ErrOOMKilled)
+	assert.True(t, res.OOMKilled)
+	assert.NotEqual(t, 0, res.ExitCode)
+	assert.Equal(t, "33554432\n", string(res.Stdout))
+}
+
+func TestCPULimit(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+
+	for _, test := range []struct {
+		name       string
+		milliCPU   int64
+		wantCPUMax string
+	}{
+		{name: "HalfCPU", milliCPU: 500, wantCPUMax: "50000 100000\n"},
+		// The kernel rejects quotas below 1ms, so tiny limits are raised to
+		// the minimum.
+		{name: "BelowMinimumQuota", milliCPU: 1, wantCPUMax: "1000 100000\n"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			wd := testfs.MakeDirAll(t, buildRoot, "work-"+test.name)
+			c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+				ContainerImage:   image,
+				CPULimitMilliCPU: test.milliCPU,
+			}})
+			require.NoError(t, err)
+			err = c.Create(ctx, wd)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				err := c.Remove(ctx)
+				require.NoError(t, err)
+			})
+
+			res := c.Exec(ctx, &repb.Command{Arguments: []string{"cat", "/sys/fs/cgroup/cpu.max"}}, &interfaces.Stdio{})
+			require.NoError(t, res.Error)
+			assert.Equal(t, 0, res.ExitCode)
+			assert.Equal(t, test.wantCPUMax, string(res.Stdout))
+			assert.Empty(t, string(res.Stderr))
+		})
+	}
+}
+
+func TestPidsLimit(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+		PidsLimit:      8,
+	}})
+	require.NoError(t, err)
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+
+	// Try to spawn more processes than the limit allows; the shell should
+	// fail to fork rather than hanging.
+	cmd := &repb.Command{Arguments: []string{"sh", "-c", `
+		cat /sys/fs/cgroup/pids.max
+		for i in $(seq 16); do sleep 5 & done
+		kill $(jobs -p) 2>/dev/null
+		exit 0
+	`}}
+	res := c.Exec(ctx, cmd, &interfaces.Stdio{})
+	require.NoError(t, res.Error)
+	assert.Equal(t, "8\n", string(res.Stdout))
+	assert.Contains(t, string(res.Stderr), "fork")
+}
+
+func TestContainerHostname(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage:    image,
+		ContainerHostname: "build-host",
+	}})
+	require.NoError(t, err)
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+
+	cmd := &repb.Command{Arguments: []string{"sh", "-ec", `
+		hostname
+		uname -n
+		cat /etc/hostname
+		echo "$HOSTNAME"
+		ping -c1 -W1 build-host >/dev/null
+	`}}
+	res := c.Exec(ctx, cmd, &interfaces.Stdio{})
+	require.NoError(t, res.Error)
+	assert.Equal(t, 0, res.ExitCode, "stderr: %s", string(res.Stderr))
+	assert.Equal(t, "build-host\nbuild-host\nbuild-host\nbuild-host\n", string(res.Stdout))
+}
+
+func TestExtraHosts(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+		ExtraHosts: []*platform.HostEntry{
+			{Hostname: "db.internal", IP: "127.0.0.2"},
+			{Hostname: "cache.internal", IP: "127.0.0.3"},
+		},
+	}})
+	require.NoError(t, err)
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+
+	// The entries should be present on every exec, and should not be
+	// written to the image layers.
+	for i := 0; i < 2; i++ {
+		cmd := &repb.Command{Arguments: []string{"sh", "-ec", `
+			tail -n2 /etc/hosts
+			ping -c1 -W1 db.internal >/dev/null
+		`}}
+		res := c.Exec(ctx, cmd, &interfaces.Stdio{})
+		require.NoError(t, res.Error)
+		assert.Equal(t, 0, res.ExitCode, "stderr: %s", string(res.Stderr))
+		assert.Equal(t, "127.0.0.2 db.internal\n127.0.0.3 cache.internal\n", string(res.Stdout))
+	}
+	layersDir := filepath.Join(buildRoot, "executor", "oci", "layers")
+	err = filepath.WalkDir(layersDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Base(path) != "hosts" {
+			return err
+		}
+		b, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.NotContains(t, string(b), "db.internal", "extra hosts leaked into image layer %s", path)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestDNS(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+
+	for _, test := range []struct {
+		name     string
+		network  string
+		expected string
+	}{
+		{
+			name:     "NetworkEnabled",
+			expected: "nameserver 10.0.0.2\nnameserver 10.0.0.3\nsearch corp.example.com example.com\n",
+		},
+		{
+			name:    "NetworkDisabled",
+			network: "off",
+			// DNS config should be omitted.
+			expected: "",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			wd := testfs.MakeDirAll(t, buildRoot, "work-"+test.name)
+			c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+				ContainerImage: image,
+				DockerNetwork:  test.network,
+				DNSServers:     []string{"10.0.0.2", "10.0.0.3"},
+				DNSSearch:      []string{"corp.example.com", "example.com"},
+			}})
+			require.NoError(t, err)
+			err = c.Create(ctx, wd)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				err := c.Remove(ctx)
+				require.NoError(t, err)
+			})
+
+			cmd := &repb.Command{Arguments: []string{"sh", "-c", "cat /etc/resolv.conf 2>/dev/null || true"}}
+			res := c.Exec(ctx, cmd, &interfaces.Stdio{})
+			require.NoError(t, res.Error)
+			assert.Equal(t, 0, res.ExitCode)
+			assert.Equal(t, test.expected, string(res.Stdout))
+		})
+	}
+}
+
+func TestUlimits(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+		Ulimits: []*platform.Ulimit{
+			{Type: "RLIMIT_NOFILE", Soft: 2048, Hard: 4096},
+			{Type: "RLIMIT_CORE", Soft: 0, Hard: 0},
+		},
+	}})
+	require.NoError(t, err)
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+
+	cmd := &repb.Command{Arguments: []string{"sh", "-c", "ulimit -n && ulimit -Hn && ulimit -c"}}
+	res := c.Exec(ctx, cmd, &interfaces.Stdio{})
+	require.NoError(t, res.Error)
+	assert.Equal(t, 0, res.ExitCode)
+	assert.Equal(t, "2048\n4096\n0\n", string(res.Stdout))
+}
+
+func TestSeccompProfile(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+	flags.Set(t, "executor.oci.allow_seccomp_profile_override", true)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	// Allow everything except chmod.
+	profile := `{
+		"defaultAction": "SCMP_ACT_ALLOW",
+		"syscalls": [
+			{
+				"names": ["chmod", "fchmod", "fchmodat", "fchmodat2"],
+				"action": "SCMP_ACT_ERRNO"
+			}
+		]
+	}`
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+		SeccompProfile: profile,
+	}})
+	require.NoError(t, err)
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+
+	cmd := &repb.Command{Arguments: []string{"sh", "-c", "touch f && chmod 777 f"}}
+	res := c.Exec(ctx, cmd, &interfaces.Stdio{})
+	require.NoError(t, res.Error)
+	assert.NotEqual(t, 0, res.ExitCode)
+	assert.Contains(t, string(res.Stderr), "Operation not permitted")
+
+	// Overriding the profile should not be allowed unless enabled.
+	flags.Set(t, "executor.oci.allow_seccomp_profile_override", false)
+	_, err = provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+		SeccompProfile: profile,
+	}})
+	require.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied error, got %v", err)
+}
+
+func TestAppArmorProfile(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	// Overriding the profile should not be allowed unless enabled.
+	_, err = provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage:  image,
+		AppArmorProfile: "unconfined",
+	}})
+	require.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied error, got %v", err)
+
+	// "unconfined" should work regardless of whether AppArmor is enabled on
+	// the host.
+	flags.Set(t, "executor.oci.allow_apparmor_profile_override", true)
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage:  image,
+		AppArmorProfile: "unconfined",
+	}})
+	require.NoError(t, err)
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+
+	cmd := &repb.Command{Arguments: []string{"sh", "-c", "echo ok"}}
+	res := c.Exec(ctx, cmd, &interfaces.Stdio{})
+	require.NoError(t, res.Error)
+	assert.Equal(t, 0, res.ExitCode)
+	assert.Equal(t, "ok\n", string(res.Stdout))
+}
+
+func TestGPU(t *testing.T) {
+	if _, err := os.Stat("/dev/nvidiactl"); err != nil {
+		t.Skipf("NVIDIA devices are not available: %s", err)
+	}
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+		GPU:            true,
+	}})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+	res := c.Run(ctx, &repb.Command{
+		Arguments: []string{"sh", "-e", "-c", `
+			stat -c '%n: %F' /dev/nvidiactl
+			# Device should be accessible (allowed by cgroup device rules).
+			test -r /dev/nvidiactl
+		`},
+	}, wd, oci.Credentials{})
+	require.NoError(t, res.Error)
+	assert.Equal(t, 0, res.ExitCode)
+	assert.Equal(t, "/dev/nvidiactl: character special file\n", string(res.Stdout))
+	assert.Equal(t, "", string(res.Stderr))
+}
+
+func TestNetwork_Enabled(t *testing.T) {
+	testnetworking.Setup(t)
+
+	// Note: busybox has ping, but it fails with 'permission denied (are you
+	// root?)' This is fixed by adding CAP_NET_RAW but we don't grant it by
+	// default (see TestCapAdd).
+	// So just use the net-tools image which doesn't have this issue for
+	// whatever reason (presumably it's some difference in the ping
+	// implementation) - it's enough to just set `net.ipv4.ping_group_range`.
+	// (Note that podman has this same issue.)
+	image := netToolsImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+	}})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+
+	// Run
+	cmd := &repb.Command{
+		Arguments: []string{"sh", "-ec", `
+			ping -c1 -W1 $(hostname)
+			ping -c1 -W2 8.8.8.8
+			ping -c1 -W2 example.com
+		`},
+	}
+	res := c.Run(ctx, cmd, wd, oci.Credentials{})
+	require.NoError(t, res.Error)
+	t.Logf("stdout: %s", string(res.Stdout))
+	assert.Empty(t, string(res.Stderr))
+	assert.Equal(t, 0, res.ExitCode)
+	// The external pings should be counted in the network stats.
+	assert.Greater(t, res.UsageStats.GetNetworkRxBytes(), int64(0), "rx")
+	assert.Greater(t, res.UsageStats.GetNetworkTxBytes(), int64(0), "tx")
+}
+
+func TestCapAdd(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	// Adding capabilities should not be allowed unless the executor allows
+	// them.
+	_, err = provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+		CapAdd:         []string{"CAP_NET_RAW"},
+	}})
+	require.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied error, got %v", err)
+
+	flags.Set(t, "executor.oci.allowed_added_capabilities", []string{"CAP_NET_RAW"})
+	_, err = provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+		CapAdd:         []string{"CAP_NOT_A_REAL_CAPABILITY"},
+	}})
+	require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error, got %v", err)
+
+	// busybox ping uses a raw socket, which requires CAP_NET_RAW.
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+		CapAdd:         []string{"net_raw"},
+	}})
+	require.NoError(t, err)
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+
+	cmd := &repb.Command{Arguments: []string{"ping", "-c1", "-W1", "127.0.0.1"}}
+	res := c.Exec(ctx, cmd, &interfaces.Stdio{})
+	require.NoError(t, res.Error)
+	assert.Empty(t, string(res.Stderr))
+	assert.Equal(t, 0, res.ExitCode)
+}
+
+func TestNonRootCapabilities(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+	flags.Set(t, "executor.oci.allowed_added_capabilities", []string{"CAP_NET_RAW"})
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	// Non-root processes should not have any capabilities, including added
+	// ones.
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+		CapAdd:         []string{"CAP_NET_RAW"},
+		ContainerUID:   pointer(uint32(1000)),
+		ContainerGID:   pointer(uint32(1000)),
+	}})
+	require.NoError(t, err)
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+
+	cmd := &repb.Command{Arguments: []string{"sh", "-c", `grep -E '^Cap(Inh|Eff|Amb):' /proc/self/status`}}
+	res := c.Exec(ctx, cmd, &interfaces.Stdio{})
+	require.NoError(t, res.Error)
+	assert.Empty(t, string(res.Stderr))
+	assert.Equal(t, 0, res.ExitCode)
+	assert.Equal(t, "CapInh:\t0000000000000000\nCapEff:\t0000000000000000\nCapAmb:\t0000000000000000\n", string(res.Stdout))
+}
+
+func TestPublishPorts(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+		PublishPorts:   []*platform.PortMapping{{HostPort: 0, ContainerPort: 8080}},
+	}})
+	require.NoError(t, err)
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+
+	ports := c.(interface{ PublishedPorts() map[int]int }).PublishedPorts()
+	hostPort := ports[8080]
+	require.NotZero(t, hostPort)
+
+	// Serve a file from the container and fetch it from the host via the
+	// published port.
+	serveCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		cmd := &repb.Command{Arguments: []string{"sh", "-c", `
+			mkdir -p /tmp/www && echo hello > /tmp/www/index.html
+			exec httpd -f -p 8080 -h /tmp/www
+		`}}
+		c.Exec(serveCtx, cmd, &interfaces.Stdio{})
+	}()
+	url := fmt.Sprintf("http://127.0.0.1:%d/index.html", hostPort)
+	var body []byte
+	require.Eventually(t, func() bool {
+		rsp, err := http.Get(url)
+		if err != nil {
+			return false
+		}
+		defer rsp.Body.Close()
+		body, err = io.ReadAll(rsp.Body)
+		return err == nil && rsp.StatusCode == http.StatusOK
+	}, 10*time.Second, 100*time.Millisecond)
+	assert.Equal(t, "hello\n", string(body))
+}
+
+func TestPublishPorts_HostPortNotAllowed(t *testing.T) {
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+
+	props := &platform.Properties{
+		ContainerImage: "docker.io/library/busybox",
+		PublishPorts:   []*platform.PortMapping{{HostPort: 8080, ContainerPort: 8080}},
+	}
+	_, err = provider.New(ctx, &container.Init{Props: props})
+	require.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied error, got %v", err)
+
+	flags.Set(t, "executor.oci.allowed_publish_host_ports", []int{8080})
+	_, err = provider.New(ctx, &container.Init{Props: props})
+	require.NoError(t, err)
+}
+
+func TestStaticIP(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	const ip = "192.168.20.6"
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+		ContainerIP:    ip,
+	}})
+	require.NoError(t, err)
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+
+	cmd := &repb.Command{Arguments: []string{"sh", "-c", "ip -4 -o addr show | grep -v ' lo '"}}
+	res := c.Exec(ctx, cmd, &interfaces.Stdio{})
+	require.NoError(t, res.Error)
+	assert.Equal(t, 0, res.ExitCode)
+	assert.Contains(t, string(res.Stdout), " "+ip+"/30 ")
+
+	// Another container requesting the same IP should fail while the first
+	// container is still running.
+	wd2 := testfs.MakeDirAll(t, buildRoot, "work2")
+	c2, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+		ContainerIP:    ip,
+	}})
+	require.NoError(t, err)
+	err = c2.Create(ctx, wd2)
+	require.True(t, status.IsAlreadyExistsError(err), "expected AlreadyExists error, got %v", err)
+}
+
+func TestNetwork_Host(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	// Host networking should not be allowed unless enabled.
+	_, err = provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+		DockerNetwork:  "host",
+	}})
+	require.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied error, got %v", err)
+
+	flags.Set(t, "executor.oci.allow_host_network", true)
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+		DockerNetwork:  "host",
+	}})
+	require.NoError(t, err)
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+
+	// The container should be able to accept connections on a host port.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := lis.Addr().(*net.TCPAddr).Port
+	// Free up the port so that the container can bind it.
+	err = lis.Close()
+	require.NoError(t, err)
+	serveCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		cmd := &repb.Command{Arguments: []string{"sh", "-c", fmt.Sprintf(`
+			mkdir -p /tmp/www && echo hello > /tmp/www/index.html
+			exec httpd -f -p 127.0.0.1:%d -h /tmp/www
+		`, port)}}
+		c.Exec(serveCtx, cmd, &interfaces.Stdio{})
+	}()
+	url := fmt.Sprintf("http://127.0.0.1:%d/index.html", port)
+	var body []byte
+	require.Eventually(t, func() bool {
+		rsp, err := http.Get(url)
+		if err != nil {
+			return false
+		}
+		defer rsp.Body.Close()
+		body, err = io.ReadAll(rsp.Body)
+		return err == nil && rsp.StatusCode == http.StatusOK
+	}, 10*time.Second, 100*time.Millisecond)
+	assert.Equal(t, "hello\n", string(body))
+}
+
+func TestNetwork_IPv6(t *testing.T) {
+	testnetworking.Setup(t)
+	if b, err := os.ReadFile("/proc/sys/net/ipv6/conf/all/forwarding"); err != nil || strings.TrimSpace(string(b)) != "1" {
+		t.Skipf("test requires IPv6 forwarding to be enabled")
+	}
+	flags.Set(t, "executor.network_ipv6_enabled", true)
+	// Busybox ping requires CAP_NET_RAW.
+	flags.Set(t, "executor.oci.allowed_added_capabilities", []string{"CAP_NET_RAW"})
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+
+	for _, test := range []struct {
+		name    string
+		network string
+		script  string
+	}{
+		{
+			name: "Enabled",
+			script: `
+				ip -6 addr show scope global | grep -q fd00:bb:
+				# Ping the host end of the veth pair.
+				ping -6 -c1 -W2 "$(ip -6 route show default | awk '{print $3}')"
+				ping -6 -c1 -W1 "$(hostname)"
+			`,
+		},
+		{
+			name:    "Disabled",
+			network: "off",
+			script: `
+				ping -6 -c1 -W1 ::1
+				if [ -n "$(ip -6 addr show scope global)" ]; then
+					echo >&2 'Should not have a global IPv6 address'
+					exit 1
+				fi
+			`,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			wd := testfs.MakeDirAll(t, buildRoot, "work-"+test.name)
+			c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+				ContainerImage: image,
+				DockerNetwork:  test.network,
+				CapAdd:         []string{"CAP_NET_RAW"},
+			}})
+			require.NoError(t, err)
+			err = c.Create(ctx, wd)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				err := c.Remove(ctx)
+				require.NoError(t, err)
+			})
+
+			cmd := &repb.Command{Arguments: []string{"sh", "-ec", test.script}}
+			res := c.Exec(ctx, cmd, &interfaces.Stdio{})
+			require.NoError(t, res.Error)
+			t.Logf("stdout: %s", string(res.Stdout))
+			assert.Empty(t, string(res.Stderr))
+			assert.Equal(t, 0, res.ExitCode)
+		})
+	}
+}
+
+func TestNetwork_Disabled(t *testing.T) {
+	testnetworking.Setup(t)
+
+	// Note: busybox has ping, but it fails with 'permission denied (are you
+	// root?)' This is fixed by adding CAP_NET_RAW but we don't grant it by
+	// default (see TestCapAdd).
+	// So just use the net-tools image which doesn't have this issue for
+	// whatever reason (presumably it's some difference in the ping
+	// implementation) - it's enough to just set `net.ipv4.ping_group_range`.
+	// (Note that podman has this same issue.)
+	image := netToolsImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+		DockerNetwork:  "off",
+	}})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+
+	// Run
+	cmd := &repb.Command{
+		Arguments: []string{"sh", "-ec", `
+			# Should still have a loopback device available.
+			ping -c1 -W1 $(hostname)
+
+			if ping -c1 -W2 8.8.8.8 2>/dev/null; then
+				echo >&2 'Should not be able to ping external network'
+				exit 1
+			fi
+		`},
+	}
+	res := c.Run(ctx, cmd, wd, oci.Credentials{})
+	require.NoError(t, res.Error)
+	t.Logf("stdout: %s", string(res.Stdout))
+	assert.Empty(t, string(res.Stderr))
+	assert.Equal(t, 0, res.ExitCode)
+	// Loopback traffic isn't counted.
+	assert.Equal(t, int64(0), res.UsageStats.GetNetworkRxBytes(), "rx")
+	assert.Equal(t, int64(0), res.UsageStats.GetNetworkTxBytes(), "tx")
+}
+
+func TestUser(t *testing.T) {
+	testnetworking.Setup(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+
+	for _, test := range []struct {
+		name       string
+		props      *platform.Properties
+		expectedID string
+	}{
+		{
+			name: "Busybox/Default",
+			props: &platform.Properties{
+				ContainerImage: realBusyboxImage(t),
+			},
+			expectedID: "uid=0(root) gid=0(root) groups=0(root)",
+		},
+		{
+			name: "Busybox/UnknownUID",
+			props: &platform.Properties{
+				ContainerImage: realBusyboxImage(t),
+				DockerUser:     "2024",
+			},
+			expectedID: "uid=2024 gid=0(root) groups=0(root)",
+		},
+		{
+			name: "Busybox/UnknownUIDAndGID",
+			props: &platform.Properties{
+				ContainerImage: realBusyboxImage(t),
+				DockerUser:     "2024:2024",
+			},
+			expectedID: "uid=2024 gid=2024 groups=2024",
+		},
+		{
+			name: "Busybox/ContainerIDs",
+			props: &platform.Properties{
+				ContainerImage:          realBusyboxImage(t),
+				DockerUser:              "root",
+				ContainerUID:            pointer(uint32(2024)),
+				ContainerGID:            pointer(uint32(2025)),
+				ContainerAdditionalGIDs: []uint32{3000},
+			},
+			expectedID: "uid=2024 gid=2025 groups=2025,3000",
+		},
+		{
+			name: "TestImage/ForceRoot",
+			props: &platform.Properties{
+				ContainerImage:  imageConfigTestImage(t),
+				DockerForceRoot: true,
+			},
+			// With force-root, we only specify uid=0, and no gid.
+			// So we should be running with all groups that uid 0 is a part of.
+			expectedID: "uid=0(root) gid=0(root) groups=0(root),1(bin),2(daemon),3(sys),4(adm),6(disk),10(wheel),11(floppy),20(dialout),26(tape),27(video)",
+		},
+		{
+			name: "TestImage/DefaultToImageUSER",
+			props: &platform.Properties{
+				ContainerImage: imageConfigTestImage(t),
+			},
+			// There's a USER directive specifying that buildbuddy should be
+			// used, so this should override the default (root).
+			expectedID: "uid=1000(buildbuddy) gid=1000(buildbuddy) groups=1000(buildbuddy)",
+		},
+		{
+			name: "TestImage/UserProp=buildbuddy",
+			props: &platform.Properties{
+				ContainerImage: imageConfigTestImage(t),
+				DockerUser:     "buildbuddy",
+			},
+			expectedID: "uid=1000(buildbuddy) gid=1000(buildbuddy) groups=1000(buildbuddy)",
+		},
+		{
+			name: "TestImage/UserProp=1001(basil)",
+			props: &platform.Properties{
+				ContainerImage: imageConfigTestImage(t),
+				DockerUser:     "1001",
+			},
+			expectedID: "uid=1001(basil) gid=1001(basil) groups=1001(basil),1002(auxgroup)",
+		},
+		{
+			name: "TestImage/UserProp=basil:basil",
+			props: &platform.Properties{
+				ContainerImage: imageConfigTestImage(t),
+				DockerUser:     "basil:basil",
+			},
+			// Extra groups aren't included when explicitly setting a group ID
+			expectedID: "uid=1001(basil) gid=1001(basil) groups=1001(basil)",
+		},
+		{
+			name: "TestImage/ContainerUID=1001",
+			props: &platform.Properties{
+				ContainerImage:          imageConfigTestImage(t),
+				ContainerUID:            pointer(uint32(1001)),
+				ContainerAdditionalGIDs: []uint32{1000},
+			},
+			expectedID: "uid=1001(basil) gid=1001(basil) groups=1000(buildbuddy),1001(basil),1002(auxgroup)",
+		},
+		{
+			name: "TestImage/UserProp=basil:auxgroup",
+			props: &platform.Properties{
+				ContainerImage: imageConfigTestImage(t),
+				DockerUser:     "basil:auxgroup",
+			},
+			expectedID: "uid=1001(basil) gid=1002(auxgroup) groups=1002(auxgroup)",
+		},
+		{
+			name: "TestImage/UserProp=1001:1002",
+			props: &platform.Properties{
+				ContainerImage: imageConfigTestImage(t),
+				DockerUser:     "1001:1002",
+			},
+			expectedID: "uid=1001(basil) gid=1002(auxgroup) groups=1002(auxgroup)",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			wd := testfs.MakeDirAll(t, buildRoot, uuid.New())
+			c, err := provider.New(ctx, &container.Init{Props: test.props})
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				err := c.Remove(ctx)
+				require.NoError(t, err)
+			})
+			cmd := &repb.Command{Arguments: []string{"id"}}
+			res := c.Run(ctx, cmd, wd, oci.Credentials{})
+			require.NoError(t, res.Error)
+			assert.Equal(t, test.expectedID, strings.TrimSpace(string(res.Stdout)))
+			assert.Empty(t, string(res.Stderr))
+			assert.Equal(t, 0, res.ExitCode)
+		})
+	}
+
+}
+
+func TestOverlayfsEdgeCases(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := imageConfigTestImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+	}})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+
+	// Run
+	cmd := &repb.Command{Arguments: []string{"sh", "-c", `
+		test "$(cat /test/foo)" -eq 2 || echo >&2 "/test/foo contains $(cat /test/foo) but should contain '2'"
+		test -e /test/DELETED_DIR && echo >&2 "/test/DELETED_DIR unexpectedly exists"
+		test -e /test/DELETED_FILE && echo >&2 "/test/DELETED_FILE unexpectedly exists"
+		exit 0
+	`}}
+	res := c.Run(ctx, cmd, wd, oci.Credentials{})
+	require.NoError(t, res.Error)
+	assert.Empty(t, string(res.Stdout))
+	assert.Empty(t, string(res.Stderr))
+	assert.Equal(t, 0, res.ExitCode)
+}
+
+func TestWhiteouts(t *testing.T) {
+	testnetworking.Setup(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	// Build an image on top of busybox where the last layer deletes a file
+	// and replaces the contents of a directory from the layer below it.
+	base, err := crane.Pull(realBusyboxImage(t), crane.WithPlatform(&v1.Platform{OS: "linux", Architecture: runtime.GOARCH}))
+	require.NoError(t, err)
+	lower, err := crane.Layer(map[string][]byte{
+		"test/deleted.txt":  []byte("deleted"),
+		"test/kept.txt":     []byte("kept"),
+		"test/opaque/a.txt": []byte("a"),
+	})
+	require.NoError(t, err)
+	upper, err := crane.Layer(map[string][]byte{
+		"test/.wh.deleted.txt":     nil,
+		"test/opaque/.wh..wh..opq": nil,
+		"test/opaque/b.txt":        []byte("b"),
+	})
+	require.NoError(t, err)
+	image, err := mutate.AppendLayers(base, lower, upper)
+	require.NoError(t, err)
+	reg := testregistry.Run(t, testregistry.Opts{})
+	imageName := reg.Push(t, image, "whiteout-test")
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: imageName,
+	}})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+
+	cmd := &repb.Command{Arguments: []string{"sh", "-c", `
+		test -e /test/deleted.txt && echo >&2 "/test/deleted.txt unexpectedly exists"
+		test -e /test/.wh.deleted.txt && echo >&2 "/test/.wh.deleted.txt unexpectedly exists"
+		test -e /test/opaque/a.txt && echo >&2 "/test/opaque/a.txt unexpectedly exists"
+		test -e /test/opaque/.wh..wh..opq && echo >&2 "/test/opaque/.wh..wh..opq unexpectedly exists"
+		ls -A /test /test/opaque
+	`}}
+	res := c.Run(ctx, cmd, wd, oci.Credentials{})
+	require.NoError(t, res.Error)
+	assert.Empty(t, string(res.Stderr))
+	assert.Equal(t, 0, res.ExitCode)
+	assert.Equal(t, "/test:\nkept.txt\nopaque\n\n/test/opaque:\nb.txt\n", string(res.Stdout))
+}
+
+func TestScratchImage(t *testing.T) {
+	if !hasMountPermissions(t) {
+		t.Skipf("using an image-backed rootfs with overlayfs requires mount permissions")
+	}
+	testnetworking.Setup(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	// busybox is statically linked, so it can run on its own in an
+	// otherwise empty rootfs.
+	busyboxPath, err := runfiles.Rlocation(busyboxRlocationpath)
+	require.NoError(t, err)
+	busybox, err := os.ReadFile(busyboxPath)
+	require.NoError(t, err)
+	binDir := testfs.MakeTempDir(t)
+	err = os.WriteFile(filepath.Join(binDir, "busybox"), busybox, 0755)
+	require.NoError(t, err)
+	flags.Set(t, "executor.oci.allowed_bind_mount_sources", []string{binDir})
+
+	// Build the equivalent of "FROM scratch; COPY busybox /".
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	err = tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "busybox", Mode: 0755, Size: int64(len(busybox))})
+	require.NoError(t, err)
+	_, err = tw.Write(busybox)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	})
+	require.NoError(t, err)
+	singleBinaryImage, err := mutate.AppendLayers(empty.Image, layer)
+	require.NoError(t, err)
+
+	reg := testregistry.Run(t, testregistry.Opts{})
+	for _, test := range []struct {
+		name       string
+		image      v1.Image
+		bindMounts []*platform.BindMount
+		binary     string
+	}{
+		{
+			name:   "SingleBinary",
+			image:  singleBinaryImage,
+			binary: "/busybox",
+		},
+		{
+			// An image with no layers at all, with the binary mounted in
+			// from the host.
+			name:       "NoLayers",
+			image:      empty.Image,
+			bindMounts: []*platform.BindMount{{Source: binDir, Target: "/bin", ReadOnly: true}},
+			binary:     "/bin/busybox",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			imageName := reg.Push(t, test.image, "scratch-"+strings.ToLower(test.name))
+			provider, err := ociruntime.NewProvider(env, buildRoot)
+			require.NoError(t, err)
+			wd := testfs.MakeDirAll(t, buildRoot, test.name)
+
+			c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+				ContainerImage: imageName,
+				BindMounts:     test.bindMounts,
+			}})
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				err := c.Remove(ctx)
+				require.NoError(t, err)
+			})
+
+			// Write to the rootfs to make sure the overlayfs upperdir works.
+			script := fmt.Sprintf("%s echo hello > /hello.txt && %s cat /hello.txt", test.binary, test.binary)
+			cmd := &repb.Command{Arguments: []string{test.binary, "sh", "-c", script}}
+			res := c.Run(ctx, cmd, wd, oci.Credentials{})
+			require.NoError(t, res.Error)
+			assert.Empty(t, string(res.Stderr))
+			assert.Equal(t, "hello\n", string(res.Stdout))
+			assert.Equal(t, 0, res.ExitCode)
+		})
+	}
+}
+
+func TestFuseOverlayfs(t *testing.T) {
+	testnetworking.Setup(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	flags.Set(t, "executor.oci.overlayfs_mode", "bogus")
+	_, err := ociruntime.NewProvider(env, buildRoot)
+	require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error, got %v", err)
+
+	if !hasFuseOverlayfs() {
+		t.Skip("fuse-overlayfs is not available")
+	}
+	flags.Set(t, "executor.oci.overlayfs_mode", "fuse")
+
+	// Build an image where the second layer deletes a file from the first,
+	// to make sure whiteouts are handled.
+	busyboxPath, err := runfiles.Rlocation(busyboxRlocationpath)
+	require.NoError(t, err)
+	busybox, err := os.ReadFile(busyboxPath)
+	require.NoError(t, err)
+	image := empty.Image
+	for _, files := range []map[string][]byte{
+		{"busybox": busybox, "etc/deleted.txt": []byte("deleted")},
+		{"etc/.wh.deleted.txt": nil},
+	} {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0755})
+		require.NoError(t, err)
+		for name, content := range files {
+			err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0755, Size: int64(len(content))})
+			require.NoError(t, err)
+			_, err = tw.Write(content)
+			require.NoError(t, err)
+		}
+		require.NoError(t, tw.Close())
+		layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(buf.Bytes())), nil
+		})
+		require.NoError(t, err)
+		image, err = mutate.AppendLayers(image, layer)
+		require.NoError(t, err)
+	}
+	reg := testregistry.Run(t, testregistry.Opts{})
+	imageName := reg.Push(t, image, "fuse-overlayfs-test")
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: imageName,
+	}})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+
+	// The rootfs should be writable, hide the deleted file, and be mounted
+	// with fuse-overlayfs.
+	cmd := &repb.Command{Arguments: []string{"/busybox", "sh", "-ec", `
+		/busybox test ! -e /etc/deleted.txt
+		/busybox echo hello > /hello.txt && /busybox cat /hello.txt
+		/busybox awk '$2 == "/" { print $3 }' /proc/mounts
+	`}}
+	res := c.Run(ctx, cmd, wd, oci.Credentials{})
+	require.NoError(t, res.Error)
+	assert.Empty(t, string(res.Stderr))
+	assert.Equal(t, "hello\nfuse.fuse-overlayfs\n", string(res.Stdout))
+	assert.Equal(t, 0, res.ExitCode)
+}
+
+func TestOverlayRoot(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := realBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+	overlayRoot := filepath.Join(testfs.MakeTempDir(t), "overlay")
+	flags.Set(t, "executor.oci.overlay_root", overlayRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+	}})
+	require.NoError(t, err)
+	err = c.PullImage(ctx, oci.Credentials{})
+	require.NoError(t, err)
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+
+	// Files written to the rootfs should be stored in the overlay root
+	// rather than next to the workspace.
+	res := c.Exec(ctx, &repb.Command{Arguments: []string{"touch", "/foo.txt"}}, &interfaces.Stdio{})
+	require.NoError(t, res.Error)
+	require.Equal(t, 0, res.ExitCode)
+	id := c.(interface{ ID() string }).ID()
+	assert.FileExists(t, filepath.Join(overlayRoot, id, "upper", "foo.txt"))
+	assert.NoDirExists(t, wd+".overlay")
+
+	err = c.Remove(ctx)
+	require.NoError(t, err)
+	assert.NoDirExists(t, filepath.Join(overlayRoot, id))
+	assert.DirExists(t, overlayRoot)
+}
+
+func TestUserNamespace(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	for _, test := range []struct {
+		name        string
+		subuidRange string
+		subgidRange string
+	}{
+		{name: "MissingGIDRange", subuidRange: "100000:65536"},
+		{name: "IncludesRoot", subuidRange: "0:65536", subgidRange: "100000:65536"},
+		{name: "EmptyRange", subuidRange: "100000:0", subgidRange: "100000:65536"},
+		{name: "BadFormat", subuidRange: "100000", subgidRange: "100000:65536"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			flags.Set(t, "executor.oci.subuid_range", test.subuidRange)
+			flags.Set(t, "executor.oci.subgid_range", test.subgidRange)
+			_, err := ociruntime.NewProvider(env, buildRoot)
+			require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error, got %v", err)
+		})
+	}
+
+	flags.Set(t, "executor.oci.subuid_range", "100000:65536")
+	flags.Set(t, "executor.oci.subgid_range", "200000:65536")
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+	testfs.MakeDirAll(t, wd, "outputs")
+
+	// IDs outside of the mapped ranges should be rejected.
+	_, err = provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+		ContainerUID:   pointer(uint32(65536)),
+	}})
+	require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error, got %v", err)
+	_, err = provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+		ContainerGID:   pointer(uint32(65536)),
+	}})
+	require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error, got %v", err)
+
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+	}})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+
+	// Container root should be mapped to the start of the configured
+	// ranges, and should be able to write to the rootfs.
+	cmd := &repb.Command{Arguments: []string{"sh", "-ec", `
+		awk '{ print $1, $2, $3 }' /proc/self/uid_map /proc/self/gid_map
+		id -u
+		touch /root-file.txt
+		touch out.txt
+		touch outputs/out.txt
+	`}}
+	res := c.Run(ctx, cmd, wd, oci.Credentials{})
+	require.NoError(t, res.Error)
+	assert.Empty(t, string(res.Stderr))
+	assert.Equal(t, "0 100000 65536\n0 200000 65536\n0\n", string(res.Stdout))
+	assert.Equal(t, 0, res.ExitCode)
+
+	// Files written by the container should be owned by the mapped host IDs.
+	info, err := os.Stat(filepath.Join(wd, "out.txt"))
+	require.NoError(t, err)
+	st := info.Sys().(*syscall.Stat_t)
+	assert.Equal(t, uint32(100000), st.Uid)
+	assert.Equal(t, uint32(200000), st.Gid)
+}
+
+func TestMetrics(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	operationCount := func(operation, status string) float64 {
+		return testmetrics.CounterValue(t, metrics.OCIContainerOperationCount.With(prometheus.Labels{
+			metrics.ContainerOperation:       operation,
+			metrics.StatusHumanReadableLabel: status,
+		}))
+	}
+	createsBefore := operationCount("create", "OK")
+	execsBefore := operationCount("exec", "OK")
+	removesBefore := operationCount("remove", "OK")
+	liveBefore := testmetrics.GaugeValue(t, metrics.OCILiveContainers)
+
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, liveBefore+1, testmetrics.GaugeValue(t, metrics.OCILiveContainers))
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+	res := c.Exec(ctx, &repb.Command{Arguments: []string{"true"}}, &interfaces.Stdio{})
+	require.NoError(t, res.Error)
+	err = c.Remove(ctx)
+	require.NoError(t, err)
+	// Removing the container again shouldn't affect the live container
+	// count.
+	err = c.Remove(ctx)
+	require.NoError(t, err)
+
+	assert.Equal(t, createsBefore+1, operationCount("create", "OK"))
+	assert.Equal(t, execsBefore+1, operationCount("exec", "OK"))
+	assert.Equal(t, removesBefore+2, operationCount("remove", "OK"))
+	assert.Equal(t, liveBefore, testmetrics.GaugeValue(t, metrics.OCILiveContainers))
+
+	// Pull failures should be labeled by image repo and reason.
+	reg := testregistry.Run(t, testregistry.Opts{})
+	imageRef := reg.ImageAddress("missing") + ":latest"
+	failureLabels := prometheus.Labels{
+		metrics.ContainerImageRepo:     reg.ImageAddress("missing"),
+		metrics.ImagePullFailureReason: "image_not_found",
+	}
+	failuresBefore := testmetrics.CounterValue(t, metrics.OCIImagePullFailureCount.With(failureLabels))
+	c, err = provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: imageRef,
+	}})
+	require.NoError(t, err)
+	err = c.PullImage(ctx, oci.Credentials{})
+	require.ErrorIs(t, err, ociruntime.ErrImageNotFound)
+	err = c.Remove(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, failuresBefore+1, testmetrics.CounterValue(t, metrics.OCIImagePullFailureCount.With(failureLabels)))
+}
+
+func TestDockerInit(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+	tiniPath, err := runfiles.Rlocation(tiniRlocationpath)
+	require.NoError(t, err)
+	flags.Set(t, "executor.oci.init_path", tiniPath)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	for _, test := range []struct {
+		name        string
+		dockerInit  bool
+		wantPID1    string
+		wantZombies bool
+	}{
+		{name: "Default", dockerInit: false, wantPID1: "sleep\n", wantZombies: true},
+		{name: "DockerInit", dockerInit: true, wantPID1: "init\n", wantZombies: false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+				ContainerImage: image,
+				DockerInit:     test.dockerInit,
+			}})
+			require.NoError(t, err)
+			err = c.Create(ctx, wd)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				err := c.Remove(ctx)
+				require.NoError(t, err)
+			})
+
+			cmd := &repb.Command{Arguments: []string{"cat", "/proc/1/comm"}}
+			res := c.Exec(ctx, cmd, &interfaces.Stdio{})
+			require.NoError(t, res.Error)
+			assert.Equal(t, test.wantPID1, string(res.Stdout))
+
+			// Orphan a short-lived background process, which gets reparented
+			// to PID 1 and becomes a zombie when it exits unless PID 1 reaps
+			// it.
+			cmd = &repb.Command{Arguments: []string{"sh", "-c", "(sleep 0.1 &)"}}
+			res = c.Exec(ctx, cmd, &interfaces.Stdio{})
+			require.NoError(t, res.Error)
+			time.Sleep(500 * time.Millisecond)
+			cmd = &repb.Command{Arguments: []string{"sh", "-c", `
+				for f in /proc/[0-9]*/status; do
+					grep -q '^State:.*Z' "$f" && echo "$f"
+				done
+				true
+			`}}
+			res = c.Exec(ctx, cmd, &interfaces.Stdio{})
+			require.NoError(t, res.Error)
+			if test.wantZombies {
+				assert.NotEmpty(t, string(res.Stdout))
+			} else {
+				assert.Empty(t, string(res.Stdout))
+			}
+		})
+	}
+}
+
+func TestPersistentWorker(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	// Create workspace with testworker binary
+	buildRoot := testfs.MakeTempDir(t)
+	ws, err := workspace.New(env, buildRoot, &workspace.Opts{Preserve: true})
+	require.NoError(t, err)
+	testworkerPath, err := runfiles.Rlocation(testworkerRlocationpath)
+	require.NoError(t, err)
+	testfs.CopyFile(t, testworkerPath, ws.Path(), "testworker")
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+	}})
+	require.NoError(t, err)
+
+	// Create container
+	require.NoError(t, err)
+	err = c.Create(ctx, ws.Path())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err = c.Remove(ctx)
+		require.NoError(t, err)
+	})
+
+	// Prepare a static response that the persistent worker will return on each
+	// request.
+	responseBase64 := ""
+	{
+		rsp := &wkpb.WorkResponse{
+			Output:   "test-output",
+			ExitCode: 42,
+		}
+		b, err := proto.Marshal(rsp)
+		require.NoError(t, err)
+		size := make([]byte, binary.MaxVarintLen64)
+		n := binary.PutUvarint(size, uint64(len(b)))
+		responseBase64 = base64.StdEncoding.EncodeToString(append(size[:n], b...))
+	}
+
+	// Start worker (Exec)
+	worker := persistentworker.Start(ctx, ws, c, "proto" /*=protocol*/, &repb.Command{
+		Arguments: []string{"./testworker", "--persistent_worker", "--response_base64", responseBase64},
+	})
+
+	// Send work request.
+	// The command doesn't matter - the test worker always just returns a fixed
+	// response.
+	res := worker.Exec(ctx, &repb.Command{})
+
+	assert.Equal(t, "test-output", string(res.Stderr))
+	assert.Equal(t, 42, res.ExitCode)
+
+	// Pause container and stop worker
+	err = c.Pause(ctx)
+	require.NoError(t, err)
+	err = worker.Stop()
+	assert.NoError(t, err)
+}
+
+func TestCancelRun(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+	}})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(context.Background())
+		require.NoError(t, err)
+	})
+
+	// Run
+	childID := "child" + fmt.Sprint(rand.Uint64())
+	cmd := &repb.Command{
+		Arguments: []string{"sh", "-c", `
+			echo "Hello world!"
+			touch ./DONE
+			sh -c "sleep 1000000000 # ` + childID + `" &
+			sleep 1000000000
+		`},
+	}
+	// Wait for the command to write the file "DONE" which means it is done
+	// writing to stdout.
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		defer cancel()
+		err := disk.WaitUntilExists(ctx, filepath.Join(wd, "DONE"), disk.WaitOpts{Timeout: -1})
+		require.NoError(t, err)
+	}()
+	res := c.Run(ctx, cmd, wd, oci.Credentials{})
+	assert.True(t, status.IsCanceledError(res.Error), "expected CanceledError, got %+#v", res.Error)
+	assert.Equal(t, "Hello world!\n", string(res.Stdout))
+	assert.Empty(t, string(res.Stderr))
+	// Make sure all child processes were killed.
+	out := testshell.Run(t, wd, `( ps aux | grep `+childID+` | grep -v grep ) || true`)
+	assert.Empty(t, out)
+}
+
+func TestCancelRun_KillsCgroup(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+	}})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(context.Background())
+		require.NoError(t, err)
+	})
+
+	// Start a process in its own session so that it isn't killed along with
+	// the main process's process group.
+	childID := "child" + fmt.Sprint(rand.Uint64())
+	cmd := &repb.Command{
+		Arguments: []string{"sh", "-c", `
+			setsid sh -c "sleep 30 # ` + childID + `" &
+			touch ./DONE
+			sleep 30
+		`},
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		defer cancel()
+		err := disk.WaitUntilExists(ctx, filepath.Join(wd, "DONE"), disk.WaitOpts{Timeout: -1})
+		require.NoError(t, err)
+	}()
+	start := time.Now()
+	res := c.Run(ctx, cmd, wd, oci.Credentials{})
+	assert.Less(t, time.Since(start), 10*time.Second)
+	assert.True(t, status.IsCanceledError(res.Error), "expected CanceledError, got %+#v", res.Error)
+	// All processes in the container should have been killed, without
+	// needing to remove the container.
+	out := testshell.Run(t, wd, `( ps aux | grep `+childID+` | grep -v grep ) || true`)
+	assert.Empty(t, out)
+}
+
+func TestCgroupParent(t *testing.T) {
+	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err != nil {
+		t.Skipf("cgroup parent requires cgroup v2: %s", err)
+	}
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+	parent := fmt.Sprintf("/ociruntime-test-%d/containers", rand.Uint64())
+	flags.Set(t, "executor.oci.cgroup_parent", parent)
+	parentDir := filepath.Join("/sys/fs/cgroup", parent)
+	t.Cleanup(func() {
+		err := os.Remove(parentDir)
+		require.NoError(t, err)
+		err = os.Remove(filepath.Dir(parentDir))
+		require.NoError(t, err)
+	})
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage:   image,
+		MemoryLimitBytes: 100_000_000,
+	}})
+	require.NoError(t, err)
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+
+	// The container's cgroup should be created beneath the parent, with the
+	// container's limits applied to it.
+	entries, err := os.ReadDir(parentDir)
+	require.NoError(t, err)
+	var children []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			children = append(children, entry.Name())
+		}
+	}
+	require.Len(t, children, 1)
+	childDir := filepath.Join(parentDir, children[0])
+	assert.Equal(t, "100000000\n", testfs.ReadFileAsString(t, childDir, "memory.max"))
+	procs := testfs.ReadFileAsString(t, childDir, "cgroup.procs")
+	assert.NotEmpty(t, strings.TrimSpace(procs))
+
+	res := c.Exec(ctx, &repb.Command{Arguments: []string{"sh", "-c", "exit 0"}}, &interfaces.Stdio{})
+	require.NoError(t, res.Error)
+	assert.Equal(t, 0, res.ExitCode)
+
+	// Removing the container should remove its cgroup, but not the parent.
+	err = c.Remove(ctx)
+	require.NoError(t, err)
+	assert.NoDirExists(t, childDir)
+	assert.DirExists(t, parentDir)
+}
+
+func TestReapOrphanedContainers(t *testing.T) {
+	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err != nil {
+		t.Skipf("test requires cgroup v2: %s", err)
+	}
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+	parent := fmt.Sprintf("/ociruntime-test-%d", rand.Uint64())
+	flags.Set(t, "executor.oci.cgroup_parent", parent)
+	parentDir := filepath.Join("/sys/fs/cgroup", parent)
+	t.Cleanup(func() {
+		err := os.Remove(parentDir)
+		require.NoError(t, err)
+	})
+
+	buildRoot := testfs.MakeTempDir(t)
+	containersRoot := filepath.Join(buildRoot, "executor", "oci", "run")
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+
+	// Create a container which is still running, which should not be
+	// reaped.
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+	}})
+	require.NoError(t, err)
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+	live, err := os.ReadDir(containersRoot)
+	require.NoError(t, err)
+	require.Len(t, live, 1)
+
+	// Simulate a container whose runtime crashed, leaving behind its cgroup
+	// and bundle but no runtime state.
+	orphanCID := fmt.Sprintf("%016x%016x%016x%016x", rand.Uint64(), rand.Uint64(), rand.Uint64(), rand.Uint64())
+	err = os.Mkdir(filepath.Join(parentDir, orphanCID), 0755)
+	require.NoError(t, err)
+	testfs.WriteAllFileContents(t, containersRoot, map[string]string{
+		filepath.Join(orphanCID, "config.json"): "{}",
+	})
+
+	// Creating a new provider, as a restarted executor would, should clean
+	// up the orphaned container.
+	_, err = ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	assert.NoDirExists(t, filepath.Join(parentDir, orphanCID))
+	assert.NoDirExists(t, filepath.Join(containersRoot, orphanCID))
+	assert.DirExists(t, filepath.Join(parentDir, live[0].Name()))
+	assert.DirExists(t, filepath.Join(containersRoot, live[0].Name()))
+
+	res := c.Exec(ctx, &repb.Command{Arguments: []string{"sh", "-c", "exit 0"}}, &interfaces.Stdio{})
+	require.NoError(t, res.Error)
+	assert.Equal(t, 0, res.ExitCode)
+}
+
+func TestPruneStateDirs(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+	flags.Set(t, "executor.oci.state_max_age", 1*time.Hour)
+	flags.Set(t, "executor.oci.state_max_count", 1)
+
+	buildRoot := testfs.MakeTempDir(t)
+	containersRoot := filepath.Join(buildRoot, "executor", "oci", "run")
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+
+	// Create a live container with old state dirs, which should never be
+	// pruned.
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+	}})
+	require.NoError(t, err)
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+	liveCID := c.(interface{ ID() string }).ID()
+	longAgo := time.Now().Add(-24 * time.Hour)
+	for _, dir := range []string{runtimeRoot, containersRoot} {
+		err := os.Chtimes(filepath.Join(dir, liveCID), longAgo, longAgo)
+		require.NoError(t, err)
+	}
+
+	// Simulate state left behind by containers whose removal failed.
+	newCID := func() string {
+		return fmt.Sprintf("%016x%016x%016x%016x", rand.Uint64(), rand.Uint64(), rand.Uint64(), rand.Uint64())
+	}
+	expiredCID := newCID()
+	olderCID := newCID()
+	newestCID := newCID()
+	for _, d := range []struct {
+		dir     string
+		modTime time.Time
+	}{
+		{filepath.Join(runtimeRoot, expiredCID), time.Now().Add(-2 * time.Hour)},
+		{filepath.Join(containersRoot, expiredCID), time.Now().Add(-2 * time.Hour)},
+		{filepath.Join(containersRoot, olderCID), time.Now().Add(-1 * time.Minute)},
+		{filepath.Join(containersRoot, newestCID), time.Now()},
+		// Dirs which aren't named like container IDs are ignored.
+		{filepath.Join(runtimeRoot, "not-a-container"), longAgo},
+	} {
+		err := os.Mkdir(d.dir, 0755)
+		require.NoError(t, err)
+		err = os.Chtimes(d.dir, d.modTime, d.modTime)
+		require.NoError(t, err)
+	}
+
+	// The expired container should be pruned due to its age, and the older
+	// of the two recent containers due to the max count.
+	pruned := provider.PruneStateDirs(ctx)
+	assert.Equal(t, 2, pruned)
+	assert.NoDirExists(t, filepath.Join(runtimeRoot, expiredCID))
+	assert.NoDirExists(t, filepath.Join(containersRoot, expiredCID))
+	assert.NoDirExists(t, filepath.Join(containersRoot, olderCID))
+	assert.DirExists(t, filepath.Join(containersRoot, newestCID))
+	assert.DirExists(t, filepath.Join(runtimeRoot, "not-a-container"))
+	assert.DirExists(t, filepath.Join(runtimeRoot, liveCID))
+	assert.DirExists(t, filepath.Join(containersRoot, liveCID))
+
+	res := c.Exec(ctx, &repb.Command{Arguments: []string{"sh", "-c", "exit 0"}}, &interfaces.Stdio{})
+	require.NoError(t, res.Error)
+	assert.Equal(t, 0, res.ExitCode)
+}
+
+func TestPruneStateDirs_FailedRemoval(t *testing.T) {
+	testnetworking.Setup(t)
+	if !hasMountPermissions(t) {
+		t.Skipf("using a mount to make removal fail requires mount permissions")
+	}
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+	flags.Set(t, "executor.oci.state_max_age", 1*time.Nanosecond)
+
+	buildRoot := testfs.MakeTempDir(t)
+	containersRoot := filepath.Join(buildRoot, "executor", "oci", "run")
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+	}})
+	require.NoError(t, err)
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+	cid := c.(interface{ ID() string }).ID()
+
+	// Make removal fail by mounting over a dir in the container's bundle,
+	// which can't be deleted while it is mounted.
+	busyDir := testfs.MakeDirAll(t, filepath.Join(containersRoot, cid), "busy")
+	err = syscall.Mount("tmpfs", busyDir, "tmpfs", 0, "")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = syscall.Unmount(busyDir, syscall.MNT_DETACH)
+	})
+	err = c.Remove(ctx)
+	require.Error(t, err)
+	assert.DirExists(t, filepath.Join(containersRoot, cid))
+
+	// Once the bundle can be deleted, the leftover state of the failed
+	// removal should be pruned.
+	err = syscall.Unmount(busyDir, 0)
+	require.NoError(t, err)
+	pruned := provider.PruneStateDirs(ctx)
+	assert.Equal(t, 1, pruned)
+	assert.NoDirExists(t, filepath.Join(containersRoot, cid))
+	assert.NoDirExists(t, filepath.Join(runtimeRoot, cid))
+}
+
+func TestCancelExec(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+	}})
+	require.NoError(t, err)
+	// Create
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+	removed := false
+	t.Cleanup(func() {
+		if removed {
+			return
+		}
+		err := c.Remove(context.Background())
+		require.NoError(t, err)
+	})
+	childID := "child" + fmt.Sprint(rand.Uint64())
+	cmd := &repb.Command{
+		Arguments: []string{"sh", "-c", `
+			echo "Hello world!"
+			touch ./DONE
+			sh -c "sleep 1000000000 # ` + childID + `" &
+			sleep 1000000000
+		`},
+	}
+	// Wait for the command to write the file "DONE" which means it is done
+	// writing to stdout.
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		defer cancel()
+		err := disk.WaitUntilExists(ctx, filepath.Join(wd, "DONE"), disk.WaitOpts{Timeout: -1})
+		require.NoError(t, err)
+	}()
+	res := c.Exec(ctx, cmd, &interfaces.Stdio{})
+	assert.True(t, status.IsCanceledError(res.Error), "expected CanceledError, got %+#v", res.Error)
+	assert.Equal(t, "Hello world!\n", string(res.Stdout))
+	assert.Empty(t, string(res.Stderr))
+	// Make sure all child processes were killed.
+	// In the Exec() case, it's fine if child processes stick around until we
+	// call Remove().
+	err = c.Remove(context.Background())
+	require.NoError(t, err)
+	removed = true
+	out := testshell.Run(t, wd, `( ps aux | grep `+childID+` | grep -v grep ) || true`)
+	assert.Empty(t, out)
+}
+
+func TestExecTimeout(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+	}})
+	require.NoError(t, err)
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(context.Background())
+		require.NoError(t, err)
+	})
+
+	childID := "child" + fmt.Sprint(rand.Uint64())
+	cmd := &repb.Command{
+		Arguments: []string{"sh", "-c", `
+			echo stdout
+			echo stderr >&2
+			sh -c "sleep 1000000000 # ` + childID + `" &
+			sleep 1000000000
+		`},
+	}
+	execCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	start := time.Now()
+	res := c.Exec(execCtx, cmd, &interfaces.Stdio{})
+	assert.Less(t, time.Since(start), 10*time.Second)
+	assert.True(t, status.IsDeadlineExceededError(res.Error), "expected DeadlineExceeded error, got %+#v", res.Error)
+	assert.ErrorIs(t, res.Error, ociruntime.ErrTimeout)
+	assert.Equal(t, "stdout\n", string(res.Stdout))
+	assert.Equal(t, "stderr\n", string(res.Stderr))
+
+	// The exec'd process and its children should have been killed, without
+	// needing to remove the container.
+	out := testshell.Run(t, wd, `( ps aux | grep `+childID+` | grep -v grep ) || true`)
+	assert.Empty(t, out)
+
+	// The container should still be usable.
+	cmd = &repb.Command{Arguments: []string{"echo", "still alive"}}
+	res = c.Exec(ctx, cmd, &interfaces.Stdio{})
+	require.NoError(t, res.Error)
+	assert.Equal(t, 0, res.ExitCode)
+	assert.Equal(t, "still alive\n", string(res.Stdout))
+}
+
+func TestPullImageProgress(t *testing.T) {
+	ctx := context.Background()
+	reg := testregistry.Run(t, testregistry.Opts{})
+	imageName := reg.PushRandomImage(t)
+	layersDir := testfs.MakeTempDir(t)
+	store := ociruntime.NewImageStore(layersDir)
+
+	var updates []ociruntime.PullProgress
+	recordProgress := func(p *ociruntime.PullProgress) {
+		updates = append(updates, ociruntime.PullProgress{
+			BytesDownloaded: p.BytesDownloaded,
+			BytesTotal:      p.BytesTotal,
+			Layers:          append([]ociruntime.LayerProgress(nil), p.Layers...),
+			Done:            p.Done,
+		})
+	}
+	image, err := store.Pull(ctx, imageName, oci.RuntimePlatform(), oci.Credentials{}, recordProgress)
+	require.NoError(t, err)
+	require.NotEmpty(t, updates)
+	last := updates[len(updates)-1]
+	assert.True(t, last.Done)
+	require.Len(t, last.Layers, len(image.Layers))
+	assert.Greater(t, last.BytesTotal, int64(0))
+	assert.Equal(t, last.BytesTotal, last.BytesDownloaded)
+	for _, l := range last.Layers {
+		assert.Equal(t, ociruntime.LayerDone, l.Status)
+		assert.Greater(t, l.DownloadDuration, time.Duration(0))
+		assert.Greater(t, l.ExtractedBytes, int64(0))
+	}
+	for _, u := range updates[:len(updates)-1] {
+		assert.False(t, u.Done)
+	}
+
+	// Pulling the same image into a new store with a nil progress func should
+	// work too.
+	_, err = ociruntime.NewImageStore(layersDir).Pull(ctx, imageName, oci.RuntimePlatform(), oci.Credentials{}, nil)
+	require.NoError(t, err)
+
+	// Layers which are already cached should be reported as cached, with no
+	// download time.
+	updates = nil
+	_, err = ociruntime.NewImageStore(layersDir).Pull(ctx, imageName, oci.RuntimePlatform(), oci.Credentials{}, recordProgress)
+	require.NoError(t, err)
+	require.NotEmpty(t, updates)
+	last = updates[len(updates)-1]
+	assert.True(t, last.Done)
+	assert.Equal(t, int64(0), last.BytesTotal)
+	assert.Equal(t, int64(0), last.BytesDownloaded)
+	require.Len(t, last.Layers, len(image.Layers))
+	for _, l := range last.Layers {
+		assert.Equal(t, ociruntime.LayerCached, l.Status)
+		assert.Equal(t, time.Duration(0), l.DownloadDuration)
+		assert.Greater(t, l.ExtractedBytes, int64(0))
+	}
+}
+
+func TestContainerPullImageProgress(t *testing.T) {
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+	reg := testregistry.Run(t, testregistry.Opts{})
+	imageName := reg.PushRandomImage(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	var updates []container.ImagePullProgress
+	c, err := provider.New(ctx, &container.Init{
+		Props: &platform.Properties{ContainerImage: imageName},
+		PullProgress: func(p *container.ImagePullProgress) {
+			updates = append(updates, *p)
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+	err = c.PullImage(ctx, oci.Credentials{})
+	require.NoError(t, err)
+
+	require.NotEmpty(t, updates)
+	last := updates[len(updates)-1]
+	assert.True(t, last.Done)
+	assert.Greater(t, last.BytesTotal, int64(0))
+	assert.Equal(t, last.BytesTotal, last.BytesDownloaded)
+
+	// When concurrent pulls of the same image are deduped, each container
+	// should still get a final update. Hold the layer downloads so that the
+	// pulls overlap.
+	release := make(chan struct{})
+	requested := make(chan struct{}, 1)
+	reg = testregistry.Run(t, testregistry.Opts{
+		HttpInterceptor: func(w http.ResponseWriter, r *http.Request) bool {
+			if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/blobs/") {
+				select {
+				case requested <- struct{}{}:
+				default:
+				}
+				<-release
+			}
+			return true
+		},
+	})
+	imageName = reg.PushRandomImage(t)
+	const n = 2
+	containerUpdates := make([][]container.ImagePullProgress, n)
+	var eg errgroup.Group
+	for i := range n {
+		c, err := provider.New(ctx, &container.Init{
+			Props: &platform.Properties{ContainerImage: imageName},
+			PullProgress: func(p *container.ImagePullProgress) {
+				containerUpdates[i] = append(containerUpdates[i], *p)
+			},
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			err := c.Remove(ctx)
+			require.NoError(t, err)
+		})
+		eg.Go(func() error {
+			return c.PullImage(ctx, oci.Credentials{})
+		})
+	}
+	<-requested
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	require.NoError(t, eg.Wait())
+	for i, updates := range containerUpdates {
+		require.NotEmpty(t, updates, "container %d", i)
+		assert.True(t, updates[len(updates)-1].Done, "container %d", i)
+	}
+}
+
+func TestImageStoreGC(t *testing.T) {
+	ctx := context.Background()
+	reg := testregistry.Run(t, testregistry.Opts{})
+	imageName := reg.PushRandomImage(t)
+	layersDir := testfs.MakeTempDir(t)
+	store := ociruntime.NewImageStore(layersDir)
+	image, err := store.Pull(ctx, imageName, oci.RuntimePlatform(), oci.Credentials{}, nil)
+	require.NoError(t, err)
+	require.NotEmpty(t, image.Layers)
+
+	// Simulate a layer left over from an image that is no longer cached, as
+	// well as an interrupted layer extraction.
+	orphanContents := strings.Repeat("a", 1000)
+	testfs.WriteAllFileContents(t, layersDir, map[string]string{
+		"sha256/0000000000000000000000000000000000000000000000000000000000000000/foo.txt":         orphanContents,
+		"sha256/1111111111111111111111111111111111111111111111111111111111111111.123.tmp/bar.txt": orphanContents,
+	})
+
+	reclaimed, err := store.GC(ctx)
+	require.NoError(t, err)
+	// Reclaimed bytes include directory entry sizes, so only check a lower
+	// bound.
+	assert.GreaterOrEqual(t, reclaimed, int64(2*len(orphanContents)))
+	assert.NoDirExists(t, filepath.Join(layersDir, "sha256/0000000000000000000000000000000000000000000000000000000000000000"))
+	assert.NoDirExists(t, filepath.Join(layersDir, "sha256/1111111111111111111111111111111111111111111111111111111111111111.123.tmp"))
+	for _, layer := range image.Layers {
+		assert.DirExists(t, filepath.Join(layersDir, layer.DiffID.Algorithm, layer.DiffID.Hex))
+	}
+
+	// GC should be a no-op while below the high watermark.
+	testfs.WriteAllFileContents(t, layersDir, map[string]string{
+		"sha256/0000000000000000000000000000000000000000000000000000000000000000/foo.txt": orphanContents,
+	})
+	flags.Set(t, "executor.oci.layer_gc_high_watermark_bytes", int64(1e9))
+	reclaimed, err = store.GC(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), reclaimed)
+}
+
+func TestImageStoreLRUEviction(t *testing.T) {
+	ctx := context.Background()
+	reg := testregistry.Run(t, testregistry.Opts{})
+	layersDir := testfs.MakeTempDir(t)
+	platform := oci.RuntimePlatform()
+
+	// Push 3 single-layer images, each with a distinct layer of a bit over
+	// 100KB when extracted.
+	var imageNames []string
+	for i := 0; i < 3; i++ {
+		image, err := crane.Image(map[string][]byte{
+			"/data.txt": []byte(strings.Repeat(strconv.Itoa(i), 100_000)),
+		})
+		require.NoError(t, err)
+		imageNames = append(imageNames, reg.Push(t, image, fmt.Sprintf("test-%d", i)))
+	}
+	// Leave room for 2 of the 3 images.
+	flags.Set(t, "executor.oci.layer_cache_max_size_bytes", int64(250_000))
+
+	store := ociruntime.NewImageStore(layersDir)
+	var images []*ociruntime.Image
+	for _, imageName := range imageNames {
+		image, err := store.Pull(ctx, imageName, platform, oci.Credentials{}, nil)
+		require.NoError(t, err)
+		images = append(images, image)
+	}
+	_, ok := store.CachedImage(imageNames[0], platform)
+	assert.False(t, ok, "least recently used image should be evicted")
+	for _, imageName := range imageNames[1:] {
+		_, ok := store.CachedImage(imageName, platform)
+		assert.True(t, ok, "recently used image %q should be cached", imageName)
+	}
+
+	// Access times should be persisted across restarts: pulling the first
+	// image again with a new store should evict the second image, which is
+	// now the least recently used.
+	store = ociruntime.NewImageStore(layersDir)
+	_, err := store.Pull(ctx, imageNames[0], platform, oci.Credentials{}, nil)
+	require.NoError(t, err)
+	layerDir := func(image *ociruntime.Image) string {
+		return filepath.Join(layersDir, image.Layers[0].DiffID.Algorithm, image.Layers[0].DiffID.Hex)
+	}
+	assert.DirExists(t, layerDir(images[0]))
+	assert.NoDirExists(t, layerDir(images[1]))
+	assert.DirExists(t, layerDir(images[2]))
+}
+
+func TestPulledImageNotEvictedBeforeCreate(t *testing.T) {
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+	reg := testregistry.Run(t, testregistry.Opts{})
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+	buildRoot := testfs.MakeTempDir(t)
+
+	// Push 2 single-layer images, and leave room for only one of them.
+	var imageNames []string
+	for i := 0; i < 2; i++ {
+		image, err := crane.Image(map[string][]byte{
+			"/data.txt": []byte(strings.Repeat(strconv.Itoa(i), 100_000)),
+		})
+		require.NoError(t, err)
+		imageNames = append(imageNames, reg.Push(t, image, fmt.Sprintf("test-%d", i)))
+	}
+	flags.Set(t, "executor.oci.layer_cache_max_size_bytes", int64(150_000))
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	var containers []container.CommandContainer
+	for _, imageName := range imageNames {
+		c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+			ContainerImage: imageName,
+		}})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			err := c.Remove(ctx)
+			require.NoError(t, err)
+		})
+		err = c.PullImage(ctx, oci.Credentials{})
+		require.NoError(t, err)
+		containers = append(containers, c)
+	}
+
+	// The second pull should not have evicted the first image, since the
+	// first container has pulled it but not yet been created.
+	cached, err := containers[0].IsImageCached(ctx)
+	require.NoError(t, err)
+	assert.True(t, cached, "image pulled by a container should not be evicted before it is removed")
+}
+
+func TestImageStoreVerifiesCachedLayers(t *testing.T) {
+	ctx := context.Background()
+	reg := testregistry.Run(t, testregistry.Opts{})
+	layersDir := testfs.MakeTempDir(t)
+	platform := oci.RuntimePlatform()
+	image, err := crane.Image(map[string][]byte{"/data.txt": []byte("original")})
+	require.NoError(t, err)
+	imageName := reg.Push(t, image, "test")
+
+	pulled, err := ociruntime.NewImageStore(layersDir).Pull(ctx, imageName, platform, oci.Credentials{}, nil)
+	require.NoError(t, err)
+	require.Len(t, pulled.Layers, 1)
+	layerDir := filepath.Join(layersDir, pulled.Layers[0].DiffID.Algorithm, pulled.Layers[0].DiffID.Hex)
+
+	// Corrupt the extracted layer without changing its size. With
+	// verification enabled, pulling the image with a new store should detect
+	// the corruption and extract the layer again.
+	flags.Set(t, "executor.oci.verify_cached_layers", true)
+	testfs.WriteAllFileContents(t, layerDir, map[string]string{"data.txt": "tampered"})
+	_, err = ociruntime.NewImageStore(layersDir).Pull(ctx, imageName, platform, oci.Credentials{}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "original", testfs.ReadFileAsString(t, layerDir, "data.txt"))
+
+	// With verification disabled, the corrupted layer is reused as-is.
+	flags.Set(t, "executor.oci.verify_cached_layers", false)
+	testfs.WriteAllFileContents(t, layerDir, map[string]string{"data.txt": "tampered"})
+	_, err = ociruntime.NewImageStore(layersDir).Pull(ctx, imageName, platform, oci.Credentials{}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "tampered", testfs.ReadFileAsString(t, layerDir, "data.txt"))
+}
+
+func TestImageStorePreservesXattrs(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skipf("setting file capabilities requires root")
+	}
+	getcap, err := exec.LookPath("getcap")
+	if err != nil {
+		t.Skipf("getcap not found: %s", err)
+	}
+	ctx := context.Background()
+	reg := testregistry.Run(t, testregistry.Opts{})
+	layersDir := testfs.MakeTempDir(t)
+
+	// Build a layer with a binary that has cap_net_raw in its permitted and
+	// effective sets (a version 2 vfs_cap_data struct), like ping in many
+	// distro images, as well as a user xattr and an overlayfs xattr.
+	capability := make([]byte, 20)
+	binary.LittleEndian.PutUint32(capability[0:], 0x02000000|0x1) // VFS_CAP_REVISION_2 | VFS_CAP_FLAGS_EFFECTIVE
+	binary.LittleEndian.PutUint32(capability[4:], 1<<13)          // CAP_NET_RAW
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{
+			Typeflag: tar.TypeReg,
+			Name:     "bin/ping",
+			Mode:     0755,
+			Format:   tar.FormatPAX,
+			PAXRecords: map[string]string{
+				"SCHILY.xattr.security.capability": string(capability),
+				"SCHILY.xattr.user.test":           "hello",
+			},
+		},
+		{
+			Typeflag:   tar.TypeDir,
+			Name:       "forged-opaque-dir/",
+			Mode:       0755,
+			Format:     tar.FormatPAX,
+			PAXRecords: map[string]string{"SCHILY.xattr.user.overlay.opaque": "y"},
+		},
+	} {
+		err := tw.WriteHeader(hdr)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	})
+	require.NoError(t, err)
+	image, err := mutate.AppendLayers(empty.Image, layer)
+	require.NoError(t, err)
+	imageName := reg.Push(t, image, "xattr-test")
+
+	pulled, err := ociruntime.NewImageStore(layersDir).Pull(ctx, imageName, oci.RuntimePlatform(), oci.Credentials{}, nil)
+	require.NoError(t, err)
+	require.Len(t, pulled.Layers, 1)
+	layerDir := filepath.Join(layersDir, pulled.Layers[0].DiffID.Algorithm, pulled.Layers[0].DiffID.Hex)
+
+	out, err := exec.Command(getcap, filepath.Join(layerDir, "bin", "ping")).CombinedOutput()
+	require.NoError(t, err, "getcap: %s", string(out))
+	assert.Contains(t, string(out), "cap_net_raw")
+
+	value := make([]byte, 64)
+	n, err := syscall.Getxattr(filepath.Join(layerDir, "bin", "ping"), "user.test", value)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(value[:n]))
+
+	_, err = syscall.Getxattr(filepath.Join(layerDir, "forged-opaque-dir"), "user.overlay.opaque", value)
+	assert.ErrorIs(t, err, syscall.ENODATA, "overlayfs xattrs should not be extracted")
+}
+
+func TestImageStorePreservesSpecialFiles(t *testing.T) {
+	ctx := context.Background()
+	reg := testregistry.Run(t, testregistry.Opts{})
+	layersDir := testfs.MakeTempDir(t)
+
+	headers := []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "bin/", Mode: 0755},
+		{Typeflag: tar.TypeReg, Name: "bin/su", Mode: 04755, Size: int64(len("su"))},
+		{Typeflag: tar.TypeReg, Name: "bin/wall", Mode: 02755},
+		{Typeflag: tar.TypeLink, Name: "bin/su-link", Linkname: "bin/su"},
+		{Typeflag: tar.TypeDir, Name: "tmp/", Mode: 01777},
+		{Typeflag: tar.TypeFifo, Name: "tmp/fifo", Mode: 0600},
+	}
+	// Creating device nodes requires root.
+	isRoot := os.Geteuid() == 0
+	if isRoot {
+		headers = append(headers,
+			&tar.Header{Typeflag: tar.TypeDir, Name: "dev/", Mode: 0755},
+			&tar.Header{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0666, Devmajor: 1, Devminor: 3},
+		)
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range headers {
+		err := tw.WriteHeader(hdr)
+		require.NoError(t, err)
+		if hdr.Name == "bin/su" {
+			_, err := tw.Write([]byte("su"))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	})
+	require.NoError(t, err)
+	image, err := mutate.AppendLayers(empty.Image, layer)
+	require.NoError(t, err)
+	imageName := reg.Push(t, image, "special-files-test")
+
+	pulled, err := ociruntime.NewImageStore(layersDir).Pull(ctx, imageName, oci.RuntimePlatform(), oci.Credentials{}, nil)
+	require.NoError(t, err)
+	require.Len(t, pulled.Layers, 1)
+	layerDir := filepath.Join(layersDir, pulled.Layers[0].DiffID.Algorithm, pulled.Layers[0].DiffID.Hex)
+
+	su, err := os.Stat(filepath.Join(layerDir, "bin", "su"))
+	require.NoError(t, err)
+	assert.Equal(t, os.ModeSetuid|0755, su.Mode())
+	wall, err := os.Stat(filepath.Join(layerDir, "bin", "wall"))
+	require.NoError(t, err)
+	assert.Equal(t, os.ModeSetgid|0755, wall.Mode())
+	link, err := os.Stat(filepath.Join(layerDir, "bin", "su-link"))
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(su, link), "hardlinks should share an inode")
+	tmp, err := os.Stat(filepath.Join(layerDir, "tmp"))
+	require.NoError(t, err)
+	assert.Equal(t, os.ModeDir|os.ModeSticky|0777, tmp.Mode())
+	fifo, err := os.Stat(filepath.Join(layerDir, "tmp", "fifo"))
+	require.NoError(t, err)
+	assert.Equal(t, os.ModeNamedPipe|0600, fifo.Mode())
+	if isRoot {
+		null, err := os.Stat(filepath.Join(layerDir, "dev", "null"))
+		require.NoError(t, err)
+		assert.Equal(t, os.ModeDevice|os.ModeCharDevice|0666, null.Mode())
+		assert.Equal(t, unix.Mkdev(1, 3), uint64(null.Sys().(*syscall.Stat_t).Rdev))
+	}
+}
+
+func TestImageStoreRejectsPathTraversal(t *testing.T) {
+	ctx := context.Background()
+	reg := testregistry.Run(t, testregistry.Opts{})
+	layersDir := testfs.MakeTempDir(t)
+	// hostDir stands in for a directory on the host outside of the layer.
+	hostDir := testfs.MakeTempDir(t)
+	testfs.WriteAllFileContents(t, hostDir, map[string]string{"secret": "host secret"})
+
+	for _, test := range []struct {
+		name    string
+		headers []*tar.Header
+	}{
+		{
+			name: "DotDot",
+			headers: []*tar.Header{
+				{Typeflag: tar.TypeReg, Name: "../evil", Mode: 0644},
+				{Typeflag: tar.TypeReg, Name: "../../evil", Mode: 0644},
+			},
+		},
+		{
+			name: "NestedDotDot",
+			headers: []*tar.Header{
+				{Typeflag: tar.TypeDir, Name: "usr/", Mode: 0755},
+				{Typeflag: tar.TypeReg, Name: "usr/../../evil", Mode: 0644},
+			},
+		},
+		{
+			name: "SymlinkToEtc",
+			headers: []*tar.Header{
+				{Typeflag: tar.TypeSymlink, Name: "etc", Linkname: "/etc"},
+				{Typeflag: tar.TypeReg, Name: "etc/evil", Mode: 0644},
+			},
+		},
+		{
+			name: "SymlinkToHostDir",
+			headers: []*tar.Header{
+				{Typeflag: tar.TypeSymlink, Name: "host", Linkname: hostDir},
+				{Typeflag: tar.TypeReg, Name: "host/secret", Mode: 0644, Size: int64(len("evil"))},
+			},
+		},
+		{
+			name: "DirectoryReplacingSymlink",
+			headers: []*tar.Header{
+				{Typeflag: tar.TypeSymlink, Name: "host", Linkname: hostDir},
+				{Typeflag: tar.TypeDir, Name: "host/", Mode: 0777},
+			},
+		},
+		{
+			name: "HardlinkThroughSymlink",
+			headers: []*tar.Header{
+				{Typeflag: tar.TypeSymlink, Name: "host", Linkname: hostDir},
+				{Typeflag: tar.TypeLink, Name: "secret", Linkname: "host/secret"},
+			},
+		},
+		{
+			name: "HardlinkOutsideLayer",
+			headers: []*tar.Header{
+				{Typeflag: tar.TypeLink, Name: "secret", Linkname: "../../../secret"},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			for _, hdr := range test.headers {
+				err := tw.WriteHeader(hdr)
+				require.NoError(t, err)
+				if hdr.Size > 0 {
+					_, err := tw.Write([]byte("evil"))
+					require.NoError(t, err)
+				}
+			}
+			require.NoError(t, tw.Close())
+			layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(buf.Bytes())), nil
+			})
+			require.NoError(t, err)
+			image, err := mutate.AppendLayers(empty.Image, layer)
+			require.NoError(t, err)
+			imageName := reg.Push(t, image, "path-traversal-"+strings.ToLower(test.name))
+
+			_, err = ociruntime.NewImageStore(layersDir).Pull(ctx, imageName, oci.RuntimePlatform(), oci.Credentials{}, nil)
+			require.Error(t, err)
+			assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error, got %s", err)
+
+			// Nothing should have been written outside of the layer dir.
+			assert.NoFileExists(t, "/etc/evil")
+			assert.NoFileExists(t, filepath.Join(layersDir, "evil"))
+			assert.NoFileExists(t, filepath.Join(layersDir, "sha256", "evil"))
+			assert.Equal(t, "host secret", testfs.ReadFileAsString(t, hostDir, "secret"))
+			info, err := os.Stat(hostDir)
+			require.NoError(t, err)
+			assert.NotEqual(t, fs.FileMode(0777), info.Mode().Perm())
+			entries, err := os.ReadDir(hostDir)
+			require.NoError(t, err)
+			assert.Len(t, entries, 1)
+			// The rejected layer should not be cached.
+			entries, err = os.ReadDir(filepath.Join(layersDir, "sha256"))
+			if err == nil {
+				assert.Empty(t, entries)
+			}
+		})
+	}
+}
+
+func TestImageStoreExtractsSparseFiles(t *testing.T) {
+	ctx := context.Background()
+	reg := testregistry.Run(t, testregistry.Opts{})
+	layersDir := testfs.MakeTempDir(t)
+
+	// A mostly empty file, like a preallocated database, with data at the
+	// start, in the middle, and at the end.
+	const size = 64 * 1024 * 1024
+	content := make([]byte, size)
+	copy(content, "header")
+	copy(content[size/2:], "middle")
+	copy(content[size-len("trailer"):], "trailer")
+	modTime := time.Unix(1700000000, 0)
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Typeflag: tar.TypeReg, Name: "data.db", Mode: 0644, Size: size, ModTime: modTime},
+		{Typeflag: tar.TypeReg, Name: "readonly.db", Mode: 0444, Size: size, ModTime: modTime},
+	} {
+		err := tw.WriteHeader(hdr)
+		require.NoError(t, err)
+		_, err = tw.Write(content)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	})
+	require.NoError(t, err)
+	image, err := mutate.AppendLayers(empty.Image, layer)
+	require.NoError(t, err)
+	imageName := reg.Push(t, image, "sparse-test")
+
+	pulled, err := ociruntime.NewImageStore(layersDir).Pull(ctx, imageName, oci.RuntimePlatform(), oci.Credentials{}, nil)
+	require.NoError(t, err)
+	require.Len(t, pulled.Layers, 1)
+	layerDir := filepath.Join(layersDir, pulled.Layers[0].DiffID.Algorithm, pulled.Layers[0].DiffID.Hex)
+
+	for _, test := range []struct {
+		name string
+		mode fs.FileMode
+	}{
+		{name: "data.db", mode: 0644},
+		{name: "readonly.db", mode: 0444},
+	} {
+		path := filepath.Join(layerDir, test.name)
+		var st syscall.Stat_t
+		err := syscall.Stat(path, &st)
+		require.NoError(t, err)
+		assert.Equal(t, int64(size), st.Size)
+		allocated := st.Blocks * 512
+		assert.Less(t, allocated, int64(size/16), "%s should be sparse", test.name)
+
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, test.mode, info.Mode().Perm())
+		assert.True(t, modTime.Equal(info.ModTime()), "mtime of %s: expected %s, got %s", test.name, modTime, info.ModTime())
+		b, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(content, b), "contents of %s should be unchanged", test.name)
+	}
+}
+
+func TestImageStoreReadsContainerdContentStore(t *testing.T) {
+	ctx := context.Background()
+	var layerPath string
+	var layerDownloads atomic.Int32
+	reg := testregistry.Run(t, testregistry.Opts{
+		HttpInterceptor: func(w http.ResponseWriter, r *http.Request) bool {
+			if r.Method == http.MethodGet && r.URL.Path == layerPath {
+				layerDownloads.Add(1)
+			}
+			return true
+		},
+	})
+	image, err := crane.Image(map[string][]byte{"/hello.txt": []byte("hello from containerd")})
+	require.NoError(t, err)
+	layers, err := image.Layers()
+	require.NoError(t, err)
+	layerDigest, err := layers[0].Digest()
+	require.NoError(t, err)
+	rc, err := layers[0].Compressed()
+	require.NoError(t, err)
+	layerBlob, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	rc.Close()
+	imageName := reg.Push(t, image, "containerd-content-test")
+	layerPath = "/v2/containerd-content-test/blobs/" + layerDigest.String()
+
+	for _, test := range []struct {
+		name string
+		// Contents of the layer blob in the containerd content store, or nil
+		// if the store doesn't have it.
+		blob              []byte
+		expectedDownloads int32
+	}{
+		{name: "BlobPresent", blob: layerBlob, expectedDownloads: 0},
+		{name: "BlobMissing", blob: nil, expectedDownloads: 1},
+		{name: "BlobCorrupt", blob: append([]byte("garbage"), layerBlob...), expectedDownloads: 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			contentStore := testfs.MakeTempDir(t)
+			flags.Set(t, "executor.oci.containerd_content_store", contentStore)
+			if test.blob != nil {
+				blobPath := filepath.Join(contentStore, "blobs", layerDigest.Algorithm, layerDigest.Hex)
+				err := os.MkdirAll(filepath.Dir(blobPath), 0755)
+				require.NoError(t, err)
+				err = os.WriteFile(blobPath, test.blob, 0644)
+				require.NoError(t, err)
+			}
+			layerDownloads.Store(0)
+			layersDir := testfs.MakeTempDir(t)
+
+			pulled, err := ociruntime.NewImageStore(layersDir).Pull(ctx, imageName, oci.RuntimePlatform(), oci.Credentials{}, nil)
+			require.NoError(t, err)
+			require.Len(t, pulled.Layers, 1)
+			assert.Equal(t, test.expectedDownloads, layerDownloads.Load())
+			layerDir := filepath.Join(layersDir, pulled.Layers[0].DiffID.Algorithm, pulled.Layers[0].DiffID.Hex)
+			b, err := os.ReadFile(filepath.Join(layerDir, "hello.txt"))
+			require.NoError(t, err)
+			assert.Equal(t, "hello from containerd", string(b))
+		})
+	}
+}
+
+func pointer[T any](val T) *T {
+	return &val
+}
+
+// canMountOverlay returns whether the container rootfs overlay can be
+// mounted, either with kernel overlayfs or with the fuse-overlayfs fallback.
+func canMountOverlay(t *testing.T) bool {
+	return hasMountPermissions(t) || hasFuseOverlayfs()
+}
+
+func hasFuseOverlayfs() bool {
+	if _, err := exec.LookPath("fuse-overlayfs"); err != nil {
+		return false
+	}
+	_, err := os.Stat("/dev/fuse")
+	return err == nil
+}
+
+func hasMountPermissions(t *testing.T) bool {
+	dir1 := testfs.MakeTempDir(t)
+	dir2 := testfs.MakeTempDir(t)
+	if err := syscall.Mount(dir1, dir2, "", syscall.MS_BIND, ""); err != nil {
+		return false
+	}
+	err := syscall.Unmount(dir2, syscall.MNT_FORCE)
+	require.NoError(t, err, "unmount")
+	return true
+}
+
+func TestCheckpointRestore(t *testing.T) {
+	if _, err := exec.LookPath("criu"); err != nil {
+		t.Skip("criu is not installed")
+	}
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+	}})
+	require.NoError(t, err)
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+
+	// Start a background process that keeps a counter in memory and
+	// periodically writes it to the workspace.
+	cmd := &repb.Command{Arguments: []string{"sh", "-c", `
+		sh -c 'i=0; while true; do i=$((i+1)); echo $i > COUNT.tmp && mv COUNT.tmp COUNT; sleep 0.05; done' </dev/null >/dev/null 2>&1 &
+	`}}
+	res := c.Exec(ctx, cmd, &interfaces.Stdio{})
+	require.NoError(t, res.Error)
+	require.Equal(t, 0, res.ExitCode)
+	readCount := func() int {
+		b, err := os.ReadFile(filepath.Join(wd, "COUNT"))
+		if err != nil {
+			return 0
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+		return n
+	}
+	require.Eventually(t, func() bool { return readCount() >= 10 }, 10*time.Second, 10*time.Millisecond)
+
+	checkpointDir := testfs.MakeTempDir(t)
+	err = c.(interface {
+		Checkpoint(ctx context.Context, dir string) error
+	}).Checkpoint(ctx, checkpointDir)
+	require.NoError(t, err)
+	err = c.Remove(ctx)
+	require.NoError(t, err)
+	countAtCheckpoint := readCount()
+	require.GreaterOrEqual(t, countAtCheckpoint, 10)
+
+	// Restore into a new container using the same workspace. The counter
+	// should resume from where it left off rather than starting over.
+	c, err = provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+	}})
+	require.NoError(t, err)
+	err = c.(interface {
+		CreateFromCheckpoint(ctx context.Context, workDir, checkpointDir string) error
+	}).CreateFromCheckpoint(ctx, wd, checkpointDir)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+	require.Eventually(t, func() bool { return readCount() > countAtCheckpoint+10 }, 10*time.Second, 10*time.Millisecond)
+}
+
+func TestCommit(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := realBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+	}})
+	require.NoError(t, err)
+	err = c.PullImage(ctx, oci.Credentials{})
+	require.NoError(t, err)
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+
+	// Add a file, delete a file from the base image, and replace a directory
+	// from the base image.
+	cmd := &repb.Command{Arguments: []string{"sh", "-ec", `
+		echo hello > /greeting.txt
+		rm /bin/ls
+		rm -rf /var
+		mkdir /var
+		echo new > /var/only-file
+	`}}
+	res := c.Exec(ctx, cmd, &interfaces.Stdio{})
+	require.NoError(t, res.Error)
+	require.Equal(t, 0, res.ExitCode, "stderr: %s", string(res.Stderr))
+
+	const committedImage = "committed-image"
+	err = c.(interface {
+		Commit(ctx context.Context, imageName string) error
+	}).Commit(ctx, committedImage)
+	require.NoError(t, err)
+
+	// A container created from the committed image should see the changes
+	// without pulling.
+	c2, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: committedImage,
+	}})
+	require.NoError(t, err)
+	cached, err := c2.IsImageCached(ctx)
+	require.NoError(t, err)
+	require.True(t, cached, "IsImageCached")
+	wd2 := testfs.MakeDirAll(t, buildRoot, "work2")
+	err = c2.Create(ctx, wd2)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c2.Remove(ctx)
+		require.NoError(t, err)
+	})
+	cmd = &repb.Command{Arguments: []string{"sh", "-c", `
+		cat /greeting.txt
+		test -e /bin/ls && echo >&2 "/bin/ls unexpectedly exists"
+		ls /var
+		exit 0
+	`}}
+	res = c2.Exec(ctx, cmd, &interfaces.Stdio{})
+	require.NoError(t, res.Error)
+	assert.Empty(t, string(res.Stderr))
+	assert.Equal(t, "hello\nonly-file\n", string(res.Stdout))
+	assert.Equal(t, 0, res.ExitCode)
+}
+
+func TestExportDiff(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := realBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+	}})
+	require.NoError(t, err)
+	err = c.PullImage(ctx, oci.Credentials{})
+	require.NoError(t, err)
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+
+	cmd := &repb.Command{Arguments: []string{"sh", "-ec", `
+		echo hello > /greeting.txt
+		rm /bin/ls
+		rm -rf /var
+		mkdir /var
+	`}}
+	res := c.Exec(ctx, cmd, &interfaces.Stdio{})
+	require.NoError(t, res.Error)
+	require.Equal(t, 0, res.ExitCode, "stderr: %s", string(res.Stderr))
+
+	var buf bytes.Buffer
+	err = c.(interface {
+		ExportDiff(ctx context.Context, w io.Writer) error
+	}).ExportDiff(ctx, &buf)
+	require.NoError(t, err)
+
+	contents := map[string]string{}
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		b, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		contents[hdr.Name] = string(b)
+	}
+	assert.Equal(t, "hello\n", contents["greeting.txt"])
+	assert.Contains(t, contents, "bin/.wh.ls")
+	assert.Contains(t, contents, "var/.wh..wh..opq")
+	assert.NotContains(t, contents, "bin/ls")
+}
+
+func TestImportRootfsTarball(t *testing.T) {
+	if !hasMountPermissions(t) {
+		t.Skipf("using an image-backed rootfs with overlayfs requires mount permissions")
+	}
+	testnetworking.Setup(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	// Write a gzipped rootfs tarball containing busybox and a test file.
+	busyboxPath, err := runfiles.Rlocation(busyboxRlocationpath)
+	require.NoError(t, err)
+	busybox, err := os.ReadFile(busyboxPath)
+	require.NoError(t, err)
+	tarPath := filepath.Join(testfs.MakeTempDir(t), "rootfs.tar.gz")
+	f, err := os.Create(tarPath)
+	require.NoError(t, err)
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	for _, hdr := range []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "bin/", Mode: 0755},
+		{Typeflag: tar.TypeReg, Name: "bin/busybox", Mode: 0755, Size: int64(len(busybox))},
+		{Typeflag: tar.TypeSymlink, Name: "bin/sh", Linkname: "busybox"},
+		{Typeflag: tar.TypeSymlink, Name: "bin/cat", Linkname: "busybox"},
+		{Typeflag: tar.TypeReg, Name: "hello.txt", Mode: 0644, Size: int64(len("hello\n"))},
+	} {
+		err := tw.WriteHeader(hdr)
+		require.NoError(t, err)
+		switch hdr.Name {
+		case "bin/busybox":
+			_, err = tw.Write(busybox)
+		case "hello.txt":
+			_, err = tw.Write([]byte("hello\n"))
+		}
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, zw.Close())
+	require.NoError(t, f.Close())
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	c, err := provider.New(ctx, &container.Init{
+		Props:         &platform.Properties{},
+		RootfsTarPath: tarPath,
+	})
+	require.NoError(t, err)
+	cached, err := c.IsImageCached(ctx)
+	require.NoError(t, err)
+	assert.False(t, cached, "IsImageCached before import")
+	err = c.PullImage(ctx, oci.Credentials{})
+	require.NoError(t, err)
+	cached, err = c.IsImageCached(ctx)
+	require.NoError(t, err)
+	assert.True(t, cached, "IsImageCached after import")
+
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+	res := c.Exec(ctx, &repb.Command{Arguments: []string{"cat", "/hello.txt"}}, &interfaces.Stdio{})
+	require.NoError(t, res.Error)
+	assert.Empty(t, string(res.Stderr))
+	assert.Equal(t, "hello\n", string(res.Stdout))
+	assert.Equal(t, 0, res.ExitCode)
+}
+
+func TestProviderRuntimeOpts(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	// Use a runtime binary whose name doesn't identify the runtime type, so
+	// that the type has to be detected from the version output.
+	crunPath, err := runfiles.Rlocation(crunRlocationpath)
+	require.NoError(t, err)
+	runtimePath := filepath.Join(testfs.MakeTempDir(t), "oci-runtime")
+	err = os.Symlink(crunPath, runtimePath)
+	require.NoError(t, err)
+
+	provider, err := ociruntime.NewProviderWithOpts(env, buildRoot, &ociruntime.ProviderOpts{RuntimePath: runtimePath})
+	require.NoError(t, err)
+	assert.Equal(t, ociruntime.RuntimeTypeCrun, provider.RuntimeType())
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+	}})
+	require.NoError(t, err)
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+	res := c.Exec(ctx, &repb.Command{Arguments: []string{"echo", "hello"}}, &interfaces.Stdio{})
+	require.NoError(t, res.Error)
+	assert.Equal(t, "hello\n", string(res.Stdout))
+	assert.Equal(t, 0, res.ExitCode)
+
+	// Unsupported runtime types should be rejected.
+	_, err = ociruntime.NewProviderWithOpts(env, buildRoot, &ociruntime.ProviderOpts{RuntimePath: runtimePath, RuntimeType: "kata"})
+	assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error, got %v", err)
+}
+
+func TestRuntimeVersion(t *testing.T) {
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	v, err := provider.RuntimeVersion(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, string(provider.RuntimeType()), v.Name)
+	assert.NotEmpty(t, v.Version)
+	assert.True(t, v.AtLeast("0.1"), "version %s", v)
+	assert.False(t, v.AtLeast("1000"), "version %s", v)
+}
+
+func TestRuntimeVersionAtLeast(t *testing.T) {
+	for _, test := range []struct {
+		version    string
+		minVersion string
+		want       bool
+	}{
+		{version: "1.15", minVersion: "1.15", want: true},
+		{version: "1.15", minVersion: "1.8", want: true},
+		{version: "1.8", minVersion: "1.15", want: false},
+		{version: "1.1.12", minVersion: "1.1", want: true},
+		{version: "1.1", minVersion: "1.1.1", want: false},
+		{version: "1.2.0-rc.1", minVersion: "1.2", want: true},
+		{version: "2.0", minVersion: "1.99.99", want: true},
+		{version: "release-20240513.0", minVersion: "20240101", want: true},
+		{version: "release-20240513.0", minVersion: "20250101", want: false},
+	} {
+		v := &ociruntime.RuntimeVersion{Name: "crun", Version: test.version}
+		assert.Equal(t, test.want, v.AtLeast(test.minVersion), "%q.AtLeast(%q)", test.version, test.minVersion)
+	}
+}
+
+func TestRunsc(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	// Only runsc may be requested in place of the default runtime.
+	_, err = provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+		OCIRuntime:     "kata",
+	}})
+	require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error, got %v", err)
+
+	if _, err := exec.LookPath("runsc"); err != nil {
+		t.Skip("runsc is not installed")
+	}
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+		OCIRuntime:     "runsc",
+	}})
+	require.NoError(t, err)
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+
+	// gVisor's kernel log identifies the sandbox.
+	res := c.Exec(ctx, &repb.Command{Arguments: []string{"dmesg"}}, &interfaces.Stdio{})
+	require.NoError(t, res.Error)
+	assert.Equal(t, 0, res.ExitCode)
+	assert.Contains(t, string(res.Stdout), "gVisor")
+
+	stats, err := c.Stats(ctx)
+	require.NoError(t, err)
+	assert.Greater(t, stats.GetMemoryBytes(), int64(0))
+}
+
+func TestExtraRuntimeArgs(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	// Flags managed by the executor and unknown subcommands are rejected.
+	_, err := ociruntime.NewProviderWithOpts(env, buildRoot, &ociruntime.ProviderOpts{ExtraGlobalArgs: []string{"--root=/tmp"}})
+	assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error, got %v", err)
+	_, err = ociruntime.NewProviderWithOpts(env, buildRoot, &ociruntime.ProviderOpts{ExtraCommandArgs: map[string][]string{"exec": {"some-arg"}}})
+	assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error, got %v", err)
+	_, err = ociruntime.NewProviderWithOpts(env, buildRoot, &ociruntime.ProviderOpts{ExtraCommandArgs: map[string][]string{"frobnicate": {"--foo"}}})
+	assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error, got %v", err)
+
+	_, err = ociruntime.NewProviderWithOpts(env, buildRoot, &ociruntime.ProviderOpts{ExtraCommandArgs: map[string][]string{"exec": {"--env=FOO=1"}}})
+	assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error, got %v", err)
+
+	provider, err := ociruntime.NewProviderWithOpts(env, buildRoot, &ociruntime.ProviderOpts{
+		ExtraCommandArgs: map[string][]string{"exec": {"--user=1234:5678"}},
+	})
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+	}})
+	require.NoError(t, err)
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+	res := c.Exec(ctx, &repb.Command{Arguments: []string{"sh", "-c", "echo $(id -u):$(id -g)"}}, &interfaces.Stdio{})
+	require.NoError(t, res.Error)
+	assert.Equal(t, 0, res.ExitCode, "stderr: %s", string(res.Stderr))
+	assert.Equal(t, "1234:5678\n", string(res.Stdout))
+}
+
+func TestHooks(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	// Invalid hooks are rejected.
+	for _, hook := range []ociruntime.Hook{
+		{Stage: "createRuntime", Path: "sh"},
+		{Stage: "preboot", Path: "/bin/sh"},
+		{Stage: "poststop", Path: "/bin/sh", Timeout: -1},
+	} {
+		_, err := ociruntime.NewProviderWithOpts(env, buildRoot, &ociruntime.ProviderOpts{Hooks: []ociruntime.Hook{hook}})
+		assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error for %+v, got %v", hook, err)
+	}
+
+	// Configure hooks which save the container state that they receive on
+	// stdin.
+	hookOutputDir := testfs.MakeTempDir(t)
+	var hooks []ociruntime.Hook
+	for _, stage := range []string{"createRuntime", "poststop"} {
+		hooks = append(hooks, ociruntime.Hook{
+			Stage:   stage,
+			Path:    "/bin/sh",
+			Args:    []string{"sh", "-c", `cat > "$0"`, filepath.Join(hookOutputDir, stage+".json")},
+			Timeout: 10,
+		})
+	}
+	provider, err := ociruntime.NewProviderWithOpts(env, buildRoot, &ociruntime.ProviderOpts{Hooks: hooks})
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: image,
+	}})
+	require.NoError(t, err)
+	removed := false
+	t.Cleanup(func() {
+		if !removed {
+			err := c.Remove(ctx)
+			require.NoError(t, err)
+		}
+	})
+	cid := c.(interface{ ID() string }).ID()
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+	assert.NoFileExists(t, filepath.Join(hookOutputDir, "poststop.json"))
+	res := c.Exec(ctx, &repb.Command{Arguments: []string{"sh", "-c", "exit 0"}}, &interfaces.Stdio{})
+	require.NoError(t, res.Error)
+	assert.Equal(t, 0, res.ExitCode)
+	err = c.Remove(ctx)
+	require.NoError(t, err)
+	removed = true
+
+	for _, stage := range []string{"createRuntime", "poststop"} {
+		b, err := os.ReadFile(filepath.Join(hookOutputDir, stage+".json"))
+		require.NoError(t, err, "%s hook should have run", stage)
+		state := map[string]any{}
+		err = json.Unmarshal(b, &state)
+		require.NoError(t, err)
+		assert.Equal(t, cid, state["id"], "%s hook state", stage)
+	}
+}
+
+func TestWaitHealthy(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+
+	for _, test := range []struct {
+		name      string
+		cmd       string
+		expectErr bool
+	}{
+		{name: "BecomesHealthy", cmd: "test -e ready"},
+		{name: "Unhealthy", cmd: "echo not ready; exit 1", expectErr: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			wd := testfs.MakeDirAll(t, buildRoot, test.name)
+			c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+				ContainerImage: image,
+				HealthCheck: &platform.HealthCheck{
+					Command:  []string{"sh", "-c", test.cmd},
+					Interval: 20 * time.Millisecond,
+					Timeout:  5 * time.Second,
+					Retries:  5,
+				},
+			}})
+			require.NoError(t, err)
+			err = c.Create(ctx, wd)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				err := c.Remove(ctx)
+				require.NoError(t, err)
+			})
+
+			// Make the first few checks fail.
+			time.AfterFunc(50*time.Millisecond, func() {
+				testfs.WriteAllFileContents(t, wd, map[string]string{"ready": ""})
+			})
+			err = c.(interface {
+				WaitHealthy(ctx context.Context) error
+			}).WaitHealthy(ctx)
+			if test.expectErr {
+				require.True(t, status.IsUnavailableError(err), "expected Unavailable error, got %v", err)
+				assert.Contains(t, err.Error(), "not ready")
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestImageLabels(t *testing.T) {
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	reg := testregistry.Run(t, testregistry.Opts{})
+	image, err := crane.Image(map[string][]byte{"/hello.txt": []byte("hello")})
+	require.NoError(t, err)
+	image, err = mutate.Config(image, v1.Config{Labels: map[string]string{
+		"org.example.toolchain-version": "1.2.3",
+	}})
+	require.NoError(t, err)
+	imageName := reg.Push(t, image, "labeled")
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: imageName,
+	}})
+	require.NoError(t, err)
+	labeled := c.(interface{ ImageLabels() map[string]string })
+
+	// Labels are not available until the image is pulled.
+	assert.Nil(t, labeled.ImageLabels())
+
+	err = c.PullImage(ctx, oci.Credentials{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"org.example.toolchain-version": "1.2.3"}, labeled.ImageLabels())
+}
+
+func TestAnnotations(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := manuallyProvisionedBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	c, err := provider.New(ctx, &container.Init{
+		Task: &repb.ScheduledTask{ExecutionTask: &repb.ExecutionTask{
+			InvocationId: "test-invocation-id",
+			ExecutionId:  "test-execution-id",
+		}},
+		Props: &platform.Properties{
+			ContainerImage:       image,
+			ContainerAnnotations: map[string]string{"com.example.team": "infra"},
+		},
+	})
+	require.NoError(t, err)
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+
+	configPaths, err := filepath.Glob(filepath.Join(buildRoot, "executor", "oci", "run", "*", "config.json"))
+	require.NoError(t, err)
+	require.Len(t, configPaths, 1)
+	b, err := os.ReadFile(configPaths[0])
+	require.NoError(t, err)
+	var spec struct {
+		Annotations map[string]string `json:"annotations"`
+	}
+	err = json.Unmarshal(b, &spec)
+	require.NoError(t, err)
+	assert.Equal(t, "infra", spec.Annotations["com.example.team"])
+	assert.Equal(t, "test-invocation-id", spec.Annotations[ociruntime.InvocationIDAnnotation])
+	assert.Equal(t, "test-execution-id", spec.Annotations[ociruntime.ExecutionIDAnnotation])
+}
+
+func TestImageDigestPinning(t *testing.T) {
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	reg := testregistry.Run(t, testregistry.Opts{})
+	pushImage := func(contents string) (string, string) {
+		image, err := crane.Image(map[string][]byte{"/version.txt": []byte(contents)})
+		require.NoError(t, err)
+		digest, err := image.Digest()
+		require.NoError(t, err)
+		return reg.Push(t, image, "pinning-test:latest"), digest.String()
+	}
+	imageName, digest1 := pushImage("v1")
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	type digester interface{ ImageDigest() string }
+
+	c1, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: imageName,
+	}})
+	require.NoError(t, err)
+	assert.Empty(t, c1.(digester).ImageDigest())
+	err = c1.PullImage(ctx, oci.Credentials{})
+	require.NoError(t, err)
+	assert.Equal(t, digest1, c1.(digester).ImageDigest())
+
+	// Move the tag.
+	_, digest2 := pushImage("v2")
+	require.NotEqual(t, digest1, digest2)
+
+	// The first container should keep using the pinned digest.
+	cached, err := c1.IsImageCached(ctx)
+	require.NoError(t, err)
+	assert.True(t, cached)
+	err = c1.PullImage(ctx, oci.Credentials{})
+	require.NoError(t, err)
+	assert.Equal(t, digest1, c1.(digester).ImageDigest())
+
+	// A new container should see that the tag has moved.
+	c2, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: imageName,
+	}})
+	require.NoError(t, err)
+	cached, err = c2.IsImageCached(ctx)
+	require.NoError(t, err)
+	assert.False(t, cached, "IsImageCached should return false after the tag moves")
+	err = c2.PullImage(ctx, oci.Credentials{})
+	require.NoError(t, err)
+	assert.Equal(t, digest2, c2.(digester).ImageDigest())
+
+	// The tag was just resolved, so if it moves again, new containers keep
+	// using the cached image until the tag check interval has passed.
+	flags.Set(t, "executor.oci.image_tag_check_interval", 1*time.Hour)
+	pushImage("v3")
+	c3, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: imageName,
+	}})
+	require.NoError(t, err)
+	cached, err = c3.IsImageCached(ctx)
+	require.NoError(t, err)
+	assert.True(t, cached, "IsImageCached should not check the registry within the tag check interval")
+
+	flags.Set(t, "executor.oci.image_tag_check_interval", time.Duration(0))
+	cached, err = c3.IsImageCached(ctx)
+	require.NoError(t, err)
+	assert.False(t, cached, "IsImageCached should return false after the tag moves")
+}
+
+func TestPullTimeout(t *testing.T) {
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+	flags.Set(t, "executor.oci.pull_timeout", 1*time.Second)
+
+	buildRoot := testfs.MakeTempDir(t)
+	imageName := stallingLayerRegistry(t, "pull-timeout-test").imageName
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: imageName,
+	}})
+	require.NoError(t, err)
+
+	start := time.Now()
+	err = c.PullImage(ctx, oci.Credentials{})
+	require.Error(t, err)
+	assert.True(t, status.IsUnavailableError(err), "expected Unavailable error, got %v", err)
+	assert.Contains(t, err.Error(), "timed out")
+	assert.ErrorIs(t, err, ociruntime.ErrTimeout)
+	assert.Less(t, time.Since(start), 10*time.Second)
+
+	// The partially extracted layer should be cleaned up.
+	layersDir := filepath.Join(buildRoot, "executor", "oci", "layers")
+	require.Eventually(t, func() bool {
+		entries, err := os.ReadDir(filepath.Join(layersDir, "sha256"))
+		return (err == nil || os.IsNotExist(err)) && len(entries) == 0
+	}, 10*time.Second, 50*time.Millisecond)
+	cached, err := c.IsImageCached(ctx)
+	require.NoError(t, err)
+	assert.False(t, cached)
+}
+
+func TestPullImageCanceled(t *testing.T) {
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+	reg := stallingLayerRegistry(t, "pull-cancel-test")
+	imageName, stalled, aborted := reg.imageName, reg.stalled, reg.aborted
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	layersDir := filepath.Join(buildRoot, "executor", "oci", "layers")
+
+	for _, test := range []struct {
+		name string
+		// If set, the pull context has this timeout. Otherwise, it is
+		// canceled once the layer download stalls.
+		timeout time.Duration
+		isErr   func(error) bool
+	}{
+		{name: "Canceled", isErr: status.IsCanceledError},
+		{name: "DeadlineExceeded", timeout: 2 * time.Second, isErr: status.IsDeadlineExceededError},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var ctx context.Context
+			var cancel context.CancelFunc
+			if test.timeout > 0 {
+				ctx, cancel = context.WithTimeout(context.Background(), test.timeout)
+			} else {
+				ctx, cancel = context.WithCancel(context.Background())
+				go func() {
+					<-stalled
+					cancel()
+				}()
+			}
+			defer cancel()
+			c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+				ContainerImage: imageName,
+			}})
+			require.NoError(t, err)
+
+			start := time.Now()
+			err = c.PullImage(ctx, oci.Credentials{})
+			require.Error(t, err)
+			assert.True(t, test.isErr(err), "unexpected error type: %v", err)
+			assert.Less(t, time.Since(start), test.timeout+5*time.Second)
+
+			// The in-flight layer download should be aborted, and the
+			// partially extracted layer cleaned up.
+			select {
+			case <-aborted:
+			case <-time.After(10 * time.Second):
+				require.FailNow(t, "layer download was not aborted")
+			}
+			if test.timeout > 0 {
+				<-stalled
+			}
+			require.Eventually(t, func() bool {
+				entries, err := os.ReadDir(filepath.Join(layersDir, "sha256"))
+				return (err == nil || os.IsNotExist(err)) && len(entries) == 0
+			}, 10*time.Second, 50*time.Millisecond)
+			cached, err := c.IsImageCached(context.Background())
+			require.NoError(t, err)
+			assert.False(t, cached)
+		})
+	}
+}
+
+// stallingRegistry is a registry serving an image whose layer downloads
+// stall partway through.
+type stallingRegistry struct {
+	imageName string
+	// stalled receives a value whenever a layer download stalls, and
+	// aborted whenever the client then aborts it. Values are dropped if the
+	// previous one has not been received yet.
+	stalled chan struct{}
+	aborted chan struct{}
+}
+
+// stallingLayerRegistry starts a registry serving a single-layer image in the
+// given repository. Downloads of the layer serve the first half of the layer,
+// then stall until the client aborts the request.
+func stallingLayerRegistry(t *testing.T, repo string) *stallingRegistry {
+	sr := &stallingRegistry{
+		stalled: make(chan struct{}, 1),
+		aborted: make(chan struct{}, 1),
+	}
+	notify := func(ch chan struct{}) {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+	var stall atomic.Bool
+	var layerPath string
+	var layerBlob []byte
+	reg := testregistry.Run(t, testregistry.Opts{
+		HttpInterceptor: func(w http.ResponseWriter, r *http.Request) bool {
+			if !stall.Load() || r.Method != http.MethodGet || r.URL.Path != layerPath {
+				return true
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(len(layerBlob)))
+			w.WriteHeader(http.StatusOK)
+			w.Write(layerBlob[:len(layerBlob)/2])
+			w.(http.Flusher).Flush()
+			notify(sr.stalled)
+			<-r.Context().Done()
+			notify(sr.aborted)
+			return false
+		},
+	})
+	data := make([]byte, 10_000_000)
+	for i := range data {
+		data[i] = byte(rand.IntN(256))
+	}
+	image, err := crane.Image(map[string][]byte{"/data.bin": data})
+	require.NoError(t, err)
+	layers, err := image.Layers()
+	require.NoError(t, err)
+	layerDigest, err := layers[0].Digest()
+	require.NoError(t, err)
+	rc, err := layers[0].Compressed()
+	require.NoError(t, err)
+	layerBlob, err = io.ReadAll(rc)
+	require.NoError(t, err)
+	rc.Close()
+	sr.imageName = reg.Push(t, image, repo)
+	layerPath = "/v2/" + repo + "/blobs/" + layerDigest.String()
+	stall.Store(true)
+	return sr
+}
+
+func TestPullImageErrors(t *testing.T) {
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	// Deny access to the manifests of the "private" repository.
+	reg := testregistry.Run(t, testregistry.Opts{
+		HttpInterceptor: func(w http.ResponseWriter, r *http.Request) bool {
+			if strings.HasPrefix(r.URL.Path, "/v2/private/manifests/") {
+				w.WriteHeader(http.StatusForbidden)
+				return false
+			}
+			return true
+		},
+	})
+	image, err := crane.Image(map[string][]byte{"/hello.txt": []byte("hello")})
+	require.NoError(t, err)
+	reg.Push(t, image, "public")
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	for _, test := range []struct {
+		name     string
+		imageRef string
+		isErr    func(error) bool
+		sentinel error
+	}{
+		{
+			name:     "NotFound",
+			imageRef: reg.ImageAddress("missing"),
+			isErr:    status.IsNotFoundError,
+			sentinel: ociruntime.ErrImageNotFound,
+		},
+		{
+			name:     "Unauthorized",
+			imageRef: reg.ImageAddress("private"),
+			isErr:    status.IsPermissionDeniedError,
+			sentinel: ociruntime.ErrUnauthorized,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+				ContainerImage: test.imageRef,
+			}})
+			require.NoError(t, err)
+			err = c.PullImage(ctx, oci.Credentials{})
+			require.Error(t, err)
+			assert.True(t, test.isErr(err), "unexpected error type: %v", err)
+			assert.ErrorIs(t, err, test.sentinel)
+
+			// Run should report the same error when it pulls the image.
+			c, err = provider.New(ctx, &container.Init{Props: &platform.Properties{
+				ContainerImage: test.imageRef,
+			}})
+			require.NoError(t, err)
+			res := c.Run(ctx, &repb.Command{Arguments: []string{"true"}}, testfs.MakeTempDir(t), oci.Credentials{})
+			require.Error(t, res.Error)
+			assert.True(t, test.isErr(res.Error), "unexpected error type: %v", res.Error)
+			assert.ErrorIs(t, res.Error, test.sentinel)
+		})
+	}
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: reg.ImageAddress("public"),
+	}})
+	require.NoError(t, err)
+	err = c.PullImage(ctx, oci.Credentials{})
+	require.NoError(t, err)
+}
+
+func TestOfflineMode(t *testing.T) {
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	var requests atomic.Int64
+	reg := testregistry.Run(t, testregistry.Opts{
+		HttpInterceptor: func(w http.ResponseWriter, r *http.Request) bool {
+			requests.Add(1)
+			return true
+		},
+	})
+	pushImage := func(name string) string {
+		image, err := crane.Image(map[string][]byte{"/name.txt": []byte(name)})
+		require.NoError(t, err)
+		return reg.Push(t, image, name)
+	}
+	cachedImageName := pushImage("cached")
+	uncachedImageName := pushImage("uncached")
+
+	// Pull an image while online.
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: cachedImageName,
+	}})
+	require.NoError(t, err)
+	err = c.PullImage(ctx, oci.Credentials{})
+	require.NoError(t, err)
+
+	// Using a new offline provider, as if the executor had restarted, the
+	// cached image should be usable and the uncached image should not,
+	// without contacting the registry.
+	requests.Store(0)
+	provider, err = ociruntime.NewProviderWithOpts(env, buildRoot, &ociruntime.ProviderOpts{Offline: true})
+	require.NoError(t, err)
+
+	c, err = provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: cachedImageName,
+	}})
+	require.NoError(t, err)
+	cached, err := c.IsImageCached(ctx)
+	require.NoError(t, err)
+	assert.True(t, cached)
+	err = c.PullImage(ctx, oci.Credentials{})
+	require.NoError(t, err)
+
+	c, err = provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: uncachedImageName,
+	}})
+	require.NoError(t, err)
+	cached, err = c.IsImageCached(ctx)
+	require.NoError(t, err)
+	assert.False(t, cached)
+	err = c.PullImage(ctx, oci.Credentials{})
+	require.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition error, got %v", err)
+	assert.Contains(t, err.Error(), "not available offline")
+
+	assert.Equal(t, int64(0), requests.Load(), "registry should not be contacted in offline mode")
+}
+
+func TestPrefetch(t *testing.T) {
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	reg := testregistry.Run(t, testregistry.Opts{})
+	var imageRefs []string
+	for i := range 3 {
+		image, err := crane.Image(map[string][]byte{"/name.txt": []byte(strconv.Itoa(i))})
+		require.NoError(t, err)
+		imageRefs = append(imageRefs, reg.Push(t, image, fmt.Sprintf("prefetch-%d", i)))
+	}
+	imageRefs = append(imageRefs, reg.ImageAddress("does-not-exist"))
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	liveBefore := testmetrics.GaugeValue(t, metrics.OCILiveContainers)
+	results := provider.Prefetch(ctx, imageRefs, oci.Credentials{})
+	require.Len(t, results, len(imageRefs))
+	// Prefetching shouldn't leave any containers behind.
+	assert.Equal(t, liveBefore, testmetrics.GaugeValue(t, metrics.OCILiveContainers))
+	for i, res := range results[:3] {
+		assert.Equal(t, imageRefs[i], res.ImageRef)
+		assert.NoError(t, res.Err)
+		assert.False(t, res.Cached)
+	}
+	assert.Equal(t, imageRefs[3], results[3].ImageRef)
+	assert.Error(t, results[3].Err)
+
+	// Prefetched images should now be cached.
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage: imageRefs[0],
+	}})
+	require.NoError(t, err)
+	cached, err := c.IsImageCached(ctx)
+	require.NoError(t, err)
+	assert.True(t, cached)
+
+	// Prefetching again should skip the cached images.
+	results = provider.Prefetch(ctx, imageRefs[:3], oci.Credentials{})
+	for _, res := range results {
+		assert.NoError(t, res.Err)
+		assert.True(t, res.Cached)
+	}
+}
+
+func TestConcurrentPullsAreDeduped(t *testing.T) {
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+
+	image, err := crane.Image(map[string][]byte{"/data.txt": []byte(strings.Repeat("x", 1_000_000))})
+	require.NoError(t, err)
+	layers, err := image.Layers()
+	require.NoError(t, err)
+	layerDigest, err := layers[0].Digest()
+	require.NoError(t, err)
+	imageDigest, err := image.Digest()
+	require.NoError(t, err)
+
+	// Count layer downloads.
+	var layerFetches atomic.Int64
+	reg := testregistry.Run(t, testregistry.Opts{
+		HttpInterceptor: func(w http.ResponseWriter, r *http.Request) bool {
+			if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/blobs/"+layerDigest.String()) {
+				layerFetches.Add(1)
+			}
+			return true
+		},
+	})
+	imageName := reg.Push(t, image, "dedupe-test")
+	// Refer to the image both by tag and by digest.
+	imageRefs := []string{imageName, reg.ImageAddress("dedupe-test@" + imageDigest.String())}
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+	const n = 10
+	var eg errgroup.Group
+	for i := range n {
+		eg.Go(func() error {
+			c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+				ContainerImage: imageRefs[i%len(imageRefs)],
+			}})
+			if err != nil {
+				return err
+			}
+			return c.PullImage(ctx, oci.Credentials{})
+		})
+	}
+	require.NoError(t, eg.Wait())
+	assert.Equal(t, int64(1), layerFetches.Load(), "layer should be downloaded and extracted exactly once")
+}
+
+func TestLayersSharedAcrossContainers(t *testing.T) {
+	testnetworking.Setup(t)
+
+	image := realBusyboxImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+	layersDir := filepath.Join(buildRoot, "executor", "oci", "layers")
+
+	provider, err := ociruntime.NewProvider(env, buildRoot)
+	require.NoError(t, err)
+
+	newContainer := func(name string) container.CommandContainer {
+		wd := testfs.MakeDirAll(t, buildRoot, name)
+		c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+			ContainerImage: image,
+		}})
+		require.NoError(t, err)
+		err = c.PullImage(ctx, oci.Credentials{})
+		require.NoError(t, err)
+		err = c.Create(ctx, wd)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			err := c.Remove(ctx)
+			require.NoError(t, err)
+		})
+		return c
+	}
+	c1 := newContainer("c1")
+	layers, err := os.ReadDir(filepath.Join(layersDir, "sha256"))
+	require.NoError(t, err)
+	c2 := newContainer("c2")
+
+	// The second container should reuse the extracted layers rather than
+	// copying them.
+	layersAfter, err := os.ReadDir(filepath.Join(layersDir, "sha256"))
+	require.NoError(t, err)
+	assert.Equal(t, len(layers), len(layersAfter))
+
+	// Modifying the rootfs in one container should not affect the shared
+	// layers or the other container.
+	cmd := &repb.Command{Arguments: []string{"sh", "-c", "echo c1 > /bin/marker && rm /bin/ls"}}
+	res := c1.Exec(ctx, cmd, &interfaces.Stdio{})
+	require.NoError(t, res.Error)
+	require.Equal(t, 0, res.ExitCode, "stderr: %s", res.Stderr)
+
+	cmd = &repb.Command{Arguments: []string{"sh", "-c", "test ! -e /bin/marker && test -e /bin/ls"}}
+	res = c2.Exec(ctx, cmd, &interfaces.Stdio{})
+	require.NoError(t, res.Error)
+	assert.Equal(t, 0, res.ExitCode)
+
+	lsFound := false
+	for _, layer := range layers {
+		assert.NoFileExists(t, filepath.Join(layersDir, "sha256", layer.Name(), "bin", "marker"))
+		if _, err := os.Lstat(filepath.Join(layersDir, "sha256", layer.Name(), "bin", "ls")); err == nil {
+			lsFound = true
+		}
+	}
+	assert.True(t, lsFound, "deleted file should still exist in the shared layer")
+}
+
+func BenchmarkPullMultiLayerImage(b *testing.B) {
+	ctx := context.Background()
+
+	// Build an image with several layers of incompressible data, so that
+	// pulls spend most of their time decompressing and extracting layers.
+	const numLayers = 8
+	var layers []v1.Layer
+	for i := range numLayers {
+		files := map[string][]byte{}
+		for j := range 10 {
+			data := make([]byte, 1_000_000)
+			for k := range data {
+				data[k] = byte(rand.IntN(256))
+			}
+			files[fmt.Sprintf("/layer%d/file%d.bin", i, j)] = data
+		}
+		layer, err := crane.Layer(files)
+		require.NoError(b, err)
+		layers = append(layers, layer)
+	}
+	image, err := mutate.AppendLayers(empty.Image, layers...)
+	require.NoError(b, err)
+	reg := testregistry.Run(b, testregistry.Opts{})
+	imageName := reg.Push(b, image, "multi-layer-bench")
+
+	for _, test := range []struct {
+		Name        string
+		Parallelism int
+	}{
+		{Name: "Sequential", Parallelism: 1},
+		{Name: "Parallel", Parallelism: 0},
+	} {
+		b.Run(test.Name, func(b *testing.B) {
+			flags.Set(b, "executor.oci.layer_extraction_parallelism", test.Parallelism)
+			for range b.N {
+				// Pull into an empty store each time so that no layers are
+				// cached.
+				b.StopTimer()
+				store := ociruntime.NewImageStore(testfs.MakeTempDir(b))
+				b.StartTimer()
+				_, err := store.Pull(ctx, imageName, oci.RuntimePlatform(), oci.Credentials{}, nil)
+				require.NoError(b, err)
+			}
+		})
 	}
-	err := syscall.Unmount(dir2, syscall.MNT_FORCE)
-	require.NoError(t, err, "unmount")
-	return true
 }
@@ -4,6 +4,10 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
+	"math"
+	"net/netip"
+	"path/filepath"
+	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
@@ -124,6 +128,187 @@ const (
 	EstimatedCPUPropertyName    = "EstimatedCPU"
 	EstimatedMemoryPropertyName = "EstimatedMemory"
 
+	// MemoryLimitPropertyName specifies a hard memory limit for the action.
+	// Unlike EstimatedMemory, which is only used for scheduling, this limit is
+	// enforced by the isolation type (currently only OCI) and the action is
+	// OOM-killed if it is exceeded.
+	MemoryLimitPropertyName = "memory-limit"
+
+	// CPULimitPropertyName specifies a hard CPU limit for the action, in the
+	// same format as EstimatedCPU. The action is throttled if it exceeds the
+	// limit. Currently only enforced for OCI isolation.
+	CPULimitPropertyName = "cpu-limit"
+
+	// PidsLimitPropertyName specifies the maximum number of processes that
+	// the action may have running at once. Currently only enforced for OCI
+	// isolation, where it can only lower the executor's configured limit.
+	PidsLimitPropertyName = "pids-limit"
+
+	// Block IO throttling properties. The weight is in the range [10, 1000]
+	// (as with docker's --blkio-weight), and the read/write limits are in
+	// bytes per second and apply to the device backing the action's
+	// workspace. Currently only enforced for OCI isolation.
+	IOWeightPropertyName   = "io-weight"
+	IOReadBPSPropertyName  = "io-read-bps"
+	IOWriteBPSPropertyName = "io-write-bps"
+
+	// ReadOnlyRootfsPropertyName specifies that the container root filesystem
+	// should be mounted read-only, so that the action may only write to its
+	// workspace and any explicitly requested scratch mounts. Currently only
+	// supported for OCI isolation.
+	ReadOnlyRootfsPropertyName = "read-only-rootfs"
+
+	// UlimitsPropertyName specifies a comma-separated list of resource limits
+	// (rlimits) to apply to the container process, in the format
+	// "NAME=SOFT[:HARD]", where NAME is a lowercase rlimit name as accepted by
+	// docker's --ulimit flag (e.g. "nofile", "nproc", or "core"). If HARD is
+	// omitted, it is the same as SOFT. Limits may be "unlimited". For example:
+	// "nofile=65536,core=0:unlimited". Currently only supported for OCI
+	// isolation.
+	UlimitsPropertyName = "ulimits"
+
+	// TmpfsMountsPropertyName specifies a comma-separated list of tmpfs mounts
+	// to create in the container, in the format "PATH[:SIZE]". For example:
+	// "/tmp:1GB,/scratch". Currently only supported for OCI isolation.
+	TmpfsMountsPropertyName = "tmpfs-mounts"
+
+	// BindMountsPropertyName specifies a comma-separated list of host paths to
+	// bind-mount into the container, in the format
+	// "HOST_PATH:CONTAINER_PATH[:ro]". Only host paths explicitly allowed by
+	// the executor configuration may be mounted. Currently only supported for
+	// OCI isolation.
+	BindMountsPropertyName = "bind-mounts"
+
+	// GPUPropertyName specifies whether the host's NVIDIA GPU devices should
+	// be made available to the action. Currently only supported for OCI
+	// isolation.
+	GPUPropertyName = "gpu"
+
+	// ContainerImagePlatformPropertyName overrides the platform used to
+	// select an image from a multi-platform image index, in the format
+	// "os/arch[/variant]". By default, the executor's own platform is used.
+	// This is useful for running emulated builds. Currently only supported for
+	// OCI isolation.
+	ContainerImagePlatformPropertyName = "container-image-platform"
+
+	// UseImageWorkingDirPropertyName specifies that commands should run in
+	// the WORKDIR configured in the container image, if any, instead of the
+	// action's execution root. Currently only supported for OCI isolation.
+	UseImageWorkingDirPropertyName = "use-image-working-dir"
+
+	// UseImageEnvPropertyName specifies whether the environment variables
+	// set by ENV in the container image are applied to commands. Defaults to
+	// true. Variables set by the command always take precedence over image
+	// variables with the same name. Currently only supported for OCI
+	// isolation.
+	UseImageEnvPropertyName = "use-image-env"
+
+	// ContainerWorkingDirPropertyName overrides the absolute path inside the
+	// container in which commands are run. It takes precedence over
+	// use-image-working-dir. Currently only supported for OCI isolation.
+	ContainerWorkingDirPropertyName = "container-working-dir"
+
+	// Container process identity properties. These set the numeric user ID,
+	// primary group ID, and supplementary group IDs of the container process,
+	// taking precedence over dockerUser and the image USER. The supplementary
+	// group IDs are a comma-separated list. Currently only supported for OCI
+	// isolation.
+	ContainerUIDPropertyName            = "container-uid"
+	ContainerGIDPropertyName            = "container-gid"
+	ContainerAdditionalGIDsPropertyName = "container-additional-gids"
+
+	// SeccompProfilePropertyName specifies a seccomp profile to apply to the
+	// container, as inline JSON in docker's seccomp profile format, or
+	// "unconfined" to disable seccomp. Only honored by executors which allow
+	// seccomp profile overrides. Currently only supported for OCI isolation.
+	SeccompProfilePropertyName = "seccomp-profile"
+
+	// AppArmorProfilePropertyName specifies the name of an AppArmor profile
+	// (already loaded on the executor host) to confine the container with, or
+	// "unconfined" to run the container without an AppArmor profile. Only
+	// honored by executors which allow AppArmor profile overrides. Currently
+	// only supported for OCI isolation.
+	AppArmorProfilePropertyName = "apparmor-profile"
+
+	// CapAddPropertyName and CapDropPropertyName are comma-separated lists of
+	// Linux capabilities to add to or drop from the default set of container
+	// capabilities, e.g. "CAP_NET_RAW". The "CAP_" prefix is optional, and
+	// "ALL" may be used to drop all default capabilities. Added capabilities
+	// must be allowed by the executor. Currently only supported for OCI
+	// isolation.
+	CapAddPropertyName  = "cap-add"
+	CapDropPropertyName = "cap-drop"
+
+	// ExtraHostsPropertyName specifies a comma-separated list of static
+	// entries to add to the container's /etc/hosts file, in the format
+	// "HOSTNAME=IP". For example: "db.internal=10.0.0.5,cache=10.0.0.6".
+	// Currently only supported for OCI isolation.
+	ExtraHostsPropertyName = "extra-hosts"
+
+	// DNSServersPropertyName and DNSSearchPropertyName specify
+	// comma-separated lists of DNS server IP addresses and search domains to
+	// write to the container's /etc/resolv.conf, replacing the executor's
+	// default DNS configuration. Ignored if networking is disabled. Currently
+	// only supported for OCI isolation.
+	DNSServersPropertyName = "dns-servers"
+	DNSSearchPropertyName  = "dns-search"
+
+	// PublishPortsPropertyName specifies a comma-separated list of container
+	// TCP ports to make reachable from the executor host, in the format
+	// "[HOST_PORT:]CONTAINER_PORT". If HOST_PORT is omitted or 0, a random
+	// available port is chosen. Other host ports must be explicitly allowed
+	// by the executor. Published ports are only reachable via the
+	// host's loopback interface. Requires networking to be enabled. Currently
+	// only supported for OCI isolation.
+	PublishPortsPropertyName = "publish-ports"
+
+	// ContainerIPPropertyName specifies a static IPv4 address to assign to
+	// the container, instead of the next available address. It may be given
+	// as an address or as an address with a /30 prefix length, and must be a
+	// valid container address within the executor's container network.
+	// Requires networking to be enabled. Currently only supported for OCI
+	// isolation.
+	ContainerIPPropertyName = "container-ip"
+
+	// ContainerHostnamePropertyName specifies the hostname of the container.
+	// It is reflected in the container's UTS namespace, /etc/hostname,
+	// /etc/hosts, and the HOSTNAME environment variable. Currently only
+	// supported for OCI isolation.
+	ContainerHostnamePropertyName = "container-hostname"
+
+	// OCIRuntimePropertyName selects the OCI runtime used to run the
+	// container instead of the executor's default runtime. Currently the only
+	// supported value is "runsc", which runs the container under gVisor for
+	// stronger isolation at the cost of some performance. Currently only
+	// supported for OCI isolation.
+	OCIRuntimePropertyName = "oci-runtime"
+
+	// ContainerAnnotationsPropertyName specifies a comma-separated list of
+	// annotations to set in the container's OCI runtime spec, in the format
+	// "KEY=VALUE", for use by runtime hooks and monitoring tools. Keys with
+	// the "io.buildbuddy." prefix are reserved. Currently only supported for
+	// OCI isolation.
+	ContainerAnnotationsPropertyName = "container-annotations"
+
+	// ReservedAnnotationPrefix is the prefix of container annotation keys
+	// which are set by the executor.
+	ReservedAnnotationPrefix = "io.buildbuddy."
+
+	// Health check properties, modeled after docker's HEALTHCHECK. If
+	// health-cmd is set, it is run as a shell command inside the container
+	// every health-interval (default 30s) after the container is created,
+	// and the container becomes healthy once the command exits with code 0.
+	// Each check fails if it does not complete within health-timeout
+	// (default 30s). The container is unhealthy after health-retries
+	// (default 3) consecutive failures, not counting failures within
+	// health-start-period (default 0s) of creating the container. Currently
+	// only supported for OCI isolation.
+	HealthCmdPropertyName         = "health-cmd"
+	HealthIntervalPropertyName    = "health-interval"
+	HealthTimeoutPropertyName     = "health-timeout"
+	HealthRetriesPropertyName     = "health-retries"
+	HealthStartPeriodPropertyName = "health-start-period"
+
 	// Property name prefix indicating a custom resource assignment.
 	customResourcePrefix = "resources:"
 
@@ -152,7 +337,38 @@ type Properties struct {
 	EstimatedMemoryBytes      int64
 	EstimatedFreeDiskBytes    int64
 	CustomResources           []*scpb.CustomResource
+	MemoryLimitBytes          int64
+	CPULimitMilliCPU          int64
+	PidsLimit                 int64
+	IOWeight                  int64
+	IOReadBPS                 int64
+	IOWriteBPS                int64
+	ReadOnlyRootfs            bool
+	Ulimits                   []*Ulimit
+	TmpfsMounts               []*TmpfsMount
+	BindMounts                []*BindMount
+	ExtraHosts                []*HostEntry
+	DNSServers                []string
+	DNSSearch                 []string
+	PublishPorts              []*PortMapping
+	ContainerIP               string
+	GPU                       bool
 	ContainerImage            string
+	ContainerImagePlatform    string
+	UseImageWorkingDir        bool
+	IgnoreImageEnv            bool
+	ContainerWorkingDir       string
+	ContainerHostname         string
+	OCIRuntime                string
+	HealthCheck               *HealthCheck
+	ContainerAnnotations      map[string]string
+	ContainerUID              *uint32
+	ContainerGID              *uint32
+	ContainerAdditionalGIDs   []uint32
+	SeccompProfile            string
+	AppArmorProfile           string
+	CapAdd                    []string
+	CapDrop                   []string
 	ContainerRegistryUsername string
 	ContainerRegistryPassword string
 	WorkloadIsolationType     string
@@ -229,6 +445,68 @@ type Properties struct {
 	EnvOverrides []string
 }
 
+// TmpfsMount is a tmpfs mount requested via platform properties.
+type TmpfsMount struct {
+	// Path is the absolute mount point path within the container.
+	Path string
+	// SizeBytes is the tmpfs size limit. If 0, the kernel default is used.
+	SizeBytes int64
+}
+
+// Ulimit is a resource limit requested via platform properties.
+type Ulimit struct {
+	// Type is the rlimit type, e.g. "RLIMIT_NOFILE".
+	Type string
+	// Soft is the soft limit (the value enforced by the kernel).
+	Soft uint64
+	// Hard is the hard limit (the ceiling for the soft limit).
+	Hard uint64
+}
+
+// HostEntry is a static /etc/hosts entry requested via platform properties.
+type HostEntry struct {
+	// Hostname is the name that resolves to IP.
+	Hostname string
+	// IP is the IPv4 or IPv6 address.
+	IP string
+}
+
+// PortMapping is a published container port requested via platform
+// properties.
+type PortMapping struct {
+	// HostPort is the port on the host. If 0, a random port is chosen.
+	HostPort int
+	// ContainerPort is the TCP port within the container.
+	ContainerPort int
+}
+
+// HealthCheck is a container health check requested via platform
+// properties.
+type HealthCheck struct {
+	// Command is the health check command.
+	Command []string
+	// Interval is the time to wait before each check.
+	Interval time.Duration
+	// Timeout is the maximum duration of each check.
+	Timeout time.Duration
+	// Retries is the number of consecutive failures after which the
+	// container is unhealthy.
+	Retries int
+	// StartPeriod is the time after container creation during which failed
+	// checks are not counted towards Retries.
+	StartPeriod time.Duration
+}
+
+// BindMount is a host bind mount requested via platform properties.
+type BindMount struct {
+	// Source is the absolute path on the host.
+	Source string
+	// Target is the absolute mount point path within the container.
+	Target string
+	// ReadOnly specifies whether the mount is read-only.
+	ReadOnly bool
+}
+
 // ContainerType indicates the type of containerization required by an executor.
 type ContainerType string
 
@@ -287,6 +565,113 @@ func ParseProperties(task *repb.ExecutionTask) (*Properties, error) {
 		return nil, err
 	}
 
+	cpuLimit := milliCPUProp(m, CPULimitPropertyName, 0)
+	if stringProp(m, CPULimitPropertyName, "") != "" && cpuLimit <= 0 {
+		return nil, status.InvalidArgumentErrorf("execution property %q: value must be a positive CPU quantity", CPULimitPropertyName)
+	}
+
+	pidsLimit := int64Prop(m, PidsLimitPropertyName, 0)
+	if pidsLimit < 0 {
+		return nil, status.InvalidArgumentErrorf("execution property %q: value must not be negative", PidsLimitPropertyName)
+	}
+
+	ioWeight := int64Prop(m, IOWeightPropertyName, 0)
+	if ioWeight != 0 && (ioWeight < 10 || ioWeight > 1000) {
+		return nil, status.InvalidArgumentErrorf("execution property %q: value must be between 10 and 1000", IOWeightPropertyName)
+	}
+
+	containerHostname := strings.ToLower(stringProp(m, ContainerHostnamePropertyName, ""))
+	if containerHostname != "" && (len(containerHostname) > 253 || !hostnameRegexp.MatchString(containerHostname)) {
+		return nil, status.InvalidArgumentErrorf("execution property %q: invalid hostname %q", ContainerHostnamePropertyName, containerHostname)
+	}
+
+	ulimits, err := ulimitsProp(m, UlimitsPropertyName)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpfsMounts, err := tmpfsMountsProp(m, TmpfsMountsPropertyName)
+	if err != nil {
+		return nil, err
+	}
+
+	bindMounts, err := bindMountsProp(m, BindMountsPropertyName)
+	if err != nil {
+		return nil, err
+	}
+
+	extraHosts, err := extraHostsProp(m, ExtraHostsPropertyName)
+	if err != nil {
+		return nil, err
+	}
+
+	containerAnnotations, err := annotationsProp(m, ContainerAnnotationsPropertyName)
+	if err != nil {
+		return nil, err
+	}
+
+	publishPorts, err := publishPortsProp(m, PublishPortsPropertyName)
+	if err != nil {
+		return nil, err
+	}
+
+	healthCheck, err := healthCheckProp(m)
+	if err != nil {
+		return nil, err
+	}
+
+	containerIP := stringProp(m, ContainerIPPropertyName, "")
+	if containerIP != "" {
+		ip, prefixLen, hasPrefix := strings.Cut(containerIP, "/")
+		addr, err := netip.ParseAddr(ip)
+		if err != nil || !addr.Is4() || (hasPrefix && prefixLen != "30") {
+			return nil, status.InvalidArgumentErrorf("execution property %q: invalid address %q (expected an IPv4 address, optionally with a /30 prefix length)", ContainerIPPropertyName, containerIP)
+		}
+		containerIP = addr.String()
+	}
+
+	var dnsServers []string
+	for _, item := range stringListProp(m, DNSServersPropertyName) {
+		addr, err := netip.ParseAddr(item)
+		if err != nil {
+			return nil, status.InvalidArgumentErrorf("execution property %q: invalid IP address %q", DNSServersPropertyName, item)
+		}
+		dnsServers = append(dnsServers, addr.String())
+	}
+	var dnsSearch []string
+	for _, item := range stringListProp(m, DNSSearchPropertyName) {
+		domain := strings.ToLower(strings.TrimSuffix(item, "."))
+		if len(domain) > 253 || !hostnameRegexp.MatchString(domain) {
+			return nil, status.InvalidArgumentErrorf("execution property %q: invalid search domain %q", DNSSearchPropertyName, item)
+		}
+		dnsSearch = append(dnsSearch, domain)
+	}
+
+	containerUID, err := uint32Prop(m, ContainerUIDPropertyName)
+	if err != nil {
+		return nil, err
+	}
+	containerGID, err := uint32Prop(m, ContainerGIDPropertyName)
+	if err != nil {
+		return nil, err
+	}
+	var containerAdditionalGIDs []uint32
+	for _, item := range stringListProp(m, ContainerAdditionalGIDsPropertyName) {
+		gid, err := strconv.ParseUint(item, 10, 32)
+		if err != nil {
+			return nil, status.InvalidArgumentErrorf("execution property %q: invalid group ID %q", ContainerAdditionalGIDsPropertyName, item)
+		}
+		containerAdditionalGIDs = append(containerAdditionalGIDs, uint32(gid))
+	}
+
+	containerWorkingDir := stringProp(m, ContainerWorkingDirPropertyName, "")
+	if containerWorkingDir != "" {
+		if !filepath.IsAbs(containerWorkingDir) {
+			return nil, status.InvalidArgumentErrorf("execution property %q: path must be absolute", ContainerWorkingDirPropertyName)
+		}
+		containerWorkingDir = filepath.Clean(containerWorkingDir)
+	}
+
 	// Parse custom resources
 	var customResources []*scpb.CustomResource
 	for k, v := range m {
@@ -312,7 +697,38 @@ func ParseProperties(task *repb.ExecutionTask) (*Properties, error) {
 		EstimatedMilliCPU:         milliCPUProp(m, EstimatedCPUPropertyName, 0),
 		EstimatedFreeDiskBytes:    iecBytesProp(m, EstimatedFreeDiskPropertyName, 0),
 		CustomResources:           customResources,
+		MemoryLimitBytes:          iecBytesProp(m, MemoryLimitPropertyName, 0),
+		CPULimitMilliCPU:          cpuLimit,
+		PidsLimit:                 pidsLimit,
+		IOWeight:                  ioWeight,
+		IOReadBPS:                 iecBytesProp(m, IOReadBPSPropertyName, 0),
+		IOWriteBPS:                iecBytesProp(m, IOWriteBPSPropertyName, 0),
+		ReadOnlyRootfs:            boolProp(m, ReadOnlyRootfsPropertyName, false),
+		Ulimits:                   ulimits,
+		TmpfsMounts:               tmpfsMounts,
+		BindMounts:                bindMounts,
+		ExtraHosts:                extraHosts,
+		DNSServers:                dnsServers,
+		DNSSearch:                 dnsSearch,
+		PublishPorts:              publishPorts,
+		ContainerIP:               containerIP,
+		GPU:                       boolProp(m, GPUPropertyName, false),
 		ContainerImage:            stringProp(m, containerImagePropertyName, ""),
+		ContainerImagePlatform:    stringProp(m, ContainerImagePlatformPropertyName, ""),
+		UseImageWorkingDir:        boolProp(m, UseImageWorkingDirPropertyName, false),
+		IgnoreImageEnv:            !boolProp(m, UseImageEnvPropertyName, true),
+		ContainerWorkingDir:       containerWorkingDir,
+		ContainerHostname:         containerHostname,
+		OCIRuntime:                stringProp(m, OCIRuntimePropertyName, ""),
+		HealthCheck:               healthCheck,
+		ContainerAnnotations:      containerAnnotations,
+		ContainerUID:              containerUID,
+		ContainerGID:              containerGID,
+		ContainerAdditionalGIDs:   containerAdditionalGIDs,
+		SeccompProfile:            stringProp(m, SeccompProfilePropertyName, ""),
+		AppArmorProfile:           stringProp(m, AppArmorProfilePropertyName, ""),
+		CapAdd:                    stringListProp(m, CapAddPropertyName),
+		CapDrop:                   stringListProp(m, CapDropPropertyName),
 		ContainerRegistryUsername: stringProp(m, containerRegistryUsernamePropertyName, ""),
 		ContainerRegistryPassword: stringProp(m, containerRegistryPasswordPropertyName, ""),
 		WorkloadIsolationType:     stringProp(m, workloadIsolationPropertyName, ""),
@@ -645,6 +1061,21 @@ func milliCPUProp(props map[string]string, name string, defaultValue int64) int6
 	return int64(cpu * 1000)
 }
 
+// uint32Prop parses an optional uint32 property, returning nil if the
+// property is not set.
+func uint32Prop(props map[string]string, name string) (*uint32, error) {
+	val := props[strings.ToLower(name)]
+	if val == "" {
+		return nil, nil
+	}
+	i, err := strconv.ParseUint(val, 10, 32)
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("execution property %q: value must be a non-negative 32-bit integer", name)
+	}
+	v := uint32(i)
+	return &v, nil
+}
+
 func stringListProp(props map[string]string, name string) []string {
 	vals := []string{}
 	for _, item := range strings.Split(props[strings.ToLower(name)], ",") {
@@ -656,6 +1087,159 @@ func stringListProp(props map[string]string, name string) []string {
 	return vals
 }
 
+// Matches valid hostnames (RFC 1123): dot-separated labels of up to 63
+// alphanumeric characters or hyphens, not starting or ending with a hyphen,
+// up to 253 characters in total.
+var hostnameRegexp = regexp.MustCompile(`^(?:[a-z0-9](?:[a-z0-9-]{0,61}[a-z0-9])?)(?:\.[a-z0-9](?:[a-z0-9-]{0,61}[a-z0-9])?)*$`)
+
+// Maps ulimit names to rlimit types.
+var ulimitTypes = map[string]string{
+	"as":         "RLIMIT_AS",
+	"core":       "RLIMIT_CORE",
+	"cpu":        "RLIMIT_CPU",
+	"data":       "RLIMIT_DATA",
+	"fsize":      "RLIMIT_FSIZE",
+	"locks":      "RLIMIT_LOCKS",
+	"memlock":    "RLIMIT_MEMLOCK",
+	"msgqueue":   "RLIMIT_MSGQUEUE",
+	"nice":       "RLIMIT_NICE",
+	"nofile":     "RLIMIT_NOFILE",
+	"nproc":      "RLIMIT_NPROC",
+	"rss":        "RLIMIT_RSS",
+	"rtprio":     "RLIMIT_RTPRIO",
+	"rttime":     "RLIMIT_RTTIME",
+	"sigpending": "RLIMIT_SIGPENDING",
+	"stack":      "RLIMIT_STACK",
+}
+
+func ulimitsProp(props map[string]string, name string) ([]*Ulimit, error) {
+	var ulimits []*Ulimit
+	seen := map[string]bool{}
+	for _, item := range stringListProp(props, name) {
+		limitName, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, status.InvalidArgumentErrorf("execution property %q: invalid ulimit %q (expected NAME=SOFT[:HARD])", name, item)
+		}
+		limitName = strings.ToLower(strings.TrimSpace(limitName))
+		rlimitType, ok := ulimitTypes[limitName]
+		if !ok {
+			return nil, status.InvalidArgumentErrorf("execution property %q: unknown ulimit %q", name, limitName)
+		}
+		if seen[limitName] {
+			return nil, status.InvalidArgumentErrorf("execution property %q: ulimit %q is specified more than once", name, limitName)
+		}
+		seen[limitName] = true
+		softStr, hardStr, hasHard := strings.Cut(value, ":")
+		if !hasHard {
+			hardStr = softStr
+		}
+		soft, err := parseUlimitValue(softStr)
+		if err != nil {
+			return nil, status.InvalidArgumentErrorf("execution property %q: invalid soft limit %q for ulimit %q", name, softStr, limitName)
+		}
+		hard, err := parseUlimitValue(hardStr)
+		if err != nil {
+			return nil, status.InvalidArgumentErrorf("execution property %q: invalid hard limit %q for ulimit %q", name, hardStr, limitName)
+		}
+		if soft > hard {
+			return nil, status.InvalidArgumentErrorf("execution property %q: soft limit exceeds hard limit for ulimit %q", name, limitName)
+		}
+		ulimits = append(ulimits, &Ulimit{Type: rlimitType, Soft: soft, Hard: hard})
+	}
+	return ulimits, nil
+}
+
+// parseUlimitValue parses an rlimit value, where "unlimited" corresponds to
+// RLIM_INFINITY.
+func parseUlimitValue(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	if s == "unlimited" {
+		return math.MaxUint64, nil
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
+
+func tmpfsMountsProp(props map[string]string, name string) ([]*TmpfsMount, error) {
+	var mounts []*TmpfsMount
+	seen := map[string]bool{}
+	for _, item := range stringListProp(props, name) {
+		path, size, hasSize := strings.Cut(item, ":")
+		path = filepath.Clean(path)
+		if !filepath.IsAbs(path) {
+			return nil, status.InvalidArgumentErrorf("execution property %q: mount path %q is not absolute", name, path)
+		}
+		if seen[path] {
+			return nil, status.InvalidArgumentErrorf("execution property %q: mount path %q is specified more than once", name, path)
+		}
+		seen[path] = true
+		mount := &TmpfsMount{Path: path}
+		if hasSize {
+			n, err := units.RAMInBytes(size)
+			if err != nil || n <= 0 {
+				return nil, status.InvalidArgumentErrorf("execution property %q: invalid size %q for mount path %q", name, size, path)
+			}
+			mount.SizeBytes = n
+		}
+		mounts = append(mounts, mount)
+	}
+	return mounts, nil
+}
+
+func bindMountsProp(props map[string]string, name string) ([]*BindMount, error) {
+	var mounts []*BindMount
+	for _, item := range stringListProp(props, name) {
+		parts := strings.Split(item, ":")
+		if len(parts) < 2 || len(parts) > 3 || (len(parts) == 3 && parts[2] != "ro") {
+			return nil, status.InvalidArgumentErrorf("execution property %q: invalid mount %q (expected HOST_PATH:CONTAINER_PATH[:ro])", name, item)
+		}
+		mount := &BindMount{
+			Source:   filepath.Clean(parts[0]),
+			Target:   filepath.Clean(parts[1]),
+			ReadOnly: len(parts) == 3,
+		}
+		if !filepath.IsAbs(mount.Source) || !filepath.IsAbs(mount.Target) {
+			return nil, status.InvalidArgumentErrorf("execution property %q: mount paths in %q must be absolute", name, item)
+		}
+		mounts = append(mounts, mount)
+	}
+	return mounts, nil
+}
+
+// healthCheckProp parses the health check properties, returning nil if no
+// health check command is set.
+func healthCheckProp(props map[string]string) (*HealthCheck, error) {
+	cmd := stringProp(props, HealthCmdPropertyName, "")
+	if cmd == "" {
+		return nil, nil
+	}
+	hc := &HealthCheck{Command: []string{"sh", "-c", cmd}}
+	for _, d := range []struct {
+		name         string
+		defaultValue time.Duration
+		dst          *time.Duration
+	}{
+		{HealthIntervalPropertyName, 30 * time.Second, &hc.Interval},
+		{HealthTimeoutPropertyName, 30 * time.Second, &hc.Timeout},
+		{HealthStartPeriodPropertyName, 0, &hc.StartPeriod},
+	} {
+		v, err := durationProp(props, d.name, d.defaultValue)
+		if err != nil {
+			return nil, err
+		}
+		if v < 0 || (v == 0 && d.name != HealthStartPeriodPropertyName) {
+			return nil, status.InvalidArgumentErrorf("execution property %q: duration must be positive", d.name)
+		}
+		*d.dst = v
+	}
+	retries := stringProp(props, HealthRetriesPropertyName, "3")
+	n, err := strconv.Atoi(retries)
+	if err != nil || n <= 0 {
+		return nil, status.InvalidArgumentErrorf("execution property %q: value must be a positive integer", HealthRetriesPropertyName)
+	}
+	hc.Retries = n
+	return hc, nil
+}
+
 func durationProp(props map[string]string, name string, defaultValue time.Duration) (time.Duration, error) {
 	val := props[strings.ToLower(name)]
 	if val == "" {
@@ -722,3 +1306,72 @@ func IsCICommand(cmd *repb.Command) bool {
 	}
 	return false
 }
+
+func extraHostsProp(props map[string]string, name string) ([]*HostEntry, error) {
+	var entries []*HostEntry
+	for _, item := range stringListProp(props, name) {
+		hostname, ip, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, status.InvalidArgumentErrorf("execution property %q: invalid host entry %q (expected HOSTNAME=IP)", name, item)
+		}
+		hostname = strings.ToLower(strings.TrimSpace(hostname))
+		if len(hostname) > 253 || !hostnameRegexp.MatchString(hostname) {
+			return nil, status.InvalidArgumentErrorf("execution property %q: invalid hostname %q", name, hostname)
+		}
+		addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+		if err != nil {
+			return nil, status.InvalidArgumentErrorf("execution property %q: invalid IP address %q for hostname %q", name, ip, hostname)
+		}
+		entries = append(entries, &HostEntry{Hostname: hostname, IP: addr.String()})
+	}
+	return entries, nil
+}
+
+func annotationsProp(props map[string]string, name string) (map[string]string, error) {
+	var annotations map[string]string
+	for _, item := range stringListProp(props, name) {
+		key, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, status.InvalidArgumentErrorf("execution property %q: invalid annotation %q (expected KEY=VALUE)", name, item)
+		}
+		key = strings.TrimSpace(key)
+		if key == "" {
+			return nil, status.InvalidArgumentErrorf("execution property %q: annotation key must not be empty", name)
+		}
+		if strings.HasPrefix(key, ReservedAnnotationPrefix) {
+			return nil, status.InvalidArgumentErrorf("execution property %q: annotation key %q uses reserved prefix %q", name, key, ReservedAnnotationPrefix)
+		}
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[key] = strings.TrimSpace(value)
+	}
+	return annotations, nil
+}
+
+func publishPortsProp(props map[string]string, name string) ([]*PortMapping, error) {
+	var mappings []*PortMapping
+	seenHostPorts := map[int]bool{}
+	seenContainerPorts := map[int]bool{}
+	for _, item := range stringListProp(props, name) {
+		hostPortStr, containerPortStr, ok := strings.Cut(item, ":")
+		if !ok {
+			hostPortStr, containerPortStr = "0", item
+		}
+		hostPort, err := strconv.Atoi(hostPortStr)
+		if err != nil || hostPort < 0 || hostPort > 65535 {
+			return nil, status.InvalidArgumentErrorf("execution property %q: invalid host port in %q", name, item)
+		}
+		containerPort, err := strconv.Atoi(containerPortStr)
+		if err != nil || containerPort < 1 || containerPort > 65535 {
+			return nil, status.InvalidArgumentErrorf("execution property %q: invalid container port in %q", name, item)
+		}
+		if seenContainerPorts[containerPort] || (hostPort != 0 && seenHostPorts[hostPort]) {
+			return nil, status.InvalidArgumentErrorf("execution property %q: port in %q is specified more than once", name, item)
+		}
+		seenContainerPorts[containerPort] = true
+		seenHostPorts[hostPort] = true
+		mappings = append(mappings, &PortMapping{HostPort: hostPort, ContainerPort: containerPort})
+	}
+	return mappings, nil
+}
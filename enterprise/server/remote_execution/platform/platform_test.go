@@ -3,6 +3,7 @@ package platform
 import (
 	"encoding/base64"
 	"fmt"
+	"math"
 	"strings"
 	"testing"
 	"time"
@@ -254,6 +255,349 @@ func TestParse_EstimatedMemory(t *testing.T) {
 	}
 }
 
+func TestParse_MemoryLimit(t *testing.T) {
+	for _, testCase := range []struct {
+		rawValue      string
+		expectedValue int64
+	}{
+		{"", 0},
+		{"1e9", 1e9},
+		{"512M", 512 * 1024 * 1024},
+		{"2GB", 2 * 1024 * 1024 * 1024},
+	} {
+		plat := &repb.Platform{Properties: []*repb.Platform_Property{
+			{Name: "memory-limit", Value: testCase.rawValue},
+		}}
+		platformProps, err := ParseProperties(&repb.ExecutionTask{Command: &repb.Command{Platform: plat}})
+		require.NoError(t, err)
+		assert.Equal(t, testCase.expectedValue, platformProps.MemoryLimitBytes)
+	}
+}
+
+func TestParse_PidsLimit(t *testing.T) {
+	for _, testCase := range []struct {
+		rawValue      string
+		expectedValue int64
+	}{
+		{"", 0},
+		{"100", 100},
+	} {
+		plat := &repb.Platform{Properties: []*repb.Platform_Property{
+			{Name: "pids-limit", Value: testCase.rawValue},
+		}}
+		platformProps, err := ParseProperties(&repb.ExecutionTask{Command: &repb.Command{Platform: plat}})
+		require.NoError(t, err)
+		assert.Equal(t, testCase.expectedValue, platformProps.PidsLimit)
+	}
+
+	for _, rawValue := range []string{"-1", "-100"} {
+		plat := &repb.Platform{Properties: []*repb.Platform_Property{
+			{Name: "pids-limit", Value: rawValue},
+		}}
+		_, err := ParseProperties(&repb.ExecutionTask{Command: &repb.Command{Platform: plat}})
+		require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error for %q, got %v", rawValue, err)
+	}
+}
+
+func TestParse_CPULimit(t *testing.T) {
+	for _, testCase := range []struct {
+		rawValue      string
+		expectedValue int64
+	}{
+		{"", 0},
+		{"2", 2000},
+		{"0.5", 500},
+		{"250m", 250},
+	} {
+		plat := &repb.Platform{Properties: []*repb.Platform_Property{
+			{Name: "cpu-limit", Value: testCase.rawValue},
+		}}
+		platformProps, err := ParseProperties(&repb.ExecutionTask{Command: &repb.Command{Platform: plat}})
+		require.NoError(t, err)
+		assert.Equal(t, testCase.expectedValue, platformProps.CPULimitMilliCPU)
+	}
+
+	for _, rawValue := range []string{"0", "-1", "0m", "abc"} {
+		plat := &repb.Platform{Properties: []*repb.Platform_Property{
+			{Name: "cpu-limit", Value: rawValue},
+		}}
+		_, err := ParseProperties(&repb.ExecutionTask{Command: &repb.Command{Platform: plat}})
+		require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error for %q, got %v", rawValue, err)
+	}
+}
+
+func TestParse_TmpfsMounts(t *testing.T) {
+	plat := &repb.Platform{Properties: []*repb.Platform_Property{
+		{Name: "tmpfs-mounts", Value: "/tmp:64M, /scratch"},
+	}}
+	platformProps, err := ParseProperties(&repb.ExecutionTask{Command: &repb.Command{Platform: plat}})
+	require.NoError(t, err)
+	assert.Equal(t, []*TmpfsMount{
+		{Path: "/tmp", SizeBytes: 64 * 1024 * 1024},
+		{Path: "/scratch"},
+	}, platformProps.TmpfsMounts)
+
+	for _, rawValue := range []string{"/tmp,/tmp/", "relative/path", "/tmp:bogus"} {
+		plat := &repb.Platform{Properties: []*repb.Platform_Property{
+			{Name: "tmpfs-mounts", Value: rawValue},
+		}}
+		_, err := ParseProperties(&repb.ExecutionTask{Command: &repb.Command{Platform: plat}})
+		require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error for %q, got %v", rawValue, err)
+	}
+}
+
+func TestParse_Ulimits(t *testing.T) {
+	plat := &repb.Platform{Properties: []*repb.Platform_Property{
+		{Name: "ulimits", Value: "nofile=1024:65536, NPROC=512, core=0:unlimited"},
+	}}
+	platformProps, err := ParseProperties(&repb.ExecutionTask{Command: &repb.Command{Platform: plat}})
+	require.NoError(t, err)
+	assert.Equal(t, []*Ulimit{
+		{Type: "RLIMIT_NOFILE", Soft: 1024, Hard: 65536},
+		{Type: "RLIMIT_NPROC", Soft: 512, Hard: 512},
+		{Type: "RLIMIT_CORE", Soft: 0, Hard: math.MaxUint64},
+	}, platformProps.Ulimits)
+
+	for _, rawValue := range []string{"nofile", "bogus=1", "nofile=1,nofile=2", "nofile=abc", "nofile=2:1"} {
+		plat := &repb.Platform{Properties: []*repb.Platform_Property{
+			{Name: "ulimits", Value: rawValue},
+		}}
+		_, err := ParseProperties(&repb.ExecutionTask{Command: &repb.Command{Platform: plat}})
+		require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error for %q, got %v", rawValue, err)
+	}
+}
+
+func TestParse_ExtraHosts(t *testing.T) {
+	plat := &repb.Platform{Properties: []*repb.Platform_Property{
+		{Name: "extra-hosts", Value: "db.internal=10.0.0.5, Cache=::1"},
+	}}
+	platformProps, err := ParseProperties(&repb.ExecutionTask{Command: &repb.Command{Platform: plat}})
+	require.NoError(t, err)
+	assert.Equal(t, []*HostEntry{
+		{Hostname: "db.internal", IP: "10.0.0.5"},
+		{Hostname: "cache", IP: "::1"},
+	}, platformProps.ExtraHosts)
+
+	for _, rawValue := range []string{"db.internal", "db.internal=bogus", "db_internal=10.0.0.5", "=10.0.0.5"} {
+		plat := &repb.Platform{Properties: []*repb.Platform_Property{
+			{Name: "extra-hosts", Value: rawValue},
+		}}
+		_, err := ParseProperties(&repb.ExecutionTask{Command: &repb.Command{Platform: plat}})
+		require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error for %q, got %v", rawValue, err)
+	}
+}
+
+func TestParse_ContainerAnnotations(t *testing.T) {
+	plat := &repb.Platform{Properties: []*repb.Platform_Property{
+		{Name: "container-annotations", Value: "com.example.team=infra, com.example.tier="},
+	}}
+	platformProps, err := ParseProperties(&repb.ExecutionTask{Command: &repb.Command{Platform: plat}})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"com.example.team": "infra",
+		"com.example.tier": "",
+	}, platformProps.ContainerAnnotations)
+
+	for _, rawValue := range []string{"com.example.team", "=infra", "io.buildbuddy.invocation-id=foo"} {
+		plat := &repb.Platform{Properties: []*repb.Platform_Property{
+			{Name: "container-annotations", Value: rawValue},
+		}}
+		_, err := ParseProperties(&repb.ExecutionTask{Command: &repb.Command{Platform: plat}})
+		require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error for %q, got %v", rawValue, err)
+	}
+}
+
+func TestParse_DNS(t *testing.T) {
+	plat := &repb.Platform{Properties: []*repb.Platform_Property{
+		{Name: "dns-servers", Value: "10.0.0.2, 2001:4860:4860::8888"},
+		{Name: "dns-search", Value: "corp.example.com,Example.org."},
+	}}
+	platformProps, err := ParseProperties(&repb.ExecutionTask{Command: &repb.Command{Platform: plat}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.2", "2001:4860:4860::8888"}, platformProps.DNSServers)
+	assert.Equal(t, []string{"corp.example.com", "example.org"}, platformProps.DNSSearch)
+
+	for _, prop := range []*repb.Platform_Property{
+		{Name: "dns-servers", Value: "dns.example.com"},
+		{Name: "dns-search", Value: "bad_domain"},
+	} {
+		plat := &repb.Platform{Properties: []*repb.Platform_Property{prop}}
+		_, err := ParseProperties(&repb.ExecutionTask{Command: &repb.Command{Platform: plat}})
+		require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error for %s=%q, got %v", prop.Name, prop.Value, err)
+	}
+}
+
+func TestParse_PublishPorts(t *testing.T) {
+	plat := &repb.Platform{Properties: []*repb.Platform_Property{
+		{Name: "publish-ports", Value: "8080:80, 0:443, 9000"},
+	}}
+	platformProps, err := ParseProperties(&repb.ExecutionTask{Command: &repb.Command{Platform: plat}})
+	require.NoError(t, err)
+	assert.Equal(t, []*PortMapping{
+		{HostPort: 8080, ContainerPort: 80},
+		{HostPort: 0, ContainerPort: 443},
+		{HostPort: 0, ContainerPort: 9000},
+	}, platformProps.PublishPorts)
+
+	for _, rawValue := range []string{"http", "8080:0", "70000:80", "80,80", "8080:80,8080:81"} {
+		plat := &repb.Platform{Properties: []*repb.Platform_Property{
+			{Name: "publish-ports", Value: rawValue},
+		}}
+		_, err := ParseProperties(&repb.ExecutionTask{Command: &repb.Command{Platform: plat}})
+		require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error for %q, got %v", rawValue, err)
+	}
+}
+
+func TestParse_ContainerIP(t *testing.T) {
+	for _, rawValue := range []string{"192.168.1.6", "192.168.1.6/30"} {
+		plat := &repb.Platform{Properties: []*repb.Platform_Property{
+			{Name: "container-ip", Value: rawValue},
+		}}
+		platformProps, err := ParseProperties(&repb.ExecutionTask{Command: &repb.Command{Platform: plat}})
+		require.NoError(t, err)
+		assert.Equal(t, "192.168.1.6", platformProps.ContainerIP)
+	}
+
+	for _, rawValue := range []string{"bogus", "fd00::6", "192.168.1.6/24"} {
+		plat := &repb.Platform{Properties: []*repb.Platform_Property{
+			{Name: "container-ip", Value: rawValue},
+		}}
+		_, err := ParseProperties(&repb.ExecutionTask{Command: &repb.Command{Platform: plat}})
+		require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error for %q, got %v", rawValue, err)
+	}
+}
+
+func TestParse_ContainerWorkingDir(t *testing.T) {
+	plat := &repb.Platform{Properties: []*repb.Platform_Property{
+		{Name: "container-working-dir", Value: "/src/"},
+	}}
+	platformProps, err := ParseProperties(&repb.ExecutionTask{Command: &repb.Command{Platform: plat}})
+	require.NoError(t, err)
+	assert.Equal(t, "/src", platformProps.ContainerWorkingDir)
+
+	platformProps, err = ParseProperties(&repb.ExecutionTask{Command: &repb.Command{}})
+	require.NoError(t, err)
+	assert.Equal(t, "", platformProps.ContainerWorkingDir)
+
+	plat = &repb.Platform{Properties: []*repb.Platform_Property{
+		{Name: "container-working-dir", Value: "src"},
+	}}
+	_, err = ParseProperties(&repb.ExecutionTask{Command: &repb.Command{Platform: plat}})
+	require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error, got %v", err)
+}
+
+func TestParse_UseImageEnv(t *testing.T) {
+	platformProps, err := ParseProperties(&repb.ExecutionTask{Command: &repb.Command{}})
+	require.NoError(t, err)
+	assert.False(t, platformProps.IgnoreImageEnv)
+
+	plat := &repb.Platform{Properties: []*repb.Platform_Property{
+		{Name: "use-image-env", Value: "false"},
+	}}
+	platformProps, err = ParseProperties(&repb.ExecutionTask{Command: &repb.Command{Platform: plat}})
+	require.NoError(t, err)
+	assert.True(t, platformProps.IgnoreImageEnv)
+}
+
+func TestParse_ContainerHostname(t *testing.T) {
+	plat := &repb.Platform{Properties: []*repb.Platform_Property{
+		{Name: "container-hostname", Value: "Build-Host.example.com"},
+	}}
+	platformProps, err := ParseProperties(&repb.ExecutionTask{Command: &repb.Command{Platform: plat}})
+	require.NoError(t, err)
+	assert.Equal(t, "build-host.example.com", platformProps.ContainerHostname)
+
+	for _, rawValue := range []string{"-host", "host-", "build_host", "host..example", strings.Repeat("a", 64)} {
+		plat := &repb.Platform{Properties: []*repb.Platform_Property{
+			{Name: "container-hostname", Value: rawValue},
+		}}
+		_, err := ParseProperties(&repb.ExecutionTask{Command: &repb.Command{Platform: plat}})
+		require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error for %q, got %v", rawValue, err)
+	}
+}
+
+func TestParse_HealthCheck(t *testing.T) {
+	plat := &repb.Platform{Properties: []*repb.Platform_Property{}}
+	platformProps, err := ParseProperties(&repb.ExecutionTask{Command: &repb.Command{Platform: plat}})
+	require.NoError(t, err)
+	assert.Nil(t, platformProps.HealthCheck)
+
+	plat = &repb.Platform{Properties: []*repb.Platform_Property{
+		{Name: "health-cmd", Value: "curl -f localhost:8080"},
+	}}
+	platformProps, err = ParseProperties(&repb.ExecutionTask{Command: &repb.Command{Platform: plat}})
+	require.NoError(t, err)
+	assert.Equal(t, &HealthCheck{
+		Command:  []string{"sh", "-c", "curl -f localhost:8080"},
+		Interval: 30 * time.Second,
+		Timeout:  30 * time.Second,
+		Retries:  3,
+	}, platformProps.HealthCheck)
+
+	plat = &repb.Platform{Properties: []*repb.Platform_Property{
+		{Name: "health-cmd", Value: "true"},
+		{Name: "health-interval", Value: "1s"},
+		{Name: "health-timeout", Value: "500ms"},
+		{Name: "health-retries", Value: "10"},
+		{Name: "health-start-period", Value: "1m"},
+	}}
+	platformProps, err = ParseProperties(&repb.ExecutionTask{Command: &repb.Command{Platform: plat}})
+	require.NoError(t, err)
+	assert.Equal(t, &HealthCheck{
+		Command:     []string{"sh", "-c", "true"},
+		Interval:    1 * time.Second,
+		Timeout:     500 * time.Millisecond,
+		Retries:     10,
+		StartPeriod: 1 * time.Minute,
+	}, platformProps.HealthCheck)
+
+	for _, prop := range []*repb.Platform_Property{
+		{Name: "health-interval", Value: "0s"},
+		{Name: "health-timeout", Value: "-1s"},
+		{Name: "health-retries", Value: "0"},
+		{Name: "health-retries", Value: "many"},
+		{Name: "health-start-period", Value: "soon"},
+	} {
+		plat := &repb.Platform{Properties: []*repb.Platform_Property{
+			{Name: "health-cmd", Value: "true"},
+			prop,
+		}}
+		_, err := ParseProperties(&repb.ExecutionTask{Command: &repb.Command{Platform: plat}})
+		require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error for %s=%q, got %v", prop.Name, prop.Value, err)
+	}
+}
+
+func TestParse_ContainerUserIDs(t *testing.T) {
+	plat := &repb.Platform{Properties: []*repb.Platform_Property{
+		{Name: "container-uid", Value: "0"},
+		{Name: "container-gid", Value: "2000"},
+		{Name: "container-additional-gids", Value: "3000, 3001"},
+	}}
+	platformProps, err := ParseProperties(&repb.ExecutionTask{Command: &repb.Command{Platform: plat}})
+	require.NoError(t, err)
+	require.NotNil(t, platformProps.ContainerUID)
+	assert.Equal(t, uint32(0), *platformProps.ContainerUID)
+	require.NotNil(t, platformProps.ContainerGID)
+	assert.Equal(t, uint32(2000), *platformProps.ContainerGID)
+	assert.Equal(t, []uint32{3000, 3001}, platformProps.ContainerAdditionalGIDs)
+
+	platformProps, err = ParseProperties(&repb.ExecutionTask{Command: &repb.Command{}})
+	require.NoError(t, err)
+	assert.Nil(t, platformProps.ContainerUID)
+	assert.Nil(t, platformProps.ContainerGID)
+	assert.Empty(t, platformProps.ContainerAdditionalGIDs)
+
+	for _, prop := range []*repb.Platform_Property{
+		{Name: "container-uid", Value: "-1"},
+		{Name: "container-gid", Value: "4294967296"},
+		{Name: "container-additional-gids", Value: "1,root"},
+	} {
+		plat := &repb.Platform{Properties: []*repb.Platform_Property{prop}}
+		_, err := ParseProperties(&repb.ExecutionTask{Command: &repb.Command{Platform: plat}})
+		require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error for %s=%q, got %v", prop.GetName(), prop.GetValue(), err)
+	}
+}
+
 func TestParse_Duration(t *testing.T) {
 	const durationProperty = "runner-recycling-max-wait"
 
@@ -53,11 +53,17 @@ func (p *pool) registerContainerProviders(providers map[platform.ContainerType]c
 	}
 
 	if executor.SupportsIsolation(platform.OCIContainerType) {
-		p, err := ociruntime.NewProvider(p.env, p.buildRoot)
+		ociProvider, err := ociruntime.NewProvider(p.env, p.buildRoot)
 		if err != nil {
 			return status.FailedPreconditionErrorf("Failed to initialize OCI container provider: %s", err)
 		}
-		providers[platform.OCIContainerType] = p
+		if v, err := ociProvider.RuntimeVersion(context.Background()); err != nil {
+			log.Warningf("Failed to get OCI runtime version: %s", err)
+		} else {
+			log.Infof("Using OCI runtime %s", v)
+		}
+		p.env.GetHealthChecker().RegisterShutdownFunction(ociProvider.Shutdown)
+		providers[platform.OCIContainerType] = ociProvider
 	}
 
 	return nil
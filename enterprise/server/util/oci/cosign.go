@@ -0,0 +1,200 @@
+package oci
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+
+	ctrname "github.com/google/go-containerregistry/pkg/name"
+)
+
+var (
+	cosignEnabled       = flag.Bool("executor.container_registry_cosign.enabled", false, "If true, images must have a valid cosign signature made with the key at executor.container_registry_cosign.public_key_file in order to be pulled. Only key-based signatures are supported; keyless (Fulcio/Rekor) signatures are not.")
+	cosignPublicKeyFile = flag.String("executor.container_registry_cosign.public_key_file", "", "Path to a PEM-encoded ECDSA, RSA, or Ed25519 public key used to verify cosign image signatures.")
+)
+
+const (
+	// Media type of cosign signature layers. Each layer contains a signed
+	// "simple signing" payload.
+	cosignSignatureMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+
+	// Layer annotation holding the base64-encoded signature of the layer's
+	// payload.
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+
+	// Maximum size of a signature payload. Payloads are small JSON
+	// documents, so this only guards against misbehaving registries.
+	maxCosignPayloadBytes = 1 << 20
+)
+
+// cosignPayload is the subset of the cosign "simple signing" payload which is
+// needed to verify a signature.
+type cosignPayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+	} `json:"critical"`
+}
+
+// VerifiedImageRef verifies the cosign signature of the given image if
+// signature verification is enabled, and returns a reference to the verified
+// image by digest. Pulling the returned reference guarantees that the pulled
+// image is the one that was verified, even if the image's tag moves. If
+// signature verification is disabled, the image name is returned unchanged.
+//
+// Signatures are looked up using cosign's tag-based scheme, where the
+// signatures of an image with digest "sha256:abc" are stored in the same
+// repository under the tag "sha256-abc.sig".
+func VerifiedImageRef(ctx context.Context, imageName string, credentials Credentials) (string, error) {
+	if !*cosignEnabled {
+		return imageName, nil
+	}
+	publicKey, err := cosignPublicKey()
+	if err != nil {
+		return "", err
+	}
+	imageRef, err := ctrname.ParseReference(imageName)
+	if err != nil {
+		return "", status.InvalidArgumentErrorf("invalid image %q", imageName)
+	}
+	remoteOpts, err := remoteOptions(ctx, imageRef, credentials)
+	if err != nil {
+		return "", err
+	}
+	desc, err := getDescriptor(ctx, imageRef, remoteOpts)
+	if err != nil {
+		return "", manifestError(err)
+	}
+	if err := verifyCosignSignature(ctx, imageRef.Context(), desc.Digest, remoteOpts, publicKey); err != nil {
+		return "", err
+	}
+	log.CtxDebugf(ctx, "Verified cosign signature for %q (%s)", imageName, desc.Digest)
+	return imageRef.Context().Digest(desc.Digest.String()).String(), nil
+}
+
+// verifyCosignSignature returns nil if the given repository contains a
+// signature for the given manifest digest which is valid for the given public
+// key.
+func verifyCosignSignature(ctx context.Context, repo ctrname.Repository, digest v1.Hash, remoteOpts []remote.Option, publicKey crypto.PublicKey) error {
+	sigRef := repo.Tag(strings.Replace(digest.String(), ":", "-", 1) + ".sig")
+	sigDesc, err := getDescriptor(ctx, sigRef, remoteOpts)
+	if err != nil {
+		err = manifestError(err)
+		if status.IsNotFoundError(err) {
+			return status.FailedPreconditionErrorf("image %s@%s is not signed: no cosign signatures found at %q", repo, digest, sigRef)
+		}
+		return status.WrapError(err, "fetch cosign signatures")
+	}
+	sigImage, err := sigDesc.Image()
+	if err != nil {
+		return status.UnavailableErrorf("get cosign signature image: %s", err)
+	}
+	manifest, err := sigImage.Manifest()
+	if err != nil {
+		return status.UnavailableErrorf("get cosign signature manifest: %s", err)
+	}
+	for _, layerDesc := range manifest.Layers {
+		if layerDesc.MediaType != cosignSignatureMediaType {
+			continue
+		}
+		if err := verifyCosignSignatureLayer(sigImage, layerDesc, digest, publicKey); err != nil {
+			log.CtxDebugf(ctx, "Ignoring cosign signature layer %s: %s", layerDesc.Digest, err)
+			continue
+		}
+		return nil
+	}
+	return status.FailedPreconditionErrorf("image %s@%s does not have a cosign signature matching the configured public key", repo, digest)
+}
+
+func verifyCosignSignatureLayer(sigImage v1.Image, layerDesc v1.Descriptor, digest v1.Hash, publicKey crypto.PublicKey) error {
+	sig, err := base64.StdEncoding.DecodeString(layerDesc.Annotations[cosignSignatureAnnotation])
+	if err != nil {
+		return fmt.Errorf("decode signature: %w", err)
+	}
+	layer, err := sigImage.LayerByDigest(layerDesc.Digest)
+	if err != nil {
+		return fmt.Errorf("get payload layer: %w", err)
+	}
+	// Signature layers are not compressed, so the "compressed" contents are
+	// the payload itself. Reading the layer verifies its digest.
+	rc, err := layer.Compressed()
+	if err != nil {
+		return fmt.Errorf("read payload: %w", err)
+	}
+	defer rc.Close()
+	payload, err := io.ReadAll(io.LimitReader(rc, maxCosignPayloadBytes))
+	if err != nil {
+		return fmt.Errorf("read payload: %w", err)
+	}
+	if err := verifySignature(publicKey, payload, sig); err != nil {
+		return err
+	}
+	// The signature is valid, but it must also be a signature for this
+	// image rather than some other image signed with the same key.
+	var p cosignPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return fmt.Errorf("parse payload: %w", err)
+	}
+	if p.Critical.Image.DockerManifestDigest != digest.String() {
+		return fmt.Errorf("payload is for digest %q, not %q", p.Critical.Image.DockerManifestDigest, digest)
+	}
+	return nil
+}
+
+func verifySignature(publicKey crypto.PublicKey, payload, sig []byte) error {
+	h := sha256.Sum256(payload)
+	switch k := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(k, h[:], sig) {
+			return fmt.Errorf("invalid ECDSA signature")
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, h[:], sig); err != nil {
+			return fmt.Errorf("invalid RSA signature: %w", err)
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, payload, sig) {
+			return fmt.Errorf("invalid Ed25519 signature")
+		}
+	default:
+		return fmt.Errorf("unsupported public key type %T", publicKey)
+	}
+	return nil
+}
+
+func cosignPublicKey() (crypto.PublicKey, error) {
+	if *cosignPublicKeyFile == "" {
+		return nil, status.FailedPreconditionError("cosign signature verification is enabled, but executor.container_registry_cosign.public_key_file is not set")
+	}
+	b, err := os.ReadFile(*cosignPublicKeyFile)
+	if err != nil {
+		return nil, status.FailedPreconditionErrorf("read cosign public key: %s", err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, status.FailedPreconditionErrorf("cosign public key file %q does not contain a PEM block", *cosignPublicKeyFile)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, status.FailedPreconditionErrorf("parse cosign public key: %s", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,149 @@
+package oci
+
+import (
+	"context"
+	"encoding/base64"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/third_party/singleflight"
+
+	awscreds "github.com/aws/aws-sdk-go/aws/credentials"
+	awssession "github.com/aws/aws-sdk-go/aws/session"
+)
+
+var (
+	ecrEnabled         = flag.Bool("executor.container_registry_ecr.enabled", false, "If true, credentials for AWS ECR registries (*.dkr.ecr.*.amazonaws.com) are fetched automatically using AWS credentials when no explicit credentials are provided for an image.")
+	ecrAccessKeyID     = flag.String("executor.container_registry_ecr.access_key_id", "", "AWS access key ID used to fetch ECR authorization tokens. If not specified, credentials will be retrieved as described by https://docs.aws.amazon.com/sdkref/latest/guide/standardized-credentials.html")
+	ecrSecretAccessKey = flag.String("executor.container_registry_ecr.secret_access_key", "", "AWS secret access key used to fetch ECR authorization tokens.", flag.Secret)
+)
+
+const (
+	// ECR authorization tokens are valid for 12 hours. Refresh them well
+	// before they expire so that long-running pulls don't fail partway
+	// through.
+	ecrTokenRefreshWindow = 1 * time.Hour
+)
+
+// Matches ECR registry hostnames like
+// "123456789012.dkr.ecr.us-east-1.amazonaws.com", capturing the account ID
+// and region.
+var ecrHostRegexp = regexp.MustCompile(`^(\d{12})\.dkr\.ecr(?:-fips)?\.([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?$`)
+
+type ecrToken struct {
+	creds     Credentials
+	expiresAt time.Time
+}
+
+var (
+	ecrTokensMu sync.Mutex
+	// ecrTokens caches authorization tokens, keyed by registry hostname.
+	ecrTokens = map[string]*ecrToken{}
+	// ecrTokenFetches deduplicates concurrent token requests for the same
+	// registry, without blocking requests for other registries.
+	ecrTokenFetches singleflight.Group[string, *ecrToken]
+
+	// fetchECRToken fetches a new authorization token. It is replaced in
+	// tests.
+	fetchECRToken = fetchECRTokenFromAWS
+)
+
+// parseECRHost returns the AWS account ID and region for the given registry
+// hostname, and whether the hostname is an ECR registry.
+func parseECRHost(host string) (accountID, region string, ok bool) {
+	m := ecrHostRegexp.FindStringSubmatch(host)
+	if m == nil {
+		return "", "", false
+	}
+	return m[1], m[2], true
+}
+
+// ecrCredentials returns credentials for the given registry hostname if ECR
+// authentication is enabled and the hostname is an ECR registry. Tokens are
+// cached and refreshed shortly before they expire. The returned credentials
+// are empty if ECR authentication does not apply to the registry.
+func ecrCredentials(ctx context.Context, host string) (Credentials, error) {
+	if !*ecrEnabled {
+		return Credentials{}, nil
+	}
+	accountID, region, ok := parseECRHost(host)
+	if !ok {
+		return Credentials{}, nil
+	}
+
+	if t, ok := cachedECRToken(host); ok {
+		return t.creds, nil
+	}
+	// Concurrent pulls from the same registry share a single token request.
+	t, _, err := ecrTokenFetches.Do(ctx, host, func(ctx context.Context) (*ecrToken, error) {
+		if t, ok := cachedECRToken(host); ok {
+			return t, nil
+		}
+		t, err := fetchECRToken(ctx, accountID, region)
+		if err != nil {
+			return nil, err
+		}
+		log.CtxDebugf(ctx, "Fetched ECR authorization token for %q (expires at %s)", host, t.expiresAt)
+		ecrTokensMu.Lock()
+		ecrTokens[host] = t
+		ecrTokensMu.Unlock()
+		return t, nil
+	})
+	if err != nil {
+		return Credentials{}, err
+	}
+	return t.creds, nil
+}
+
+// cachedECRToken returns the cached token for the given registry hostname,
+// if there is one which is not due to be refreshed.
+func cachedECRToken(host string) (*ecrToken, bool) {
+	ecrTokensMu.Lock()
+	defer ecrTokensMu.Unlock()
+	t, ok := ecrTokens[host]
+	if !ok || time.Until(t.expiresAt) <= ecrTokenRefreshWindow {
+		return nil, false
+	}
+	return t, true
+}
+
+func fetchECRTokenFromAWS(ctx context.Context, accountID, region string) (*ecrToken, error) {
+	cfg := &aws.Config{Region: aws.String(region)}
+	if *ecrAccessKeyID != "" || *ecrSecretAccessKey != "" {
+		cfg.Credentials = awscreds.NewStaticCredentials(*ecrAccessKeyID, *ecrSecretAccessKey, "")
+	}
+	sess, err := awssession.NewSession(cfg)
+	if err != nil {
+		return nil, status.UnavailableErrorf("create AWS session: %s", err)
+	}
+	rsp, err := ecr.New(sess).GetAuthorizationTokenWithContext(ctx, &ecr.GetAuthorizationTokenInput{
+		RegistryIds: []*string{aws.String(accountID)},
+	})
+	if err != nil {
+		return nil, status.UnavailableErrorf("get ECR authorization token: %s", err)
+	}
+	if len(rsp.AuthorizationData) == 0 {
+		return nil, status.UnavailableError("get ECR authorization token: response did not contain authorization data")
+	}
+	data := rsp.AuthorizationData[0]
+	// The token is a base64-encoded "username:password" pair.
+	b, err := base64.StdEncoding.DecodeString(aws.StringValue(data.AuthorizationToken))
+	if err != nil {
+		return nil, status.UnavailableErrorf("decode ECR authorization token: %s", err)
+	}
+	username, password, ok := strings.Cut(string(b), ":")
+	if !ok {
+		return nil, status.UnavailableError("decode ECR authorization token: malformed token")
+	}
+	return &ecrToken{
+		creds:     Credentials{Username: username, Password: password},
+		expiresAt: aws.TimeValue(data.ExpiresAt),
+	}, nil
+}
@@ -0,0 +1,160 @@
+package oci
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseECRHost(t *testing.T) {
+	for _, test := range []struct {
+		host          string
+		wantAccountID string
+		wantRegion    string
+		wantOK        bool
+	}{
+		{host: "123456789012.dkr.ecr.us-east-1.amazonaws.com", wantAccountID: "123456789012", wantRegion: "us-east-1", wantOK: true},
+		{host: "123456789012.dkr.ecr-fips.us-gov-west-1.amazonaws.com", wantAccountID: "123456789012", wantRegion: "us-gov-west-1", wantOK: true},
+		{host: "123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn", wantAccountID: "123456789012", wantRegion: "cn-north-1", wantOK: true},
+		{host: "public.ecr.aws"},
+		{host: "12345.dkr.ecr.us-east-1.amazonaws.com"},
+		{host: "123456789012.dkr.ecr.us-east-1.amazonaws.com.evil.com"},
+		{host: "evil.com/123456789012.dkr.ecr.us-east-1.amazonaws.com"},
+		{host: "123456789012.dkr.ecr.us-east-1.amazonaws.com:443"},
+		{host: "gcr.io"},
+		{host: ""},
+	} {
+		t.Run(test.host, func(t *testing.T) {
+			accountID, region, ok := parseECRHost(test.host)
+			assert.Equal(t, test.wantOK, ok)
+			assert.Equal(t, test.wantAccountID, accountID)
+			assert.Equal(t, test.wantRegion, region)
+		})
+	}
+}
+
+// setupFakeECR enables ECR authentication with a fake token fetcher which
+// returns tokens with the given lifetime, and returns the number of fetches.
+func setupFakeECR(t *testing.T, lifetime time.Duration) *atomic.Int32 {
+	flags.Set(t, "executor.container_registry_ecr.enabled", true)
+	var fetches atomic.Int32
+	original := fetchECRToken
+	fetchECRToken = func(ctx context.Context, accountID, region string) (*ecrToken, error) {
+		n := fetches.Add(1)
+		return &ecrToken{
+			creds:     Credentials{Username: "AWS", Password: fmt.Sprintf("%s-%s-%d", accountID, region, n)},
+			expiresAt: time.Now().Add(lifetime),
+		}, nil
+	}
+	t.Cleanup(func() {
+		fetchECRToken = original
+		ecrTokensMu.Lock()
+		ecrTokens = map[string]*ecrToken{}
+		ecrTokensMu.Unlock()
+	})
+	return &fetches
+}
+
+func TestECRCredentials_Cache(t *testing.T) {
+	ctx := context.Background()
+	const host = "123456789012.dkr.ecr.us-east-1.amazonaws.com"
+
+	t.Run("Valid", func(t *testing.T) {
+		fetches := setupFakeECR(t, 12*time.Hour)
+		creds, err := ecrCredentials(ctx, host)
+		require.NoError(t, err)
+		assert.Equal(t, Credentials{Username: "AWS", Password: "123456789012-us-east-1-1"}, creds)
+		creds, err = ecrCredentials(ctx, host)
+		require.NoError(t, err)
+		assert.Equal(t, Credentials{Username: "AWS", Password: "123456789012-us-east-1-1"}, creds)
+		assert.Equal(t, int32(1), fetches.Load(), "valid tokens should be reused")
+	})
+
+	t.Run("NearExpiry", func(t *testing.T) {
+		// Tokens which expire within the refresh window are fetched again.
+		fetches := setupFakeECR(t, ecrTokenRefreshWindow/2)
+		_, err := ecrCredentials(ctx, host)
+		require.NoError(t, err)
+		creds, err := ecrCredentials(ctx, host)
+		require.NoError(t, err)
+		assert.Equal(t, Credentials{Username: "AWS", Password: "123456789012-us-east-1-2"}, creds)
+		assert.Equal(t, int32(2), fetches.Load())
+	})
+
+	t.Run("NonECRHost", func(t *testing.T) {
+		fetches := setupFakeECR(t, 12*time.Hour)
+		creds, err := ecrCredentials(ctx, "gcr.io")
+		require.NoError(t, err)
+		assert.True(t, creds.IsEmpty())
+		assert.Equal(t, int32(0), fetches.Load())
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		fetches := setupFakeECR(t, 12*time.Hour)
+		flags.Set(t, "executor.container_registry_ecr.enabled", false)
+		creds, err := ecrCredentials(ctx, host)
+		require.NoError(t, err)
+		assert.True(t, creds.IsEmpty())
+		assert.Equal(t, int32(0), fetches.Load())
+	})
+}
+
+func TestECRCredentials_FetchError(t *testing.T) {
+	ctx := context.Background()
+	setupFakeECR(t, 12*time.Hour)
+	fetchECRToken = func(ctx context.Context, accountID, region string) (*ecrToken, error) {
+		return nil, status.UnavailableError("boom")
+	}
+	_, err := ecrCredentials(ctx, "123456789012.dkr.ecr.us-east-1.amazonaws.com")
+	require.True(t, status.IsUnavailableError(err), "expected Unavailable error, got %v", err)
+}
+
+func TestECRCredentials_ConcurrentFetches(t *testing.T) {
+	ctx := context.Background()
+	setupFakeECR(t, 12*time.Hour)
+	const slowHost = "111111111111.dkr.ecr.us-east-1.amazonaws.com"
+	const fastHost = "222222222222.dkr.ecr.us-east-1.amazonaws.com"
+
+	// Block fetches for one registry until the test releases them.
+	release := make(chan struct{})
+	var slowFetches atomic.Int32
+	fetchECRToken = func(ctx context.Context, accountID, region string) (*ecrToken, error) {
+		if accountID == "111111111111" {
+			slowFetches.Add(1)
+			<-release
+		}
+		return &ecrToken{
+			creds:     Credentials{Username: "AWS", Password: accountID},
+			expiresAt: time.Now().Add(12 * time.Hour),
+		}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			creds, err := ecrCredentials(ctx, slowHost)
+			assert.NoError(t, err)
+			assert.Equal(t, "111111111111", creds.Password)
+		}()
+	}
+	require.Eventually(t, func() bool { return slowFetches.Load() > 0 }, 10*time.Second, 10*time.Millisecond)
+
+	// A slow fetch for one registry should not block other registries.
+	creds, err := ecrCredentials(ctx, fastHost)
+	require.NoError(t, err)
+	assert.Equal(t, "222222222222", creds.Password)
+
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), slowFetches.Load(), "concurrent fetches for the same registry should be deduplicated")
+}
@@ -2,14 +2,17 @@ package oci
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"runtime"
+	"strings"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
 	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/docker/cli/cli/config"
 	"github.com/docker/distribution/reference"
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/v1"
@@ -24,7 +27,10 @@ import (
 )
 
 var (
-	registries = flag.Slice("executor.container_registries", []Registry{}, "")
+	registries      = flag.Slice("executor.container_registries", []Registry{}, "")
+	useDockerConfig = flag.Bool("executor.container_registry_use_docker_config", false, "If true, registry credentials are read from a Docker config.json file when no explicit credentials are provided for an image. Credential helpers configured via credHelpers and credsStore are supported, and must be present in PATH.")
+	dockerConfigDir = flag.String("executor.container_registry_docker_config_dir", "", "Directory containing the Docker config.json file used when executor.container_registry_use_docker_config is enabled. Defaults to $DOCKER_CONFIG if set, otherwise ~/.docker.")
+	registryMirrors = flag.Slice("executor.container_registry_mirrors", []RegistryMirror{}, `Registry mirrors to pull images from instead of the original registry. Mirrors are tried in order, falling back to the original registry if all mirrors fail. Format is --executor.container_registry_mirrors='[{"hostname":"gcr.io","mirrors":["mirror.example.com"]}]'. Docker Hub images should use the hostname "index.docker.io".`)
 )
 
 type Registry struct {
@@ -33,6 +39,16 @@ type Registry struct {
 	Password  string   `yaml:"password" json:"password" config:"secret"`
 }
 
+// RegistryMirror configures mirrors for an image registry.
+type RegistryMirror struct {
+	// Hostname is the hostname of the original registry, e.g. "gcr.io".
+	Hostname string `yaml:"hostname" json:"hostname"`
+	// Mirrors are the hostnames of the mirror registries, in the order in
+	// which they should be tried. Image repository paths are preserved when
+	// pulling from a mirror.
+	Mirrors []string `yaml:"mirrors" json:"mirrors"`
+}
+
 type Credentials struct {
 	Username string
 	Password string
@@ -128,20 +144,14 @@ func Resolve(ctx context.Context, imageName string, platform *rgpb.Platform, cre
 		return nil, status.InvalidArgumentErrorf("invalid image %q", imageName)
 	}
 
-	remoteOpts := []remote.Option{remote.WithContext(ctx)}
-	if !credentials.IsEmpty() {
-		remoteOpts = append(remoteOpts, remote.WithAuth(&authn.Basic{
-			Username: credentials.Username,
-			Password: credentials.Password,
-		}))
+	remoteOpts, err := remoteOptions(ctx, imageRef, credentials)
+	if err != nil {
+		return nil, err
 	}
 
-	remoteDesc, err := remote.Get(imageRef, remoteOpts...)
+	remoteDesc, err := getDescriptor(ctx, imageRef, remoteOpts)
 	if err != nil {
-		if t, ok := err.(*transport.Error); ok && t.StatusCode == http.StatusUnauthorized {
-			return nil, status.PermissionDeniedErrorf("could not retrieve image manifest: %s", err)
-		}
-		return nil, status.UnavailableErrorf("could not retrieve manifest from remote: %s", err)
+		return nil, manifestError(err)
 	}
 
 	switch remoteDesc.MediaType {
@@ -153,32 +163,357 @@ func Resolve(ctx context.Context, imageName string, platform *rgpb.Platform, cre
 		if err != nil {
 			return nil, status.UnknownErrorf("could not get image index from descriptor: %s", err)
 		}
-		imgs, err := partial.FindImages(imgIdx, match.Platforms(v1.Platform{
+		want := v1.Platform{
 			Architecture: platform.GetArch(),
 			OS:           platform.GetOs(),
 			Variant:      platform.GetVariant(),
-		}))
+		}
+		imgs, err := findRunnableImages(imgIdx, match.Platforms(want))
 		if err != nil {
-			return nil, status.UnavailableErrorf("could not search image index: %s", err)
+			return nil, err
 		}
 		if len(imgs) == 0 {
-			return nil, status.NotFoundErrorf("could not find suitable image in image index")
+			// Fall back to a looser match, since image indexes aren't always
+			// consistent about specifying variants (e.g. "arm64" vs.
+			// "arm64/v8").
+			imgs, err = findRunnableImages(imgIdx, compatiblePlatform(want))
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(imgs) == 0 {
+			return nil, status.NotFoundErrorf("could not find image for platform %q in image index (available platforms: %s)", want.String(), strings.Join(availablePlatforms(imgIdx), ", "))
 		}
 		if len(imgs) > 1 {
 			return nil, status.NotFoundErrorf("found multiple matching images in image index")
 		}
 		return imgs[0], nil
 	case types.OCIManifestSchema1, types.DockerManifestSchema2:
+		at, err := artifactType(remoteDesc.Manifest)
+		if err != nil {
+			return nil, err
+		}
+		if at != "" {
+			return nil, status.FailedPreconditionErrorf("%q is an OCI artifact of type %q, not a container image", imageName, at)
+		}
 		img, err := remoteDesc.Image()
 		if err != nil {
 			return nil, status.UnknownErrorf("could not get image from descriptor: %s", err)
 		}
 		return img, nil
+	case types.DockerManifestSchema1, types.DockerManifestSchema1Signed:
+		return nil, status.FailedPreconditionErrorf("%q uses the deprecated Docker image manifest schema 1, which is not supported", imageName)
 	default:
 		return nil, status.UnknownErrorf("descriptor has unknown media type %q", remoteDesc.MediaType)
 	}
 }
 
+// CopyImage copies the image or image index referenced by srcRef, along with
+// all of the manifests and layers it references, to dstRef. Content is copied
+// as-is without being extracted, so digests are preserved. dstRef may be
+// either a tag or a digest reference; a digest reference must match the
+// digest of the source manifest.
+//
+// srcCredentials and dstCredentials are used for the source and destination
+// registries respectively. If either is empty, ECR or Docker config
+// credentials are used for that registry if enabled.
+func CopyImage(ctx context.Context, srcRef, dstRef string, srcCredentials, dstCredentials Credentials) error {
+	src, err := ctrname.ParseReference(srcRef)
+	if err != nil {
+		return status.InvalidArgumentErrorf("invalid source image %q", srcRef)
+	}
+	dst, err := ctrname.ParseReference(dstRef)
+	if err != nil {
+		return status.InvalidArgumentErrorf("invalid destination image %q", dstRef)
+	}
+
+	srcOpts, err := remoteOptions(ctx, src, srcCredentials)
+	if err != nil {
+		return err
+	}
+	dstOpts, err := remoteOptions(ctx, dst, dstCredentials)
+	if err != nil {
+		return err
+	}
+
+	remoteDesc, err := getDescriptor(ctx, src, srcOpts)
+	if err != nil {
+		return manifestError(err)
+	}
+	if d, ok := dst.(ctrname.Digest); ok && d.DigestStr() != remoteDesc.Digest.String() {
+		return status.InvalidArgumentErrorf("destination digest %s does not match source digest %s", d.DigestStr(), remoteDesc.Digest)
+	}
+
+	switch remoteDesc.MediaType {
+	case types.OCIImageIndex, types.DockerManifestList:
+		imgIdx, err := remoteDesc.ImageIndex()
+		if err != nil {
+			return status.UnknownErrorf("could not get image index from descriptor: %s", err)
+		}
+		if err := remote.WriteIndex(dst, imgIdx, dstOpts...); err != nil {
+			return pushError(err)
+		}
+	case types.OCIManifestSchema1, types.DockerManifestSchema2:
+		img, err := remoteDesc.Image()
+		if err != nil {
+			return status.UnknownErrorf("could not get image from descriptor: %s", err)
+		}
+		if err := remote.Write(dst, img, dstOpts...); err != nil {
+			return pushError(err)
+		}
+	case types.DockerManifestSchema1, types.DockerManifestSchema1Signed:
+		return status.FailedPreconditionErrorf("%q uses the deprecated Docker image manifest schema 1, which is not supported", srcRef)
+	default:
+		return status.UnknownErrorf("descriptor has unknown media type %q", remoteDesc.MediaType)
+	}
+	log.CtxInfof(ctx, "Copied %q (%s) to %q", srcRef, remoteDesc.Digest, dstRef)
+	return nil
+}
+
+// remoteOptions returns options for registry requests for the given image,
+// authenticated with the given credentials if non-empty, or otherwise with
+// ECR or Docker config credentials if enabled.
+func remoteOptions(ctx context.Context, imageRef ctrname.Reference, credentials Credentials) ([]remote.Option, error) {
+	if credentials.IsEmpty() {
+		var err error
+		credentials, err = ecrCredentials(ctx, imageRef.Context().RegistryStr())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	remoteOpts := []remote.Option{remote.WithContext(ctx)}
+	if !credentials.IsEmpty() {
+		remoteOpts = append(remoteOpts, remote.WithAuth(&authn.Basic{
+			Username: credentials.Username,
+			Password: credentials.Password,
+		}))
+	} else if *useDockerConfig {
+		remoteOpts = append(remoteOpts, remote.WithAuthFromKeychain(&dockerConfigKeychain{dir: *dockerConfigDir}))
+	}
+	return remoteOpts, nil
+}
+
+// manifestError converts an error from fetching a manifest to a status error.
+func manifestError(err error) error {
+	if t, ok := err.(*transport.Error); ok {
+		switch t.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return status.PermissionDeniedErrorf("could not retrieve image manifest: %s", err)
+		case http.StatusNotFound:
+			return status.NotFoundErrorf("could not retrieve image manifest: %s", err)
+		}
+	}
+	return status.UnavailableErrorf("could not retrieve manifest from remote: %s", err)
+}
+
+// pushError converts an error from pushing an image to a status error.
+func pushError(err error) error {
+	if t, ok := err.(*transport.Error); ok {
+		switch t.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return status.PermissionDeniedErrorf("could not push image: %s", err)
+		}
+	}
+	return status.UnavailableErrorf("could not push image: %s", err)
+}
+
+// dockerConfigKeychain is an authn.Keychain which resolves registry
+// credentials from a Docker config.json file, including any configured
+// credential helpers.
+type dockerConfigKeychain struct {
+	// dir is the directory containing config.json. If empty, the default
+	// Docker config directory is used.
+	dir string
+}
+
+func (k *dockerConfigKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	// Load the config on each call so that changes to the file (e.g.
+	// refreshed tokens) are picked up without restarting the executor.
+	cf, err := config.Load(k.dir)
+	if err != nil {
+		return nil, status.UnavailableErrorf("load docker config: %s", err)
+	}
+	// Docker stores Docker Hub credentials under a legacy server address
+	// rather than the registry hostname.
+	key := target.RegistryStr()
+	if key == ctrname.DefaultRegistry {
+		key = "https://index.docker.io/v1/"
+	}
+	cfg, err := cf.GetAuthConfig(key)
+	if err != nil {
+		return nil, status.UnavailableErrorf("get docker credentials for %q: %s", target.RegistryStr(), err)
+	}
+	authConfig := authn.AuthConfig{
+		Username:      cfg.Username,
+		Password:      cfg.Password,
+		Auth:          cfg.Auth,
+		IdentityToken: cfg.IdentityToken,
+		RegistryToken: cfg.RegistryToken,
+	}
+	if authConfig == (authn.AuthConfig{}) {
+		return authn.Anonymous, nil
+	}
+	return authn.FromConfig(authConfig), nil
+}
+
+// getDescriptor fetches the descriptor for the given image reference, trying
+// any configured mirrors for the image's registry before falling back to the
+// original registry.
+//
+// Digest references are verified against the fetched manifest, so content
+// pulled from a mirror is guaranteed to match the originally requested digest.
+//
+// remoteOpts are only used for the original registry, since they may carry
+// credentials for it. Mirrors are accessed using their own ECR or docker
+// config credentials, if any, and anonymously otherwise.
+func getDescriptor(ctx context.Context, imageRef ctrname.Reference, remoteOpts []remote.Option) (*remote.Descriptor, error) {
+	for _, mirrorRef := range mirrorReferences(imageRef) {
+		mirrorOpts, err := remoteOptions(ctx, mirrorRef, Credentials{})
+		if err != nil {
+			log.CtxInfof(ctx, "Failed to get credentials for mirror %q, trying next: %s", mirrorRef, err)
+			continue
+		}
+		desc, err := remote.Get(mirrorRef, mirrorOpts...)
+		if err == nil {
+			log.CtxDebugf(ctx, "Resolved %q using mirror %q", imageRef, mirrorRef)
+			return desc, nil
+		}
+		log.CtxInfof(ctx, "Failed to resolve %q using mirror %q, trying next: %s", imageRef, mirrorRef, err)
+	}
+	return remote.Get(imageRef, remoteOpts...)
+}
+
+// mirrorReferences returns the references to the given image in each of the
+// mirrors configured for its registry, in order.
+func mirrorReferences(imageRef ctrname.Reference) []ctrname.Reference {
+	registry := imageRef.Context().RegistryStr()
+	var refs []ctrname.Reference
+	for _, cfg := range *registryMirrors {
+		if cfg.Hostname != registry {
+			continue
+		}
+		for _, mirror := range cfg.Mirrors {
+			separator := ":"
+			if _, ok := imageRef.(ctrname.Digest); ok {
+				separator = "@"
+			}
+			s := mirror + "/" + imageRef.Context().RepositoryStr() + separator + imageRef.Identifier()
+			ref, err := ctrname.ParseReference(s)
+			if err != nil {
+				log.Warningf("Ignoring invalid mirror reference %q: %s", s, err)
+				continue
+			}
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// findRunnableImages returns the images in the given index that match the
+// given matcher, excluding OCI artifacts such as signatures, SBOMs, and
+// attestations, which may be listed in image indexes alongside images.
+func findRunnableImages(idx v1.ImageIndex, matcher match.Matcher) ([]v1.Image, error) {
+	imgs, err := partial.FindImages(idx, matcher)
+	if err != nil {
+		return nil, status.UnavailableErrorf("could not search image index: %s", err)
+	}
+	var runnable []v1.Image
+	for _, img := range imgs {
+		manifest, err := img.RawManifest()
+		if err != nil {
+			return nil, manifestError(err)
+		}
+		at, err := artifactType(manifest)
+		if err != nil {
+			return nil, err
+		}
+		if at == "" {
+			runnable = append(runnable, img)
+		}
+	}
+	return runnable, nil
+}
+
+// artifactType returns the artifact type of the given image manifest if it
+// describes an OCI artifact rather than a container image, or "" if it
+// describes a container image. Per the OCI image spec, the artifact type is
+// the manifest's artifactType field if set (OCI v1.1), and otherwise the
+// config media type.
+func artifactType(rawManifest []byte) (string, error) {
+	var m struct {
+		ArtifactType string `json:"artifactType"`
+		Config       struct {
+			MediaType types.MediaType `json:"mediaType"`
+		} `json:"config"`
+	}
+	if err := json.Unmarshal(rawManifest, &m); err != nil {
+		return "", status.UnknownErrorf("could not parse image manifest: %s", err)
+	}
+	if m.ArtifactType != "" {
+		return m.ArtifactType, nil
+	}
+	switch m.Config.MediaType {
+	case types.OCIConfigJSON, types.DockerConfigJSON:
+		return "", nil
+	case "":
+		return "", status.UnknownError("image manifest has no config media type")
+	}
+	return string(m.Config.MediaType), nil
+}
+
+// compatiblePlatform returns a matcher for image index entries that can run on
+// the given platform. Unlike match.Platforms, variants only need to match if
+// both the entry and the requested platform specify one, and the default
+// arm64 variant "v8" is treated as equivalent to no variant.
+func compatiblePlatform(want v1.Platform) match.Matcher {
+	normalizeVariant := func(arch, variant string) string {
+		if arch == "arm64" && variant == "v8" {
+			return ""
+		}
+		return variant
+	}
+	wantVariant := normalizeVariant(want.Architecture, want.Variant)
+	return func(desc v1.Descriptor) bool {
+		p := desc.Platform
+		if p == nil || p.OS != want.OS || p.Architecture != want.Architecture {
+			return false
+		}
+		variant := normalizeVariant(p.Architecture, p.Variant)
+		return wantVariant == "" || variant == "" || variant == wantVariant
+	}
+}
+
+// availablePlatforms returns the platforms listed in the given image index, for
+// use in error messages.
+func availablePlatforms(idx v1.ImageIndex) []string {
+	m, err := idx.IndexManifest()
+	if err != nil {
+		return nil
+	}
+	var platforms []string
+	for _, desc := range m.Manifests {
+		if desc.Platform != nil {
+			platforms = append(platforms, desc.Platform.String())
+		}
+	}
+	return platforms
+}
+
+// ParsePlatform parses a platform string in the format "os/arch[/variant]",
+// e.g. "linux/arm64/v8".
+func ParsePlatform(s string) (*rgpb.Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return nil, status.InvalidArgumentErrorf("invalid platform %q (expected os/arch[/variant])", s)
+	}
+	p := &rgpb.Platform{Os: parts[0], Arch: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
 // RuntimePlatform returns the platform on which the program is being executed,
 // as reported by the go runtime.
 func RuntimePlatform() *rgpb.Platform {
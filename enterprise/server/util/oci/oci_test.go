@@ -2,17 +2,39 @@ package oci_test
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
 	"net/http"
+	"path/filepath"
 	"regexp"
 	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/oci"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testfs"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testregistry"
 	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -153,6 +175,331 @@ func TestResolve(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestResolve_Mirror(t *testing.T) {
+	// Push the image only to the mirror, then resolve it using a ref pointing
+	// to an unreachable registry.
+	mirror := testregistry.Run(t, testregistry.Opts{})
+	mirrorImageName := mirror.PushRandomImage(t)
+	originalImageName := strings.Replace(mirrorImageName, mirror.Address(), "unreachable.invalid", 1)
+	flags.Set(t, "executor.container_registry_mirrors", []oci.RegistryMirror{
+		{Hostname: "unreachable.invalid", Mirrors: []string{"also-unreachable.invalid", mirror.Address()}},
+	})
+
+	_, err := oci.Resolve(
+		context.Background(),
+		originalImageName,
+		&rgpb.Platform{
+			Arch: runtime.GOARCH,
+			Os:   runtime.GOOS,
+		},
+		oci.Credentials{})
+	require.NoError(t, err)
+}
+
+func TestResolve_MirrorDoesNotReceiveCredentials(t *testing.T) {
+	var mu sync.Mutex
+	var mirrorAuthHeaders []string
+	mirror := testregistry.Run(t, testregistry.Opts{
+		HttpInterceptor: func(w http.ResponseWriter, r *http.Request) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			mirrorAuthHeaders = append(mirrorAuthHeaders, r.Header.Get("Authorization"))
+			return true
+		},
+	})
+	mirrorImageName := mirror.PushRandomImage(t)
+	originalImageName := strings.Replace(mirrorImageName, mirror.Address(), "unreachable.invalid", 1)
+	flags.Set(t, "executor.container_registry_mirrors", []oci.RegistryMirror{
+		{Hostname: "unreachable.invalid", Mirrors: []string{mirror.Address()}},
+	})
+	mu.Lock()
+	mirrorAuthHeaders = nil
+	mu.Unlock()
+
+	_, err := oci.Resolve(
+		context.Background(),
+		originalImageName,
+		&rgpb.Platform{
+			Arch: runtime.GOARCH,
+			Os:   runtime.GOOS,
+		},
+		oci.Credentials{Username: "user", Password: "secret"})
+	require.NoError(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.NotEmpty(t, mirrorAuthHeaders)
+	for _, h := range mirrorAuthHeaders {
+		assert.Empty(t, h, "credentials for the original registry should not be sent to the mirror")
+	}
+}
+
+func TestResolve_NoMatchingPlatform(t *testing.T) {
+	registry := testregistry.Run(t, testregistry.Opts{})
+	amd64Image, err := crane.Image(map[string][]byte{"/amd64.txt": []byte("amd64")})
+	require.NoError(t, err)
+	arm64Image, err := crane.Image(map[string][]byte{"/arm64.txt": []byte("arm64")})
+	require.NoError(t, err)
+	index := mutate.AppendManifests(
+		mutate.IndexMediaType(empty.Index, types.OCIImageIndex),
+		mutate.IndexAddendum{Add: amd64Image, Descriptor: v1.Descriptor{Platform: &v1.Platform{Architecture: "amd64", OS: "linux"}}},
+		mutate.IndexAddendum{Add: arm64Image, Descriptor: v1.Descriptor{Platform: &v1.Platform{Architecture: "arm64", OS: "linux", Variant: "v8"}}},
+	)
+	indexName := registry.PushIndex(t, index, "multiplatform")
+
+	_, err = oci.Resolve(
+		context.Background(),
+		indexName,
+		&rgpb.Platform{
+			Arch: "riscv64",
+			Os:   "plan9",
+		},
+		oci.Credentials{})
+	require.True(t, status.IsNotFoundError(err), "expected NotFound error, got %v", err)
+	assert.Contains(t, err.Error(), "linux/amd64")
+	assert.Contains(t, err.Error(), "linux/arm64/v8")
+}
+
+func TestResolve_MediaTypes(t *testing.T) {
+	ctx := context.Background()
+	registry := testregistry.Run(t, testregistry.Opts{})
+	platform := &rgpb.Platform{Arch: runtime.GOARCH, Os: runtime.GOOS}
+	v1Platform := &v1.Platform{Architecture: runtime.GOARCH, OS: runtime.GOOS}
+
+	dockerImage, err := crane.Image(map[string][]byte{"/hello.txt": []byte("docker")})
+	require.NoError(t, err)
+	dockerImage = mutate.MediaType(dockerImage, types.DockerManifestSchema2)
+	ociImage, err := crane.Image(map[string][]byte{"/hello.txt": []byte("oci")})
+	require.NoError(t, err)
+	ociImage = mutate.ConfigMediaType(mutate.MediaType(ociImage, types.OCIManifestSchema1), types.OCIConfigJSON)
+	// An artifact, such as an SBOM, listed for the same platform as the
+	// image.
+	artifact := mutate.ConfigMediaType(mutate.MediaType(empty.Image, types.OCIManifestSchema1), "application/vnd.example.sbom.v1+json")
+
+	dockerManifestList := mutate.AppendManifests(
+		mutate.IndexMediaType(empty.Index, types.DockerManifestList),
+		mutate.IndexAddendum{Add: dockerImage, Descriptor: v1.Descriptor{Platform: v1Platform}},
+	)
+	ociIndex := mutate.AppendManifests(
+		mutate.IndexMediaType(empty.Index, types.OCIImageIndex),
+		mutate.IndexAddendum{Add: artifact, Descriptor: v1.Descriptor{Platform: v1Platform}},
+		mutate.IndexAddendum{Add: ociImage, Descriptor: v1.Descriptor{Platform: v1Platform}},
+	)
+
+	for _, test := range []struct {
+		name      string
+		imageName string
+		want      v1.Image
+	}{
+		{
+			name:      "DockerManifestSchema2",
+			imageName: registry.Push(t, dockerImage, "docker-manifest"),
+			want:      dockerImage,
+		},
+		{
+			name:      "OCIImageManifest",
+			imageName: registry.Push(t, ociImage, "oci-manifest"),
+			want:      ociImage,
+		},
+		{
+			name:      "DockerManifestList",
+			imageName: registry.PushIndex(t, dockerManifestList, "docker-manifest-list"),
+			want:      dockerImage,
+		},
+		{
+			name:      "OCIImageIndexWithArtifact",
+			imageName: registry.PushIndex(t, ociIndex, "oci-index"),
+			want:      ociImage,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			img, err := oci.Resolve(ctx, test.imageName, platform, oci.Credentials{})
+			require.NoError(t, err)
+			got, err := img.Digest()
+			require.NoError(t, err)
+			want, err := test.want.Digest()
+			require.NoError(t, err)
+			assert.Equal(t, want, got)
+		})
+	}
+
+	t.Run("ArtifactConfigMediaType", func(t *testing.T) {
+		imageName := registry.Push(t, artifact, "artifact")
+		_, err := oci.Resolve(ctx, imageName, platform, oci.Credentials{})
+		require.Error(t, err)
+		assert.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition error, got %s", err)
+	})
+
+	t.Run("ArtifactType", func(t *testing.T) {
+		// An OCI v1.1 artifact with an image config, which is only
+		// identified as an artifact by its artifactType field.
+		registry.Push(t, ociImage, "artifact-type")
+		b, err := ociImage.RawManifest()
+		require.NoError(t, err)
+		manifest := map[string]any{}
+		err = json.Unmarshal(b, &manifest)
+		require.NoError(t, err)
+		manifest["artifactType"] = "application/vnd.example.signature.v1+json"
+		b, err = json.Marshal(manifest)
+		require.NoError(t, err)
+		ref, err := name.ParseReference(registry.ImageAddress("artifact-type:v1.1"))
+		require.NoError(t, err)
+		err = remote.Put(ref, &rawManifest{body: b, mediaType: types.OCIManifestSchema1})
+		require.NoError(t, err)
+
+		_, err = oci.Resolve(ctx, ref.String(), platform, oci.Credentials{})
+		require.Error(t, err)
+		assert.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition error, got %s", err)
+		assert.Contains(t, err.Error(), "application/vnd.example.signature.v1+json")
+	})
+}
+
+// rawManifest is a manifest which can be pushed with remote.Put.
+type rawManifest struct {
+	body      []byte
+	mediaType types.MediaType
+}
+
+func (m *rawManifest) RawManifest() ([]byte, error) {
+	return m.body, nil
+}
+
+func (m *rawManifest) MediaType() (types.MediaType, error) {
+	return m.mediaType, nil
+}
+
+func TestCopyImage(t *testing.T) {
+	ctx := context.Background()
+	srcRegistry := testregistry.Run(t, testregistry.Opts{})
+	dstRegistry := testregistry.Run(t, testregistry.Opts{})
+	v1Platform := &v1.Platform{Architecture: runtime.GOARCH, OS: runtime.GOOS}
+
+	image, err := crane.Image(map[string][]byte{"/hello.txt": []byte("copy me")})
+	require.NoError(t, err)
+	imageDigest, err := image.Digest()
+	require.NoError(t, err)
+	index := mutate.AppendManifests(
+		mutate.IndexMediaType(empty.Index, types.OCIImageIndex),
+		mutate.IndexAddendum{Add: image, Descriptor: v1.Descriptor{Platform: v1Platform}},
+	)
+	indexDigest, err := index.Digest()
+	require.NoError(t, err)
+	imageName := srcRegistry.Push(t, image, "image")
+	indexName := srcRegistry.PushIndex(t, index, "index")
+
+	for _, test := range []struct {
+		name       string
+		srcRef     string
+		dstRef     string
+		wantDigest v1.Hash
+	}{
+		{
+			name:       "ImageToTag",
+			srcRef:     imageName,
+			dstRef:     dstRegistry.ImageAddress("mirror/image:v1"),
+			wantDigest: imageDigest,
+		},
+		{
+			name:       "ImageToDigest",
+			srcRef:     imageName,
+			dstRef:     dstRegistry.ImageAddress("mirror/image@" + imageDigest.String()),
+			wantDigest: imageDigest,
+		},
+		{
+			name:       "IndexToTag",
+			srcRef:     indexName,
+			dstRef:     dstRegistry.ImageAddress("mirror/index:v1"),
+			wantDigest: indexDigest,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := oci.CopyImage(ctx, test.srcRef, test.dstRef, oci.Credentials{}, oci.Credentials{})
+			require.NoError(t, err)
+
+			ref, err := name.ParseReference(test.dstRef)
+			require.NoError(t, err)
+			desc, err := remote.Get(ref)
+			require.NoError(t, err)
+			assert.Equal(t, test.wantDigest, desc.Digest)
+
+			// The copied image should be pullable from the destination,
+			// including its layers.
+			img, err := oci.Resolve(ctx, test.dstRef, &rgpb.Platform{Arch: runtime.GOARCH, Os: runtime.GOOS}, oci.Credentials{})
+			require.NoError(t, err)
+			got, err := img.Digest()
+			require.NoError(t, err)
+			assert.Equal(t, imageDigest, got)
+			layers, err := img.Layers()
+			require.NoError(t, err)
+			require.Len(t, layers, 1)
+			rc, err := layers[0].Compressed()
+			require.NoError(t, err)
+			_, err = io.Copy(io.Discard, rc)
+			require.NoError(t, err)
+			require.NoError(t, rc.Close())
+		})
+	}
+
+	t.Run("DigestMismatch", func(t *testing.T) {
+		err := oci.CopyImage(ctx, imageName, dstRegistry.ImageAddress("mirror/other@"+indexDigest.String()), oci.Credentials{}, oci.Credentials{})
+		require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error, got %v", err)
+	})
+}
+
+func TestCopyImage_SeparateCredentials(t *testing.T) {
+	ctx := context.Background()
+	var requireAuth atomic.Bool
+	srcRegistry := testregistry.Run(t, testregistry.Opts{
+		HttpInterceptor: func(w http.ResponseWriter, r *http.Request) bool {
+			if !requireAuth.Load() {
+				return true
+			}
+			if user, pass, ok := r.BasicAuth(); ok && user == "srcuser" && pass == "srcpass" {
+				return true
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="testregistry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return false
+		},
+	})
+	var mu sync.Mutex
+	var dstUsers []string
+	dstRegistry := testregistry.Run(t, testregistry.Opts{
+		HttpInterceptor: func(w http.ResponseWriter, r *http.Request) bool {
+			if user, _, ok := r.BasicAuth(); ok {
+				mu.Lock()
+				dstUsers = append(dstUsers, user)
+				mu.Unlock()
+			}
+			return true
+		},
+	})
+	imageName := srcRegistry.PushRandomImage(t)
+	requireAuth.Store(true)
+
+	err := oci.CopyImage(ctx, imageName, dstRegistry.ImageAddress("copied:v1"), oci.Credentials{Username: "srcuser", Password: "srcpass"}, oci.Credentials{})
+	require.NoError(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Empty(t, dstUsers, "source credentials should not be sent to the destination registry")
+}
+
+func TestParsePlatform(t *testing.T) {
+	p, err := oci.ParsePlatform("linux/arm64/v8")
+	require.NoError(t, err)
+	assert.True(t, proto.Equal(&rgpb.Platform{Os: "linux", Arch: "arm64", Variant: "v8"}, p))
+
+	p, err = oci.ParsePlatform("linux/amd64")
+	require.NoError(t, err)
+	assert.True(t, proto.Equal(&rgpb.Platform{Os: "linux", Arch: "amd64"}, p))
+
+	for _, s := range []string{"", "linux", "linux/", "linux/arm/v7/extra"} {
+		_, err := oci.ParsePlatform(s)
+		assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error for %q", s)
+	}
+}
+
 func TestResolve_InvalidImage(t *testing.T) {
 	_, err := oci.Resolve(
 		context.Background(),
@@ -165,6 +512,44 @@ func TestResolve_InvalidImage(t *testing.T) {
 	assert.True(t, status.IsInvalidArgumentError(err))
 }
 
+func TestResolve_DockerConfig(t *testing.T) {
+	var requireAuth atomic.Bool
+	registry := testregistry.Run(t, testregistry.Opts{
+		HttpInterceptor: func(w http.ResponseWriter, r *http.Request) bool {
+			if !requireAuth.Load() {
+				return true
+			}
+			if user, pass, ok := r.BasicAuth(); ok && user == "dockeruser" && pass == "dockerpass" {
+				return true
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="testregistry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return false
+		},
+	})
+	imageName := registry.PushRandomImage(t)
+	requireAuth.Store(true)
+
+	configDir := testfs.MakeTempDir(t)
+	auth := base64.StdEncoding.EncodeToString([]byte("dockeruser:dockerpass"))
+	testfs.WriteAllFileContents(t, configDir, map[string]string{
+		"config.json": `{"auths": {"` + registry.Address() + `": {"auth": "` + auth + `"}}}`,
+	})
+	platform := &rgpb.Platform{
+		Arch: runtime.GOARCH,
+		Os:   runtime.GOOS,
+	}
+
+	// Without the docker config, the request should be unauthorized.
+	_, err := oci.Resolve(context.Background(), imageName, platform, oci.Credentials{})
+	require.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied error, got %v", err)
+
+	flags.Set(t, "executor.container_registry_use_docker_config", true)
+	flags.Set(t, "executor.container_registry_docker_config_dir", configDir)
+	_, err = oci.Resolve(context.Background(), imageName, platform, oci.Credentials{})
+	require.NoError(t, err)
+}
+
 func TestResolve_Unauthorized(t *testing.T) {
 	registry := testregistry.Run(t, testregistry.Opts{
 		HttpInterceptor: func(w http.ResponseWriter, r *http.Request) bool {
@@ -191,3 +576,70 @@ func TestResolve_Unauthorized(t *testing.T) {
 		oci.Credentials{})
 	require.True(t, status.IsPermissionDeniedError(err))
 }
+
+func TestVerifiedImageRef(t *testing.T) {
+	ctx := context.Background()
+	registry := testregistry.Run(t, testregistry.Opts{})
+	signedImage, err := crane.Image(map[string][]byte{"signed.txt": []byte("signed")})
+	require.NoError(t, err)
+	signedImageName := registry.Push(t, signedImage, "signed")
+	unsignedImage, err := crane.Image(map[string][]byte{"unsigned.txt": []byte("unsigned")})
+	require.NoError(t, err)
+	unsignedImageName := registry.Push(t, unsignedImage, "unsigned")
+
+	// Verification is disabled by default.
+	ref, err := oci.VerifiedImageRef(ctx, unsignedImageName, oci.Credentials{})
+	require.NoError(t, err)
+	assert.Equal(t, unsignedImageName, ref)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	signedDigest, err := signedImage.Digest()
+	require.NoError(t, err)
+	pushCosignSignature(t, registry, "signed", signedDigest, key)
+
+	keyDir := testfs.MakeTempDir(t)
+	writePublicKey(t, keyDir, "cosign.pub", &key.PublicKey)
+	flags.Set(t, "executor.container_registry_cosign.enabled", true)
+	flags.Set(t, "executor.container_registry_cosign.public_key_file", filepath.Join(keyDir, "cosign.pub"))
+
+	ref, err = oci.VerifiedImageRef(ctx, signedImageName, oci.Credentials{})
+	require.NoError(t, err)
+	assert.Equal(t, registry.ImageAddress("signed")+"@"+signedDigest.String(), ref)
+
+	_, err = oci.VerifiedImageRef(ctx, unsignedImageName, oci.Credentials{})
+	require.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition error, got %v", err)
+
+	// A signature made with a different key should be rejected.
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	writePublicKey(t, keyDir, "other.pub", &otherKey.PublicKey)
+	flags.Set(t, "executor.container_registry_cosign.public_key_file", filepath.Join(keyDir, "other.pub"))
+	_, err = oci.VerifiedImageRef(ctx, signedImageName, oci.Credentials{})
+	require.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition error, got %v", err)
+}
+
+// pushCosignSignature pushes a cosign signature for the image with the given
+// digest, using cosign's tag-based signature storage scheme.
+func pushCosignSignature(t *testing.T, registry *testregistry.Registry, repo string, digest v1.Hash, key *ecdsa.PrivateKey) {
+	payload := []byte(`{"critical":{"identity":{"docker-reference":"` + registry.ImageAddress(repo) + `"},"image":{"docker-manifest-digest":"` + digest.String() + `"},"type":"cosign container image signature"},"optional":null}`)
+	h := sha256.Sum256(payload)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, h[:])
+	require.NoError(t, err)
+	sigImage, err := mutate.Append(empty.Image, mutate.Addendum{
+		Layer: static.NewLayer(payload, types.MediaType("application/vnd.dev.cosign.simplesigning.v1+json")),
+		Annotations: map[string]string{
+			"dev.cosignproject.cosign/signature": base64.StdEncoding.EncodeToString(sig),
+		},
+	})
+	require.NoError(t, err)
+	registry.Push(t, sigImage, repo+":"+strings.Replace(digest.String(), ":", "-", 1)+".sig")
+}
+
+func writePublicKey(t *testing.T, dir, name string, key *ecdsa.PublicKey) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	require.NoError(t, err)
+	testfs.WriteAllFileContents(t, dir, map[string]string{
+		name: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+	})
+}
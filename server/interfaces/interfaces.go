@@ -7,6 +7,7 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"syscall"
 	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
@@ -1007,13 +1008,47 @@ type CommandRunner interface {
 
 // Stdio specifies standard input / output readers for a command.
 type Stdio struct {
-	// Stdin is an optional stdin source for the executed process.
+	// Stdin is an optional stdin source for the executed process. The
+	// process's stdin is closed once Stdin returns an error, including
+	// io.EOF, so a caller streaming input (e.g. through an io.Pipe) can
+	// signal the end of input by closing the writing end.
 	Stdin io.Reader
 	// Stdout is an optional stdout sink for the executed process.
 	Stdout io.Writer
 	// Stderr is an optional stderr sink for the executed process.
 	Stderr io.Writer
-}
+	// Combined is an optional sink that receives both stdout and stderr, in
+	// addition to Stdout and Stderr. Output is written one line at a time, in
+	// the order that lines are received from the process. Since stdout and
+	// stderr are read from separate pipes, lines written at nearly the same
+	// time may still be reordered. Not all command runners support this
+	// option.
+	Combined io.Writer
+	// Tty specifies whether the process should be attached to a
+	// pseudo-terminal. If set, the process's stdout and stderr are both
+	// written to Stdout, since a terminal does not distinguish between them.
+	// Not all command runners support this option.
+	Tty bool
+	// OutputTruncation specifies which part of the captured stdout and
+	// stderr to keep when the output exceeds the command runner's output
+	// limit. Not all command runners limit output.
+	OutputTruncation OutputTruncationMode
+}
+
+// OutputTruncationMode specifies how a command runner truncates captured
+// output which exceeds its output limit.
+type OutputTruncationMode int
+
+const (
+	// TruncateHead keeps the beginning of the output, discarding output
+	// once the limit is reached. This is the default.
+	TruncateHead OutputTruncationMode = iota
+	// TruncateTail keeps the end of the output, which is usually the most
+	// useful part for diagnosing errors.
+	TruncateTail
+	// TruncateNone captures all output, ignoring the output limit.
+	TruncateNone
+)
 
 // CommandResult captures the output and details of an executed command.
 type CommandResult struct {
@@ -1042,6 +1077,18 @@ type CommandResult struct {
 	Stdout []byte
 	// Stderr from the command. This may contain data even if there was an Error.
 	Stderr []byte
+	// StdoutSize and StderrSize are the number of bytes that the command wrote
+	// to stdout and stderr, including any output that was streamed to Stdio
+	// writers instead of being returned in Stdout and Stderr. Not all command
+	// runners populate these.
+	StdoutSize int64
+	StderrSize int64
+	// StdoutTruncated and StderrTruncated indicate that the command's output
+	// exceeded the runner's output limit, so Stdout and Stderr only contain
+	// part of the output. StdoutSize and StderrSize still report the total
+	// size. Not all command runners limit output.
+	StdoutTruncated bool
+	StderrTruncated bool
 	// AuxiliaryLogs contain extra logs associated with the task that may be
 	// useful to present to the user.
 	AuxiliaryLogs map[string][]byte
@@ -1050,6 +1097,11 @@ type CommandResult struct {
 	// command has executed.
 	DoNotRecycle bool
 
+	// OOMKilled indicates that one or more processes were killed by the
+	// kernel OOM killer while the command was executing. If set, Error is
+	// also populated with a RESOURCE_EXHAUSTED error.
+	OOMKilled bool
+
 	// ExitCode is one of the following:
 	// * The exit code returned by the executed command
 	// * -1 if the process was killed or did not exit
@@ -1057,6 +1109,12 @@ type CommandResult struct {
 	//   an error other than exec.ExitError. This case typically means it failed to start.
 	ExitCode int
 
+	// Signal is the signal that terminated the command, if it was terminated
+	// by a signal. In that case, ExitCode is set to 128 plus the signal
+	// number, matching shell conventions. It is 0 if the command exited
+	// normally.
+	Signal syscall.Signal
+
 	// UsageStats holds the command's measured resource usage. It may be nil if
 	// resource measurement is not implemented by the command's isolation type.
 	UsageStats *repb.UsageStats
@@ -212,6 +212,18 @@ const (
 	// Container image tag.
 	ContainerImageTag = "container_image_tag"
 
+	// Container image repository, without the tag or digest, such as
+	// "index.docker.io/library/ubuntu".
+	ContainerImageRepo = "container_image_repo"
+
+	// Container lifecycle operation: "pull", "create", "run", "exec", or
+	// "remove".
+	ContainerOperation = "container_operation"
+
+	// Reason that a container image pull failed: "timeout", "unauthorized",
+	// "image_not_found", "disk_full", or "other".
+	ImagePullFailureReason = "pull_failure_reason"
+
 	// SociArtifactStore.GetArtifacts outcome tag.
 	GetSociArtifactsOutcomeTag = "get_soci_artifacts_outcome_tag"
 
@@ -2703,6 +2715,60 @@ var (
 	}, []string{
 		ContainerImageTag,
 	})
+
+	// ## OCI runtime metrics
+
+	OCIContainerOperationCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "oci",
+		Name:      "container_operation_count",
+		Help:      "Total number of OCI container lifecycle operations (image pulls, creates, runs, execs, and removes), by operation and status.",
+	}, []string{
+		ContainerOperation,
+		StatusHumanReadableLabel,
+	})
+
+	OCIImagePullLatencyUsec = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: bbNamespace,
+		Subsystem: "oci",
+		Name:      "image_pull_latency_usec",
+		Buckets:   durationUsecBuckets(1*time.Millisecond, 100*time.Minute, 2),
+		Help:      "Latency of successful OCI image pulls, in microseconds. Pulls of cached images and layers are included.",
+	}, []string{
+		ContainerImageRepo,
+	})
+
+	OCIImagePullFailureCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "oci",
+		Name:      "image_pull_failure_count",
+		Help:      "Total number of failed OCI image pulls, by image repository and reason.",
+	}, []string{
+		ContainerImageRepo,
+		ImagePullFailureReason,
+	})
+
+	OCIContainerCreateLatencyUsec = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: bbNamespace,
+		Subsystem: "oci",
+		Name:      "container_create_latency_usec",
+		Buckets:   durationUsecBuckets(1*time.Millisecond, 10*time.Minute, 2),
+		Help:      "Latency of successfully creating and starting OCI containers, in microseconds. This does not include pulling the image.",
+	})
+
+	OCILiveContainers = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: bbNamespace,
+		Subsystem: "oci",
+		Name:      "live_containers",
+		Help:      "Number of OCI containers which have been created by the executor and not yet removed.",
+	})
+
+	OCIContainerOOMKillCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "oci",
+		Name:      "container_oom_kill_count",
+		Help:      "Total number of OCI container commands that failed because a process in the container was OOM-killed.",
+	})
 )
 
 // exponentialBucketRange returns prometheus.ExponentialBuckets specified in
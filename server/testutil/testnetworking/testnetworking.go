@@ -44,6 +44,11 @@ func Setup(t *testing.T) {
 	overrideBinDir := testfs.MakeTempDir(t)
 	err = os.Symlink(iptablesLegacyPath, filepath.Join(overrideBinDir, "iptables"))
 	require.NoError(t, err)
+	// Likewise for ip6tables, which is only needed if IPv6 is enabled.
+	if ip6tablesLegacyPath, err := exec.LookPath("ip6tables-legacy"); err == nil {
+		err = os.Symlink(ip6tablesLegacyPath, filepath.Join(overrideBinDir, "ip6tables"))
+		require.NoError(t, err)
+	}
 	err = os.Setenv("PATH", overrideBinDir+":"+os.Getenv("PATH"))
 	require.NoError(t, err)
 }
@@ -27,7 +27,7 @@ type Registry struct {
 	port int
 }
 
-func Run(t *testing.T, opts Opts) *Registry {
+func Run(t testing.TB, opts Opts) *Registry {
 	handler := registry.New()
 	registry := Registry{
 		host: "localhost",
@@ -63,7 +63,7 @@ func (r *Registry) ImageAddress(imageName string) string {
 	return fmt.Sprintf("%s:%d/%s", r.host, r.port, imageName)
 }
 
-func (r *Registry) Push(t *testing.T, image v1.Image, imageName string) string {
+func (r *Registry) Push(t testing.TB, image v1.Image, imageName string) string {
 	fullImageName := r.ImageAddress(imageName)
 	ref, err := name.ParseReference(fullImageName)
 	require.NoError(t, err)
@@ -72,7 +72,18 @@ func (r *Registry) Push(t *testing.T, image v1.Image, imageName string) string {
 	return fullImageName
 }
 
-func (r *Registry) PushRandomImage(t *testing.T) string {
+// PushIndex pushes the given image index, along with the images and indexes
+// it references, and returns its full name.
+func (r *Registry) PushIndex(t testing.TB, idx v1.ImageIndex, imageName string) string {
+	fullImageName := r.ImageAddress(imageName)
+	ref, err := name.ParseReference(fullImageName)
+	require.NoError(t, err)
+	err = remote.WriteIndex(ref, idx)
+	require.NoError(t, err)
+	return fullImageName
+}
+
+func (r *Registry) PushRandomImage(t testing.TB) string {
 	files := map[string][]byte{}
 	buffer := bytes.Buffer{}
 	buffer.Grow(1024)
@@ -0,0 +1,260 @@
+package networking
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/uuid"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Name of the interface that CNI plugins create in the container's net
+	// namespace.
+	cniInterfaceName = "eth0"
+	// CNI spec version used for single-plugin config files which don't
+	// specify one.
+	defaultCNIVersion = "0.4.0"
+)
+
+// CNIConfig configures container networking using CNI plugins, as an
+// alternative to the built-in veth networking.
+type CNIConfig struct {
+	// ConfDir is the directory containing CNI network config files, e.g.
+	// /etc/cni/net.d. Both network config lists (*.conflist) and single
+	// plugin configs (*.conf, *.json) are supported.
+	ConfDir string
+
+	// NetworkName is the name of the network in ConfDir to attach
+	// containers to.
+	NetworkName string
+
+	// BinDirs are the directories searched for CNI plugin binaries, e.g.
+	// /opt/cni/bin.
+	BinDirs []string
+}
+
+// cniNetwork is a parsed CNI network config list.
+type cniNetwork struct {
+	CNIVersion string            `json:"cniVersion"`
+	Name       string            `json:"name"`
+	Plugins    []json.RawMessage `json:"plugins"`
+}
+
+// cniError is the error format written to stdout by CNI plugins.
+type cniError struct {
+	Code    int    `json:"code"`
+	Msg     string `json:"msg"`
+	Details string `json:"details"`
+}
+
+// CreateCNIContainerNetwork creates a net namespace for the container with
+// the given ID and attaches it to the configured CNI network, by invoking the
+// network's plugins with the ADD command. Cleaning up the returned network
+// invokes the plugins with the DEL command before deleting the namespace.
+//
+// The network is fully managed by the CNI plugins, so the returned network
+// has no HostNetwork, and ports can't be published with PublishPort.
+func CreateCNIContainerNetwork(ctx context.Context, cfg *CNIConfig, containerID string) (_ *ContainerNetwork, err error) {
+	network, err := loadCNINetwork(cfg.ConfDir, cfg.NetworkName)
+	if err != nil {
+		return nil, err
+	}
+
+	var cleanupStack cleanupStack
+	defer func() {
+		if err != nil {
+			_ = cleanupStack.Cleanup(ctx)
+		}
+	}()
+
+	nsid := uuid.New()
+	if err := CreateNetNamespace(ctx, nsid); err != nil {
+		return nil, status.WrapError(err, "create net namespace")
+	}
+	cleanupStack = append(cleanupStack, func(ctx context.Context) error {
+		return RemoveNetNamespace(ctx, nsid)
+	})
+
+	if err := runCommand(ctx, namespace(nsid, "ip", "link", "set", "lo", "up")...); err != nil {
+		return nil, status.WrapError(err, "bring up loopback device")
+	}
+
+	// Plugins must be called with DEL even if ADD fails, so that they can
+	// release any resources that were partially allocated.
+	invocation := &cniInvocation{
+		network:     network,
+		binDirs:     cfg.BinDirs,
+		containerID: containerID,
+		netnsPath:   NetNamespacePath(nsid),
+	}
+	cleanupStack = append(cleanupStack, invocation.del)
+	if err := invocation.add(ctx); err != nil {
+		return nil, status.WrapErrorf(err, "add container to CNI network %q", network.Name)
+	}
+
+	return &ContainerNetwork{
+		netns:   NetNamespace(nsid),
+		cleanup: cleanupStack.Cleanup,
+	}, nil
+}
+
+// loadCNINetwork returns the network with the given name from the config
+// files in the given dir. If multiple files define the network, the first
+// one in lexicographic order is used.
+func loadCNINetwork(confDir, name string) (*cniNetwork, error) {
+	entries, err := os.ReadDir(confDir)
+	if err != nil {
+		return nil, status.FailedPreconditionErrorf("read CNI config dir: %s", err)
+	}
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || !slices.Contains([]string{".conflist", ".conf", ".json"}, ext) {
+			continue
+		}
+		path := filepath.Join(confDir, entry.Name())
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, status.FailedPreconditionErrorf("read CNI config: %s", err)
+		}
+		network := &cniNetwork{}
+		if err := json.Unmarshal(b, network); err != nil {
+			return nil, status.FailedPreconditionErrorf("parse CNI config %q: %s", path, err)
+		}
+		if ext != ".conflist" {
+			// A single plugin config is equivalent to a list containing
+			// only that plugin.
+			network.Plugins = []json.RawMessage{b}
+		}
+		if network.Name != name {
+			continue
+		}
+		if len(network.Plugins) == 0 {
+			return nil, status.FailedPreconditionErrorf("CNI network %q in %q has no plugins", name, path)
+		}
+		if network.CNIVersion == "" {
+			network.CNIVersion = defaultCNIVersion
+		}
+		return network, nil
+	}
+	return nil, status.FailedPreconditionErrorf("CNI network %q not found in %q", name, confDir)
+}
+
+// cniInvocation invokes the plugins of a CNI network for a single container.
+type cniInvocation struct {
+	network     *cniNetwork
+	binDirs     []string
+	containerID string
+	netnsPath   string
+
+	// Result returned by the last plugin in the chain, or nil if ADD hasn't
+	// completed.
+	result json.RawMessage
+}
+
+// add invokes each plugin with the ADD command, in order, passing each
+// plugin the result of the previous one.
+func (i *cniInvocation) add(ctx context.Context) error {
+	var prevResult json.RawMessage
+	for _, plugin := range i.network.Plugins {
+		out, err := i.invoke(ctx, "ADD", plugin, prevResult)
+		if err != nil {
+			return err
+		}
+		prevResult = out
+	}
+	i.result = prevResult
+	return nil
+}
+
+// del invokes each plugin with the DEL command, in reverse order. All
+// plugins are invoked even if some fail, and the first error is returned.
+func (i *cniInvocation) del(ctx context.Context) error {
+	var firstErr error
+	for j := len(i.network.Plugins) - 1; j >= 0; j-- {
+		if _, err := i.invoke(ctx, "DEL", i.network.Plugins[j], i.result); err != nil && firstErr == nil {
+			firstErr = status.WrapErrorf(err, "remove container from CNI network %q", i.network.Name)
+		}
+	}
+	return firstErr
+}
+
+// invoke runs a single plugin with the given command, as specified by the CNI
+// spec, and returns its output.
+func (i *cniInvocation) invoke(ctx context.Context, command string, rawPluginConfig, prevResult json.RawMessage) (json.RawMessage, error) {
+	pluginConfig := map[string]any{}
+	if err := json.Unmarshal(rawPluginConfig, &pluginConfig); err != nil {
+		return nil, status.FailedPreconditionErrorf("parse CNI plugin config: %s", err)
+	}
+	pluginType, _ := pluginConfig["type"].(string)
+	if pluginType == "" || strings.Contains(pluginType, "/") {
+		return nil, status.FailedPreconditionErrorf("invalid CNI plugin type %q", pluginType)
+	}
+	pluginPath := ""
+	for _, dir := range i.binDirs {
+		path := filepath.Join(dir, pluginType)
+		if _, err := os.Stat(path); err == nil {
+			pluginPath = path
+			break
+		}
+	}
+	if pluginPath == "" {
+		return nil, status.FailedPreconditionErrorf("CNI plugin %q not found in %q", pluginType, i.binDirs)
+	}
+
+	// The network name and version are inherited from the network config,
+	// and plugins after the first receive the previous plugin's result.
+	pluginConfig["name"] = i.network.Name
+	pluginConfig["cniVersion"] = i.network.CNIVersion
+	if prevResult != nil {
+		pluginConfig["prevResult"] = prevResult
+	} else {
+		delete(pluginConfig, "prevResult")
+	}
+	stdin, err := json.Marshal(pluginConfig)
+	if err != nil {
+		return nil, status.InternalErrorf("marshal CNI plugin config: %s", err)
+	}
+
+	// Pass the CNI parameters using env(1) rather than the process env, so
+	// that they are preserved if the plugin is run with sudo.
+	args := []string{
+		"env",
+		"CNI_COMMAND=" + command,
+		"CNI_CONTAINERID=" + i.containerID,
+		"CNI_NETNS=" + i.netnsPath,
+		"CNI_IFNAME=" + cniInterfaceName,
+		"CNI_PATH=" + strings.Join(i.binDirs, string(os.PathListSeparator)),
+		pluginPath,
+	}
+	if unix.Getuid() != 0 {
+		args = append([]string{"sudo", "-A"}, args...)
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		cniErr := &cniError{}
+		if jsonErr := json.Unmarshal(stdout.Bytes(), cniErr); jsonErr == nil && cniErr.Msg != "" {
+			return nil, status.UnavailableErrorf("CNI plugin %q %s failed with code %d: %s (%s)", pluginType, command, cniErr.Code, cniErr.Msg, cniErr.Details)
+		}
+		return nil, status.UnavailableErrorf("CNI plugin %q %s failed: %s: %q", pluginType, command, err, stderr.String())
+	}
+	if stderr.Len() > 0 {
+		log.CtxDebugf(ctx, "CNI plugin %q %s stderr: %s", pluginType, command, stderr.String())
+	}
+	if command == "DEL" || stdout.Len() == 0 {
+		return nil, nil
+	}
+	return json.RawMessage(stdout.Bytes()), nil
+}
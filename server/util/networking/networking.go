@@ -5,9 +5,13 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"net"
+	"net/netip"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -25,6 +29,8 @@ import (
 var (
 	routePrefix                   = flag.String("executor.route_prefix", defaultRoute, "The prefix in the ip route to locate a device: either 'default' or the ip range of the subnet e.g. 172.24.0.0/18")
 	blackholePrivateRanges        = flag.Bool("executor.blackhole_private_ranges", false, "If true, no traffic will be allowed to RFC1918 ranges.")
+	enableIPv6                    = flag.Bool("executor.network_ipv6_enabled", false, "If true, container networks are dual-stack: in addition to an IPv4 address, each network is assigned an IPv6 address from executor.network_ipv6_subnet, and outgoing IPv6 traffic is masqueraded on the host. Requires IPv6 forwarding to be enabled on the host (net.ipv6.conf.all.forwarding=1).")
+	ipv6Subnet                    = flag.String("executor.network_ipv6_subnet", "fd00:bb::/64", "IPv6 subnet from which container network IPv6 addresses are assigned, if executor.network_ipv6_enabled is set. The prefix length must be at most 116.")
 	preserveExistingNetNamespaces = flag.Bool("executor.preserve_existing_netns", false, "Preserve existing bb-executor net namespaces. By default all \"bb-executor\" net namespaces are removed on executor startup, but if multiple executors are running on the same machine this behavior should be disabled to prevent them interfering with each other.")
 
 	// Private IP ranges, as defined in RFC1918.
@@ -53,6 +59,10 @@ const (
 
 	// CIDR matching all container networks on the host.
 	containerNetworkingCIDR = "192.168.0.0/16"
+
+	// IPv6 prefix length for veth-based networks. As with IPv4, we only need
+	// 2 addresses, one for the host end and one for the namespaced end.
+	ipv6PrefixLen = 126
 )
 
 // runCommand runs the provided command, prepending sudo if the calling user is
@@ -251,6 +261,52 @@ func (n *HostNet) NamespacedIPWithCIDR() string {
 	return n.NamespacedIP() + cidrSuffix
 }
 
+// HostIPv6 returns the IPv6 address of the host end of the network, or an
+// empty string if IPv6 is not enabled.
+func (n *HostNet) HostIPv6() string {
+	return n.ipv6(1)
+}
+
+func (n *HostNet) HostIPv6WithCIDR() string {
+	return fmt.Sprintf("%s/%d", n.HostIPv6(), ipv6PrefixLen)
+}
+
+// NamespacedIPv6 returns the IPv6 address of the namespaced end of the
+// network, or an empty string if IPv6 is not enabled.
+func (n *HostNet) NamespacedIPv6() string {
+	return n.ipv6(2)
+}
+
+func (n *HostNet) NamespacedIPv6WithCIDR() string {
+	return fmt.Sprintf("%s/%d", n.NamespacedIPv6(), ipv6PrefixLen)
+}
+
+// IPv6CIDR returns the IPv6 network containing both ends of the network.
+func (n *HostNet) IPv6CIDR() string {
+	return fmt.Sprintf("%s/%d", n.ipv6(0), ipv6PrefixLen)
+}
+
+// ipv6 returns the IPv6 address at the given offset within the network's
+// IPv6 range. Each network is assigned a /126 range within the configured
+// IPv6 subnet, in the same order as the IPv4 ranges.
+func (n *HostNet) ipv6(offset int) string {
+	if !IsIPv6Enabled() {
+		return ""
+	}
+	subnet, err := IPv6Subnet()
+	if err != nil {
+		return ""
+	}
+	b := subnet.Addr().As16()
+	// The subnet prefix length is at most 116, so the low 12 bits are
+	// always free for the network index.
+	suffix := uint32(n.netIdx)<<(128-ipv6PrefixLen) | uint32(offset)
+	for i := 0; i < 4; i++ {
+		b[15-i] |= byte(suffix >> (8 * i))
+	}
+	return netip.AddrFrom16(b).String()
+}
+
 func (n *HostNet) Unlock() {
 	n.unlock()
 }
@@ -274,6 +330,50 @@ func (a *HostNetAllocator) Get() (*HostNet, error) {
 	return nil, status.ResourceExhaustedError("host IP address space exhausted")
 }
 
+// GetForNamespacedIP assigns the host network whose namespaced IP is the given
+// address. The address must be of the form returned by
+// HostNet.NamespacedIP(). Returns an AlreadyExists error if the network is
+// already in use.
+func (a *HostNetAllocator) GetForNamespacedIP(namespacedIP string) (*HostNet, error) {
+	netIdx, err := namespacedIPIndex(namespacedIP)
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.inUse[netIdx] {
+		return nil, status.AlreadyExistsErrorf("IP address %s is already assigned to another container", namespacedIP)
+	}
+	a.inUse[netIdx] = true
+	return &HostNet{
+		netIdx: netIdx,
+		unlock: func() { a.unlock(netIdx) },
+	}, nil
+}
+
+// namespacedIPIndex returns the network index corresponding to the given
+// namespaced IP, which is the inverse of HostNet.NamespacedIP().
+func namespacedIPIndex(namespacedIP string) (int, error) {
+	addr, err := netip.ParseAddr(namespacedIP)
+	if err != nil || !addr.Is4() {
+		return 0, status.InvalidArgumentErrorf("invalid IPv4 address %q", namespacedIP)
+	}
+	if !netip.MustParsePrefix(containerNetworkingCIDR).Contains(addr) {
+		return 0, status.InvalidArgumentErrorf("IP address %s is not within the container network %s", namespacedIP, containerNetworkingCIDR)
+	}
+	b := addr.As4()
+	// Each /30 network is allocated at an 8-address stride within a /24,
+	// with the namespaced IP at offset 6.
+	if b[3]%8 != 6 || int(b[3])/8 >= 30 {
+		return 0, status.InvalidArgumentErrorf("IP address %s is not an assignable container address (the last octet must be 8*N+6, for N < 30)", namespacedIP)
+	}
+	netIdx := int(b[2])*30 + int(b[3])/8
+	if netIdx >= numAssignableNetworks {
+		return 0, status.InvalidArgumentErrorf("IP address %s is outside of the assignable container address range", namespacedIP)
+	}
+	return netIdx, nil
+}
+
 func (a *HostNetAllocator) unlock(netIdx int) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
@@ -341,7 +441,14 @@ type VethPair struct {
 //
 //	# add a route in the root namespace so that traffic to 192.168.0.3 hits 10.0.0.2, the veth0 end of the pair
 //	$ sudo ip route add 192.168.0.3 via 10.0.0.2
-func SetupVethPair(ctx context.Context, netNamespace string) (_ *VethPair, err error) {
+func SetupVethPair(ctx context.Context, netNamespace string) (*VethPair, error) {
+	return setupVethPair(ctx, netNamespace, "")
+}
+
+// setupVethPair creates a veth pair as described in SetupVethPair. If
+// namespacedIP is non-empty, the namespaced end of the pair is assigned that
+// IP address instead of the next available address.
+func setupVethPair(ctx context.Context, netNamespace, namespacedIP string) (_ *VethPair, err error) {
 	// Keep a list of cleanup work to be done.
 	var cleanupStack cleanupStack
 	// If we return an error from this func then we need to clean up any
@@ -373,7 +480,12 @@ func SetupVethPair(ctx context.Context, netNamespace string) (_ *VethPair, err e
 
 	// This addr will be used for the host-side of the veth pair, so it
 	// needs to to be unique on the host.
-	network, err := hostNetAllocator.Get()
+	var network *HostNet
+	if namespacedIP != "" {
+		network, err = hostNetAllocator.GetForNamespacedIP(namespacedIP)
+	} else {
+		network, err = hostNetAllocator.Get()
+	}
 	if err != nil {
 		return nil, status.WrapError(err, "assign host network to VM")
 	}
@@ -407,6 +519,12 @@ func SetupVethPair(ctx context.Context, netNamespace string) (_ *VethPair, err e
 		return nil, status.WrapError(err, "add default route in namespace")
 	}
 
+	if IsIPv6Enabled() {
+		if err := setupVethPairIPv6(ctx, netNamespace, veth0, veth1, device, network, &cleanupStack); err != nil {
+			return nil, status.WrapError(err, "set up IPv6")
+		}
+	}
+
 	if IsSecondaryNetworkEnabled() {
 		err = runCommand(ctx, "ip", "rule", "add", "from", network.NamespacedIP(), "lookup", routingTableName)
 		if err != nil {
@@ -448,6 +566,48 @@ func SetupVethPair(ctx context.Context, netNamespace string) (_ *VethPair, err e
 	}, nil
 }
 
+// setupVethPairIPv6 assigns IPv6 addresses to both ends of a veth pair and
+// configures IPv6 routing and forwarding rules, analogous to the IPv4
+// configuration done in SetupVethPair. Cleanup tasks are pushed onto the
+// given cleanup stack.
+func setupVethPairIPv6(ctx context.Context, netNamespace, veth0, veth1, device string, network *HostNet, cleanupStack *cleanupStack) error {
+	subnet, err := IPv6Subnet()
+	if err != nil {
+		return err
+	}
+	// Duplicate address detection is disabled ("nodad"), since addresses
+	// are unique by construction and DAD would delay the addresses from
+	// becoming usable.
+	err = runCommand(ctx, namespace(netNamespace, "ip", "-6", "addr", "add", network.NamespacedIPv6WithCIDR(), "dev", veth0, "nodad")...)
+	if err != nil {
+		return status.WrapError(err, "attach IPv6 address to veth device in namespace")
+	}
+	err = runCommand(ctx, "ip", "-6", "addr", "add", network.HostIPv6WithCIDR(), "dev", veth1, "nodad")
+	if err != nil {
+		return status.WrapError(err, "attach IPv6 address to host veth device")
+	}
+	err = runCommand(ctx, namespace(netNamespace, "ip", "-6", "route", "add", "default", "via", network.HostIPv6())...)
+	if err != nil {
+		return status.WrapError(err, "add default IPv6 route in namespace")
+	}
+	ip6tablesRules := [][]string{
+		{"FORWARD", "-i", veth1, "-o", device, "-j", "ACCEPT"},
+		{"FORWARD", "-i", device, "-o", veth1, "-j", "ACCEPT"},
+		// Drop any traffic from the namespace that is targeting another
+		// namespace.
+		{"FORWARD", "-s", network.IPv6CIDR(), "-d", subnet.String(), "-j", "DROP"},
+	}
+	for _, rule := range ip6tablesRules {
+		if err := runCommand(ctx, append([]string{"ip6tables", "--wait", "-A"}, rule...)...); err != nil {
+			return err
+		}
+		*cleanupStack = append(*cleanupStack, func(ctx context.Context) error {
+			return runCommand(ctx, append([]string{"ip6tables", "--wait", "--delete"}, rule...)...)
+		})
+	}
+	return nil
+}
+
 // List of cleanup tasks which should be executed in the reverse order in which
 // the corresponding resources were created.
 type cleanupStack []func(ctx context.Context) error
@@ -494,6 +654,12 @@ type ContainerNetwork struct {
 	netns    string
 	vethPair *VethPair
 	cleanup  func(ctx context.Context) error
+
+	mu sync.Mutex
+	// Listeners for published ports.
+	listeners []net.Listener
+	// Open connections proxied to published ports.
+	conns map[net.Conn]struct{}
 }
 
 // CreateContainerNetwork initializes a network namespace, networking
@@ -501,7 +667,10 @@ type ContainerNetwork struct {
 //
 // If loopbackOnly is true, only a loopback interface will be created in the
 // namespace, and the container will not be able to reach external addresses.
-func CreateContainerNetwork(ctx context.Context, loopbackOnly bool) (_ *ContainerNetwork, err error) {
+//
+// If namespacedIP is non-empty, the container is assigned that IP address
+// rather than the next available one. See HostNetAllocator.GetForNamespacedIP.
+func CreateContainerNetwork(ctx context.Context, loopbackOnly bool, namespacedIP string) (_ *ContainerNetwork, err error) {
 	var cleanupStack cleanupStack
 	defer func() {
 		// If we failed to fully set up the network, make sure to clean up any
@@ -528,7 +697,7 @@ func CreateContainerNetwork(ctx context.Context, loopbackOnly bool) (_ *Containe
 	var vethPair *VethPair
 	if !loopbackOnly {
 		// Create a veth pair with one end in the namespace.
-		vp, err := SetupVethPair(ctx, nsid)
+		vp, err := setupVethPair(ctx, nsid, namespacedIP)
 		if err != nil {
 			return nil, status.WrapError(err, "setup veth pair")
 		}
@@ -556,7 +725,141 @@ func (c *ContainerNetwork) HostNetwork() *HostNet {
 	return c.vethPair.network
 }
 
+// NetworkStats holds traffic counters for a container network, from the
+// perspective of the container.
+type NetworkStats struct {
+	// RxBytes is the number of bytes received by the container.
+	RxBytes int64
+	// TxBytes is the number of bytes sent by the container.
+	TxBytes int64
+}
+
+// Stats returns the traffic counters for the network's veth pair, which
+// include all traffic between the container and the host or external network.
+// Loopback-only networks have no veth pair, so their counters are always zero.
+func (c *ContainerNetwork) Stats() (*NetworkStats, error) {
+	if c.vethPair == nil {
+		return &NetworkStats{}, nil
+	}
+	// Read the counters from the host end of the veth pair, where received
+	// bytes were sent by the container and vice versa.
+	statsDir := filepath.Join("/sys/class/net", c.vethPair.hostDevice, "statistics")
+	hostRx, err := readInt64File(filepath.Join(statsDir, "rx_bytes"))
+	if err != nil {
+		return nil, err
+	}
+	hostTx, err := readInt64File(filepath.Join(statsDir, "tx_bytes"))
+	if err != nil {
+		return nil, err
+	}
+	return &NetworkStats{RxBytes: hostTx, TxBytes: hostRx}, nil
+}
+
+func readInt64File(path string) (int64, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+}
+
+// PublishPort forwards TCP connections accepted on the given port of the
+// host's loopback interface to the given port in the namespace. If hostPort
+// is 0, a random available port is chosen. It returns the host port.
+//
+// Published ports are implemented with a userspace proxy rather than iptables
+// DNAT rules, since DNAT does not apply to connections to the loopback
+// interface without also enabling route_localnet. The ports are unpublished
+// when the network is cleaned up.
+func (c *ContainerNetwork) PublishPort(ctx context.Context, hostPort, containerPort int) (int, error) {
+	if c.vethPair == nil {
+		return 0, status.FailedPreconditionError("cannot publish ports on a loopback-only network")
+	}
+	lis, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(hostPort)))
+	if err != nil {
+		return 0, status.UnavailableErrorf("listen on host port %d: %s", hostPort, err)
+	}
+	c.mu.Lock()
+	c.listeners = append(c.listeners, lis)
+	c.mu.Unlock()
+	target := net.JoinHostPort(c.vethPair.network.NamespacedIP(), strconv.Itoa(containerPort))
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				// The listener was closed.
+				return
+			}
+			go c.proxy(conn, target)
+		}
+	}()
+	return lis.Addr().(*net.TCPAddr).Port, nil
+}
+
+// proxy copies data between the given connection and a new connection to the
+// target address until either side is closed.
+func (c *ContainerNetwork) proxy(conn net.Conn, target string) {
+	defer conn.Close()
+	upstream, err := net.DialTimeout("tcp", target, 10*time.Second)
+	if err != nil {
+		log.Debugf("Failed to connect to published port %s: %s", target, err)
+		return
+	}
+	defer upstream.Close()
+	if !c.trackConns(conn, upstream) {
+		return
+	}
+	defer c.untrackConns(conn, upstream)
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(upstream, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(conn, upstream)
+		done <- struct{}{}
+	}()
+	// Once either direction is done, close both connections so that the
+	// other direction is unblocked.
+	<-done
+}
+
+// trackConns registers proxied connections so that they can be closed on
+// cleanup. It returns false if the network has already been cleaned up.
+func (c *ContainerNetwork) trackConns(conns ...net.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.listeners == nil {
+		return false
+	}
+	if c.conns == nil {
+		c.conns = map[net.Conn]struct{}{}
+	}
+	for _, conn := range conns {
+		c.conns[conn] = struct{}{}
+	}
+	return true
+}
+
+func (c *ContainerNetwork) untrackConns(conns ...net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, conn := range conns {
+		delete(c.conns, conn)
+	}
+}
+
 func (c *ContainerNetwork) Cleanup(ctx context.Context) error {
+	c.mu.Lock()
+	for _, lis := range c.listeners {
+		lis.Close()
+	}
+	c.listeners = nil
+	for conn := range c.conns {
+		conn.Close()
+	}
+	c.conns = nil
+	c.mu.Unlock()
 	return c.cleanup(ctx)
 }
 
@@ -654,10 +957,26 @@ func EnableMasquerading(ctx context.Context) error {
 	device := route.device
 	// Skip appending the rule if it's already in the table.
 	err = runCommand(ctx, "iptables", "--wait", "-t", "nat", "--check", "POSTROUTING", "-o", device, "-j", "MASQUERADE")
-	if err == nil {
+	if err != nil {
+		if err := runCommand(ctx, "iptables", "--wait", "-t", "nat", "-A", "POSTROUTING", "-o", device, "-j", "MASQUERADE"); err != nil {
+			return err
+		}
+	}
+	if !IsIPv6Enabled() {
 		return nil
 	}
-	return runCommand(ctx, "iptables", "--wait", "-t", "nat", "-A", "POSTROUTING", "-o", device, "-j", "MASQUERADE")
+	// Container IPv6 addresses are typically not globally routable (the
+	// default subnet is a unique local address range), so masquerade them as
+	// well.
+	subnet, err := IPv6Subnet()
+	if err != nil {
+		return err
+	}
+	rule := []string{"POSTROUTING", "-s", subnet.String(), "-o", device, "-j", "MASQUERADE"}
+	if err := runCommand(ctx, append([]string{"ip6tables", "--wait", "-t", "nat", "--check"}, rule...)...); err == nil {
+		return nil
+	}
+	return runCommand(ctx, append([]string{"ip6tables", "--wait", "-t", "nat", "-A"}, rule...)...)
 }
 
 // AddRoutingTableEntryIfNotPresent adds [tableID, tableName] name pair to /etc/iproute2/rt_tables if
@@ -847,6 +1166,26 @@ func IsSecondaryNetworkEnabled() bool {
 	return *routePrefix != "default"
 }
 
+// IsIPv6Enabled returns whether container networks are assigned IPv6
+// addresses in addition to IPv4 addresses.
+func IsIPv6Enabled() bool {
+	return *enableIPv6
+}
+
+// IPv6Subnet returns the configured subnet from which container network IPv6
+// addresses are assigned.
+func IPv6Subnet() (netip.Prefix, error) {
+	p, err := netip.ParsePrefix(*ipv6Subnet)
+	if err != nil || !p.Addr().Is6() || p.Addr().Is4In6() {
+		return netip.Prefix{}, status.InvalidArgumentErrorf("invalid IPv6 subnet %q", *ipv6Subnet)
+	}
+	// Leave enough room for a /126 for each assignable network.
+	if p.Bits() > 116 {
+		return netip.Prefix{}, status.InvalidArgumentErrorf("IPv6 subnet %q is too small (prefix length must be at most 116)", *ipv6Subnet)
+	}
+	return p.Masked(), nil
+}
+
 func IsPrivateRangeBlackholingEnabled() bool {
 	return *blackholePrivateRanges
 }
@@ -7,11 +7,14 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"testing"
 
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testnetworking"
 	"github.com/buildbuddy-io/buildbuddy/server/util/networking"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
 	"github.com/buildbuddy-io/buildbuddy/server/util/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -86,6 +89,67 @@ func TestHostNetAllocator(t *testing.T) {
 	require.Equal(t, unlockedCloneIP, net.NamespacedIP())
 }
 
+func TestHostNetAllocator_GetForNamespacedIP(t *testing.T) {
+	a := &networking.HostNetAllocator{}
+
+	n, err := a.GetForNamespacedIP("192.168.33.78")
+	require.NoError(t, err)
+	assert.Equal(t, "192.168.33.78", n.NamespacedIP())
+	assert.Equal(t, "192.168.33.77", n.HostIP())
+
+	// Requesting the same IP again should fail until it is unlocked.
+	_, err = a.GetForNamespacedIP("192.168.33.78")
+	require.True(t, status.IsAlreadyExistsError(err), "expected AlreadyExists error, got %v", err)
+	n.Unlock()
+	n, err = a.GetForNamespacedIP("192.168.33.78")
+	require.NoError(t, err)
+	n.Unlock()
+
+	// Networks assigned by IP should not be handed out by Get().
+	n, err = a.GetForNamespacedIP("192.168.0.6")
+	require.NoError(t, err)
+	defer n.Unlock()
+	n2, err := a.Get()
+	require.NoError(t, err)
+	defer n2.Unlock()
+	assert.NotEqual(t, "192.168.0.6", n2.NamespacedIP())
+
+	for _, ip := range []string{"bogus", "::1", "10.0.0.6", "192.168.0.5", "192.168.0.246", "192.168.33.86"} {
+		_, err := a.GetForNamespacedIP(ip)
+		require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error for %q, got %v", ip, err)
+	}
+}
+
+func TestHostNetAllocator_IPv6(t *testing.T) {
+	a := &networking.HostNetAllocator{}
+	n, err := a.Get()
+	require.NoError(t, err)
+	defer n.Unlock()
+
+	// IPv6 addresses should be empty unless IPv6 is enabled.
+	assert.Equal(t, "", n.NamespacedIPv6())
+
+	flags.Set(t, "executor.network_ipv6_enabled", true)
+	flags.Set(t, "executor.network_ipv6_subnet", "fd00:bb::/64")
+	assert.Equal(t, "fd00:bb::/126", n.IPv6CIDR())
+	assert.Equal(t, "fd00:bb::1", n.HostIPv6())
+	assert.Equal(t, "fd00:bb::1/126", n.HostIPv6WithCIDR())
+	assert.Equal(t, "fd00:bb::2", n.NamespacedIPv6())
+	assert.Equal(t, "fd00:bb::2/126", n.NamespacedIPv6WithCIDR())
+
+	n2, err := a.GetForNamespacedIP("192.168.33.78")
+	require.NoError(t, err)
+	defer n2.Unlock()
+	assert.Equal(t, "fd00:bb::f9d", n2.HostIPv6())
+	assert.Equal(t, "fd00:bb::f9e", n2.NamespacedIPv6())
+
+	for _, subnet := range []string{"bogus", "10.0.0.0/8", "fd00:bb::/120"} {
+		flags.Set(t, "executor.network_ipv6_subnet", subnet)
+		_, err := networking.IPv6Subnet()
+		require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument error for %q, got %v", subnet, err)
+	}
+}
+
 func TestConcurrentSetupAndCleanup(t *testing.T) {
 	testnetworking.Setup(t)
 
@@ -209,8 +273,81 @@ func TestContainerNetworking(t *testing.T) {
 	}
 }
 
+func TestCNIContainerNetwork(t *testing.T) {
+	testnetworking.Setup(t)
+	ctx := context.Background()
+
+	// Set up a network with two fake plugins, which log their invocations
+	// and return a fixed result.
+	root := t.TempDir()
+	binDir := filepath.Join(root, "bin")
+	confDir := filepath.Join(root, "net.d")
+	logPath := filepath.Join(root, "plugins.log")
+	for _, dir := range []string{binDir, confDir} {
+		err := os.Mkdir(dir, 0755)
+		require.NoError(t, err)
+	}
+	plugin := `#!/bin/sh
+		config=$(cat)
+		test -e "$CNI_NETNS" || { echo '{"code":11,"msg":"netns does not exist"}'; exit 1; }
+		echo "$CNI_COMMAND $(basename "$0") $CNI_CONTAINERID $CNI_IFNAME $config" >> ` + logPath + `
+		if [ "$CNI_COMMAND" = ADD ]; then
+			echo '{"cniVersion":"1.0.0","ips":[{"address":"10.99.0.2/24"}]}'
+		fi
+	`
+	for _, name := range []string{"fake-bridge", "fake-firewall"} {
+		err := os.WriteFile(filepath.Join(binDir, name), []byte(plugin), 0755)
+		require.NoError(t, err)
+	}
+	err := os.WriteFile(filepath.Join(binDir, "fake-failing"), []byte(`#!/bin/sh
+		echo '{"code":7,"msg":"no addresses available"}'
+		exit 1
+	`), 0755)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(confDir, "10-test.conflist"), []byte(`{
+		"cniVersion": "1.0.0",
+		"name": "test-net",
+		"plugins": [{"type": "fake-bridge", "bridge": "br-test"}, {"type": "fake-firewall"}]
+	}`), 0644)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(confDir, "20-failing.conf"), []byte(`{"cniVersion": "1.0.0", "name": "failing-net", "type": "fake-failing"}`), 0644)
+	require.NoError(t, err)
+
+	cfg := &networking.CNIConfig{ConfDir: confDir, NetworkName: "test-net", BinDirs: []string{binDir}}
+	c, err := networking.CreateCNIContainerNetwork(ctx, cfg, "test-container")
+	require.NoError(t, err)
+	assert.Nil(t, c.HostNetwork())
+	netnsExec(t, c.NetNamespace(), `ping -c 1 -W 1 127.0.0.1`)
+	err = c.Cleanup(ctx)
+	require.NoError(t, err)
+	_, err = os.Stat("/var/run/netns/" + c.NetNamespace())
+	assert.True(t, os.IsNotExist(err), "netns should be removed, got %v", err)
+
+	// Plugins should be invoked in order for ADD, and in reverse order for
+	// DEL, with each plugin receiving the previous result.
+	b, err := os.ReadFile(logPath)
+	require.NoError(t, err)
+	result := `{"cniVersion":"1.0.0","ips":[{"address":"10.99.0.2/24"}]}`
+	assert.Equal(t, strings.Join([]string{
+		`ADD fake-bridge test-container eth0 {"bridge":"br-test","cniVersion":"1.0.0","name":"test-net","type":"fake-bridge"}`,
+		`ADD fake-firewall test-container eth0 {"cniVersion":"1.0.0","name":"test-net","prevResult":` + result + `,"type":"fake-firewall"}`,
+		`DEL fake-firewall test-container eth0 {"cniVersion":"1.0.0","name":"test-net","prevResult":` + result + `,"type":"fake-firewall"}`,
+		`DEL fake-bridge test-container eth0 {"bridge":"br-test","cniVersion":"1.0.0","name":"test-net","prevResult":` + result + `,"type":"fake-bridge"}`,
+	}, "\n")+"\n", string(b))
+
+	// Plugin errors should be returned, and the netns cleaned up.
+	cfg.NetworkName = "failing-net"
+	_, err = networking.CreateCNIContainerNetwork(ctx, cfg, "test-container")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no addresses available")
+
+	cfg.NetworkName = "missing-net"
+	_, err = networking.CreateCNIContainerNetwork(ctx, cfg, "test-container")
+	assert.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition error, got %v", err)
+}
+
 func createContainerNetwork(ctx context.Context, t *testing.T) *networking.ContainerNetwork {
-	c, err := networking.CreateContainerNetwork(ctx, false /*=loopbackOnly*/)
+	c, err := networking.CreateContainerNetwork(ctx, false /*=loopbackOnly*/, "" /*=namespacedIP*/)
 	require.NoError(t, err)
 	t.Cleanup(func() {
 		err := c.Cleanup(context.Background())
@@ -16,6 +16,14 @@ const stackDepth = 10
 type wrappedError struct {
 	error
 	*stack
+	// The error passed to WrapError, if any.
+	cause error
+}
+
+// Unwrap returns the error passed to WrapError, so that errors.Is and
+// errors.As can match errors after more context has been added to them.
+func (w *wrappedError) Unwrap() error {
+	return w.cause
 }
 
 func (w *wrappedError) GRPCStatus() *status.Status {
@@ -47,8 +55,8 @@ func callers() *stack {
 
 func makeStatusError(code codes.Code, msg string) error {
 	return &wrappedError{
-		status.Error(code, msg),
-		callers(),
+		error: status.Error(code, msg),
+		stack: callers(),
 	}
 }
 
@@ -201,8 +209,13 @@ func UnauthenticatedErrorf(format string, a ...interface{}) error {
 }
 
 // Wrap adds additional context to an error, preserving the underlying status code.
+// The returned error wraps err, so it matches err with errors.Is.
 func WrapError(err error, msg string) error {
-	return makeStatusError(status.Code(err), fmt.Sprintf("%s: %s", msg, Message(err)))
+	return &wrappedError{
+		error: status.Error(status.Code(err), fmt.Sprintf("%s: %s", msg, Message(err))),
+		stack: callers(),
+		cause: err,
+	}
 }
 
 // Wrapf is the "Printf" version of `Wrap`.
@@ -1,6 +1,7 @@
 package status_test
 
 import (
+	"context"
 	"testing"
 
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
@@ -52,3 +53,16 @@ func TestHasStacktrace(t *testing.T) {
 	stackTrace := se.StackTrace()
 	assert.NotNil(t, stackTrace)
 }
+
+func TestWrapError(t *testing.T) {
+	sentinel := status.NotFoundError("sentinel")
+	err := status.WrapError(sentinel, "outer")
+	err = status.WrapErrorf(err, "outermost %d", 1)
+	assert.True(t, status.IsNotFoundError(err))
+	assert.Equal(t, "outermost 1: outer: sentinel", status.Message(err))
+	assert.True(t, errors.Is(err, sentinel))
+	assert.False(t, errors.Is(err, status.NotFoundError("sentinel")))
+
+	err = status.WrapError(context.Canceled, "wrapped")
+	assert.True(t, errors.Is(err, context.Canceled))
+}